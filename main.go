@@ -1,15 +1,30 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
 	"github.com/utkarsh-pro/use/pkg/config"
+	"github.com/utkarsh-pro/use/pkg/id"
 	"github.com/utkarsh-pro/use/pkg/log"
 	"github.com/utkarsh-pro/use/pkg/shutdown"
 	"github.com/utkarsh-pro/use/pkg/storage"
 	scfg "github.com/utkarsh-pro/use/pkg/storage/config"
 	"github.com/utkarsh-pro/use/pkg/transport"
+
+	// The built-in storages and transports register themselves
+	_ "github.com/utkarsh-pro/use/pkg/storage/btree"
+	_ "github.com/utkarsh-pro/use/pkg/storage/lsm"
+	_ "github.com/utkarsh-pro/use/pkg/storage/memory"
+	_ "github.com/utkarsh-pro/use/pkg/storage/stupid"
+	_ "github.com/utkarsh-pro/use/pkg/transport/http"
 )
 
-func generateStorageCfg() scfg.Config {
+func generateStorageCfg() (scfg.Config, error) {
 	storageCfg := scfg.DefaultConfig()
 
 	if config.DBSyncType == "sync" {
@@ -20,35 +35,131 @@ func generateStorageCfg() scfg.Config {
 		storageCfg = storageCfg.WithNoneSync()
 	}
 
+	storageCfg = storageCfg.WithSyncInterval(config.DBSyncInterval)
+	storageCfg = storageCfg.WithSyncBytes(int64(config.DBSyncBytes))
+
 	if config.DBReadOnly {
 		storageCfg = storageCfg.WithReadOnly()
 	} else {
 		storageCfg = storageCfg.WithReadWrite()
 	}
 
-	return storageCfg
+	storageCfg = storageCfg.WithCompactionRatio(config.DBCompactionRatio)
+	storageCfg = storageCfg.WithSegmentSize(int64(config.DBSegmentSize))
+	storageCfg = storageCfg.WithFilterFalsePositiveRate(config.DBFilterFPR)
+
+	storageCfg = storageCfg.WithMaxMemory(int64(config.DBMaxMemory))
+	if config.DBEviction == "lru" {
+		storageCfg = storageCfg.WithLRUEviction()
+	} else if config.DBEviction == "lfu" {
+		storageCfg = storageCfg.WithLFUEviction()
+	}
+
+	opts, err := scfg.ParseOptions(config.DBOptions)
+	if err != nil {
+		return storageCfg, err
+	}
+	storageCfg = storageCfg.WithOptions(opts)
+
+	if config.DBAsOf != "" {
+		asOf, err := id.Parse(config.DBAsOf)
+		if err != nil {
+			return storageCfg, err
+		}
+
+		storageCfg = storageCfg.WithAsOf(asOf)
+	}
+
+	return storageCfg, nil
+}
+
+// restoredFile is the file in the storage directory holding the checksum
+// of the physical snapshot the storage was last restored from.
+const restoredFile = "restored-from"
+
+// restore restores the storage in the given directory from the physical
+// snapshot at the given path.
+//
+// The restore is one-shot, the snapshot recorded as restored already is
+// skipped. So a node started with -restore-from can be restarted with
+// the same flags without losing the writes made since the restore.
+func restore(s storage.Storage, dir, path string, force bool) error {
+	restorer, ok := s.(storage.PhysicalRestorer)
+	if !ok {
+		return fmt.Errorf("storage %s can't be restored from a physical snapshot", config.Storage)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening snapshot: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	marker := filepath.Join(dir, restoredFile)
+	if b, err := os.ReadFile(marker); err == nil && string(b) == sum {
+		log.Infoln("storage was restored from the snapshot already, skipping: ", path)
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+
+	if err := restorer.RestorePhysical(f, force); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(marker, []byte(sum), 0666); err != nil {
+		return fmt.Errorf("error recording restore: %w", err)
+	}
+
+	return nil
 }
 
 func main() {
+	for _, t := range storage.Types() {
+		config.StorageTypes = append(config.StorageTypes, string(t))
+	}
+	for _, t := range transport.Types() {
+		config.TransportTypes = append(config.TransportTypes, string(t))
+	}
+
 	config.Setup()
 	log.SetLevel(config.LogLevel)
 
+	storageCfg, err := generateStorageCfg()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	storage, err := storage.New(
 		storage.StorageType(config.Storage),
 		config.StoragePath,
-		generateStorageCfg(),
+		storageCfg,
 	)
 	if err != nil {
-		panic(err)
+		log.Fatalln(err)
 	}
 
 	if err := storage.Init(); err != nil {
-		panic(err)
+		log.Fatalln(err)
+	}
+
+	if config.RestoreFrom != "" {
+		if err := restore(storage, config.StoragePath, config.RestoreFrom, config.RestoreForce); err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	transport, err := transport.New(transport.TransportType(config.Transport), storage)
 	if err != nil {
-		panic(err)
+		log.Fatalln(err)
 	}
 
 	go func() {
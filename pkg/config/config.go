@@ -3,7 +3,9 @@ package config
 import (
 	"flag"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/utkarsh-pro/use/pkg/utils"
 )
@@ -16,7 +18,23 @@ var StoragePath = ""
 var WorkerID = 4095
 var LogLevel = "info"
 var DBSyncType = "none"
+var DBSyncInterval = time.Second
+var DBSyncBytes = 4 << 20
 var DBReadOnly = false
+var DBCompactionRatio = 0.5
+var DBSegmentSize = 64 << 20
+var DBFilterFPR = 0.01
+var DBAsOf = ""
+var DBMaxMemory = 0
+var DBEviction = "lru"
+var DBOptions = ""
+var RestoreFrom = ""
+var RestoreForce = false
+
+// StorageTypes and TransportTypes are the available storages and
+// transports, listed by the usage of the flags if set before Setup.
+var StorageTypes []string
+var TransportTypes []string
 
 func Setup() {
 	setupFlags()
@@ -27,7 +45,7 @@ func setupFlags() {
 		&Transport,
 		"transport",
 		utils.GetEnvOrDefault(convertToEnvName("USE", "transport"), Transport),
-		"transport to use",
+		oneOf("transport to use", TransportTypes),
 	)
 	flag.StringVar(
 		&Address,
@@ -39,7 +57,7 @@ func setupFlags() {
 		&Storage,
 		"storage",
 		utils.GetEnvOrDefault(convertToEnvName("USE", "storage"), Storage),
-		"storage to use",
+		oneOf("storage to use", StorageTypes),
 	)
 	flag.StringVar(
 		&StoragePath,
@@ -66,6 +84,22 @@ func setupFlags() {
 		utils.GetEnvOrDefault(convertToEnvName("USE", "db-sync-type"), DBSyncType),
 		"db sync type",
 	)
+	flag.DurationVar(
+		&DBSyncInterval,
+		"db-sync-interval",
+		utils.StringToDuration(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "db-sync-interval"), utils.DurationToString(DBSyncInterval)),
+		),
+		"interval at which the writes are synced in async sync mode, <= 0 disables it",
+	)
+	flag.IntVar(
+		&DBSyncBytes,
+		"db-sync-bytes",
+		utils.StringToInt(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "db-sync-bytes"), utils.IntToString(DBSyncBytes)),
+		),
+		"unsynced bytes beyond which the writes are synced in async sync mode, <= 0 disables it",
+	)
 	flag.BoolVar(
 		&DBReadOnly,
 		"db-read-only",
@@ -74,8 +108,94 @@ func setupFlags() {
 		),
 		"db read only",
 	)
+	flag.Float64Var(
+		&DBCompactionRatio,
+		"db-compaction-ratio",
+		utils.StringToFloat64(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "db-compaction-ratio"), utils.Float64ToString(DBCompactionRatio)),
+		),
+		"ratio of garbage to the db size that triggers a compaction, <= 0 disables it",
+	)
+	flag.IntVar(
+		&DBSegmentSize,
+		"db-segment-size",
+		utils.StringToInt(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "db-segment-size"), utils.IntToString(DBSegmentSize)),
+		),
+		"size in bytes beyond which a db segment is rolled over",
+	)
+	flag.Float64Var(
+		&DBFilterFPR,
+		"db-filter-fpr",
+		utils.StringToFloat64(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "db-filter-fpr"), utils.Float64ToString(DBFilterFPR)),
+		),
+		"false positive rate of the db bloom filter, <= 0 disables the filter regeneration",
+	)
+	flag.StringVar(
+		&DBAsOf,
+		"db-as-of",
+		utils.GetEnvOrDefault(convertToEnvName("USE", "db-as-of"), DBAsOf),
+		"open the db read-only as of the given write ID or RFC 3339 time, ignoring the later writes; the writes before the last compaction are out of reach",
+	)
+	flag.IntVar(
+		&DBMaxMemory,
+		"db-max-memory",
+		utils.StringToInt(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "db-max-memory"), utils.IntToString(DBMaxMemory)),
+		),
+		"size in bytes beyond which an in-memory db evicts keys, <= 0 disables the eviction",
+	)
+	flag.StringVar(
+		&DBEviction,
+		"db-eviction",
+		utils.GetEnvOrDefault(convertToEnvName("USE", "db-eviction"), DBEviction),
+		"keys an in-memory db evicts first, lru (least recently used) or lfu (least frequently used)",
+	)
+	flag.StringVar(
+		&DBOptions,
+		"db-options",
+		utils.GetEnvOrDefault(convertToEnvName("USE", "db-options"), DBOptions),
+		"storage specific options as comma separated name=value pairs, e.g. cache-size=8192 for btree",
+	)
+	flag.StringVar(
+		&RestoreFrom,
+		"restore-from",
+		utils.GetEnvOrDefault(convertToEnvName("USE", "restore-from"), RestoreFrom),
+		"path to a physical snapshot to restore the storage from at startup, once: the restarts skip the snapshot restored already",
+	)
+	flag.BoolVar(
+		&RestoreForce,
+		"restore-force",
+		utils.StringToBool(
+			utils.GetEnvOrDefault(convertToEnvName("USE", "restore-force"), utils.BoolToString(RestoreForce)),
+		),
+		"restore the snapshot even if the storage is not empty, discarding its data",
+	)
 
 	flag.Parse()
+
+	// A segment would be rolled over on every write otherwise
+	if DBSegmentSize <= 0 {
+		invalidFlag("db-segment-size", utils.IntToString(DBSegmentSize), "must be > 0")
+	}
+}
+
+// invalidFlag reports the invalid value of the given flag the way the
+// flag package does and exits.
+func invalidFlag(name, value, reason string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -%s: %s\n", value, name, reason)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// oneOf appends the given values, if any, to the given flag usage.
+func oneOf(usage string, values []string) string {
+	if len(values) == 0 {
+		return usage
+	}
+
+	return usage + ", one of: " + strings.Join(values, ", ")
 }
 
 func convertToEnvName(prefix, name string) string {
@@ -95,7 +215,18 @@ func String() string {
   worker-id: %d,
   log-level: %s
   db-sync-type: %s
-  db-read-only: %t`,
+  db-sync-interval: %s
+  db-sync-bytes: %d
+  db-read-only: %t
+  db-compaction-ratio: %g
+  db-segment-size: %d
+  db-filter-fpr: %g
+  db-as-of: %s
+  db-max-memory: %d
+  db-eviction: %s
+  db-options: %s
+  restore-from: %s
+  restore-force: %t`,
 		Transport,
 		Address,
 		Storage,
@@ -104,6 +235,17 @@ func String() string {
 		WorkerID,
 		LogLevel,
 		DBSyncType,
+		DBSyncInterval,
+		DBSyncBytes,
 		DBReadOnly,
+		DBCompactionRatio,
+		DBSegmentSize,
+		DBFilterFPR,
+		DBAsOf,
+		DBMaxMemory,
+		DBEviction,
+		DBOptions,
+		RestoreFrom,
+		RestoreForce,
 	)
 }
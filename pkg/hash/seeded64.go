@@ -0,0 +1,72 @@
+package hash
+
+import (
+	"encoding/binary"
+	gohash "hash"
+)
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// Seeded64 satisfies the hash.Hash64 interface.
+//
+// It is a FNV-1a hash function whose initial state is derived from a
+// seed. Unlike maphash, the hash values depend only on the seed and the
+// input which makes them stable across the processes.
+type Seeded64 struct {
+	seed uint64
+	sum  uint64
+}
+
+func NewSeeded64(seed uint64) gohash.Hash64 {
+	h := &Seeded64{seed: seed}
+	h.Reset()
+
+	return h
+}
+
+func (h *Seeded64) Write(p []byte) (n int, err error) {
+	for _, b := range p {
+		h.sum ^= uint64(b)
+		h.sum *= prime64
+	}
+
+	return len(p), nil
+}
+
+func (h *Seeded64) Reset() {
+	h.sum = offset64 ^ mix64(h.seed)
+}
+
+func (h *Seeded64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}
+
+func (h *Seeded64) Size() int {
+	return 8
+}
+
+func (h *Seeded64) BlockSize() int {
+	return 1
+}
+
+// Sum64 returns the FNV-1a hash passed through a finalizer so that all
+// the bits of the hash depend on all the bits of the input.
+func (h *Seeded64) Sum64() uint64 {
+	return mix64(h.sum)
+}
+
+// mix64 is the finalizer of splitmix64.
+//
+// Based on: https://prng.di.unimi.it/splitmix64.c
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -1,6 +1,10 @@
 package id
 
 import (
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/utkarsh-pro/use/pkg/config"
 	"github.com/utkarsh-pro/use/pkg/id/snowflake"
 )
@@ -14,3 +18,29 @@ type Gen interface {
 func New() Gen {
 	return snowflake.New(0, int64(config.WorkerID))
 }
+
+// Time returns the time at which the given ID was generated.
+func Time(id uint64) time.Time {
+	return time.UnixMilli(snowflake.Timestamp(id, 0))
+}
+
+// Max returns the largest ID which can be generated at the given time,
+// every ID generated till the given time is <= Max.
+func Max(t time.Time) uint64 {
+	return snowflake.Max(t.UnixMilli(), 0)
+}
+
+// Parse parses the given ID which is either a number or a point in time
+// formatted as RFC 3339, in which case the ID is the Max of the time.
+func Parse(s string) (uint64, error) {
+	if id, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return id, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q, expected a number or an RFC 3339 time", s)
+	}
+
+	return Max(t), nil
+}
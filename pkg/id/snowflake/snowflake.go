@@ -59,3 +59,15 @@ func (s *Snowflake) Next() uint64 {
 
 	return id
 }
+
+// Timestamp returns the time in unix milliseconds at which the given ID
+// was generated by a generator with the given epoch offset.
+func Timestamp(id uint64, epochOffset int64) int64 {
+	return int64(id>>22) + epochOffset
+}
+
+// Max returns the largest ID a generator with the given epoch offset
+// can generate at the given time in unix milliseconds.
+func Max(ts int64, epochOffset int64) uint64 {
+	return uint64(ts-epochOffset)<<22 | (1<<22 - 1)
+}
@@ -24,3 +24,23 @@ func TestSnowflake_Next(t *testing.T) {
 		}
 	})
 }
+
+func TestTimestamp(t *testing.T) {
+	s := New(1000, 5)
+
+	before := time.Now().UnixMilli()
+	id := s.Next()
+	after := time.Now().UnixMilli()
+
+	if ts := Timestamp(id, 1000); ts < before || ts > after {
+		t.Errorf("expected timestamp in [%d, %d], got %d", before, after, ts)
+	}
+
+	if max := Max(after, 1000); id > max {
+		t.Errorf("expected ID <= %d, got %d", max, id)
+	}
+
+	if max := Max(before-1, 1000); id <= max {
+		t.Errorf("expected ID > %d, got %d", max, id)
+	}
+}
@@ -0,0 +1,127 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// Batch is a group of writes which are committed in a single transaction,
+// so either all of them survive a crash or none of them do.
+type Batch struct {
+	s   *Storage
+	ops []op
+
+	// err is the error of the first invalid write added to the batch,
+	// the batch isn't committed if it is set.
+	err error
+}
+
+// op is a write in a batch.
+type op struct {
+	key string
+	val []byte
+	exp int64
+	del bool
+}
+
+// NewBatch returns a new empty batch of writes.
+func (s *Storage) NewBatch() types.Batch {
+	return &Batch{s: s}
+}
+
+// Put adds setting the value for the given key to the batch.
+func (b *Batch) Put(key []byte, value []byte, opts ...types.SetOption) {
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+
+		return
+	}
+
+	b.ops = append(b.ops, op{
+		key: string(key),
+		val: append([]byte{}, value...),
+		exp: expiry(o),
+	})
+}
+
+// Delete adds deleting the value for the given key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, op{key: string(key), del: true})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the batch to the storage in one go.
+func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext writes the batch to the storage in one go, none of the
+// writes are applied once the given context is done.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	s := b.s
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	err := s.update(func(tx *tx) error {
+		// The context may have been done while waiting for the write lock
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for _, o := range b.ops {
+			if len(o.key) > maxKeyLen {
+				return ErrKeyTooLarge
+			}
+
+			if o.del {
+				if err := tx.del(o.key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			v, err := tx.value(o.val, o.exp)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.put(o.key, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.ops = nil
+	return nil
+}
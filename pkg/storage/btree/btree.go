@@ -0,0 +1,677 @@
+// btree package implements a storage based on a copy-on-write B+tree.
+//
+// The tree is kept in fixed-size pages of a single data file. A write never
+// modifies a page in use, it copies the nodes on the path to the modified
+// leaf to free pages and then writes a new meta pointing to the new root.
+// So a crash leaves the file with either the old or the new tree, and the
+// readers see a consistent tree without blocking the writer.
+package btree
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/id"
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage"
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+const (
+	// dataFile is the name of the data file in the storage directory.
+	dataFile = "btree.db"
+
+	// metaPages is the number of the meta pages at the start of the file.
+	metaPages = 2
+
+	// OptionCacheSize is the storage option setting the number of the
+	// pages kept in the page cache, DefaultCacheSize by default.
+	OptionCacheSize = "cache-size"
+)
+
+// ErrAsOfUnsupported is returned when the storage is opened as of a write,
+// the storage doesn't keep the overwritten values.
+var ErrAsOfUnsupported = fmt.Errorf("btree storage can't be opened as of a write")
+
+// Storage is a B+tree storage.
+type Storage struct {
+	// Conditional implements the conditional writes over SetIf and
+	// DeleteIf.
+	types.Conditional
+
+	// dir is path to the storage directory.
+	dir string
+	// fd is the data file, nil if the storage is read-only and the file
+	// doesn't exist.
+	fd *os.File
+
+	// mu guards the meta against being swapped while a tree is read, so
+	// that the pages of the tree aren't reused meanwhile.
+	mu *sync.RWMutex
+	// meta is the meta of the latest commit.
+	meta *meta
+
+	// cache is the cache of the decoded pages.
+	cache *cache
+
+	// idgen is the id generator.
+	idgen id.Gen
+
+	// wmu is the write mutex.
+	wmu *sync.Mutex
+	// fl tracks the free pages.
+	//
+	// fl is guarded by the write lock.
+	fl *freelist
+	// durable is the ID of the latest commit synced to the disk.
+	//
+	// durable is guarded by the write lock.
+	durable uint64
+	// pins are the number of the snapshots of the commits, by the ID of
+	// the commit.
+	//
+	// pins is guarded by the write lock.
+	pins map[uint64]int
+	// unsynced is the number of bytes written to the data file since it
+	// was synced last.
+	//
+	// unsynced is guarded by the write lock.
+	unsynced int64
+
+	// flush wakes up the async syncer.
+	flush chan struct{}
+
+	// initialized is true when the storage is initialized.
+	initialized *atomic.Bool
+
+	// cfg is the storage config.
+	cfg config.Config
+
+	// done is closed to stop the background workers.
+	done chan struct{}
+	// wg waits for the background workers to stop.
+	wg *sync.WaitGroup
+}
+
+// init registers the storage, see storage.Register.
+func init() {
+	storage.Register(storage.BTreeStorageType, func(path string, cfg config.Config) (storage.Storage, error) {
+		return New(path, cfg), nil
+	})
+}
+
+// New returns a new Storage instance.
+func New(dir string, cfg config.Config) *Storage {
+	s := &Storage{
+		dir:         dir,
+		mu:          &sync.RWMutex{},
+		idgen:       id.New(),
+		wmu:         &sync.Mutex{},
+		pins:        make(map[uint64]int),
+		flush:       make(chan struct{}, 1),
+		initialized: &atomic.Bool{},
+		cfg:         cfg,
+		wg:          &sync.WaitGroup{},
+	}
+	s.Conditional = types.NewConditional(s)
+
+	return s
+}
+
+// Init configures the storage.
+//
+// The latest commit whose meta and free pages are intact is recovered,
+// the commits which didn't make it to the disk completely are discarded
+// along with the pages they wrote.
+func (s *Storage) Init() error {
+	if s.cfg.AsOf > 0 {
+		return ErrAsOfUnsupported
+	}
+
+	if err := s.cfg.Options.Check(OptionCacheSize); err != nil {
+		return err
+	}
+
+	size, err := s.cfg.Options.Int(OptionCacheSize, DefaultCacheSize)
+	if err != nil {
+		return err
+	}
+
+	if size <= 0 {
+		return fmt.Errorf("invalid value %d of storage option %s: must be > 0", size, OptionCacheSize)
+	}
+	s.cache = newCache(size)
+
+	if !s.cfg.ReadOnly {
+		if err := os.MkdirAll(s.dir, 0777); err != nil {
+			return fmt.Errorf("error creating storage directory: %w", err)
+		}
+	}
+
+	path := filepath.Join(s.dir, dataFile)
+	if s.cfg.ReadOnly {
+		fd, err := os.Open(path)
+		switch {
+		case os.IsNotExist(err):
+			// Nothing was ever written
+			s.meta, s.fl = &meta{pages: metaPages}, newFreelist(nil)
+			s.initialized.Store(true)
+			return nil
+		case err != nil:
+			return fmt.Errorf("error opening data file: %w", err)
+		}
+		s.fd = fd
+	} else {
+		fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return fmt.Errorf("error opening data file: %w", err)
+		}
+		s.fd = fd
+
+		if err := s.create(); err != nil {
+			s.fd.Close()
+			return err
+		}
+	}
+
+	m, free, err := s.recover()
+	if err != nil {
+		s.fd.Close()
+		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+	}
+
+	s.meta, s.fl, s.durable = m, newFreelist(free), m.txid
+
+	if s.cfg.ReadOnly {
+		log.Infoln("storage is read-only, skipping recovery")
+
+		s.initialized.Store(true)
+		return nil
+	}
+
+	// The pages beyond the commit were written by the discarded commits
+	if err := s.fd.Truncate(int64(m.pages * PageSize)); err != nil {
+		s.fd.Close()
+		return fmt.Errorf("error truncating data file: %w", err)
+	}
+
+	s.initialized.Store(true)
+
+	if s.cfg.Sync == config.SyncTypeAsync {
+		done := make(chan struct{})
+		s.done = done
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.flushAsync(done)
+		}()
+	}
+
+	return nil
+}
+
+// create writes the meta of an empty tree to both the meta pages if the
+// data file is empty.
+func (s *Storage) create() error {
+	info, err := s.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading data file info: %w", err)
+	}
+
+	if info.Size() > 0 {
+		return nil
+	}
+
+	m := &meta{pages: metaPages}
+	for i := int64(0); i < metaPages; i++ {
+		if _, err := s.fd.WriteAt(m.encode(), i*PageSize); err != nil {
+			return fmt.Errorf("error writing meta: %w", err)
+		}
+	}
+
+	if err := s.fd.Sync(); err != nil {
+		return fmt.Errorf("error syncing data file: %w", err)
+	}
+
+	return syncDir(s.dir)
+}
+
+// recover returns the latest commit whose meta, free pages and root page
+// are intact along with its free pages.
+func (s *Storage) recover() (*meta, []uint64, error) {
+	var metas []*meta
+	for i := int64(0); i < metaPages; i++ {
+		b := make([]byte, PageSize)
+		if _, err := s.fd.ReadAt(b, i*PageSize); err != nil {
+			continue
+		}
+
+		if m, err := decodeMeta(b); err == nil {
+			metas = append(metas, m)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].txid > metas[j].txid })
+
+	err := fmt.Errorf("no valid meta page")
+	for _, m := range metas {
+		var free []uint64
+		if free, err = s.readFreelist(m); err != nil {
+			log.Warnf("Discarding commit %d: %s", m.txid, err)
+			continue
+		}
+
+		if m.root != 0 {
+			if _, err = s.node(m.root); err != nil {
+				log.Warnf("Discarding commit %d: %s", m.txid, err)
+				continue
+			}
+		}
+
+		return m, free, nil
+	}
+
+	return nil, nil, err
+}
+
+// readFreelist reads the free pages of the given commit.
+func (s *Storage) readFreelist(m *meta) ([]uint64, error) {
+	if m.nfree == 0 {
+		return nil, nil
+	}
+
+	b := make([]byte, m.nfree*8)
+	if _, err := s.fd.ReadAt(b, int64(m.free*PageSize)); err != nil {
+		return nil, fmt.Errorf("error reading free pages: %w", err)
+	}
+
+	return decodeFreelist(b, m.fcrc)
+}
+
+// node returns the node of the given page, from the cache if possible.
+func (s *Storage) node(id uint64) (*node, error) {
+	if n, ok := s.cache.get(id); ok {
+		return n, nil
+	}
+
+	b := make([]byte, PageSize)
+	if _, err := s.fd.ReadAt(b, int64(id*PageSize)); err != nil {
+		return nil, fmt.Errorf("%s: error reading page %d: %w", errors.ErrCorruptStorage, id, err)
+	}
+
+	n, err := decodeNode(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: page %d: %w", errors.ErrCorruptStorage, id, err)
+	}
+
+	s.cache.put(id, n)
+	return n, nil
+}
+
+// read returns a copy of the bytes of the given value, it should be called
+// with the read lock held so that the overflow pages aren't reused.
+func (s *Storage) read(v value) ([]byte, error) {
+	if v.ovf == 0 {
+		return append([]byte{}, v.val...), nil
+	}
+
+	b := make([]byte, v.vlen)
+	if _, err := s.fd.ReadAt(b, int64(v.ovf*PageSize)); err != nil {
+		return nil, fmt.Errorf("%s: error reading value: %w", errors.ErrCorruptStorage, err)
+	}
+
+	if crc32.Checksum(b, crcTable) != v.vcrc {
+		return nil, fmt.Errorf("%s: value at page %d: %w", errors.ErrCorruptStorage, v.ovf, ErrCorruptPage)
+	}
+
+	return b, nil
+}
+
+// Get returns the value for the given key.
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value for the given key.
+func (s *Storage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	val, _, err := s.GetVersionedContext(ctx, key)
+	return val, err
+}
+
+// GetVersioned returns the value for the given key along with its
+// version, which is the ID of the write of the value.
+func (s *Storage) GetVersioned(key []byte) ([]byte, uint64, error) {
+	return s.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext returns the value for the given key along with its
+// version, which is the ID of the write of the value.
+func (s *Storage) GetVersionedContext(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if !s.isInit() {
+		return nil, 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok, err := s.lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !ok {
+		return nil, 0, errors.ErrKeyNotFound
+	}
+
+	val, err := s.read(v)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return val, v.id, nil
+}
+
+// lookup returns the live value for the given key in the tree of the
+// latest commit, it should be called with the read lock held.
+func (s *Storage) lookup(key []byte) (value, bool, error) {
+	v, ok, err := get(s.node, s.meta.root, string(key))
+	if err != nil || !ok || expired(v.exp) {
+		return value{}, false, err
+	}
+
+	return v, true, nil
+}
+
+// Set sets the value for the given key.
+func (s *Storage) Set(key []byte, value []byte, opts ...types.SetOption) error {
+	return s.SetContext(context.Background(), key, value, opts...)
+}
+
+// SetContext sets the value for the given key.
+func (s *Storage) SetContext(ctx context.Context, key []byte, value []byte, opts ...types.SetOption) error {
+	_, err := s.SetIf(ctx, key, value, opts, nil)
+	return err
+}
+
+// SetIf sets the value for the given key if the given condition, if any,
+// holds and returns the version of the new value.
+func (s *Storage) SetIf(ctx context.Context, key []byte, val []byte, opts []types.SetOption, cond types.Condition) (uint64, error) {
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	exp := expiry(o)
+
+	var version uint64
+	err = s.update(func(tx *tx) error {
+		// The context may have been done while waiting for the write lock
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if len(key) > maxKeyLen {
+			return ErrKeyTooLarge
+		}
+
+		// The condition is evaluated in the transaction so that no other
+		// write to the key can sneak in before the value is written.
+		if cond != nil {
+			v, ok, err := tx.get(string(key))
+			if err != nil {
+				return err
+			}
+
+			if err := cond(v.id, ok && !expired(v.exp)); err != nil {
+				return err
+			}
+		}
+
+		v, err := tx.value(val, exp)
+		if err != nil {
+			return err
+		}
+		version = v.id
+
+		return tx.put(string(key), v)
+	})
+
+	return version, err
+}
+
+// Delete deletes the value for the given key.
+func (s *Storage) Delete(key []byte) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the value for the given key.
+func (s *Storage) DeleteContext(ctx context.Context, key []byte) error {
+	return s.DeleteIf(ctx, key, nil)
+}
+
+// DeleteIf deletes the value for the given key if the given condition,
+// if any, holds.
+func (s *Storage) DeleteIf(ctx context.Context, key []byte, cond types.Condition) error {
+	return s.update(func(tx *tx) error {
+		// The context may have been done while waiting for the write lock
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		v, ok, err := tx.get(string(key))
+		if err != nil {
+			return err
+		}
+
+		if cond != nil {
+			if err := cond(v.id, ok && !expired(v.exp)); err != nil {
+				return err
+			}
+		}
+
+		// The expired value is removed too, it takes space all the same
+		if !ok {
+			return nil
+		}
+
+		return tx.del(string(key))
+	})
+}
+
+// Exists returns true if the given key exists.
+func (s *Storage) Exists(key []byte) (bool, error) {
+	return s.ExistsContext(context.Background(), key)
+}
+
+// ExistsContext returns true if the given key exists.
+func (s *Storage) ExistsContext(ctx context.Context, key []byte) (bool, error) {
+	if !s.isInit() {
+		return false, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok, err := s.lookup(key)
+	return ok, err
+}
+
+// TTL returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTL(key []byte) (time.Duration, error) {
+	return s.TTLContext(context.Background(), key)
+}
+
+// TTLContext returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTLContext(ctx context.Context, key []byte) (time.Duration, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, errors.ErrKeyNotFound
+	}
+
+	if v.exp == 0 {
+		return types.NoExpiry, nil
+	}
+
+	return time.Until(time.UnixMilli(v.exp)), nil
+}
+
+// Len returns the number of live keys in the storage.
+func (s *Storage) Len() (int, error) {
+	return s.LenContext(context.Background())
+}
+
+// LenContext returns the number of live keys in the storage, the keys stop
+// being counted once the given context is done.
+//
+// The storage doesn't track the number of keys, the expired keys stay in
+// the tree till they are overwritten, deleted or compacted. So all the
+// keys are counted one by one.
+func (s *Storage) LenContext(ctx context.Context) (int, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	it, err := s.NewIteratorContext(ctx, types.IterOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	n := 0
+	for it.Next() {
+		n++
+	}
+
+	return n, it.Err()
+}
+
+// LogicalSnapshot writes the live keys of the storage to the given
+// writer, see logical.Export.
+func (s *Storage) LogicalSnapshot(w io.Writer) error {
+	return s.LogicalSnapshotContext(context.Background(), w)
+}
+
+// LogicalSnapshotContext writes the live keys of the storage to the given
+// writer, see logical.ExportContext.
+func (s *Storage) LogicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	return logical.ExportContext(ctx, s, w)
+}
+
+// Restore writes the keys of the logical snapshot read from the given
+// reader to the storage, see logical.Restore.
+func (s *Storage) Restore(r io.Reader) error {
+	return s.RestoreContext(context.Background(), r)
+}
+
+// RestoreContext writes the keys of the logical snapshot read from the
+// given reader to the storage, see logical.RestoreContext.
+func (s *Storage) RestoreContext(ctx context.Context, r io.Reader) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	return logical.RestoreContext(ctx, s, r)
+}
+
+// Close closes the storage, the data file is synced first.
+func (s *Storage) Close() error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	// Stop the background workers, if any.
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.initialized.Store(false)
+	if s.fd == nil {
+		return nil
+	}
+
+	if !s.cfg.ReadOnly {
+		if err := s.fd.Sync(); err != nil {
+			log.Warnln("failed to sync the data file: ", err)
+		}
+	}
+
+	err := s.fd.Close()
+	s.fd = nil
+	if err != nil {
+		return fmt.Errorf("error closing data file: %w", err)
+	}
+
+	return nil
+}
+
+// isInit returns true if the storage is initialized.
+func (s *Storage) isInit() bool {
+	return s.initialized.Load()
+}
+
+// syncDir syncs the given directory so that the files created in it
+// survive crashes.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory: %w", err)
+	}
+	defer fd.Close()
+
+	if err := fd.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,537 @@
+package btree
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+// open returns an initialized storage in the given directory.
+func open(t *testing.T, dir string, cfg config.Config) *Storage {
+	t.Helper()
+
+	s := New(dir, cfg)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// check verifies that the storage holds exactly the given keys, both
+// through the lookups and through the iteration in either direction.
+func check(t *testing.T, s *Storage, want map[string]string) {
+	t.Helper()
+
+	keys := make([]string, 0, len(want))
+	for k, v := range want {
+		keys = append(keys, k)
+
+		val, err := s.Get([]byte(k))
+		if err != nil || string(val) != v {
+			t.Fatal("expected", len(v), "bytes for", k, "got", len(val), err)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, reverse := range []bool{false, true} {
+		it, err := s.NewIterator(types.IterOptions{Reverse: reverse})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for it.Next() {
+			if string(it.Value()) != want[string(it.Key())] {
+				t.Error("unexpected value for", string(it.Key()))
+			}
+			got = append(got, string(it.Key()))
+		}
+		it.Close()
+
+		if reverse {
+			for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+				got[i], got[j] = got[j], got[i]
+			}
+		}
+
+		if err := it.Err(); err != nil || strings.Join(got, ",") != strings.Join(keys, ",") {
+			t.Fatal("expected", len(keys), "keys in order, got", len(got), err)
+		}
+	}
+}
+
+func TestNode(t *testing.T) {
+	leaf := &node{
+		leaf: true,
+		keys: []string{"a", "b"},
+		vals: []value{
+			{id: 1, exp: 100, val: []byte("inline"), vlen: 6},
+			{id: 2, ovf: 7, vlen: 10000, vcrc: 42},
+		},
+	}
+
+	branch := &node{keys: []string{"m"}, children: []uint64{3, 4}}
+
+	for _, n := range []*node{leaf, branch} {
+		b := n.encode()
+		if len(b) != PageSize {
+			t.Fatal("expected a page, got", len(b), "bytes")
+		}
+
+		got, err := decodeNode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.leaf != n.leaf || strings.Join(got.keys, ",") != strings.Join(n.keys, ",") || len(got.children) != len(n.children) {
+			t.Error("expected", n, "got", got)
+		}
+
+		for i, v := range n.vals {
+			g := got.vals[i]
+			if g.id != v.id || g.exp != v.exp || !bytes.Equal(g.val, v.val) || g.ovf != v.ovf || g.vlen != v.vlen || g.vcrc != v.vcrc {
+				t.Error("expected", v, "got", g)
+			}
+		}
+
+		b[10] ^= 1
+		if _, err := decodeNode(b); err != ErrCorruptPage {
+			t.Error("expected ErrCorruptPage, got", err)
+		}
+	}
+}
+
+func TestStorage_Tree(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir, config.DefaultConfig())
+
+	rnd := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	// Every 10th value goes to overflow pages
+	for _, i := range rnd.Perm(3000) {
+		k := "key" + utils.IntToString(i)
+		v := strings.Repeat("v", 1+i%100)
+		if i%10 == 0 {
+			v = strings.Repeat("o", 5000+i)
+		}
+
+		if err := s.Set([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+
+	root, err := s.node(s.meta.root)
+	if err != nil || root.leaf {
+		t.Fatal("expected the root to be a branch", err)
+	}
+	check(t, s, want)
+
+	// Delete two thirds of the keys and overwrite some of the rest
+	for _, i := range rnd.Perm(3000) {
+		k := "key" + utils.IntToString(i)
+		switch i % 3 {
+		case 0:
+			v := strings.Repeat("n", 1+i%700)
+			if err := s.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		default:
+			if err := s.Delete([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, k)
+		}
+	}
+	check(t, s, want)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, dir, config.DefaultConfig())
+	check(t, s, want)
+
+	b := s.NewBatch()
+	for k := range want {
+		b.Delete([]byte(k))
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.meta.root != 0 {
+		t.Error("expected an empty tree, got root", s.meta.root)
+	}
+	check(t, s, nil)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set([]byte(strings.Repeat("k", maxKeyLen+1)), nil); err != errors.ErrStorageNotInitialized {
+		t.Error("expected ErrStorageNotInitialized, got", err)
+	}
+
+	s = open(t, dir, config.DefaultConfig())
+	defer s.Close()
+
+	if err := s.Set([]byte(strings.Repeat("k", maxKeyLen+1)), nil); err != ErrKeyTooLarge {
+		t.Error("expected ErrKeyTooLarge, got", err)
+	}
+}
+
+func TestStorage_SpaceReuse(t *testing.T) {
+	for name, cfg := range map[string]config.Config{
+		"sync": config.DefaultConfig().WithSync(),
+		"none": config.DefaultConfig(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := open(t, t.TempDir(), cfg)
+			defer s.Close()
+
+			write := func(round int) {
+				b := s.NewBatch()
+				for i := 0; i < 100; i++ {
+					b.Put([]byte("key"+utils.IntToString(i)), bytes.Repeat([]byte{byte(round)}, 100+i*20))
+				}
+
+				if err := b.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write(0)
+			pages := s.meta.pages
+
+			// The file doesn't grow as the same keys are overwritten
+			for round := 1; round < 200; round++ {
+				write(round)
+			}
+
+			// Unless synced, the freed pages are reused only once there
+			// are enough of them, see reclaimPages.
+			if s.meta.pages > 2*pages+reclaimPages {
+				t.Error("expected at most", 2*pages+reclaimPages, "pages, got", s.meta.pages)
+			}
+		})
+	}
+}
+
+func TestStorage_Recovery(t *testing.T) {
+	// setup writes 10 keys, one commit each, to a closed storage and
+	// returns the path of its data file.
+	setup := func(t *testing.T) (string, string) {
+		dir := t.TempDir()
+
+		s := open(t, dir, config.DefaultConfig())
+		for i := 0; i < 10; i++ {
+			if err := s.Set([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		return dir, filepath.Join(dir, dataFile)
+	}
+
+	// check verifies that the first n keys survived
+	check := func(t *testing.T, dir string, n int) {
+		t.Helper()
+
+		s := open(t, dir, config.DefaultConfig())
+		defer s.Close()
+
+		for i := 0; i < 10; i++ {
+			val, err := s.Get([]byte("key" + utils.IntToString(i)))
+			if i < n && (err != nil || string(val) != "val"+utils.IntToString(i)) {
+				t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+			}
+
+			if i >= n && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+		}
+	}
+
+	// corrupt flips a byte of the given page
+	corrupt := func(t *testing.T, path string, page int64) {
+		fd, err := os.OpenFile(path, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+
+		b := make([]byte, 1)
+		if _, err := fd.ReadAt(b, page*PageSize+100); err != nil {
+			t.Fatal(err)
+		}
+
+		b[0] ^= 1
+		if _, err := fd.WriteAt(b, page*PageSize+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		dir, _ := setup(t)
+		check(t, dir, 10)
+	})
+
+	t.Run("torn meta", func(t *testing.T) {
+		dir, path := setup(t)
+
+		// The 10th commit wrote the meta page 0
+		corrupt(t, path, 0)
+		check(t, dir, 9)
+	})
+
+	t.Run("corrupt metas", func(t *testing.T) {
+		dir, path := setup(t)
+		corrupt(t, path, 0)
+		corrupt(t, path, 1)
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err == nil || !strings.Contains(err.Error(), errors.ErrCorruptStorage.Error()) {
+			t.Error("expected ErrCorruptStorage, got", err)
+		}
+	})
+
+	t.Run("discarded pages", func(t *testing.T) {
+		dir, path := setup(t)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Pages written by a commit which never wrote its meta
+		fd, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fd.Write(make([]byte, 3*PageSize)); err != nil {
+			t.Fatal(err)
+		}
+		fd.Close()
+
+		check(t, dir, 10)
+
+		// The last run of pages isn't padded till the file is truncated
+		size := int64(runLen(uint64(info.Size())) * PageSize)
+		if info, err := os.Stat(path); err != nil || info.Size() != size {
+			t.Error("expected the file to be truncated to", size, "got", info.Size(), err)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		dir, _ := setup(t)
+
+		s := open(t, dir, config.DefaultConfig().WithReadOnly())
+		if n, err := s.Len(); err != nil || n != 10 {
+			t.Error("expected", 10, "got", n, err)
+		}
+
+		if err := s.Set([]byte("key"), []byte("val")); err != errors.ErrReadOnlyStorage {
+			t.Error("expected ErrReadOnlyStorage, got", err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing was ever written
+		s = open(t, filepath.Join(dir, "missing"), config.DefaultConfig().WithReadOnly())
+		if n, err := s.Len(); err != nil || n != 0 {
+			t.Error("expected", 0, "got", n, err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// writerFunc calls the function on the first write and then writes to
+// the buffer.
+type writerFunc struct {
+	buf *bytes.Buffer
+	fn  func()
+}
+
+func (w *writerFunc) Write(p []byte) (int, error) {
+	if w.fn != nil {
+		w.fn()
+		w.fn = nil
+	}
+
+	return w.buf.Write(p)
+}
+
+func TestStorage_PhysicalSnapshot(t *testing.T) {
+	s := open(t, t.TempDir(), config.DefaultConfig().WithSync())
+	defer s.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		k, v := "key"+utils.IntToString(i), "val"+utils.IntToString(i)
+		if i%50 == 0 {
+			v = strings.Repeat(v, 1000)
+		}
+
+		if err := s.Set([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+
+	// The keys are rewritten while the snapshot is being copied, which
+	// would reuse the pages of the snapshot if they weren't pinned.
+	w := &writerFunc{buf: &bytes.Buffer{}, fn: func() {
+		for i := 0; i < 500; i++ {
+			k := []byte("key" + utils.IntToString(i))
+			if err := s.Delete(k); err != nil {
+				t.Error(err)
+			}
+
+			if err := s.Set(k, bytes.Repeat([]byte("x"), 600)); err != nil {
+				t.Error(err)
+			}
+		}
+	}}
+
+	if err := s.PhysicalSnapshot(w); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.pins) != 0 {
+		t.Error("expected the snapshot to be unpinned, got", s.pins)
+	}
+
+	if w.buf.Len()%PageSize != 0 {
+		t.Error("expected whole pages, got", w.buf.Len(), "bytes")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, dataFile), w.buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := open(t, dir, config.DefaultConfig())
+	defer restored.Close()
+
+	check(t, restored, want)
+}
+
+func TestStorage_Concurrent(t *testing.T) {
+	s := open(t, t.TempDir(), config.DefaultConfig())
+	defer s.Close()
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 500; i++ {
+				k := []byte("key" + utils.IntToString(w) + "-" + utils.IntToString(i))
+				v := []byte("val" + utils.IntToString(i))
+				if i%20 == 0 {
+					v = bytes.Repeat(v, 500)
+				}
+
+				if err := s.Set(k, v); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if val, err := s.Get(k); err != nil || !bytes.Equal(val, v) {
+					t.Error("expected", len(v), "bytes, got", len(val), err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 20; i++ {
+			it, err := s.NewIterator(types.IterOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			var prev []byte
+			for it.Next() {
+				if prev != nil && bytes.Compare(prev, it.Key()) >= 0 {
+					t.Error("expected the keys in order, got", string(prev), string(it.Key()))
+				}
+				prev = it.Key()
+			}
+
+			if err := it.Err(); err != nil {
+				t.Error(err)
+			}
+			it.Close()
+		}
+	}()
+	wg.Wait()
+
+	if n, err := s.Len(); err != nil || n != 2000 {
+		t.Error("expected", 2000, "got", n, err)
+	}
+}
+
+func TestStorage_Options(t *testing.T) {
+	dir := t.TempDir()
+
+	s := open(t, dir, config.DefaultConfig().WithOptions(config.Options{OptionCacheSize: "2"}))
+	want := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		k := "key" + utils.IntToString(i)
+		want[k] = strings.Repeat("v", i%100)
+
+		if err := s.Set([]byte(k), []byte(want[k])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.cache.lru.Len(); n > 2 {
+		t.Error("expected at most", 2, "cached pages got", n)
+	}
+	check(t, s, want)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, val := range []string{"0", "-1", "many"} {
+		s := New(dir, config.DefaultConfig().WithOptions(config.Options{OptionCacheSize: val}))
+		if err := s.Init(); err == nil {
+			s.Close()
+			t.Error("expected error for cache size", val)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package btree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCacheSize is the number of pages kept in the page cache.
+const DefaultCacheSize = 4096
+
+// cache is a least recently used cache of the decoded pages.
+//
+// The cached nodes are shared by the readers, which is safe because the
+// nodes are never modified. A page is cached again whenever it is written,
+// so a reused page never shows its old node.
+type cache struct {
+	mu    sync.Mutex
+	size  int
+	lru   *list.List
+	pages map[uint64]*list.Element
+}
+
+// cached is an element of the lru list.
+type cached struct {
+	id uint64
+	n  *node
+}
+
+// newCache returns a new cache holding at most size pages.
+func newCache(size int) *cache {
+	return &cache{
+		size:  size,
+		lru:   list.New(),
+		pages: make(map[uint64]*list.Element),
+	}
+}
+
+// get returns the node of the given page, if cached.
+func (c *cache) get(id uint64) (*node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.pages[id]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return el.Value.(*cached).n, true
+}
+
+// put caches the node of the given page, evicting the least recently
+// used page if the cache is full.
+func (c *cache) put(id uint64, n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.pages[id]; ok {
+		el.Value.(*cached).n = n
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.pages[id] = c.lru.PushFront(&cached{id: id, n: n})
+
+	if c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.pages, el.Value.(*cached).id)
+	}
+}
+
+// remove drops the given page from the cache.
+func (c *cache) remove(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.pages[id]; ok {
+		c.lru.Remove(el)
+		delete(c.pages, id)
+	}
+}
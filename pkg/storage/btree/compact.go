@@ -0,0 +1,108 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+)
+
+// compactBatch is the number of the expired keys removed by a single
+// transaction of a compaction.
+const compactBatch = 1024
+
+// Compact removes the expired keys from the tree.
+//
+// The pages of the overwritten and the deleted values are freed by the
+// commits themselves, but the expired keys stay in the tree till they are
+// overwritten or deleted. The keys are removed in small transactions so
+// that the writes aren't blocked for long.
+func (s *Storage) Compact() error {
+	return s.CompactContext(context.Background())
+}
+
+// CompactContext removes the expired keys from the tree like Compact, the
+// keys stop being removed once the given context is done. The keys removed
+// till then stay removed.
+func (s *Storage) CompactContext(ctx context.Context) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	keys, err := s.expiredKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for len(keys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := compactBatch
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		if err := s.update(func(tx *tx) error {
+			for _, key := range keys[:n] {
+				// The key could have been written since
+				v, ok, err := tx.get(key)
+				if err != nil {
+					return err
+				}
+
+				if !ok || !expired(v.exp) {
+					continue
+				}
+
+				if err := tx.del(key); err != nil {
+					return err
+				}
+				removed++
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	log.Debugf("Removed %d expired keys", removed)
+	return nil
+}
+
+// expiredKeys returns the expired keys in the tree of the latest commit,
+// the keys stop being looked up once the given context is done.
+func (s *Storage) expiredKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	for key, inclusive := "", true; ; inclusive = false {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		s.mu.RLock()
+		k, v, ok, err := seek(s.node, s.meta.root, key, inclusive, false)
+		s.mu.RUnlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return keys, nil
+		}
+
+		if expired(v.exp) {
+			keys = append(keys, k)
+		}
+		key = k
+	}
+}
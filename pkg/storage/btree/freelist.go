@@ -0,0 +1,140 @@
+package btree
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+)
+
+// freelist tracks the pages which aren't used by the tree of the latest
+// commit.
+//
+// A page freed by a commit is still used by the trees of the earlier
+// commits, which may be read by a reader or a snapshot, or be recovered
+// if the meta of the commit is torn by a crash. So the freed pages are
+// pending till their commit is synced and isn't pinned by a snapshot,
+// see release.
+type freelist struct {
+	// free are the pages which can be reused, sorted.
+	free []uint64
+	// pending are the pages freed by the commits, by the ID of the commit.
+	pending map[uint64][]uint64
+}
+
+// newFreelist returns a freelist with the given reusable pages.
+func newFreelist(free []uint64) *freelist {
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	return &freelist{free: free, pending: make(map[uint64][]uint64)}
+}
+
+// allocate takes a run of n contiguous reusable pages and returns the
+// first page of the run, ok is false if there is no such run.
+func (f *freelist) allocate(n uint64) (uint64, bool) {
+	if n == 1 && len(f.free) > 0 {
+		id := f.free[len(f.free)-1]
+		f.free = f.free[:len(f.free)-1]
+		return id, true
+	}
+
+	for i, start := 0, 0; i < len(f.free); i++ {
+		if i > 0 && f.free[i] != f.free[i-1]+1 {
+			start = i
+		}
+
+		if uint64(i-start+1) == n {
+			id := f.free[start]
+			f.free = append(f.free[:start], f.free[i+1:]...)
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// reuse makes the given pages reusable right away.
+func (f *freelist) reuse(ids ...uint64) {
+	f.free = append(f.free, ids...)
+	sort.Slice(f.free, func(i, j int) bool { return f.free[i] < f.free[j] })
+}
+
+// trim drops the reusable pages beyond the given number of pages.
+func (f *freelist) trim(pages uint64) {
+	i := sort.Search(len(f.free), func(i int) bool { return f.free[i] >= pages })
+	f.free = f.free[:i]
+}
+
+// freed records the given pages as freed by the commit with the given ID.
+func (f *freelist) freed(txid uint64, ids ...uint64) {
+	if len(ids) > 0 {
+		f.pending[txid] = append(f.pending[txid], ids...)
+	}
+}
+
+// release makes the pages freed by the commits with IDs <= upto
+// reusable and returns them.
+func (f *freelist) release(upto uint64) []uint64 {
+	var released []uint64
+	for txid, ids := range f.pending {
+		if txid <= upto {
+			released = append(released, ids...)
+			delete(f.pending, txid)
+		}
+	}
+
+	if len(released) > 0 {
+		f.reuse(released...)
+	}
+
+	return released
+}
+
+// npending returns the number of the pending pages.
+func (f *freelist) npending() int {
+	n := 0
+	for _, ids := range f.pending {
+		n += len(ids)
+	}
+
+	return n
+}
+
+// count returns the number of the free pages, reusable or pending.
+func (f *freelist) count() int {
+	return len(f.free) + f.npending()
+}
+
+// encode encodes the free pages, reusable or pending, along with the
+// given pages. Once the commit holding the encoded pages is recovered,
+// none of the earlier trees is around, so all of them are reusable.
+func (f *freelist) encode(extra ...uint64) ([]byte, uint32) {
+	b := make([]byte, 0, 8*(f.count()+len(extra)))
+	for _, id := range f.free {
+		b = binary.LittleEndian.AppendUint64(b, id)
+	}
+
+	for _, ids := range f.pending {
+		for _, id := range ids {
+			b = binary.LittleEndian.AppendUint64(b, id)
+		}
+	}
+
+	for _, id := range extra {
+		b = binary.LittleEndian.AppendUint64(b, id)
+	}
+
+	return b, crc32.Checksum(b, crcTable)
+}
+
+// decodeFreelist decodes the free pages encoded by encode.
+func decodeFreelist(b []byte, crc uint32) ([]uint64, error) {
+	if len(b)%8 != 0 || crc32.Checksum(b, crcTable) != crc {
+		return nil, ErrCorruptPage
+	}
+
+	ids := make([]uint64, 0, len(b)/8)
+	for i := 0; i < len(b); i += 8 {
+		ids = append(ids, binary.LittleEndian.Uint64(b[i:]))
+	}
+
+	return ids, nil
+}
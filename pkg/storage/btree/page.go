@@ -0,0 +1,373 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// PageSize is the size of every page of the data file.
+	PageSize = 4096
+
+	// FormatVersion is the current version of the data file format.
+	FormatVersion = uint16(1)
+
+	// maxKeyLen is the length of the largest key, a page holds at least
+	// a couple of the largest entries so that a split always fits.
+	maxKeyLen = 1024
+
+	// maxInlineLen is the length of the largest value stored in a leaf,
+	// the larger values are stored in runs of overflow pages.
+	maxInlineLen = 512
+
+	// pageHdrLen is the length of the header of a branch or a leaf page.
+	pageHdrLen = 1 + // type
+		2 // number of entries
+
+	// pageCrcLen is the length of the checksum at the end of every page.
+	pageCrcLen = 4
+
+	// pageCap is the number of bytes available to the entries of a page.
+	pageCap = PageSize - pageHdrLen - pageCrcLen
+)
+
+// Page types
+const (
+	metaPage   = byte(1)
+	branchPage = byte(2)
+	leafPage   = byte(3)
+)
+
+var (
+	// ErrCorruptPage is returned when a page doesn't match its checksum
+	// or is malformed.
+	ErrCorruptPage = fmt.Errorf("page is corrupted")
+
+	// ErrKeyTooLarge is returned when a key is longer than maxKeyLen.
+	ErrKeyTooLarge = fmt.Errorf("key is larger than %d bytes", maxKeyLen)
+
+	// magic are the bytes that every meta page starts with.
+	magic = []byte("USEBT")
+
+	// crcTable is the table used to calculate the checksums.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// meta is the root of the data file. The first two pages of the file
+// hold the meta of the last two commits, a commit writes its meta over
+// the meta of the commit before the previous one. So a commit whose meta
+// is torn by a crash is rolled back to the previous commit.
+type meta struct {
+	// txid is the ID of the commit, it grows with every commit.
+	txid uint64
+	// root is the root page of the tree, 0 if the tree is empty.
+	root uint64
+	// pages is the number of pages in use, the pages beyond it are free.
+	pages uint64
+
+	// free is the first page of the run holding the free pages.
+	free uint64
+	// nfree is the number of the free pages.
+	nfree uint64
+	// fcrc is the checksum of the run holding the free pages.
+	fcrc uint32
+}
+
+// encode encodes the meta into a page.
+func (m *meta) encode() []byte {
+	b := make([]byte, 0, PageSize)
+	b = append(b, metaPage)
+	b = append(b, magic...)
+	b = binary.LittleEndian.AppendUint16(b, FormatVersion)
+	b = binary.LittleEndian.AppendUint32(b, PageSize)
+	b = binary.LittleEndian.AppendUint64(b, m.txid)
+	b = binary.LittleEndian.AppendUint64(b, m.root)
+	b = binary.LittleEndian.AppendUint64(b, m.pages)
+	b = binary.LittleEndian.AppendUint64(b, m.free)
+	b = binary.LittleEndian.AppendUint64(b, m.nfree)
+	b = binary.LittleEndian.AppendUint32(b, m.fcrc)
+
+	return sealPage(b)
+}
+
+// decodeMeta decodes the meta encoded by encode.
+func decodeMeta(b []byte) (*meta, error) {
+	b, err := unsealPage(b, metaPage)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 5+2+4+5*8+4 || !bytes.Equal(b[:5], magic) {
+		return nil, ErrCorruptPage
+	}
+
+	if v := binary.LittleEndian.Uint16(b[5:]); v > FormatVersion {
+		return nil, fmt.Errorf("unsupported data file format version %d", v)
+	}
+
+	if size := binary.LittleEndian.Uint32(b[7:]); size != PageSize {
+		return nil, fmt.Errorf("unsupported page size %d", size)
+	}
+
+	b = b[11:]
+	return &meta{
+		txid:  binary.LittleEndian.Uint64(b),
+		root:  binary.LittleEndian.Uint64(b[8:]),
+		pages: binary.LittleEndian.Uint64(b[16:]),
+		free:  binary.LittleEndian.Uint64(b[24:]),
+		nfree: binary.LittleEndian.Uint64(b[32:]),
+		fcrc:  binary.LittleEndian.Uint32(b[40:]),
+	}, nil
+}
+
+// node is a decoded branch or leaf page.
+//
+// A node is never modified once it is written, the commits copy the
+// nodes they modify to new pages.
+type node struct {
+	leaf bool
+
+	// keys of a leaf are the keys of its values. keys of a branch
+	// separate its children, keys[i] is the smallest key of the
+	// subtree children[i+1].
+	keys []string
+
+	// children are the pages of the children of a branch.
+	children []uint64
+
+	// vals are the values of a leaf.
+	vals []value
+}
+
+// value is a value stored in a leaf.
+type value struct {
+	// id is the ID of the write, which is the version of the value.
+	id uint64
+	// exp is the expiry time of the value in unix milliseconds,
+	// 0 if the value never expires.
+	exp int64
+
+	// val is the value itself if it is stored in the leaf.
+	val []byte
+
+	// ovf is the first page of the run of overflow pages holding
+	// the value, 0 if the value is stored in the leaf.
+	ovf uint64
+	// vlen is the length of the value.
+	vlen uint32
+	// vcrc is the checksum of the value stored in overflow pages.
+	vcrc uint32
+}
+
+// size returns the number of bytes the value takes in a leaf.
+func (v value) size() int {
+	if v.ovf != 0 {
+		return 8 + 8 + 1 + 4 + 8 + 4
+	}
+
+	return 8 + 8 + 1 + 4 + len(v.val)
+}
+
+// clone returns a copy of the node which can be modified.
+func (n *node) clone() *node {
+	return &node{
+		leaf:     n.leaf,
+		keys:     append([]string{}, n.keys...),
+		children: append([]uint64{}, n.children...),
+		vals:     append([]value{}, n.vals...),
+	}
+}
+
+// entrySize returns the number of bytes the i-th entry takes in the page.
+func (n *node) entrySize(i int) int {
+	if n.leaf {
+		return 2 + len(n.keys[i]) + n.vals[i].size()
+	}
+
+	return 2 + len(n.keys[i]) + 8
+}
+
+// size returns the number of bytes the entries of the node take.
+func (n *node) size() int {
+	size := 0
+	if !n.leaf {
+		// The first child has no key
+		size += 8
+	}
+
+	for i := range n.keys {
+		size += n.entrySize(i)
+	}
+
+	return size
+}
+
+// encode encodes the node into a page.
+func (n *node) encode() []byte {
+	b := make([]byte, 0, PageSize)
+	if n.leaf {
+		b = append(b, leafPage)
+	} else {
+		b = append(b, branchPage)
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(n.keys)))
+
+	if !n.leaf {
+		b = binary.LittleEndian.AppendUint64(b, n.children[0])
+	}
+
+	for i, key := range n.keys {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(key)))
+		b = append(b, key...)
+
+		if !n.leaf {
+			b = binary.LittleEndian.AppendUint64(b, n.children[i+1])
+			continue
+		}
+
+		v := n.vals[i]
+		b = binary.LittleEndian.AppendUint64(b, v.id)
+		b = binary.LittleEndian.AppendUint64(b, uint64(v.exp))
+		if v.ovf != 0 {
+			b = append(b, 1)
+			b = binary.LittleEndian.AppendUint32(b, v.vlen)
+			b = binary.LittleEndian.AppendUint64(b, v.ovf)
+			b = binary.LittleEndian.AppendUint32(b, v.vcrc)
+		} else {
+			b = append(b, 0)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(v.val)))
+			b = append(b, v.val...)
+		}
+	}
+
+	return sealPage(b)
+}
+
+// decodeNode decodes the node encoded by encode.
+func decodeNode(b []byte) (*node, error) {
+	if len(b) != PageSize {
+		return nil, ErrCorruptPage
+	}
+
+	n := &node{leaf: b[0] == leafPage}
+	typ := branchPage
+	if n.leaf {
+		typ = leafPage
+	}
+
+	b, err := unsealPage(b, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &pageReader{b: b}
+	count := int(r.uint16())
+	if !n.leaf {
+		n.children = append(n.children, r.uint64())
+	}
+
+	for i := 0; i < count && r.err == nil; i++ {
+		n.keys = append(n.keys, string(r.bytes(int(r.uint16()))))
+
+		if !n.leaf {
+			n.children = append(n.children, r.uint64())
+			continue
+		}
+
+		v := value{id: r.uint64(), exp: int64(r.uint64())}
+		if r.byte() == 1 {
+			v.vlen = r.uint32()
+			v.ovf = r.uint64()
+			v.vcrc = r.uint32()
+		} else {
+			v.val = r.bytes(int(r.uint32()))
+			v.vlen = uint32(len(v.val))
+		}
+		n.vals = append(n.vals, v)
+	}
+
+	if r.err != nil {
+		return nil, ErrCorruptPage
+	}
+
+	return n, nil
+}
+
+// sealPage pads the given page and appends its checksum.
+func sealPage(b []byte) []byte {
+	b = b[:PageSize-pageCrcLen]
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// unsealPage verifies the type and the checksum of the given page and
+// returns the page without its type and checksum.
+func unsealPage(b []byte, typ byte) ([]byte, error) {
+	if len(b) != PageSize || b[0] != typ {
+		return nil, ErrCorruptPage
+	}
+
+	payload := b[:PageSize-pageCrcLen]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(b[PageSize-pageCrcLen:]) {
+		return nil, ErrCorruptPage
+	}
+
+	return payload[1:], nil
+}
+
+// pageReader reads the fields of a page, the first read beyond the
+// page sets err and the later reads return zero values.
+type pageReader struct {
+	b   []byte
+	err error
+}
+
+func (r *pageReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = ErrCorruptPage
+		return nil
+	}
+
+	b := r.b[:n:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *pageReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *pageReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *pageReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (r *pageReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+// runLen returns the number of pages in the run holding the given
+// number of bytes.
+func runLen(size uint64) uint64 {
+	return (size + PageSize - 1) / PageSize
+}
@@ -0,0 +1,62 @@
+package btree
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// PhysicalSnapshot writes a page image of the latest commit to the given
+// writer. The image is a data file holding just the commit, both of its
+// meta pages hold the meta of the commit and they are followed by the
+// pages up to the last page used by the commit, so the image can be
+// opened as the data file of a storage as is.
+//
+// The tree of the commit is pinned while it is copied, so the writes go
+// on meanwhile without reusing any of its pages, see freelist.
+func (s *Storage) PhysicalSnapshot(w io.Writer) error {
+	return s.PhysicalSnapshotContext(context.Background(), w)
+}
+
+// PhysicalSnapshotContext writes a page image of the latest commit to the
+// given writer like PhysicalSnapshot, the copy stops once the given context
+// is done and the commit is unpinned.
+func (s *Storage) PhysicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w = types.WriterWithContext(ctx, w)
+
+	m := s.pin()
+	defer s.unpin(m)
+
+	for i := 0; i < metaPages; i++ {
+		if _, err := w.Write(m.encode()); err != nil {
+			return fmt.Errorf("error generating snapshot: %w", err)
+		}
+	}
+
+	size := int64((m.pages - metaPages) * PageSize)
+	if size == 0 {
+		return nil
+	}
+
+	n, err := io.Copy(w, io.NewSectionReader(s.fd, metaPages*PageSize, size))
+	if err != nil {
+		return fmt.Errorf("error generating snapshot: %w", err)
+	}
+
+	// The last run of overflow or free pages isn't padded in the file
+	if _, err := w.Write(make([]byte, size-n)); err != nil {
+		return fmt.Errorf("error generating snapshot: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+)
+
+// flushAsync syncs the data file periodically and whenever the unsynced
+// writes cross the configured threshold till done is closed.
+func (s *Storage) flushAsync(done <-chan struct{}) {
+	var tick <-chan time.Time
+	if s.cfg.SyncInterval > 0 {
+		ticker := time.NewTicker(s.cfg.SyncInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+		case <-s.flush:
+		}
+
+		s.wmu.Lock()
+		if s.unsynced > 0 {
+			if err := s.sync(); err != nil {
+				log.Warnln(err)
+			}
+		}
+		s.wmu.Unlock()
+	}
+}
+
+// maybeFlush wakes up the syncer if the unsynced writes have crossed
+// the configured threshold, it should be called with the write lock held.
+func (s *Storage) maybeFlush() {
+	if s.cfg.SyncBytes <= 0 || s.unsynced < s.cfg.SyncBytes {
+		return
+	}
+
+	// The syncer is already awake otherwise
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+}
+
+// sync syncs the data file, it should be called with the write lock held.
+func (s *Storage) sync() error {
+	if err := s.fd.Sync(); err != nil {
+		return fmt.Errorf("error syncing data file: %w", err)
+	}
+
+	s.synced()
+	return nil
+}
+
+// synced marks the latest commit as synced and makes the pages which are
+// no longer used by any recoverable or pinned tree reusable.
+//
+// synced should be called with the write lock held.
+func (s *Storage) synced() {
+	s.unsynced = 0
+	s.durable = s.meta.txid
+	s.release()
+}
+
+// release makes the pages freed by the commits which are synced and
+// aren't pinned reusable, see freelist. It should be called with the
+// write lock held.
+func (s *Storage) release() {
+	upto := s.durable
+	for txid := range s.pins {
+		// The pinned tree uses the pages freed by the later commits
+		if txid < upto {
+			upto = txid
+		}
+	}
+
+	for _, id := range s.fl.release(upto) {
+		s.cache.remove(id)
+	}
+}
+
+// pin keeps the pages of the tree of the latest commit from being reused
+// till unpin is called and returns the meta of the commit.
+func (s *Storage) pin() meta {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	m := *s.meta
+	s.pins[m.txid]++
+
+	return m
+}
+
+// unpin releases the tree pinned by pin.
+func (s *Storage) unpin(m meta) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.pins[m.txid]--; s.pins[m.txid] <= 0 {
+		delete(s.pins, m.txid)
+	}
+
+	s.release()
+}
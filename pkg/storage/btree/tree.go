@@ -0,0 +1,148 @@
+package btree
+
+import (
+	"sort"
+)
+
+// loader returns the node of the given page.
+type loader func(id uint64) (*node, error)
+
+// search returns the index of the given key in the leaf, or the index
+// it would be inserted at, and whether the key is present.
+func (n *node) search(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+// child returns the index of the child of the branch whose subtree
+// holds the given key.
+func (n *node) child(key string) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+}
+
+// get returns the value for the given key in the tree with the given root.
+func get(load loader, root uint64, key string) (value, bool, error) {
+	if root == 0 {
+		return value{}, false, nil
+	}
+
+	for id := root; ; {
+		n, err := load(id)
+		if err != nil {
+			return value{}, false, err
+		}
+
+		if !n.leaf {
+			id = n.children[n.child(key)]
+			continue
+		}
+
+		i, ok := n.search(key)
+		if !ok {
+			return value{}, false, nil
+		}
+
+		return n.vals[i], true, nil
+	}
+}
+
+// frame is a branch on the path from the root to a leaf along with the
+// index of the child the path goes through.
+type frame struct {
+	n *node
+	i int
+}
+
+// seek returns the key following the given key in the tree with the
+// given root along with its value. The following key is the smallest key
+// greater than the given key, or the largest key smaller than the given
+// key if reverse is true, or the given key itself if inclusive is true.
+//
+// The nodes don't link to their siblings since a copied node would have
+// to copy its siblings too, so the path from the root is kept to climb
+// to the next leaf.
+func seek(load loader, root uint64, key string, inclusive, reverse bool) (string, value, bool, error) {
+	if root == 0 {
+		return "", value{}, false, nil
+	}
+
+	var path []frame
+	n, err := load(root)
+	if err != nil {
+		return "", value{}, false, err
+	}
+
+	for !n.leaf {
+		i := n.child(key)
+		path = append(path, frame{n: n, i: i})
+
+		if n, err = load(n.children[i]); err != nil {
+			return "", value{}, false, err
+		}
+	}
+
+	i, ok := n.search(key)
+	switch {
+	case !reverse && ok && !inclusive:
+		i++
+	case reverse && !(ok && inclusive):
+		i--
+	}
+
+	if i >= 0 && i < len(n.keys) {
+		return n.keys[i], n.vals[i], true, nil
+	}
+
+	// The key is beyond the leaf, climb to the closest branch which
+	// has a child in the direction of the iteration.
+	for len(path) > 0 {
+		f := path[len(path)-1]
+		path = path[:len(path)-1]
+
+		next := f.i + 1
+		if reverse {
+			next = f.i - 1
+		}
+
+		if next >= 0 && next < len(f.n.children) {
+			return edge(load, f.n.children[next], reverse)
+		}
+	}
+
+	return "", value{}, false, nil
+}
+
+// edge returns the smallest key in the subtree with the given root along
+// with its value, or the largest key if last is true.
+func edge(load loader, root uint64, last bool) (string, value, bool, error) {
+	if root == 0 {
+		return "", value{}, false, nil
+	}
+
+	for id := root; ; {
+		n, err := load(id)
+		if err != nil {
+			return "", value{}, false, err
+		}
+
+		i := 0
+		if last {
+			i = len(n.keys) - 1
+			if !n.leaf {
+				i = len(n.children) - 1
+			}
+		}
+
+		if !n.leaf {
+			id = n.children[i]
+			continue
+		}
+
+		// Only the root of an empty tree is an empty leaf
+		if len(n.keys) == 0 {
+			return "", value{}, false, nil
+		}
+
+		return n.keys[i], n.vals[i], true, nil
+	}
+}
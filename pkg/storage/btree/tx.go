@@ -0,0 +1,529 @@
+package btree
+
+import (
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// reclaimPages is the number of the pending pages beyond which a commit
+// syncs the data file, even if the sync type doesn't call for it, so that
+// the pending pages become reusable.
+const reclaimPages = 1024
+
+// tx is a write transaction, the copy of the tree it modifies becomes
+// visible only once the transaction is committed.
+//
+// The modified nodes are copied to new pages, which are kept in memory
+// and modified in place till the commit writes them.
+type tx struct {
+	s *Storage
+
+	// m is the meta of the commit.
+	m meta
+
+	// dirty are the nodes modified by the transaction, by their pages.
+	dirty map[uint64]*node
+	// allocated are the pages allocated by the transaction.
+	allocated map[uint64]bool
+	// freed are the pages of the earlier commits freed by the transaction.
+	freed []uint64
+}
+
+// child is a node replacing a child of a branch, key is the smallest key
+// of its subtree.
+type child struct {
+	key string
+	id  uint64
+}
+
+// begin starts a new write transaction, it should be called with the
+// write lock held.
+func (s *Storage) begin() *tx {
+	m := *s.meta
+	m.txid++
+
+	return &tx{
+		s:         s,
+		m:         m,
+		dirty:     make(map[uint64]*node),
+		allocated: make(map[uint64]bool),
+	}
+}
+
+// node returns the node of the given page as seen by the transaction.
+func (tx *tx) node(id uint64) (*node, error) {
+	if n, ok := tx.dirty[id]; ok {
+		return n, nil
+	}
+
+	return tx.s.node(id)
+}
+
+// get returns the value for the given key as seen by the transaction.
+func (tx *tx) get(key string) (value, bool, error) {
+	return get(tx.node, tx.m.root, key)
+}
+
+// alloc allocates a run of n contiguous pages and returns its first page,
+// the file grows if no run of the free pages is long enough.
+func (tx *tx) alloc(n uint64) uint64 {
+	id, ok := tx.s.fl.allocate(n)
+	if !ok {
+		id = tx.m.pages
+		tx.m.pages += n
+	}
+
+	for i := id; i < id+n; i++ {
+		tx.allocated[i] = true
+	}
+
+	return id
+}
+
+// free frees the run of n pages starting at the given page.
+func (tx *tx) free(id, n uint64) {
+	for i := id; i < id+n; i++ {
+		// The pages allocated by the transaction aren't used by anyone else
+		if tx.allocated[i] {
+			delete(tx.allocated, i)
+			tx.s.fl.reuse(i)
+			continue
+		}
+
+		tx.freed = append(tx.freed, i)
+	}
+}
+
+// writable returns a copy of the node of the given page which can be
+// modified, along with the page of the copy.
+func (tx *tx) writable(id uint64) (uint64, *node, error) {
+	if n, ok := tx.dirty[id]; ok {
+		return id, n, nil
+	}
+
+	n, err := tx.s.node(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tx.free(id, 1)
+
+	c := n.clone()
+	id = tx.alloc(1)
+	tx.dirty[id] = c
+
+	return id, c, nil
+}
+
+// drop frees the page of the given modified node.
+func (tx *tx) drop(id uint64) {
+	delete(tx.dirty, id)
+	tx.free(id, 1)
+}
+
+// value returns the value to be stored for the given bytes, the large
+// values are written to overflow pages right away. The pages aren't
+// reachable till the commit, so writing them early is harmless.
+func (tx *tx) value(val []byte, exp int64) (value, error) {
+	v := value{id: tx.s.idgen.Next(), exp: exp, vlen: uint32(len(val))}
+	if len(val) <= maxInlineLen {
+		v.val = append([]byte{}, val...)
+		return v, nil
+	}
+
+	v.ovf = tx.alloc(runLen(uint64(len(val))))
+	v.vcrc = crc32.Checksum(val, crcTable)
+
+	if _, err := tx.s.fd.WriteAt(val, int64(v.ovf*PageSize)); err != nil {
+		return value{}, fmt.Errorf("error writing value: %w", err)
+	}
+	tx.s.unsynced += int64(len(val))
+
+	return v, nil
+}
+
+// put sets the value for the given key.
+func (tx *tx) put(key string, v value) error {
+	if tx.m.root == 0 {
+		id := tx.alloc(1)
+		tx.dirty[id] = &node{leaf: true, keys: []string{key}, vals: []value{v}}
+		tx.m.root = id
+		return nil
+	}
+
+	kids, err := tx.insert(tx.m.root, key, v)
+	if err != nil {
+		return err
+	}
+
+	// The root has split, the new root is a branch over the splits
+	for len(kids) > 1 {
+		n := &node{children: []uint64{kids[0].id}}
+		for _, k := range kids[1:] {
+			n.keys = append(n.keys, k.key)
+			n.children = append(n.children, k.id)
+		}
+
+		id := tx.alloc(1)
+		tx.dirty[id] = n
+		kids = tx.split(id, n)
+	}
+
+	tx.m.root = kids[0].id
+	return nil
+}
+
+// insert sets the value for the given key in the subtree with the given
+// root and returns the nodes replacing the root.
+func (tx *tx) insert(id uint64, key string, v value) ([]child, error) {
+	id, n, err := tx.writable(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.leaf {
+		i, ok := n.search(key)
+		if ok {
+			tx.discard(n.vals[i])
+			n.vals[i] = v
+		} else {
+			n.keys = insertAt(n.keys, i, key)
+			n.vals = insertAt(n.vals, i, v)
+		}
+
+		return tx.split(id, n), nil
+	}
+
+	i := n.child(key)
+	kids, err := tx.insert(n.children[i], key, v)
+	if err != nil {
+		return nil, err
+	}
+
+	n.children[i] = kids[0].id
+	for j, k := range kids[1:] {
+		n.keys = insertAt(n.keys, i+j, k.key)
+		n.children = insertAt(n.children, i+j+1, k.id)
+	}
+
+	return tx.split(id, n), nil
+}
+
+// split splits the given modified node into the nodes which fit in
+// a page, the first of which stays at the page of the node.
+func (tx *tx) split(id uint64, n *node) []child {
+	if n.size() <= pageCap {
+		return []child{{id: id}}
+	}
+
+	var (
+		kids  []child
+		parts []*node
+	)
+
+	if n.leaf {
+		for start, size, i := 0, 0, 0; i <= len(n.keys); i++ {
+			if i == len(n.keys) || (i > start && size+n.entrySize(i) > pageCap) {
+				parts = append(parts, &node{
+					leaf: true,
+					keys: append([]string{}, n.keys[start:i]...),
+					vals: append([]value{}, n.vals[start:i]...),
+				})
+				kids = append(kids, child{key: n.keys[start]})
+
+				start, size = i, 0
+			}
+
+			if i < len(n.keys) {
+				size += n.entrySize(i)
+			}
+		}
+	} else {
+		// The key separating two parts moves up to the parent
+		sep := ""
+		for start, size, i := 0, 8, 0; i <= len(n.keys); i++ {
+			if i == len(n.keys) || (i > start && size+n.entrySize(i) > pageCap) {
+				parts = append(parts, &node{
+					keys:     append([]string{}, n.keys[start:i]...),
+					children: append([]uint64{}, n.children[start:i+1]...),
+				})
+				kids = append(kids, child{key: sep})
+
+				if i < len(n.keys) {
+					sep = n.keys[i]
+				}
+				start, size = i+1, 8
+				continue
+			}
+
+			size += n.entrySize(i)
+		}
+	}
+
+	for i, p := range parts {
+		if i > 0 {
+			id = tx.alloc(1)
+		}
+
+		tx.dirty[id] = p
+		kids[i].id = id
+	}
+
+	return kids
+}
+
+// del deletes the value for the given key.
+func (tx *tx) del(key string) error {
+	if tx.m.root == 0 {
+		return nil
+	}
+
+	id, empty, _, err := tx.remove(tx.m.root, key)
+	if err != nil {
+		return err
+	}
+
+	if empty {
+		tx.drop(id)
+		tx.m.root = 0
+		return nil
+	}
+
+	// A branch with a single child is of no use as the root
+	for {
+		n, err := tx.node(id)
+		if err != nil {
+			return err
+		}
+
+		if n.leaf || len(n.children) > 1 {
+			break
+		}
+
+		tx.drop(id)
+		id = n.children[0]
+	}
+
+	tx.m.root = id
+	return nil
+}
+
+// remove deletes the value for the given key from the subtree with the
+// given root and returns the node replacing the root, empty is true if
+// the node is left with no key. The nodes aren't merged once they fall
+// below half full, an empty node is removed though.
+func (tx *tx) remove(id uint64, key string) (uint64, bool, bool, error) {
+	n, err := tx.node(id)
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	if n.leaf {
+		i, ok := n.search(key)
+		if !ok {
+			return id, false, false, nil
+		}
+
+		id, n, err := tx.writable(id)
+		if err != nil {
+			return 0, false, false, err
+		}
+
+		tx.discard(n.vals[i])
+		n.keys = removeAt(n.keys, i)
+		n.vals = removeAt(n.vals, i)
+
+		return id, len(n.keys) == 0, true, nil
+	}
+
+	i := n.child(key)
+	cid, empty, found, err := tx.remove(n.children[i], key)
+	if err != nil || !found {
+		return id, false, found, err
+	}
+
+	id, n, err = tx.writable(id)
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	if !empty {
+		n.children[i] = cid
+		return id, false, true, nil
+	}
+
+	tx.drop(cid)
+	n.children = removeAt(n.children, i)
+	switch {
+	case i > 0:
+		n.keys = removeAt(n.keys, i-1)
+	case len(n.keys) > 0:
+		n.keys = removeAt(n.keys, 0)
+	}
+
+	return id, len(n.children) == 0, true, nil
+}
+
+// discard frees the overflow pages of the given value, if any.
+func (tx *tx) discard(v value) {
+	if v.ovf != 0 {
+		tx.free(v.ovf, runLen(uint64(v.vlen)))
+	}
+}
+
+// rollback returns the pages allocated by the transaction.
+func (tx *tx) rollback() {
+	ids := make([]uint64, 0, len(tx.allocated))
+	for id := range tx.allocated {
+		ids = append(ids, id)
+	}
+	tx.s.fl.reuse(ids...)
+
+	// The pages beyond the file are allocated again by growing it
+	tx.s.fl.trim(tx.s.meta.pages)
+}
+
+// commit writes the modified nodes and the free pages to new pages and
+// then the meta of the commit, which makes the new tree visible.
+//
+// In the sync mode the data file is synced before and after the meta is
+// written, so the commit survives crashes once commit returns. Otherwise
+// the commits since the last sync may be lost.
+func (tx *tx) commit() error {
+	s := tx.s
+	if len(tx.dirty) == 0 && len(tx.freed) == 0 && len(tx.allocated) == 0 {
+		return nil
+	}
+
+	// The run holding the free pages of the previous commit is freed too
+	old := make([]uint64, 0, runLen(s.meta.nfree*8))
+	for i := uint64(0); i < runLen(s.meta.nfree*8); i++ {
+		old = append(old, s.meta.free+i)
+	}
+
+	var free []byte
+	if n := runLen(uint64(s.fl.count()+len(tx.freed)+len(old)) * 8); n > 0 {
+		tx.m.free = tx.alloc(n)
+		free, tx.m.fcrc = s.fl.encode(append(old, tx.freed...)...)
+	} else {
+		tx.m.free, tx.m.fcrc = 0, 0
+	}
+	tx.m.nfree = uint64(len(free) / 8)
+
+	written := int64(0)
+	for id, n := range tx.dirty {
+		if _, err := s.fd.WriteAt(n.encode(), int64(id*PageSize)); err != nil {
+			tx.rollback()
+			return fmt.Errorf("error writing page: %w", err)
+		}
+		written += PageSize
+	}
+
+	if len(free) > 0 {
+		if _, err := s.fd.WriteAt(free, int64(tx.m.free*PageSize)); err != nil {
+			tx.rollback()
+			return fmt.Errorf("error writing free pages: %w", err)
+		}
+		written += int64(len(free))
+	}
+
+	if s.cfg.Sync == config.SyncTypeSync {
+		if err := s.fd.Sync(); err != nil {
+			tx.rollback()
+			return fmt.Errorf("error syncing data file: %w", err)
+		}
+	}
+
+	// The meta of the commit goes over the meta of the commit before the
+	// previous one, see meta.
+	if _, err := s.fd.WriteAt(tx.m.encode(), int64(tx.m.txid%2*PageSize)); err != nil {
+		tx.rollback()
+		return fmt.Errorf("error writing meta: %w", err)
+	}
+	s.unsynced += written + PageSize
+
+	for id, n := range tx.dirty {
+		s.cache.put(id, n)
+	}
+
+	s.mu.Lock()
+	m := tx.m
+	s.meta = &m
+	s.mu.Unlock()
+
+	s.fl.freed(tx.m.txid, append(old, tx.freed...)...)
+
+	switch {
+	case s.cfg.Sync == config.SyncTypeSync:
+		if err := s.fd.Sync(); err != nil {
+			return fmt.Errorf("error syncing data file: %w", err)
+		}
+		s.synced()
+	case s.fl.npending() > reclaimPages:
+		if err := s.sync(); err != nil {
+			return err
+		}
+	case s.cfg.Sync == config.SyncTypeAsync:
+		s.maybeFlush()
+	}
+
+	return nil
+}
+
+// update runs the given function in a write transaction and commits it,
+// the transaction is rolled back if the function fails.
+func (s *Storage) update(fn func(tx *tx) error) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	tx := s.begin()
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return tx.commit()
+}
+
+// insertAt inserts the given element at the given index of the slice.
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+
+	return s
+}
+
+// removeAt removes the element at the given index of the slice.
+func removeAt[T any](s []T, i int) []T {
+	return append(s[:i], s[i+1:]...)
+}
+
+// expiry returns the expiry time of a value written now with the
+// given options, 0 if the value never expires.
+func expiry(o types.SetOptions) int64 {
+	if o.TTL <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(o.TTL).UnixMilli()
+}
+
+// expired returns true if the given expiry time has passed.
+func expired(exp int64) bool {
+	return exp != 0 && exp <= time.Now().UnixMilli()
+}
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 // SyncType is the type of sync.
 type SyncType string
 
@@ -12,16 +14,89 @@ var (
 	SyncTypeAsync SyncType = "async"
 )
 
+// EvictionType is the type of eviction.
+type EvictionType string
+
+var (
+	// EvictionTypeLRU evicts the least recently used keys.
+	EvictionTypeLRU EvictionType = "lru"
+	// EvictionTypeLFU evicts the least frequently used keys.
+	EvictionTypeLFU EvictionType = "lfu"
+)
+
 // Config is the config for the storage.
 type Config struct {
 	Sync     SyncType
 	ReadOnly bool
+
+	// SyncInterval is the interval at which the writes are synced
+	// in the async sync mode.
+	//
+	// An interval <= 0 disables the periodic syncs.
+	SyncInterval time.Duration
+
+	// SyncBytes is the number of unsynced bytes beyond which the
+	// writes are synced in the async sync mode.
+	//
+	// A threshold <= 0 disables the syncs based on the size.
+	SyncBytes int64
+
+	// CompactionRatio is the ratio of garbage to the total size of
+	// the storage beyond which the storage is compacted automatically.
+	//
+	// A ratio <= 0 disables the automatic compaction.
+	CompactionRatio float64
+
+	// SegmentSize is the size in bytes beyond which the active
+	// segment of the storage is rolled over.
+	//
+	// A size <= 0 falls back to DefaultSegmentSize.
+	SegmentSize int64
+
+	// FilterFalsePositiveRate is the false positive rate the bloom
+	// filter of the storage is sized for. The filter is regenerated
+	// in the background once its false positive rate drifts away.
+	//
+	// A rate <= 0 disables the filter regeneration.
+	FilterFalsePositiveRate float64
+
+	// AsOf is the ID of the latest write the storage is opened with,
+	// the later writes are ignored as if they never happened. The
+	// storage is read-only when it is opened as of a write.
+	//
+	// AsOf = 0 opens the storage with all of its writes.
+	AsOf uint64
+
+	// MaxMemory is the number of bytes the keys and the values of an
+	// in-memory storage may take, the keys are evicted beyond it.
+	//
+	// A limit <= 0 disables the eviction.
+	MaxMemory int64
+
+	// Eviction is the policy choosing the keys evicted once the
+	// storage takes more than MaxMemory.
+	Eviction EvictionType
+
+	// Options are the options specific to the storage engine, an
+	// engine rejects the options it doesn't support.
+	Options Options
 }
 
+// DefaultSegmentSize is the segment size of the default config.
+const DefaultSegmentSize = 64 << 20 // 64MB
+
 // DefaultConfig returns the default config.
 func DefaultConfig() Config {
 	return Config{
-		Sync: SyncTypeNone,
+		Sync:            SyncTypeNone,
+		SyncInterval:    time.Second,
+		SyncBytes:       4 << 20, // 4MB
+		CompactionRatio: 0.5,
+		SegmentSize:     DefaultSegmentSize,
+
+		FilterFalsePositiveRate: 0.01,
+
+		Eviction: EvictionTypeLRU,
 	}
 }
 
@@ -43,6 +118,18 @@ func (cfg Config) WithNoneSync() Config {
 	return cfg
 }
 
+// WithSyncInterval sets the async sync interval.
+func (cfg Config) WithSyncInterval(interval time.Duration) Config {
+	cfg.SyncInterval = interval
+	return cfg
+}
+
+// WithSyncBytes sets the async sync size threshold.
+func (cfg Config) WithSyncBytes(size int64) Config {
+	cfg.SyncBytes = size
+	return cfg
+}
+
 // WithReadOnly sets the read only type.
 func (cfg Config) WithReadOnly() Config {
 	cfg.ReadOnly = true
@@ -54,3 +141,54 @@ func (cfg Config) WithReadWrite() Config {
 	cfg.ReadOnly = false
 	return cfg
 }
+
+// WithCompactionRatio sets the compaction ratio.
+func (cfg Config) WithCompactionRatio(ratio float64) Config {
+	cfg.CompactionRatio = ratio
+	return cfg
+}
+
+// WithSegmentSize sets the segment size.
+func (cfg Config) WithSegmentSize(size int64) Config {
+	cfg.SegmentSize = size
+	return cfg
+}
+
+// WithFilterFalsePositiveRate sets the bloom filter false positive rate.
+func (cfg Config) WithFilterFalsePositiveRate(rate float64) Config {
+	cfg.FilterFalsePositiveRate = rate
+	return cfg
+}
+
+// WithAsOf opens the storage read-only as of the write with the given ID.
+func (cfg Config) WithAsOf(id uint64) Config {
+	cfg.AsOf = id
+	if id > 0 {
+		cfg.ReadOnly = true
+	}
+	return cfg
+}
+
+// WithMaxMemory sets the memory limit of an in-memory storage.
+func (cfg Config) WithMaxMemory(size int64) Config {
+	cfg.MaxMemory = size
+	return cfg
+}
+
+// WithLRUEviction sets the eviction type to lru.
+func (cfg Config) WithLRUEviction() Config {
+	cfg.Eviction = EvictionTypeLRU
+	return cfg
+}
+
+// WithLFUEviction sets the eviction type to lfu.
+func (cfg Config) WithLFUEviction() Config {
+	cfg.Eviction = EvictionTypeLFU
+	return cfg
+}
+
+// WithOptions sets the engine-specific options.
+func (cfg Config) WithOptions(opts Options) Config {
+	cfg.Options = opts
+	return cfg
+}
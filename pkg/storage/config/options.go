@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options are the engine-specific options of a storage by name, each
+// storage parses the options it supports when it is initialized.
+type Options map[string]string
+
+// ParseOptions parses the options from a comma separated list of
+// name=value pairs, e.g. "cache-size=8192,foo=bar".
+func ParseOptions(s string) (Options, error) {
+	opts := Options{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, val, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid storage option %q, expected name=value", pair)
+		}
+
+		opts[strings.TrimSpace(name)] = strings.TrimSpace(val)
+	}
+
+	return opts, nil
+}
+
+// Check returns an error if an option other than the given supported
+// options is set, so that a misspelt option doesn't go unnoticed.
+func (o Options) Check(supported ...string) error {
+	var unknown []string
+	for name := range o {
+		if !contains(supported, name) {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+
+	if len(supported) == 0 {
+		return fmt.Errorf("unknown storage options: %s, the storage has no options", strings.Join(unknown, ", "))
+	}
+
+	return fmt.Errorf(
+		"unknown storage options: %s, supported: %s",
+		strings.Join(unknown, ", "),
+		strings.Join(supported, ", "),
+	)
+}
+
+// Int returns the integer value of the given option, def if it isn't set.
+func (o Options) Int(name string, def int) (int, error) {
+	val, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q of storage option %s: %w", val, name, err)
+	}
+
+	return i, nil
+}
+
+// contains returns true if the given names contain the given name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
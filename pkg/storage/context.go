@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// WithContext returns the given storage as a ContextStorage.
+//
+// A storage implementing ContextStorage is returned as is. The rest are
+// adapted so that the methods check the context before they start, the
+// iterators stop once the context is done and the snapshots stop at the
+// next write once the context is done. The optional interfaces of the
+// storage, such as Compactor, aren't implemented by the adapter.
+func WithContext(s Storage) ContextStorage {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs
+	}
+
+	return &contextStorage{Storage: s}
+}
+
+// contextStorage adapts a Storage to ContextStorage.
+type contextStorage struct {
+	Storage
+}
+
+func (s *contextStorage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.Get(key)
+}
+
+func (s *contextStorage) GetVersionedContext(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return s.GetVersioned(key)
+}
+
+func (s *contextStorage) SetContext(ctx context.Context, key []byte, value []byte, opts ...SetOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Set(key, value, opts...)
+}
+
+func (s *contextStorage) DeleteContext(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Delete(key)
+}
+
+func (s *contextStorage) SetIfAbsentContext(ctx context.Context, key []byte, value []byte, opts ...SetOption) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return s.SetIfAbsent(key, value, opts...)
+}
+
+func (s *contextStorage) SetIfVersionContext(ctx context.Context, key []byte, value []byte, version uint64, opts ...SetOption) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return s.SetIfVersion(key, value, version, opts...)
+}
+
+func (s *contextStorage) DeleteIfVersionContext(ctx context.Context, key []byte, version uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.DeleteIfVersion(key, version)
+}
+
+func (s *contextStorage) ExistsContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return s.Exists(key)
+}
+
+func (s *contextStorage) LenContext(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return s.Len()
+}
+
+func (s *contextStorage) TTLContext(ctx context.Context, key []byte) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return s.TTL(key)
+}
+
+func (s *contextStorage) NewIteratorContext(ctx context.Context, opts IterOptions) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	it, err := s.NewIterator(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return types.IteratorWithContext(ctx, it), nil
+}
+
+func (s *contextStorage) PhysicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.PhysicalSnapshot(types.WriterWithContext(ctx, w))
+}
+
+func (s *contextStorage) LogicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.LogicalSnapshot(types.WriterWithContext(ctx, w))
+}
+
+func (s *contextStorage) RestoreContext(ctx context.Context, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Restore(r)
+}
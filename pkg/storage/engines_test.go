@@ -0,0 +1,11 @@
+package storage_test
+
+// The storages register themselves and import package storage, so the
+// tests of package storage can't import them without an import cycle.
+// Importing them here links them into the test binary all the same.
+import (
+	_ "github.com/utkarsh-pro/use/pkg/storage/btree"
+	_ "github.com/utkarsh-pro/use/pkg/storage/lsm"
+	_ "github.com/utkarsh-pro/use/pkg/storage/memory"
+	_ "github.com/utkarsh-pro/use/pkg/storage/stupid"
+)
@@ -9,4 +9,13 @@ var (
 	ErrKeyNotFound           = fmt.Errorf("key not found")
 	ErrCorruptStorage        = fmt.Errorf("storage is corrupted")
 	ErrReadOnlyStorage       = fmt.Errorf("storage is read only")
+	ErrCompactionInProgress  = fmt.Errorf("compaction is already in progress")
+	ErrKeyExists             = fmt.Errorf("key already exists")
+	ErrVersionMismatch       = fmt.Errorf("version does not match")
+	ErrStorageNotEmpty       = fmt.Errorf("storage is not empty")
+	ErrCorruptSnapshot       = fmt.Errorf("snapshot is corrupted")
+	ErrStorageClosed         = fmt.Errorf("storage is closed")
+	ErrWatchLagging          = fmt.Errorf("watch fell behind the writes")
+	ErrHistoryCompacted      = fmt.Errorf("history was compacted away")
+	ErrInvalidTTL            = fmt.Errorf("ttl must be positive")
 )
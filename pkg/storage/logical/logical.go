@@ -0,0 +1,320 @@
+// logical package implements the logical snapshots of the storages.
+//
+// A logical snapshot holds only the live keys of a storage, unlike a
+// physical snapshot which is a copy of the data files. So a logical
+// snapshot of one storage type can be restored to any other.
+//
+// A logical snapshot is a stream of TLVs:
+//
+//	Header: magic, format version, creation time
+//	Entry: Key, Val and, if the key expires, Exp TLVs, repeated
+//	Trailer: number of entries and the checksum of everything before it
+package logical
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+const (
+	// HdrTypeTLV is the type of the snapshot header TLV.
+	HdrTypeTLV = byte(1)
+
+	// KeyTypeTLV is the type of the key TLV of an entry.
+	KeyTypeTLV = byte(2)
+
+	// ValTypeTLV is the type of the value TLV of an entry.
+	ValTypeTLV = byte(3)
+
+	// ExpTypeTLV is the type of the expiry TLV of an entry.
+	ExpTypeTLV = byte(4)
+
+	// TrailerTypeTLV is the type of the snapshot trailer TLV.
+	TrailerTypeTLV = byte(5)
+
+	// FormatVersion is the current version of the snapshot format.
+	FormatVersion = uint16(1)
+
+	// hdrLen is the length of the header TLV value.
+	hdrLen = 5 + // magic
+		2 + // version
+		8 // creation time
+
+	// trailerLen is the length of the trailer TLV value.
+	trailerLen = 8 + // number of entries
+		4 // checksum
+
+	// batchSize is the number of entries restored in a single batch.
+	batchSize = 1024
+)
+
+var (
+	// ErrCorruptSnapshot is returned when a snapshot doesn't match its
+	// checksum or is malformed.
+	ErrCorruptSnapshot = fmt.Errorf("logical snapshot is corrupted")
+
+	// ErrUnsupportedSnapshot is returned when a snapshot was written
+	// by a newer version of the storage.
+	ErrUnsupportedSnapshot = fmt.Errorf("unsupported logical snapshot format")
+
+	// magic are the bytes that every snapshot starts with.
+	magic = []byte("USELS")
+
+	// crcTable is the table used to calculate the snapshot checksum.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Source is a storage a logical snapshot is taken of.
+type Source interface {
+	// NewIterator returns an iterator over the live keys.
+	NewIterator(opts types.IterOptions) (types.Iterator, error)
+
+	// TTL returns the duration after which the given key expires.
+	TTL(key []byte) (time.Duration, error)
+}
+
+// Sink is a storage a logical snapshot is restored to.
+type Sink interface {
+	// NewBatch returns a new empty batch of writes.
+	NewBatch() types.Batch
+}
+
+// Export writes the logical snapshot of the given storage to the given
+// writer, see ExportContext.
+func Export(src Source, w io.Writer) error {
+	return ExportContext(context.Background(), src, w)
+}
+
+// ExportContext writes the logical snapshot of the given storage to the
+// given writer, the export stops between the keys once the given context
+// is done.
+//
+// The keys are read one after the other, so the writes made during the
+// export may or may not be part of the snapshot.
+func ExportContext(ctx context.Context, src Source, w io.Writer) error {
+	it, err := src.NewIterator(types.IterOptions{})
+	if err != nil {
+		return err
+	}
+	it = types.IteratorWithContext(ctx, it)
+	defer it.Close()
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	tw := tlvrw.NewWriter(io.MultiWriter(bw, crc))
+
+	hdr := make([]byte, 0, hdrLen)
+	hdr = append(hdr, magic...)
+	hdr = binary.LittleEndian.AppendUint16(hdr, FormatVersion)
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(time.Now().UnixMilli()))
+	if err := tw.Write(tlvrw.NewTLV(HdrTypeTLV, hdr)); err != nil {
+		return fmt.Errorf("error writing snapshot header: %w", err)
+	}
+
+	n := uint64(0)
+	for it.Next() {
+		ttl, err := src.TTL(it.Key())
+		if err == nil && ttl <= 0 && ttl != types.NoExpiry {
+			// The key expired in the meantime
+			continue
+		}
+
+		if err := tw.Write(tlvrw.NewTLV(KeyTypeTLV, it.Key())); err != nil {
+			return fmt.Errorf("error writing snapshot entry: %w", err)
+		}
+
+		if err := tw.Write(tlvrw.NewTLV(ValTypeTLV, it.Value())); err != nil {
+			return fmt.Errorf("error writing snapshot entry: %w", err)
+		}
+
+		// The keys deleted in the meantime are exported without expiry
+		if err == nil && ttl != types.NoExpiry {
+			exp := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().Add(ttl).UnixMilli()))
+			if err := tw.Write(tlvrw.NewTLV(ExpTypeTLV, exp)); err != nil {
+				return fmt.Errorf("error writing snapshot entry: %w", err)
+			}
+		}
+
+		n++
+	}
+
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("error iterating the storage: %w", err)
+	}
+
+	trailer := make([]byte, 0, trailerLen)
+	trailer = binary.LittleEndian.AppendUint64(trailer, n)
+	trailer = binary.LittleEndian.AppendUint32(trailer, crc.Sum32())
+	if err := tlvrw.NewWriter(bw).Write(tlvrw.NewTLV(TrailerTypeTLV, trailer)); err != nil {
+		return fmt.Errorf("error writing snapshot trailer: %w", err)
+	}
+
+	return bw.Flush()
+}
+
+// Restore writes the entries of the logical snapshot read from the
+// given reader to the given storage, see RestoreContext.
+func Restore(dst Sink, r io.Reader) error {
+	return RestoreContext(context.Background(), dst, r)
+}
+
+// RestoreContext writes the entries of the logical snapshot read from the
+// given reader to the given storage, the restore stops between the batches
+// once the given context is done. The batches committed by then stay.
+//
+// The keys present in the snapshot overwrite the ones in the storage,
+// the rest of the keys in the storage are left as they are. Nothing is
+// restored unless the whole snapshot is intact, so the snapshot is
+// verified before it is restored.
+func RestoreContext(ctx context.Context, dst Sink, r io.Reader) error {
+	// The snapshot is read twice, once to verify it and once
+	// to restore it.
+	f, err := os.CreateTemp("", "use-restore-*")
+	if err != nil {
+		return fmt.Errorf("error creating restore file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+
+	if err := read(f, size, nil); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b := dst.NewBatch()
+	if err := read(f, size, func(key, val []byte, exp int64) error {
+		var opts []types.SetOption
+		if exp != 0 {
+			ttl := time.Until(time.UnixMilli(exp))
+			if ttl <= 0 {
+				return nil
+			}
+
+			opts = append(opts, types.WithTTL(ttl))
+		}
+
+		b.Put(key, val, opts...)
+		if b.Len() < batchSize {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return b.Commit()
+	}); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.Commit()
+}
+
+// read verifies the snapshot of the given size read from the given
+// reader and calls the given function, if any, for every entry.
+func read(ra io.ReaderAt, size int64, fn func(key, val []byte, exp int64) error) error {
+	tr := tlvrw.NewReader(ra)
+	crc := crc32.New(crcTable)
+
+	// next reads the next TLV and adds it to the checksum
+	next := func() (*tlvrw.TLV, error) {
+		pos, _ := tr.Seek(0, io.SeekCurrent)
+
+		tlv := tlvrw.NewTLV(0, nil)
+		if err := tr.ReadLazy(tlv); err != nil || pos+tlvrw.Size(tlv.Len) > size {
+			return nil, ErrCorruptSnapshot
+		}
+
+		if err := tr.Fill(tlv); err != nil {
+			return nil, ErrCorruptSnapshot
+		}
+
+		if tlv.Typ != TrailerTypeTLV {
+			io.Copy(crc, io.NewSectionReader(ra, pos, tlvrw.Size(tlv.Len)))
+		}
+
+		return tlv, nil
+	}
+
+	hdr, err := next()
+	if err != nil || hdr.Typ != HdrTypeTLV || hdr.Len != hdrLen || string(hdr.Val[:5]) != string(magic) {
+		return ErrCorruptSnapshot
+	}
+
+	if version := binary.LittleEndian.Uint16(hdr.Val[5:7]); version > FormatVersion {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedSnapshot, version)
+	}
+
+	n := uint64(0)
+	tlv, err := next()
+	for {
+		if err != nil {
+			return err
+		}
+
+		if tlv.Typ == TrailerTypeTLV {
+			break
+		}
+
+		if tlv.Typ != KeyTypeTLV {
+			return ErrCorruptSnapshot
+		}
+		key := tlv.Val
+
+		var val *tlvrw.TLV
+		if val, err = next(); err != nil || val.Typ != ValTypeTLV {
+			return ErrCorruptSnapshot
+		}
+
+		var exp int64
+		tlv, err = next()
+		if err == nil && tlv.Typ == ExpTypeTLV {
+			if tlv.Len != 8 {
+				return ErrCorruptSnapshot
+			}
+
+			exp = int64(binary.LittleEndian.Uint64(tlv.Val))
+			tlv, err = next()
+		}
+
+		if fn != nil {
+			if err := fn(key, val.Val, exp); err != nil {
+				return err
+			}
+		}
+
+		n++
+	}
+
+	pos, _ := tr.Seek(0, io.SeekCurrent)
+	if tlv.Len != trailerLen || pos != size {
+		return ErrCorruptSnapshot
+	}
+
+	if binary.LittleEndian.Uint64(tlv.Val[0:8]) != n || binary.LittleEndian.Uint32(tlv.Val[8:12]) != crc.Sum32() {
+		return ErrCorruptSnapshot
+	}
+
+	return nil
+}
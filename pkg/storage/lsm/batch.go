@@ -0,0 +1,104 @@
+package lsm
+
+import (
+	"context"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// Batch is a group of writes which are written to the log as a single
+// record, so either all of them survive a crash or none of them do.
+type Batch struct {
+	s   *Storage
+	ops []kv
+
+	// err is the error of the first invalid write added to the batch,
+	// the batch isn't committed if it is set.
+	err error
+}
+
+// NewBatch returns a new empty batch of writes.
+func (s *Storage) NewBatch() types.Batch {
+	return &Batch{s: s}
+}
+
+// Put adds setting the value for the given key to the batch.
+func (b *Batch) Put(key []byte, value []byte, opts ...types.SetOption) {
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+
+		return
+	}
+
+	b.ops = append(b.ops, kv{
+		key: string(key),
+		e: entry{
+			op:  SetOp,
+			exp: expiry(o),
+			val: append([]byte{}, value...),
+		},
+	})
+}
+
+// Delete adds deleting the value for the given key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, kv{key: string(key), e: entry{op: DelOp}})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the batch to the storage in one go.
+func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext writes the batch to the storage in one go, none of the
+// writes are applied once the given context is done.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	s := b.s
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for i := range b.ops {
+		b.ops[i].e.id = s.idgen.Next()
+	}
+
+	if err := s.write(b.ops...); err != nil {
+		return err
+	}
+
+	b.ops = nil
+	return nil
+}
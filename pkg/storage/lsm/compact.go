@@ -0,0 +1,377 @@
+package lsm
+
+import (
+	"context"
+	"os"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+)
+
+// compactionFanIn is the number of tables of a level which are merged
+// into a table of the next level.
+const compactionFanIn = 4
+
+// Compact flushes the memtable and merges all the tables into a single
+// table which holds only the live entries.
+//
+// Reads and writes are served while the compaction is in progress and
+// are blocked only for the duration of the swap.
+func (s *Storage) Compact() error {
+	return s.CompactContext(context.Background())
+}
+
+// CompactContext flushes the memtable and merges the tables like Compact,
+// the merge stops once the given context is done and the tables are left
+// as they were.
+func (s *Storage) CompactContext(ctx context.Context) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !s.cmu.TryLock() {
+		return errors.ErrCompactionInProgress
+	}
+	defer s.cmu.Unlock()
+
+	s.wmu.Lock()
+	err := s.rollover()
+	s.wmu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for s.frozen() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.flushImmutable(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.tables) == 0 {
+		return nil
+	}
+
+	// The oldest table has the highest level
+	return s.merge(ctx, 0, len(s.tables), s.tables[len(s.tables)-1].level)
+}
+
+// compactAsync flushes the frozen memtables and compacts the tables
+// whenever it is woken up till done is closed.
+func (s *Storage) compactAsync(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.work:
+		}
+
+		s.cmu.Lock()
+		s.compactPending()
+		s.cmu.Unlock()
+	}
+}
+
+// compactPending flushes the frozen memtables and then merges the levels
+// with at least compactionFanIn tables, one level at a time.
+//
+// A table of level 0 is flushed from a memtable, the tables of level L
+// are merged into a table of level L+1. As the newer tables are flushed
+// and merged before the older ones, the levels never decrease from the
+// newest table to the oldest one and the tables of a level are adjacent.
+// So the reads go through about compactionFanIn tables per level and
+// every entry is rewritten about once per level.
+//
+// A ratio <= 0 disables the compaction of the tables.
+//
+// compactPending should be called with the compaction lock held.
+func (s *Storage) compactPending() {
+	for s.frozen() > 0 {
+		if err := s.flushImmutable(); err != nil {
+			log.Warnln("failed to flush the memtable: ", err)
+			return
+		}
+	}
+
+	if s.cfg.CompactionRatio <= 0 {
+		return
+	}
+
+	for {
+		i, j, ok := s.pickTier()
+		if !ok {
+			return
+		}
+
+		if err := s.merge(context.Background(), i, j, s.tables[i].level+1); err != nil {
+			log.Warnln("failed to compact the tables: ", err)
+			return
+		}
+	}
+}
+
+// pickTier returns the range of the tables of the lowest level with
+// at least compactionFanIn tables.
+//
+// pickTier should be called with the compaction lock held.
+func (s *Storage) pickTier() (int, int, bool) {
+	for i := 0; i < len(s.tables); {
+		j := i + 1
+		for j < len(s.tables) && s.tables[j].level == s.tables[i].level {
+			j++
+		}
+
+		if j-i >= compactionFanIn {
+			return i, j, true
+		}
+
+		i = j
+	}
+
+	return 0, 0, false
+}
+
+// frozen returns the number of the frozen memtables.
+func (s *Storage) frozen() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.imms)
+}
+
+// flushImmutable flushes the oldest frozen memtable to a new table of
+// level 0 and removes its log.
+//
+// flushImmutable should be called with the compaction lock held.
+func (s *Storage) flushImmutable() error {
+	s.mu.RLock()
+	m := s.imms[len(s.imms)-1]
+	s.mu.RUnlock()
+
+	entries := m.entries()
+	t, err := s.writeTable(func() (kv, bool, error) {
+		if len(entries) == 0 {
+			return kv{}, false, nil
+		}
+
+		kv := entries[0]
+		entries = entries[1:]
+		return kv, true, nil
+	}, 0, len(s.tables) == 0)
+	if err != nil {
+		return err
+	}
+
+	tables := s.tables
+	if t != nil {
+		tables = append([]*table{t}, s.tables...)
+	}
+
+	if err := s.record(tables, m.log); err != nil {
+		discard(t)
+		return err
+	}
+
+	s.mu.Lock()
+	s.tables = tables
+	s.imms = s.imms[:len(s.imms)-1]
+	s.mu.Unlock()
+
+	s.removeLogs(m.log)
+
+	return nil
+}
+
+// merge merges the tables in the range [i, j) into a new table of the
+// given level.
+//
+// merge should be called with the compaction lock held.
+func (s *Storage) merge(ctx context.Context, i, j int, level int) error {
+	inputs := s.tables[i:j]
+
+	next := mergeTables(inputs)
+	t, err := s.writeTable(func() (kv, bool, error) {
+		if err := ctx.Err(); err != nil {
+			return kv{}, false, err
+		}
+
+		return next()
+	}, level, j == len(s.tables))
+	if err != nil {
+		return err
+	}
+
+	tables := append([]*table{}, s.tables[:i]...)
+	if t != nil {
+		tables = append(tables, t)
+	}
+	tables = append(tables, s.tables[j:]...)
+
+	if err := s.record(tables, s.flushed); err != nil {
+		discard(t)
+		return err
+	}
+
+	// The tables lock waits for the reads of the merged tables, if any
+	s.mu.Lock()
+	s.tables = tables
+	s.mu.Unlock()
+
+	for _, t := range inputs {
+		discard(t)
+	}
+
+	log.Debugf("Merged %d tables into a table of level %d", len(inputs), level)
+	return nil
+}
+
+// record records the given tables and the ID of the latest log flushed
+// to them in the manifest.
+//
+// record should be called with the compaction lock held.
+func (s *Storage) record(tables []*table, flushed uint64) error {
+	m := &manifest{flushed: flushed}
+	for _, t := range tables {
+		m.tables = append(m.tables, tableMeta{id: t.id, level: t.level})
+	}
+
+	if err := saveManifest(s.dir, m); err != nil {
+		return err
+	}
+	s.flushed = flushed
+
+	return nil
+}
+
+// writeTable writes the entries returned by the given function, which are
+// sorted by their keys, to a new table of the given level. If bottom is
+// true then nothing older than the entries is left for their tombstones
+// and expired values to shadow, so they are dropped.
+//
+// writeTable returns a nil table if no entry is left to be written.
+func (s *Storage) writeTable(next func() (kv, bool, error), level int, bottom bool) (*table, error) {
+	id := s.next.Add(1) - 1
+	path := filePath(s.dir, id, tableExt)
+
+	w, err := newTableWriter(path, s.cfg.FilterFalsePositiveRate)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	for {
+		kv, ok, err := next()
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+
+		if !ok {
+			break
+		}
+
+		if bottom && !kv.e.live() {
+			continue
+		}
+
+		if err := w.add(kv.key, kv.e); err != nil {
+			w.abort()
+			return nil, err
+		}
+		n++
+	}
+
+	if n == 0 {
+		w.abort()
+		return nil, nil
+	}
+
+	if err := w.finish(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return openTable(path, id, level)
+}
+
+// discard closes and removes the given table, if any.
+func discard(t *table) {
+	if t == nil {
+		return
+	}
+
+	if err := t.close(); err != nil {
+		log.Warnf("failed to close table %d: %s", t.id, err)
+	}
+
+	if err := os.Remove(t.path); err != nil {
+		log.Warnf("failed to remove table %d: %s", t.id, err)
+	}
+}
+
+// mergeTables returns a function which returns the entries of the given
+// tables, ordered from the newest to the oldest, sorted by their keys.
+// A key written to several tables is returned once with its entry from
+// the newest table.
+func mergeTables(tables []*table) func() (kv, bool, error) {
+	its := make([]*tableIterator, len(tables))
+	for i, t := range tables {
+		its[i] = &tableIterator{t: t}
+	}
+
+	heads := make([]*kv, len(tables))
+	ended := make([]bool, len(tables))
+
+	return func() (kv, bool, error) {
+		for i, it := range its {
+			if heads[i] != nil || ended[i] {
+				continue
+			}
+
+			kv, ok, err := it.next()
+			if err != nil {
+				return kv, false, err
+			}
+
+			if !ok {
+				ended[i] = true
+				continue
+			}
+
+			heads[i] = &kv
+		}
+
+		// The newest table wins the ties
+		best := -1
+		for i, h := range heads {
+			if h != nil && (best < 0 || h.key < heads[best].key) {
+				best = i
+			}
+		}
+
+		if best < 0 {
+			return kv{}, false, nil
+		}
+
+		out := *heads[best]
+		for i, h := range heads {
+			if h != nil && h.key == out.key {
+				heads[i] = nil
+			}
+		}
+
+		return out, true, nil
+	}
+}
@@ -0,0 +1,147 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+var (
+	// Storage Ops
+	SetOp = byte(1)
+	DelOp = byte(2)
+)
+
+var (
+	// ErrCorruptEntry is returned when an encoded entry is malformed.
+	ErrCorruptEntry = fmt.Errorf("entry is corrupted")
+
+	// crcTable is the table used to calculate the checksums of the
+	// log records and the table blocks.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// entryHdrLen is the length of the fixed part of an encoded entry.
+const entryHdrLen = 1 + // op
+	8 + // id
+	8 // expiry
+
+// entry is a single write to a key.
+type entry struct {
+	// op is the operation of the write, SetOp or DelOp.
+	op byte
+	// id is the ID of the write, which is the version of the value.
+	id uint64
+	// exp is the expiry time of the value in unix milliseconds,
+	// 0 if the value never expires.
+	exp int64
+	// val is the value written, nil for a DelOp.
+	val []byte
+}
+
+// live returns true if the entry holds a value which hasn't expired.
+func (e entry) live() bool {
+	return e.op == SetOp && !expired(e.exp)
+}
+
+// kv is an entry along with its key.
+type kv struct {
+	key string
+	e   entry
+}
+
+// size returns the number of bytes the entry takes once encoded.
+func (e kv) size() int64 {
+	return int64(entryHdrLen + 2*binary.MaxVarintLen32 + len(e.key) + len(e.e.val))
+}
+
+// appendEntry appends the encoding of the given entry to the given buffer.
+//
+// An entry is encoded as its op, ID, expiry, the length prefixed key and
+// the length prefixed value.
+func appendEntry(b []byte, key string, e entry) []byte {
+	b = append(b, e.op)
+	b = binary.LittleEndian.AppendUint64(b, e.id)
+	b = binary.LittleEndian.AppendUint64(b, uint64(e.exp))
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	b = binary.AppendUvarint(b, uint64(len(e.val)))
+	b = append(b, e.val...)
+
+	return b
+}
+
+// decodeEntries decodes the entries encoded one after the other by
+// appendEntry, the decoded values share the memory of the given buffer.
+func decodeEntries(b []byte) ([]kv, error) {
+	var entries []kv
+	for len(b) > 0 {
+		if len(b) < entryHdrLen {
+			return nil, ErrCorruptEntry
+		}
+
+		e := entry{
+			op:  b[0],
+			id:  binary.LittleEndian.Uint64(b[1:]),
+			exp: int64(binary.LittleEndian.Uint64(b[9:])),
+		}
+		b = b[entryHdrLen:]
+
+		if e.op != SetOp && e.op != DelOp {
+			return nil, ErrCorruptEntry
+		}
+
+		klen, n := binary.Uvarint(b)
+		if n <= 0 || klen > uint64(len(b)-n) {
+			return nil, ErrCorruptEntry
+		}
+		key := string(b[n : n+int(klen)])
+		b = b[n+int(klen):]
+
+		vlen, n := binary.Uvarint(b)
+		if n <= 0 || vlen > uint64(len(b)-n) {
+			return nil, ErrCorruptEntry
+		}
+		if e.op == SetOp {
+			e.val = b[n : n+int(vlen) : n+int(vlen)]
+		}
+		b = b[n+int(vlen):]
+
+		entries = append(entries, kv{key: key, e: e})
+	}
+
+	return entries, nil
+}
+
+// seal appends the checksum of the given payload to it.
+func seal(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// unseal verifies the checksum appended by seal and returns the payload.
+func unseal(b []byte) ([]byte, bool) {
+	if len(b) < 4 {
+		return nil, false
+	}
+
+	payload := b[:len(b)-4]
+	return payload, crc32.Checksum(payload, crcTable) == binary.LittleEndian.Uint32(b[len(b)-4:])
+}
+
+// expiry returns the expiry time of an entry written now with the
+// given options, 0 if the entry never expires.
+func expiry(o types.SetOptions) int64 {
+	if o.TTL <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(o.TTL).UnixMilli()
+}
+
+// expired returns true if the given expiry time has passed.
+func expired(exp int64) bool {
+	return exp != 0 && exp <= time.Now().UnixMilli()
+}
@@ -0,0 +1,766 @@
+// lsm package implements a storage based on the log-structured merge-tree.
+//
+// The writes go to a write-ahead log and to a sorted in-memory memtable.
+// Once the memtable grows beyond the segment size it is frozen and flushed
+// to an immutable sorted table in the background, and the tables are merged
+// by a size-tiered compaction so that the reads go through a few of them.
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/id"
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage"
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+// ErrAsOfUnsupported is returned when the storage is opened as of a write,
+// the storage doesn't keep the overwritten values.
+var ErrAsOfUnsupported = fmt.Errorf("lsm storage can't be opened as of a write")
+
+// Storage is a log-structured merge-tree storage.
+type Storage struct {
+	// Conditional implements the conditional writes over SetIf and
+	// DeleteIf.
+	types.Conditional
+
+	// dir is path to the storage directory.
+	dir string
+
+	// mu guards the memtables and the tables against being swapped
+	// while they are in use.
+	mu *sync.RWMutex
+	// mem is the memtable the writes go to.
+	mem *memtable
+	// imms are the frozen memtables waiting to be flushed, from the
+	// newest to the oldest.
+	imms []*memtable
+	// tables are the tables of the storage, from the newest to the oldest.
+	//
+	// The levels of the tables never decrease from the newest to the
+	// oldest, see compactTier.
+	tables []*table
+
+	// idgen is the id generator.
+	idgen id.Gen
+
+	// wmu is the write mutex.
+	wmu *sync.Mutex
+	// log is the write-ahead log of the active memtable, nil if the
+	// storage is read-only.
+	//
+	// log is guarded by the write lock.
+	log *wal
+	// unsynced is the number of bytes written to the log since it was
+	// synced last.
+	//
+	// unsynced is guarded by the write lock.
+	unsynced int64
+
+	// cmu serializes the flushes and the compactions, which are the only
+	// ones that change the tables.
+	cmu *sync.Mutex
+	// flushed is the ID of the latest log flushed to a table.
+	//
+	// flushed is guarded by the compaction lock.
+	flushed uint64
+
+	// next is the ID of the next log or table.
+	next *atomic.Uint64
+
+	// work wakes up the background flusher and compactor.
+	work chan struct{}
+	// flush wakes up the async syncer.
+	flush chan struct{}
+
+	// initialized is true when the storage is initialized.
+	initialized *atomic.Bool
+
+	// cfg is the storage config.
+	cfg config.Config
+
+	// done is closed to stop the background workers.
+	done chan struct{}
+	// wg waits for the background workers to stop.
+	wg *sync.WaitGroup
+}
+
+// init registers the storage, see storage.Register.
+func init() {
+	storage.Register(storage.LSMStorageType, func(path string, cfg config.Config) (storage.Storage, error) {
+		return New(path, cfg), nil
+	})
+}
+
+// New returns a new Storage instance.
+func New(dir string, cfg config.Config) *Storage {
+	// The memtable would be frozen on every write otherwise
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = config.DefaultSegmentSize
+	}
+
+	s := &Storage{
+		dir:         dir,
+		mu:          &sync.RWMutex{},
+		wmu:         &sync.Mutex{},
+		cmu:         &sync.Mutex{},
+		idgen:       id.New(),
+		next:        &atomic.Uint64{},
+		work:        make(chan struct{}, 1),
+		flush:       make(chan struct{}, 1),
+		initialized: &atomic.Bool{},
+		cfg:         cfg,
+		wg:          &sync.WaitGroup{},
+	}
+	s.Conditional = types.NewConditional(s)
+
+	return s
+}
+
+// Init configures the storage.
+//
+// The tables recorded in the manifest are opened and the logs which
+// weren't flushed yet are replayed into the memtable. Unless the storage
+// is read-only the replayed memtable is flushed right away and the files
+// left behind by an interrupted flush or compaction are removed.
+func (s *Storage) Init() error {
+	if s.cfg.AsOf > 0 {
+		return ErrAsOfUnsupported
+	}
+
+	if err := s.cfg.Options.Check(); err != nil {
+		return err
+	}
+
+	if !s.cfg.ReadOnly {
+		if err := os.MkdirAll(s.dir, 0777); err != nil {
+			return fmt.Errorf("error creating storage directory: %w", err)
+		}
+	}
+
+	m, err := loadManifest(s.dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+	}
+
+	logs, err := listFiles(s.dir, walExt)
+	if err != nil {
+		return err
+	}
+
+	tables, err := listFiles(s.dir, tableExt)
+	if err != nil {
+		return err
+	}
+
+	// The IDs of the new files follow the IDs of every file around
+	next := m.flushed
+	for _, paths := range []map[uint64]string{logs, tables} {
+		for id := range paths {
+			next = utils.Max(next, id)
+		}
+	}
+	s.next.Store(next + 1)
+
+	if err := s.openTables(m, tables); err != nil {
+		return err
+	}
+	s.flushed = m.flushed
+
+	mem, err := s.replay(logs)
+	if err != nil {
+		s.closeTables()
+		return err
+	}
+
+	if s.cfg.ReadOnly {
+		log.Infoln("storage is read-only, skipping recovery")
+
+		s.mem = mem
+		s.initialized.Store(true)
+		return nil
+	}
+
+	// The replayed memtable is flushed so that the storage starts
+	// with a fresh log.
+	if mem.len() > 0 {
+		s.imms = []*memtable{mem}
+		if err := s.flushImmutable(); err != nil {
+			s.closeTables()
+			return err
+		}
+	}
+
+	s.removeLogs(mem.log)
+
+	wal, err := createWAL(s.dir, s.next.Add(1)-1)
+	if err != nil {
+		s.closeTables()
+		return err
+	}
+
+	s.log = wal
+	s.mem = newMemtable(wal.id)
+	s.initialized.Store(true)
+
+	done := make(chan struct{})
+	s.done = done
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.compactAsync(done)
+	}()
+
+	if s.cfg.Sync == config.SyncTypeAsync {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.flushAsync(done)
+		}()
+	}
+
+	return nil
+}
+
+// openTables opens the tables recorded in the given manifest and removes
+// the tables which aren't recorded in it.
+func (s *Storage) openTables(m *manifest, paths map[uint64]string) error {
+	recorded := make(map[uint64]bool)
+	for _, meta := range m.tables {
+		path, ok := paths[meta.id]
+		if !ok {
+			s.closeTables()
+			return fmt.Errorf("%s: table %d is missing", errors.ErrCorruptStorage, meta.id)
+		}
+
+		t, err := openTable(path, meta.id, meta.level)
+		if err != nil {
+			s.closeTables()
+			return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+		}
+
+		s.tables = append(s.tables, t)
+		recorded[meta.id] = true
+	}
+
+	if s.cfg.ReadOnly {
+		return nil
+	}
+
+	for id, path := range paths {
+		if recorded[id] {
+			continue
+		}
+
+		log.Infof("Removing table %d left behind by an interrupted flush or compaction", id)
+		if err := os.Remove(path); err != nil {
+			log.Warnln("failed to remove the leftover table: ", err)
+		}
+	}
+
+	return nil
+}
+
+// replay replays the logs which weren't flushed yet into a new memtable
+// in the order in which they were written.
+func (s *Storage) replay(paths map[uint64]string) (*memtable, error) {
+	ids := make([]uint64, 0, len(paths))
+	for id := range paths {
+		if id > s.flushed {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	mem := newMemtable(s.flushed)
+	for _, id := range ids {
+		if err := replayWAL(paths[id], !s.cfg.ReadOnly, func(entries []kv) {
+			mem.put(entries...)
+		}); err != nil {
+			return nil, err
+		}
+
+		mem.log = id
+	}
+
+	return mem, nil
+}
+
+// removeLogs removes the logs with IDs <= upto.
+func (s *Storage) removeLogs(upto uint64) {
+	paths, err := listFiles(s.dir, walExt)
+	if err != nil {
+		log.Warnln("failed to list the write-ahead logs: ", err)
+		return
+	}
+
+	for id, path := range paths {
+		if id > upto {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Warnln("failed to remove the flushed write-ahead log: ", err)
+		}
+	}
+}
+
+// Get returns the value for the given key.
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value for the given key.
+func (s *Storage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	val, _, err := s.GetVersionedContext(ctx, key)
+	return val, err
+}
+
+// GetVersioned returns the value for the given key along with its
+// version, which is the ID of the write of the value.
+func (s *Storage) GetVersioned(key []byte) ([]byte, uint64, error) {
+	return s.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext returns the value for the given key along with its
+// version, which is the ID of the write of the value.
+func (s *Storage) GetVersionedContext(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if !s.isInit() {
+		return nil, 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	e, err := s.lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !e.live() {
+		return nil, 0, errors.ErrKeyNotFound
+	}
+
+	// The value may be shared with the memtable or a cached block
+	return append([]byte{}, e.val...), e.id, nil
+}
+
+// lookup returns the latest entry for the given key, which is a zero
+// entry if the key was never written.
+//
+// The memtables are looked up first and then the tables from the newest
+// to the oldest, the first entry found is the latest one.
+func (s *Storage) lookup(key []byte) (entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k := string(key)
+	for _, m := range s.memtables() {
+		if e, ok := m.get(k); ok {
+			return e, nil
+		}
+	}
+
+	for _, t := range s.tables {
+		e, ok, err := t.get(key)
+		if err != nil {
+			return entry{}, fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+		}
+
+		if ok {
+			return e, nil
+		}
+	}
+
+	return entry{}, nil
+}
+
+// memtables returns the memtables from the newest to the oldest, it
+// should be called with the read lock held.
+func (s *Storage) memtables() []*memtable {
+	return append([]*memtable{s.mem}, s.imms...)
+}
+
+// Set sets the value for the given key.
+func (s *Storage) Set(key []byte, value []byte, opts ...types.SetOption) error {
+	return s.SetContext(context.Background(), key, value, opts...)
+}
+
+// SetContext sets the value for the given key.
+func (s *Storage) SetContext(ctx context.Context, key []byte, value []byte, opts ...types.SetOption) error {
+	_, err := s.SetIf(ctx, key, value, opts, nil)
+	return err
+}
+
+// SetIf sets the value for the given key if the given condition, if any,
+// holds and returns the version of the new value.
+func (s *Storage) SetIf(ctx context.Context, key []byte, value []byte, opts []types.SetOption, cond types.Condition) (uint64, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return 0, errors.ErrReadOnlyStorage
+	}
+
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	exp := expiry(o)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// The condition is evaluated under the write lock so that no other
+	// write to the key can sneak in before the entry is written.
+	if cond != nil {
+		e, err := s.lookup(key)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := cond(e.id, e.live()); err != nil {
+			return 0, err
+		}
+	}
+
+	e := entry{
+		op:  SetOp,
+		id:  s.idgen.Next(),
+		exp: exp,
+		val: append([]byte{}, value...),
+	}
+	if err := s.write(kv{key: string(key), e: e}); err != nil {
+		return 0, err
+	}
+
+	return e.id, nil
+}
+
+// Delete deletes the value for the given key.
+func (s *Storage) Delete(key []byte) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the value for the given key.
+func (s *Storage) DeleteContext(ctx context.Context, key []byte) error {
+	return s.DeleteIf(ctx, key, nil)
+}
+
+// DeleteIf deletes the value for the given key if the given condition,
+// if any, holds.
+func (s *Storage) DeleteIf(ctx context.Context, key []byte, cond types.Condition) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	e, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	if cond != nil {
+		if err := cond(e.id, e.live()); err != nil {
+			return err
+		}
+	}
+
+	// Writing a tombstone for a key which isn't live is a waste of space
+	if !e.live() {
+		return nil
+	}
+
+	return s.write(kv{key: string(key), e: entry{op: DelOp, id: s.idgen.Next()}})
+}
+
+// write writes the given entries to the log as a single record and then
+// to the memtable, the memtable is frozen once it grows beyond the
+// segment size.
+//
+// write should be called with the write lock held.
+func (s *Storage) write(entries ...kv) error {
+	n, err := s.log.append(entries...)
+	if err != nil {
+		return err
+	}
+	s.unsynced += n
+
+	switch s.cfg.Sync {
+	case config.SyncTypeSync:
+		if err := s.log.sync(); err != nil {
+			// The write is reported as failed, so it must not come
+			// back on the next start
+			s.unsynced -= n
+			return s.log.discard(s.log.size-n, fmt.Errorf("error syncing write-ahead log: %w", err))
+		}
+		s.unsynced = 0
+	case config.SyncTypeAsync:
+		s.maybeFlush()
+	}
+
+	s.mem.put(entries...)
+
+	if s.mem.bytes() >= s.cfg.SegmentSize {
+		if err := s.rollover(); err != nil {
+			log.Warnln("failed to roll over the memtable: ", err)
+		}
+	}
+
+	return nil
+}
+
+// rollover freezes the memtable, which is flushed in the background,
+// and starts a new memtable along with a new log.
+//
+// rollover should be called with the write lock held.
+func (s *Storage) rollover() error {
+	if s.mem.len() == 0 {
+		return nil
+	}
+
+	// The log won't be written to ever again, so the memtable is frozen
+	// only once its writes are durable. The next rollover retries it.
+	if err := s.log.sync(); err != nil {
+		return fmt.Errorf("error syncing write-ahead log: %w", err)
+	}
+
+	wal, err := createWAL(s.dir, s.next.Add(1)-1)
+	if err != nil {
+		return err
+	}
+
+	if err := s.log.close(); err != nil {
+		log.Warnln("failed to close the write-ahead log: ", err)
+	}
+
+	s.mu.Lock()
+	s.imms = append([]*memtable{s.mem}, s.imms...)
+	s.mem = newMemtable(wal.id)
+	s.mu.Unlock()
+
+	s.log = wal
+	s.unsynced = 0
+
+	// The flusher is already awake otherwise
+	select {
+	case s.work <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Exists returns true if the given key exists.
+func (s *Storage) Exists(key []byte) (bool, error) {
+	return s.ExistsContext(context.Background(), key)
+}
+
+// ExistsContext returns true if the given key exists.
+//
+// The bloom filters of the tables rule out most of the tables which
+// don't hold the key.
+func (s *Storage) ExistsContext(ctx context.Context, key []byte) (bool, error) {
+	if !s.isInit() {
+		return false, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	e, err := s.lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return e.live(), nil
+}
+
+// TTL returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTL(key []byte) (time.Duration, error) {
+	return s.TTLContext(context.Background(), key)
+}
+
+// TTLContext returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTLContext(ctx context.Context, key []byte) (time.Duration, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	e, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if !e.live() {
+		return 0, errors.ErrKeyNotFound
+	}
+
+	if e.exp == 0 {
+		return types.NoExpiry, nil
+	}
+
+	return time.Until(time.UnixMilli(e.exp)), nil
+}
+
+// Len returns the number of live keys in the storage.
+func (s *Storage) Len() (int, error) {
+	return s.LenContext(context.Background())
+}
+
+// LenContext returns the number of live keys in the storage, the keys stop
+// being counted once the given context is done.
+//
+// The storage doesn't track the number of keys, a key may be written to
+// any number of the memtables and the tables. So all the keys are counted
+// one by one.
+func (s *Storage) LenContext(ctx context.Context) (int, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	it, err := s.NewIteratorContext(ctx, types.IterOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	n := 0
+	for it.Next() {
+		n++
+	}
+
+	return n, it.Err()
+}
+
+// LogicalSnapshot writes the live keys of the storage to the given
+// writer, see logical.Export.
+func (s *Storage) LogicalSnapshot(w io.Writer) error {
+	return s.LogicalSnapshotContext(context.Background(), w)
+}
+
+// LogicalSnapshotContext writes the live keys of the storage to the given
+// writer, see logical.ExportContext.
+func (s *Storage) LogicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	return logical.ExportContext(ctx, s, w)
+}
+
+// Restore writes the keys of the logical snapshot read from the given
+// reader to the storage, see logical.Restore.
+func (s *Storage) Restore(r io.Reader) error {
+	return s.RestoreContext(context.Background(), r)
+}
+
+// RestoreContext writes the keys of the logical snapshot read from the
+// given reader to the storage, see logical.RestoreContext.
+func (s *Storage) RestoreContext(ctx context.Context, r io.Reader) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	return logical.RestoreContext(ctx, s, r)
+}
+
+// Close closes the storage.
+//
+// The memtables aren't flushed, their logs are replayed on the next start.
+func (s *Storage) Close() error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	// Stop the background workers, if any.
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+
+	// Wait for the running compaction, if any.
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.log != nil {
+		if err := s.log.sync(); err != nil {
+			log.Warnln("failed to sync the write-ahead log: ", err)
+		}
+
+		if err := s.log.close(); err != nil {
+			return fmt.Errorf("error closing write-ahead log: %w", err)
+		}
+		s.log = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeTables()
+	s.mem, s.imms = nil, nil
+	s.initialized.Store(false)
+
+	return nil
+}
+
+// closeTables closes the tables of the storage.
+func (s *Storage) closeTables() {
+	for _, t := range s.tables {
+		if err := t.close(); err != nil {
+			log.Warnf("failed to close table %d: %s", t.id, err)
+		}
+	}
+	s.tables = nil
+}
+
+// isInit returns true if the storage is initialized.
+func (s *Storage) isInit() bool {
+	return s.initialized.Load()
+}
@@ -0,0 +1,641 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	stderrors "errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+// smallConfig returns a config which rolls over the memtable every few
+// writes so that the writes end up in many tables.
+func smallConfig() config.Config {
+	return config.DefaultConfig().WithSegmentSize(1 << 10)
+}
+
+// settle flushes the frozen memtables and compacts the tables the way
+// the background worker does.
+func settle(s *Storage) {
+	s.cmu.Lock()
+	s.compactPending()
+	s.cmu.Unlock()
+}
+
+func TestTable(t *testing.T) {
+	dir := t.TempDir()
+	path := filePath(dir, 1, tableExt)
+
+	w, err := newTableWriter(path, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys with even numbers only, so that the odd ones are missing
+	var keys []string
+	for i := 0; i < 2000; i += 2 {
+		keys = append(keys, "key"+utils.IntToString(i))
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if err := w.add(k, entry{op: SetOp, id: uint64(i + 1), val: []byte("val-" + k)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl, err := openTable(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.close()
+
+	if len(tbl.index) < 2 {
+		t.Fatal("expected more than one block, got", len(tbl.index))
+	}
+
+	if tbl.count != uint64(len(keys)) || tbl.maxID != uint64(len(keys)) {
+		t.Error("expected", len(keys), "got", tbl.count, tbl.maxID)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		for _, k := range keys {
+			e, ok, err := tbl.get([]byte(k))
+			if err != nil || !ok || string(e.val) != "val-"+k {
+				t.Error("expected", "val-"+k, "got", string(e.val), ok, err)
+			}
+		}
+
+		for i := 1; i < 2000; i += 2 {
+			if _, ok, err := tbl.get([]byte("key" + utils.IntToString(i))); err != nil || ok {
+				t.Error("expected missing key", i, ok, err)
+			}
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		fp := 0
+		for i := 1; i < 2000; i += 2 {
+			if tbl.mayContain([]byte("key" + utils.IntToString(i))) {
+				fp++
+			}
+		}
+
+		if fp > 50 {
+			t.Error("expected about 1% false positives, got", fp, "of", 1000)
+		}
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		// Seek from every key and from right before every block
+		for i, k := range keys {
+			kv, ok, err := tbl.seek(k, true, false)
+			if err != nil || !ok || kv.key != k {
+				t.Error("expected", k, "got", kv.key, ok, err)
+			}
+
+			kv, ok, err = tbl.seek(k, false, false)
+			if i+1 < len(keys) && (err != nil || !ok || kv.key != keys[i+1]) {
+				t.Error("expected", keys[i+1], "got", kv.key, ok, err)
+			}
+			if i+1 == len(keys) && ok {
+				t.Error("expected no key after the last one, got", kv.key)
+			}
+
+			kv, ok, err = tbl.seek(k, false, true)
+			if i > 0 && (err != nil || !ok || kv.key != keys[i-1]) {
+				t.Error("expected", keys[i-1], "got", kv.key, ok, err)
+			}
+			if i == 0 && ok {
+				t.Error("expected no key before the first one, got", kv.key)
+			}
+		}
+
+		if kv, ok, err := tbl.seek("", true, false); err != nil || !ok || kv.key != keys[0] {
+			t.Error("expected", keys[0], "got", kv.key, ok, err)
+		}
+
+		if kv, ok, err := tbl.seek("z", true, true); err != nil || !ok || kv.key != keys[len(keys)-1] {
+			t.Error("expected", keys[len(keys)-1], "got", kv.key, ok, err)
+		}
+
+		if kv, ok, err := tbl.last(); err != nil || !ok || kv.key != keys[len(keys)-1] {
+			t.Error("expected", keys[len(keys)-1], "got", kv.key, ok, err)
+		}
+	})
+
+	t.Run("corrupt block", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Flip a bit in the value of the first entry
+		data[tbl.index[0].pos+tlvrw.Size(0)+entryHdrLen+2] ^= 1
+		corrupt := filePath(dir, 2, tableExt)
+		if err := os.WriteFile(corrupt, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		ctbl, err := openTable(corrupt, 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctbl.close()
+
+		if _, _, err := ctbl.get([]byte(keys[0])); err == nil {
+			t.Error("expected error reading corrupt block")
+		}
+	})
+
+	t.Run("corrupt footer", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data[len(data)-10] ^= 1
+		corrupt := filePath(dir, 3, tableExt)
+		if err := os.WriteFile(corrupt, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := openTable(corrupt, 3, 0); err == nil {
+			t.Error("expected error opening corrupt table")
+		}
+	})
+}
+
+func TestStorage_FlushAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(dir, smallConfig())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		k := "key" + utils.IntToString(i%500)
+		v := "val" + utils.IntToString(i)
+
+		if i%7 == 0 {
+			if err := s.Delete([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+			delete(expected, k)
+			continue
+		}
+
+		if err := s.Set([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		expected[k] = v
+	}
+	settle(s)
+
+	// check verifies that the storage holds exactly the expected keys
+	check := func(t *testing.T, s *Storage) {
+		t.Helper()
+
+		for i := 0; i < 500; i++ {
+			k := "key" + utils.IntToString(i)
+
+			val, err := s.Get([]byte(k))
+			if v, ok := expected[k]; ok && (err != nil || string(val) != v) {
+				t.Error("expected", v, "got", string(val), err)
+			}
+
+			if _, ok := expected[k]; !ok && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+		}
+
+		if n, err := s.Len(); err != nil || n != len(expected) {
+			t.Error("expected", len(expected), "got", n, err)
+		}
+	}
+
+	t.Run("tiers", func(t *testing.T) {
+		if len(s.tables) == 0 {
+			t.Fatal("expected the memtables to be flushed")
+		}
+
+		levels := make(map[int]int)
+		for i, tbl := range s.tables {
+			if i > 0 && tbl.level < s.tables[i-1].level {
+				t.Error("expected the levels not to decrease from the newest table")
+			}
+			levels[tbl.level]++
+		}
+
+		for level, n := range levels {
+			if n >= compactionFanIn {
+				t.Error("expected level", level, "to be compacted, got", n, "tables")
+			}
+		}
+
+		if levels[1] == 0 && levels[2] == 0 {
+			t.Error("expected the tables to be merged, got", levels)
+		}
+
+		check(t, s)
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.tables) != 1 {
+			t.Fatal("expected a single table, got", len(s.tables))
+		}
+
+		// The tombstones are dropped with nothing left to shadow
+		if s.tables[0].count != uint64(len(expected)) {
+			t.Error("expected", len(expected), "entries, got", s.tables[0].count)
+		}
+
+		check(t, s)
+	})
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		s := New(dir, smallConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s)
+	})
+}
+
+func TestStorage_Recovery(t *testing.T) {
+	// setup writes 10 keys to the log of a closed storage and returns
+	// the path of the log.
+	setup := func(t *testing.T) (string, string) {
+		dir := t.TempDir()
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := s.Set([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		path := filePath(dir, s.log.id, walExt)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		return dir, path
+	}
+
+	// check verifies that the first n keys survived
+	check := func(t *testing.T, dir string, n int) {
+		t.Helper()
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		for i := 0; i < 10; i++ {
+			val, err := s.Get([]byte("key" + utils.IntToString(i)))
+			if i < n && (err != nil || string(val) != "val"+utils.IntToString(i)) {
+				t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+			}
+
+			if i >= n && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+		}
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		dir, path := setup(t)
+		check(t, dir, 10)
+
+		// The replayed log is flushed to a table
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error("expected the replayed log to be removed")
+		}
+
+		check(t, dir, 10)
+	})
+
+	t.Run("torn record", func(t *testing.T) {
+		dir, path := setup(t)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, data[:len(data)-3], 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, dir, 9)
+	})
+
+	t.Run("corrupt record", func(t *testing.T) {
+		dir, path := setup(t)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every record is as long as the first one, corrupt the 6th one
+		size := len(data) / 10
+		data[5*size+size/2] ^= 1
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, dir, 5)
+	})
+
+	// failed writes a key, a key whose write is made to fail by the given
+	// function and then a key after it, and verifies that only the failed
+	// write is lost on restart
+	failed := func(t *testing.T, fail func()) {
+		t.Helper()
+
+		dir := t.TempDir()
+
+		s := New(dir, config.DefaultConfig().WithSync())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("before"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		fail()
+		err := s.Set([]byte("failed"), []byte("val"))
+		writeFile, syncFile = (*os.File).Write, (*os.File).Sync
+		if err == nil {
+			t.Error("expected the write to fail")
+		}
+
+		if err := s.Set([]byte("after"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		for _, k := range []string{"before", "after"} {
+			if val, err := s.Get([]byte(k)); err != nil || string(val) != "val" {
+				t.Error("expected", "val", "got", string(val), err)
+			}
+		}
+
+		if _, err := s.Get([]byte("failed")); err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+	}
+
+	t.Run("failed write", func(t *testing.T) {
+		failed(t, func() {
+			// The record is torn rather than not written at all
+			writeFile = func(fd *os.File, b []byte) (int, error) {
+				n, _ := fd.Write(b[:len(b)/2])
+				return n, stderrors.New("write failed")
+			}
+		})
+	})
+
+	t.Run("failed sync", func(t *testing.T) {
+		failed(t, func() {
+			syncFile = func(*os.File) error {
+				return stderrors.New("fsync failed")
+			}
+		})
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		dir, path := setup(t)
+
+		s := New(dir, config.DefaultConfig().WithReadOnly())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := s.Len(); err != nil || n != 10 {
+			t.Error("expected", 10, "got", n, err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The log is left as is
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("leftovers", func(t *testing.T) {
+		dir, _ := setup(t)
+
+		// A table written by an interrupted compaction
+		stray := filePath(dir, 100, tableExt)
+		if err := os.WriteFile(stray, []byte("garbage"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, dir, 10)
+
+		if _, err := os.Stat(stray); !os.IsNotExist(err) {
+			t.Error("expected the leftover table to be removed")
+		}
+	})
+}
+
+func TestStorage_PhysicalSnapshot(t *testing.T) {
+	s := New(t.TempDir(), smallConfig().WithCompactionRatio(0))
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 500; i++ {
+		if err := s.Set([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settle(s)
+
+	buf := &bytes.Buffer{}
+	if err := s.PhysicalSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unpack the snapshot into a new storage directory
+	dir := t.TempDir()
+	r := tlvrw.NewReader(bytes.NewReader(buf.Bytes()))
+
+	hdr := tlvrw.NewTLV(0, nil)
+	if err := r.Read(hdr); err != nil || hdr.Typ != SnapshotHdrTypeTLV || !bytes.HasPrefix(hdr.Val, tableMagic) {
+		t.Fatal("expected snapshot header, got", hdr.Typ, err)
+	}
+
+	files := 0
+	for {
+		name := tlvrw.NewTLV(0, nil)
+		if err := r.Read(name); err != nil {
+			break
+		}
+
+		data, sum := tlvrw.NewTLV(0, nil), tlvrw.NewTLV(0, nil)
+		if err := r.Read(data); err != nil || data.Typ != FileDataTypeTLV {
+			t.Fatal("expected file data, got", data.Typ, err)
+		}
+
+		if err := r.Read(sum); err != nil || sum.Typ != FileCrcTypeTLV {
+			t.Fatal("expected file checksum, got", sum.Typ, err)
+		}
+
+		if crc32.Checksum(data.Val, crcTable) != binary.LittleEndian.Uint32(sum.Val) {
+			t.Error("checksum mismatch for", string(name.Val))
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, string(name.Val)), data.Val, 0666); err != nil {
+			t.Fatal(err)
+		}
+		files++
+	}
+
+	// The manifest, the tables and the log
+	if files != len(s.tables)+2 {
+		t.Error("expected", len(s.tables)+2, "files, got", files)
+	}
+
+	restored := New(dir, config.DefaultConfig())
+	if err := restored.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	for i := 0; i < 500; i++ {
+		val, err := restored.Get([]byte("key" + utils.IntToString(i)))
+		if err != nil || string(val) != "val"+utils.IntToString(i) {
+			t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+		}
+	}
+}
+
+func TestStorage_Concurrent(t *testing.T) {
+	s := New(t.TempDir(), smallConfig())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 500; i++ {
+				k := []byte("key" + utils.IntToString(w) + "-" + utils.IntToString(i))
+				if err := s.Set(k, []byte("val"+utils.IntToString(i))); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if val, err := s.Get(k); err != nil || string(val) != "val"+utils.IntToString(i) {
+					t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 20; i++ {
+			it, err := s.NewIterator(types.IterOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			var prev []byte
+			for it.Next() {
+				if prev != nil && bytes.Compare(prev, it.Key()) >= 0 {
+					t.Error("expected the keys in order, got", string(prev), string(it.Key()))
+				}
+				prev = it.Key()
+			}
+
+			if err := it.Err(); err != nil {
+				t.Error(err)
+			}
+			it.Close()
+		}
+	}()
+	wg.Wait()
+
+	if n, err := s.Len(); err != nil || n != 2000 {
+		t.Error("expected", 2000, "got", n, err)
+	}
+}
+
+func TestStorage_ZeroSegmentSize(t *testing.T) {
+	s := New(t.TempDir(), config.Config{Sync: config.SyncTypeNone})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	first := s.log.id
+	for i := 0; i < 5; i++ {
+		if err := s.Set([]byte("key"+utils.IntToString(i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The zero size falls back to the default size
+	if s.log.id != first {
+		t.Error("expected the log", first, "got", s.log.id)
+	}
+}
@@ -0,0 +1,213 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+const (
+	// ManifestTypeTLV is the type of the manifest TLV.
+	ManifestTypeTLV = byte(6)
+
+	// ManifestFormatVersion is the current version of the manifest format.
+	ManifestFormatVersion = uint16(1)
+
+	// manifestFile is the name of the manifest file.
+	manifestFile = "MANIFEST"
+
+	// tmpExt is the extension of a file which is being written and
+	// replaces the file without the extension once complete.
+	tmpExt = ".tmp"
+
+	// walExt is the extension of the write-ahead log files.
+	walExt = ".wal"
+
+	// tableExt is the extension of the table files.
+	tableExt = ".sst"
+)
+
+// ErrCorruptManifest is returned when the manifest doesn't match its
+// checksum or is malformed.
+var ErrCorruptManifest = fmt.Errorf("manifest is corrupted")
+
+// manifest records the tables of the storage.
+//
+// The manifest is replaced as a whole every time the tables change, a
+// table which isn't in the manifest is a leftover of an interrupted flush
+// or compaction and is removed on the next start.
+type manifest struct {
+	// flushed is the ID of the latest log flushed to a table, the logs
+	// with IDs <= flushed are no longer needed.
+	flushed uint64
+	// tables are the tables of the storage from the newest to the oldest.
+	tables []tableMeta
+}
+
+// tableMeta identifies a table in the manifest.
+type tableMeta struct {
+	id    uint64
+	level int
+}
+
+// encode encodes the manifest.
+func (m *manifest) encode() []byte {
+	b := binary.LittleEndian.AppendUint16(nil, ManifestFormatVersion)
+	b = binary.LittleEndian.AppendUint64(b, m.flushed)
+	b = binary.AppendUvarint(b, uint64(len(m.tables)))
+	for _, t := range m.tables {
+		b = binary.LittleEndian.AppendUint64(b, t.id)
+		b = binary.AppendUvarint(b, uint64(t.level))
+	}
+
+	return seal(b)
+}
+
+// decode decodes the manifest encoded by encode.
+func (m *manifest) decode(b []byte) error {
+	b, ok := unseal(b)
+	if !ok || len(b) < 10 {
+		return ErrCorruptManifest
+	}
+
+	if v := binary.LittleEndian.Uint16(b); v > ManifestFormatVersion {
+		return fmt.Errorf("unsupported manifest format version %d", v)
+	}
+
+	m.flushed = binary.LittleEndian.Uint64(b[2:])
+	b = b[10:]
+
+	n, l := binary.Uvarint(b)
+	if l <= 0 {
+		return ErrCorruptManifest
+	}
+	b = b[l:]
+
+	m.tables = nil
+	for i := uint64(0); i < n; i++ {
+		if len(b) < 8 {
+			return ErrCorruptManifest
+		}
+		id := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+
+		level, l := binary.Uvarint(b)
+		if l <= 0 {
+			return ErrCorruptManifest
+		}
+		b = b[l:]
+
+		m.tables = append(m.tables, tableMeta{id: id, level: int(level)})
+	}
+
+	return nil
+}
+
+// loadManifest loads the manifest from the given directory, an empty
+// manifest is returned if the storage is new.
+func loadManifest(dir string) (*manifest, error) {
+	m := &manifest{}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	tlv := tlvrw.NewTLV(0, nil)
+	if err := tlvrw.NewReader(bytes.NewReader(data)).Read(tlv); err != nil || tlv.Typ != ManifestTypeTLV {
+		return nil, ErrCorruptManifest
+	}
+
+	if err := m.decode(tlv.Val); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// saveManifest replaces the manifest in the given directory atomically.
+func saveManifest(dir string, m *manifest) error {
+	buf := &bytes.Buffer{}
+	if err := tlvrw.NewWriter(buf).Write(tlvrw.NewTLV(ManifestTypeTLV, m.encode())); err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	path := filepath.Join(dir, manifestFile)
+	fd, err := os.Create(path + tmpExt)
+	if err != nil {
+		return fmt.Errorf("error creating manifest: %w", err)
+	}
+
+	if _, err := fd.Write(buf.Bytes()); err != nil {
+		fd.Close()
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return fmt.Errorf("error syncing manifest: %w", err)
+	}
+
+	if err := fd.Close(); err != nil {
+		return fmt.Errorf("error closing manifest: %w", err)
+	}
+
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return fmt.Errorf("error replacing manifest: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// filePath returns the path of the file with the given ID and extension.
+//
+// The logs and the tables share the IDs, which grow with every new file.
+func filePath(dir string, id uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", id, ext))
+}
+
+// listFiles returns the paths of the files with the given extension in
+// the given directory by their IDs.
+func listFiles(dir string, ext string) (map[uint64]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage directory: %w", err)
+	}
+
+	paths := make(map[uint64]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		paths[id] = filepath.Join(dir, name)
+	}
+
+	return paths, nil
+}
+
+// syncDir makes the changes to the entries of the given directory durable.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return fd.Sync()
+}
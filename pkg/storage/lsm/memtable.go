@@ -0,0 +1,128 @@
+package lsm
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/utkarsh-pro/use/pkg/structures/skiplist"
+)
+
+// memtable holds the latest writes in memory, sorted by their keys,
+// till they are flushed to a table.
+type memtable struct {
+	// mu guards the skiplist, which isn't safe for concurrent use.
+	mu *sync.RWMutex
+	sl *skiplist.SkipList[string, entry]
+
+	// size is the approximate number of bytes held by the memtable.
+	//
+	// size is guarded by mu.
+	size int64
+
+	// log is the ID of the write-ahead log backing the memtable,
+	// 0 if the memtable isn't backed by any log.
+	log uint64
+}
+
+// newMemtable returns a new empty memtable backed by the given log.
+func newMemtable(log uint64) *memtable {
+	return &memtable{
+		mu:  &sync.RWMutex{},
+		sl:  skiplist.New[string, entry](strings.Compare),
+		log: log,
+	}
+}
+
+// put records the given entries, the later entries for a key replace
+// the earlier ones.
+func (m *memtable) put(entries ...kv) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, kv := range entries {
+		m.sl.Set(kv.key, kv.e)
+		m.size += kv.size()
+	}
+}
+
+// get returns the latest entry for the given key.
+func (m *memtable) get(key string) (entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sl.Get(key)
+}
+
+// seek returns the smallest key >= the given key, or > if inclusive is
+// false, along with its entry. If reverse is true then it returns the
+// largest key <= the given key, or < if inclusive is false.
+func (m *memtable) seek(key string, inclusive, reverse bool) (string, entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if reverse {
+		n := m.sl.SeekLE(key)
+		if n != nil && !inclusive && n.Key() == key {
+			n = n.Prev()
+		}
+
+		if n == nil {
+			return "", entry{}, false
+		}
+
+		return n.Key(), n.Value(), true
+	}
+
+	n := m.sl.Seek(key)
+	if n != nil && !inclusive && n.Key() == key {
+		n = n.Next()
+	}
+
+	if n == nil {
+		return "", entry{}, false
+	}
+
+	return n.Key(), n.Value(), true
+}
+
+// last returns the largest key along with its entry.
+func (m *memtable) last() (string, entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := m.sl.Last()
+	if n == nil {
+		return "", entry{}, false
+	}
+
+	return n.Key(), n.Value(), true
+}
+
+// len returns the number of keys in the memtable.
+func (m *memtable) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sl.Len()
+}
+
+// bytes returns the approximate number of bytes held by the memtable.
+func (m *memtable) bytes() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.size
+}
+
+// entries returns the entries of the memtable sorted by their keys.
+func (m *memtable) entries() []kv {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := make([]kv, 0, m.sl.Len())
+	for n := m.sl.First(); n != nil; n = n.Next() {
+		entries = append(entries, kv{key: n.Key(), e: n.Value()})
+	}
+
+	return entries
+}
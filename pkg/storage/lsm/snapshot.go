@@ -0,0 +1,198 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+const (
+	// SnapshotHdrTypeTLV is the type of the physical snapshot header TLV.
+	SnapshotHdrTypeTLV = byte(7)
+
+	// FileNameTypeTLV is the type of the TLV holding the name of a file
+	// in the physical snapshot.
+	FileNameTypeTLV = byte(8)
+
+	// FileDataTypeTLV is the type of the TLV holding the contents of a
+	// file in the physical snapshot.
+	FileDataTypeTLV = byte(9)
+
+	// FileCrcTypeTLV is the type of the TLV holding the checksum of the
+	// contents of a file in the physical snapshot.
+	FileCrcTypeTLV = byte(10)
+
+	// SnapshotFormatVersion is the current version of the physical
+	// snapshot format.
+	SnapshotFormatVersion = uint16(1)
+)
+
+// snapshotFile is a file copied to a physical snapshot.
+type snapshotFile struct {
+	name string
+	// r reads the contents of the file.
+	r    io.Reader
+	size int64
+}
+
+// PhysicalSnapshot writes the files of the storage to the given writer.
+// The snapshot is written in a format that can be read only by the storage:
+//
+//	Header: magic, format version
+//	File: name, contents and checksum TLVs, repeated
+//
+// The files are the manifest, the tables and the logs of the memtables.
+// The tables are immutable and the logs are only appended to, so copying
+// the logs up to their sizes at the start makes the snapshot consistent.
+// Only the flushes and the compactions are blocked while the snapshot is
+// being generated.
+func (s *Storage) PhysicalSnapshot(w io.Writer) error {
+	return s.PhysicalSnapshotContext(context.Background(), w)
+}
+
+// PhysicalSnapshotContext writes the files of the storage to the given
+// writer like PhysicalSnapshot, the copy stops once the given context is
+// done and the flushes and the compactions go on.
+func (s *Storage) PhysicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w = types.WriterWithContext(ctx, w)
+
+	// Make sure that the tables aren't swapped and the logs aren't
+	// removed while the snapshot is being generated.
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	m := &manifest{flushed: s.flushed}
+	for _, t := range s.tables {
+		m.tables = append(m.tables, tableMeta{id: t.id, level: t.level})
+	}
+
+	files := []snapshotFile{}
+	for _, t := range s.tables {
+		files = append(files, snapshotFile{
+			name: filepath.Base(t.path),
+			r:    io.NewSectionReader(t.fd, 0, t.size),
+			size: t.size,
+		})
+	}
+
+	logs, err := s.snapshotLogs()
+	if err != nil {
+		return err
+	}
+	files = append(files, logs...)
+
+	buf := &bytes.Buffer{}
+	if err := tlvrw.NewWriter(buf).Write(tlvrw.NewTLV(ManifestTypeTLV, m.encode())); err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+	files = append(files, snapshotFile{name: manifestFile, r: buf, size: int64(buf.Len())})
+
+	hdr := append([]byte{}, tableMagic...)
+	hdr = binary.LittleEndian.AppendUint16(hdr, SnapshotFormatVersion)
+
+	tw := tlvrw.NewWriter(w)
+	if err := tw.Write(tlvrw.NewTLV(SnapshotHdrTypeTLV, hdr)); err != nil {
+		return fmt.Errorf("error generating snapshot: %w", err)
+	}
+
+	for _, f := range files {
+		if err := writeSnapshotFile(w, f); err != nil {
+			return fmt.Errorf("error generating snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// snapshotLogs returns the logs which aren't flushed yet, the active log
+// is copied only up to its current size.
+//
+// snapshotLogs should be called with the compaction lock held.
+func (s *Storage) snapshotLogs() ([]snapshotFile, error) {
+	s.wmu.Lock()
+	paths, err := listFiles(s.dir, walExt)
+	active, size := uint64(0), int64(0)
+	if s.log != nil {
+		active, size = s.log.id, s.log.size
+	}
+	s.wmu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(paths))
+	for id := range paths {
+		if id > s.flushed {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var files []snapshotFile
+	for _, id := range ids {
+		data, err := os.ReadFile(paths[id])
+		if err != nil {
+			return nil, fmt.Errorf("error reading write-ahead log: %w", err)
+		}
+
+		// The active log may have grown since
+		if id == active && int64(len(data)) > size {
+			data = data[:size]
+		}
+
+		files = append(files, snapshotFile{
+			name: filepath.Base(paths[id]),
+			r:    bytes.NewReader(data),
+			size: int64(len(data)),
+		})
+	}
+
+	return files, nil
+}
+
+// writeSnapshotFile writes the given file to the given physical snapshot.
+func writeSnapshotFile(w io.Writer, f snapshotFile) error {
+	if f.size > math.MaxUint32 {
+		return fmt.Errorf("file %s is too large", f.name)
+	}
+
+	tw := tlvrw.NewWriter(w)
+	if err := tw.Write(tlvrw.NewTLV(FileNameTypeTLV, []byte(f.name))); err != nil {
+		return err
+	}
+
+	// The contents are streamed rather than read into a TLV value
+	hdr := []byte{FileDataTypeTLV}
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(f.size))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	crc := crc32.New(crcTable)
+	if n, err := io.Copy(io.MultiWriter(w, crc), f.r); err != nil {
+		return err
+	} else if n != f.size {
+		return io.ErrUnexpectedEOF
+	}
+
+	return tw.Write(tlvrw.NewTLV(FileCrcTypeTLV, binary.LittleEndian.AppendUint32(nil, crc.Sum32())))
+}
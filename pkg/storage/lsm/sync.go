@@ -0,0 +1,54 @@
+package lsm
+
+import (
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+)
+
+// flushAsync syncs the log periodically and whenever the unsynced writes
+// cross the configured threshold till done is closed.
+func (s *Storage) flushAsync(done <-chan struct{}) {
+	var tick <-chan time.Time
+	if s.cfg.SyncInterval > 0 {
+		ticker := time.NewTicker(s.cfg.SyncInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+		case <-s.flush:
+		}
+
+		// The log is synced under the write lock so that it isn't
+		// closed by a rollover meanwhile.
+		s.wmu.Lock()
+		if s.unsynced > 0 {
+			if err := s.log.sync(); err != nil {
+				log.Warnln("failed to sync the write-ahead log: ", err)
+			} else {
+				s.unsynced = 0
+			}
+		}
+		s.wmu.Unlock()
+	}
+}
+
+// maybeFlush wakes up the syncer if the unsynced writes have crossed
+// the configured threshold, it should be called with the write lock held.
+func (s *Storage) maybeFlush() {
+	if s.cfg.SyncBytes <= 0 || s.unsynced < s.cfg.SyncBytes {
+		return
+	}
+
+	// The syncer is already awake otherwise
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+}
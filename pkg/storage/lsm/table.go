@@ -0,0 +1,565 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/utkarsh-pro/use/pkg/structures/bloom/standard"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+const (
+	// BlockTypeTLV is the type of a data block TLV of a table.
+	BlockTypeTLV = byte(2)
+
+	// IndexTypeTLV is the type of the block index TLV of a table.
+	IndexTypeTLV = byte(3)
+
+	// FilterTypeTLV is the type of the bloom filter TLV of a table.
+	FilterTypeTLV = byte(4)
+
+	// FooterTypeTLV is the type of the footer TLV of a table.
+	FooterTypeTLV = byte(5)
+
+	// TableFormatVersion is the current version of the table format.
+	TableFormatVersion = uint16(1)
+
+	// footerLen is the length of the footer TLV value.
+	footerLen = 6 + // magic
+		2 + // version
+		8 + // index position
+		8 + // filter position
+		8 + // number of entries
+		8 + // largest ID
+		4 // checksum
+
+	// blockSize is the size in bytes beyond which a data block is cut.
+	blockSize = 4 << 10 // 4KB
+
+	// filterDefaultFPR is the false positive rate of the bloom filters
+	// of the tables when none is configured.
+	filterDefaultFPR = 0.01
+)
+
+var (
+	// ErrCorruptTable is returned when a table doesn't match its
+	// checksums or is malformed.
+	ErrCorruptTable = fmt.Errorf("table is corrupted")
+
+	// ErrUnsupportedTable is returned when a table was written by a
+	// newer version of the storage.
+	ErrUnsupportedTable = fmt.Errorf("unsupported table format")
+
+	// tableMagic are the bytes that the footer of every table starts with.
+	tableMagic = []byte("USELSM")
+)
+
+// A table is an immutable file holding entries sorted by their keys,
+// every key appears at most once in a table.
+//
+// The entries are grouped into data blocks of about blockSize bytes,
+// which are followed by the block index, the bloom filter of the keys
+// and a fixed size footer locating them:
+//
+//	Block: entries, checksum
+//	Index: first key, position and length of every block, checksum
+//	Filter: bloom filter of the keys, checksum
+//	Footer: magic, version, index and filter positions, number of
+//	        entries, largest ID, checksum
+type table struct {
+	// id is the ID of the table, see filePath.
+	id uint64
+	// level is the level of the table, a table of level L+1 is made
+	// by merging the tables of level L.
+	level int
+
+	path string
+	fd   *os.File
+	size int64
+
+	// count is the number of entries in the table.
+	count uint64
+	// maxID is the largest ID of the entries in the table.
+	maxID uint64
+
+	// index holds the location of every block.
+	index []blockHandle
+
+	// fmu guards the filter, whose hash functions aren't safe
+	// for concurrent use.
+	fmu    *sync.Mutex
+	filter *standard.Filter
+
+	// cached is the block read last, which makes the iterations
+	// read every block only once.
+	cached *atomic.Pointer[cachedBlock]
+}
+
+// blockHandle is the location of a block in a table.
+type blockHandle struct {
+	// first is the smallest key in the block.
+	first string
+	pos   int64
+	len   int64
+}
+
+// cachedBlock is a decoded block.
+type cachedBlock struct {
+	i       int
+	entries []kv
+}
+
+// tableWriter writes a new table.
+type tableWriter struct {
+	path string
+	fd   *os.File
+	bw   *bufio.Writer
+	tw   *tlvrw.Writer
+
+	// pos is the number of bytes written so far.
+	pos int64
+
+	// block is the block being filled.
+	block []byte
+	// first is the smallest key of the block being filled.
+	first string
+
+	index []byte
+	keys  []string
+	maxID uint64
+	fpr   float64
+}
+
+// newTableWriter creates a new table at the given path whose filter is
+// sized for the given false positive rate.
+func newTableWriter(path string, fpr float64) (*tableWriter, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table: %w", err)
+	}
+
+	if fpr <= 0 {
+		fpr = filterDefaultFPR
+	}
+
+	bw := bufio.NewWriter(fd)
+	return &tableWriter{
+		path: path,
+		fd:   fd,
+		bw:   bw,
+		tw:   tlvrw.NewWriter(bw),
+		fpr:  fpr,
+	}, nil
+}
+
+// add adds the given entry to the table, the entries should be added
+// in the order of their keys.
+func (w *tableWriter) add(key string, e entry) error {
+	if len(w.block) == 0 {
+		w.first = key
+	}
+
+	w.block = appendEntry(w.block, key, e)
+	w.keys = append(w.keys, key)
+	if e.id > w.maxID {
+		w.maxID = e.id
+	}
+
+	if len(w.block) >= blockSize {
+		return w.cut()
+	}
+
+	return nil
+}
+
+// cut writes the block being filled.
+func (w *tableWriter) cut() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	pos, err := w.write(BlockTypeTLV, seal(w.block))
+	if err != nil {
+		return err
+	}
+
+	w.index = binary.AppendUvarint(w.index, uint64(len(w.first)))
+	w.index = append(w.index, w.first...)
+	w.index = binary.AppendUvarint(w.index, uint64(pos))
+	w.index = binary.AppendUvarint(w.index, uint64(w.pos-pos))
+	w.block = w.block[:0]
+
+	return nil
+}
+
+// write writes a TLV of the given type and returns its position.
+func (w *tableWriter) write(typ byte, val []byte) (int64, error) {
+	pos := w.pos
+	if err := w.tw.Write(tlvrw.NewTLV(typ, val)); err != nil {
+		return 0, fmt.Errorf("error writing table: %w", err)
+	}
+	w.pos += tlvrw.Size(uint32(len(val)))
+
+	return pos, nil
+}
+
+// finish writes the index, the filter and the footer of the table and
+// makes the table durable.
+func (w *tableWriter) finish() error {
+	defer w.fd.Close()
+
+	if err := w.cut(); err != nil {
+		return err
+	}
+
+	indexPos, err := w.write(IndexTypeTLV, seal(w.index))
+	if err != nil {
+		return err
+	}
+
+	f := standard.NewWithEstimates(uint(utils.Max(len(w.keys), 1)), w.fpr, nil)
+	for _, key := range w.keys {
+		f.Add([]byte(key))
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error encoding filter: %w", err)
+	}
+
+	filterPos, err := w.write(FilterTypeTLV, seal(data))
+	if err != nil {
+		return err
+	}
+
+	footer := append([]byte{}, tableMagic...)
+	footer = binary.LittleEndian.AppendUint16(footer, TableFormatVersion)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(indexPos))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(filterPos))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(w.keys)))
+	footer = binary.LittleEndian.AppendUint64(footer, w.maxID)
+	if _, err := w.write(FooterTypeTLV, seal(footer)); err != nil {
+		return err
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return fmt.Errorf("error writing table: %w", err)
+	}
+
+	if err := w.fd.Sync(); err != nil {
+		return fmt.Errorf("error syncing table: %w", err)
+	}
+
+	return w.fd.Close()
+}
+
+// abort discards the table being written.
+func (w *tableWriter) abort() {
+	w.fd.Close()
+	os.Remove(w.path)
+}
+
+// openTable opens the table at the given path and loads its index
+// and filter.
+func openTable(path string, id uint64, level int) (*table, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening table: %w", err)
+	}
+
+	t := &table{
+		id:     id,
+		level:  level,
+		path:   path,
+		fd:     fd,
+		fmu:    &sync.Mutex{},
+		cached: &atomic.Pointer[cachedBlock]{},
+	}
+
+	if err := t.load(); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%w: table %d: %s", ErrCorruptTable, id, err)
+	}
+
+	return t, nil
+}
+
+// load reads the footer, the index and the filter of the table.
+func (t *table) load() error {
+	fi, err := t.fd.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = fi.Size()
+
+	footerSize := tlvrw.Size(footerLen)
+	if t.size < footerSize {
+		return fmt.Errorf("table is too short")
+	}
+
+	footer, err := t.read(FooterTypeTLV, t.size-footerSize, footerSize)
+	if err != nil {
+		return err
+	}
+
+	if len(footer) != footerLen-4 || !bytes.Equal(footer[:6], tableMagic) {
+		return fmt.Errorf("malformed footer")
+	}
+
+	if v := binary.LittleEndian.Uint16(footer[6:]); v > TableFormatVersion {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedTable, v)
+	}
+
+	indexPos := int64(binary.LittleEndian.Uint64(footer[8:]))
+	filterPos := int64(binary.LittleEndian.Uint64(footer[16:]))
+	t.count = binary.LittleEndian.Uint64(footer[24:])
+	t.maxID = binary.LittleEndian.Uint64(footer[32:])
+
+	if indexPos < 0 || filterPos < indexPos || filterPos > t.size-footerSize {
+		return fmt.Errorf("malformed footer")
+	}
+
+	index, err := t.read(IndexTypeTLV, indexPos, filterPos-indexPos)
+	if err != nil {
+		return err
+	}
+
+	for len(index) > 0 {
+		var h blockHandle
+
+		klen, n := binary.Uvarint(index)
+		if n <= 0 || klen > uint64(len(index)-n) {
+			return fmt.Errorf("malformed index")
+		}
+		h.first = string(index[n : n+int(klen)])
+		index = index[n+int(klen):]
+
+		pos, n := binary.Uvarint(index)
+		if n <= 0 {
+			return fmt.Errorf("malformed index")
+		}
+		index = index[n:]
+
+		l, n := binary.Uvarint(index)
+		if n <= 0 || pos+l > uint64(indexPos) {
+			return fmt.Errorf("malformed index")
+		}
+		index = index[n:]
+
+		h.pos, h.len = int64(pos), int64(l)
+		t.index = append(t.index, h)
+	}
+
+	data, err := t.read(FilterTypeTLV, filterPos, t.size-footerSize-filterPos)
+	if err != nil {
+		return err
+	}
+
+	t.filter = &standard.Filter{}
+	return t.filter.UnmarshalBinary(data)
+}
+
+// read reads the TLV of the given type and size at the given position
+// and verifies its checksum.
+func (t *table) read(typ byte, pos, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := t.fd.ReadAt(buf, pos); err != nil {
+		return nil, err
+	}
+
+	tlv := tlvrw.NewTLV(0, nil)
+	if err := tlvrw.NewReader(bytes.NewReader(buf)).Read(tlv); err != nil {
+		return nil, err
+	}
+
+	if tlv.Typ != typ || tlvrw.Size(tlv.Len) != size {
+		return nil, fmt.Errorf("unexpected TLV %d of %d bytes", tlv.Typ, tlv.Len)
+	}
+
+	val, ok := unseal(tlv.Val)
+	if !ok {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	return val, nil
+}
+
+// block returns the entries of the block with the given index.
+func (t *table) block(i int) ([]kv, error) {
+	if c := t.cached.Load(); c != nil && c.i == i {
+		return c.entries, nil
+	}
+
+	h := t.index[i]
+	data, err := t.read(BlockTypeTLV, h.pos, h.len)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %d: %s", ErrCorruptTable, t.id, err)
+	}
+
+	entries, err := decodeEntries(data)
+	if err != nil || len(entries) == 0 {
+		return nil, fmt.Errorf("%w: table %d: malformed block", ErrCorruptTable, t.id)
+	}
+
+	t.cached.Store(&cachedBlock{i: i, entries: entries})
+	return entries, nil
+}
+
+// mayContain returns false if the table definitely doesn't hold
+// the given key.
+func (t *table) mayContain(key []byte) bool {
+	t.fmu.Lock()
+	defer t.fmu.Unlock()
+
+	return t.filter.Contains(key)
+}
+
+// find returns the index of the last block whose first key is <= the
+// given key, -1 if there is none.
+func (t *table) find(key string) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].first > key
+	}) - 1
+}
+
+// get returns the entry for the given key.
+func (t *table) get(key []byte) (entry, bool, error) {
+	if !t.mayContain(key) {
+		return entry{}, false, nil
+	}
+
+	k := string(key)
+	i := t.find(k)
+	if i < 0 {
+		return entry{}, false, nil
+	}
+
+	entries, err := t.block(i)
+	if err != nil {
+		return entry{}, false, err
+	}
+
+	j := sort.Search(len(entries), func(j int) bool {
+		return entries[j].key >= k
+	})
+	if j == len(entries) || entries[j].key != k {
+		return entry{}, false, nil
+	}
+
+	return entries[j].e, true, nil
+}
+
+// seek returns the smallest key >= the given key, or > if inclusive is
+// false, along with its entry. If reverse is true then it returns the
+// largest key <= the given key, or < if inclusive is false.
+func (t *table) seek(key string, inclusive, reverse bool) (kv, bool, error) {
+	i := t.find(key)
+
+	if reverse {
+		for ; i >= 0; i-- {
+			entries, err := t.block(i)
+			if err != nil {
+				return kv{}, false, err
+			}
+
+			j := sort.Search(len(entries), func(j int) bool {
+				if inclusive {
+					return entries[j].key > key
+				}
+
+				return entries[j].key >= key
+			}) - 1
+			if j >= 0 {
+				return entries[j], true, nil
+			}
+		}
+
+		return kv{}, false, nil
+	}
+
+	for i = utils.Max(i, 0); i < len(t.index); i++ {
+		entries, err := t.block(i)
+		if err != nil {
+			return kv{}, false, err
+		}
+
+		j := sort.Search(len(entries), func(j int) bool {
+			if inclusive {
+				return entries[j].key >= key
+			}
+
+			return entries[j].key > key
+		})
+		if j < len(entries) {
+			return entries[j], true, nil
+		}
+	}
+
+	return kv{}, false, nil
+}
+
+// last returns the largest key of the table along with its entry.
+func (t *table) last() (kv, bool, error) {
+	if len(t.index) == 0 {
+		return kv{}, false, nil
+	}
+
+	entries, err := t.block(len(t.index) - 1)
+	if err != nil {
+		return kv{}, false, err
+	}
+
+	return entries[len(entries)-1], true, nil
+}
+
+// close closes the table.
+func (t *table) close() error {
+	return t.fd.Close()
+}
+
+// tableIterator goes through the entries of a table in the order
+// of their keys.
+type tableIterator struct {
+	t *table
+	// bi is the index of the block being read.
+	bi int
+	// entries are the entries of the block being read.
+	entries []kv
+}
+
+// next returns the next entry of the table.
+func (it *tableIterator) next() (kv, bool, error) {
+	for len(it.entries) == 0 {
+		if it.bi >= len(it.t.index) {
+			return kv{}, false, nil
+		}
+
+		// The block isn't cached so that the reads which are served
+		// meanwhile don't lose their cached block.
+		h := it.t.index[it.bi]
+		data, err := it.t.read(BlockTypeTLV, h.pos, h.len)
+		if err != nil {
+			return kv{}, false, fmt.Errorf("%w: table %d: %s", ErrCorruptTable, it.t.id, err)
+		}
+
+		entries, err := decodeEntries(data)
+		if err != nil {
+			return kv{}, false, fmt.Errorf("%w: table %d: malformed block", ErrCorruptTable, it.t.id)
+		}
+
+		it.entries = entries
+		it.bi++
+	}
+
+	kv := it.entries[0]
+	it.entries = it.entries[1:]
+
+	return kv, true, nil
+}
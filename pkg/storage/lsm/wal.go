@@ -0,0 +1,169 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+// RecordTypeTLV is the type of a write-ahead log record TLV.
+//
+// A record holds the entries of a single write, which is a single Set,
+// Delete or a whole batch, followed by their checksum. So a write either
+// survives a crash completely or not at all.
+const RecordTypeTLV = byte(1)
+
+var (
+	// writeFile and syncFile write to and fsync the log, the tests
+	// replace them to make the writes and the fsyncs fail.
+	writeFile = (*os.File).Write
+	syncFile  = (*os.File).Sync
+)
+
+// wal is a write-ahead log, it holds the writes of a memtable till the
+// memtable is flushed to a table.
+type wal struct {
+	// id is the ID of the log, see filePath.
+	id uint64
+	// fd is the writing file descriptor of the log.
+	fd *os.File
+	// size is the size of the log in bytes.
+	size int64
+	// broken is the reason no more records are written to the log, it is
+	// set once a failed record can't be discarded, see discard.
+	broken error
+}
+
+// createWAL creates a new empty log with the given ID.
+func createWAL(dir string, id uint64) (*wal, error) {
+	fd, err := os.OpenFile(filePath(dir, id, walExt), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error creating write-ahead log: %w", err)
+	}
+
+	return &wal{id: id, fd: fd}, nil
+}
+
+// append writes the given entries to the log as a single record and
+// returns the number of bytes written.
+func (w *wal) append(entries ...kv) (int64, error) {
+	if w.broken != nil {
+		return 0, w.broken
+	}
+
+	var payload []byte
+	for _, kv := range entries {
+		payload = appendEntry(payload, kv.key, kv.e)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tlvrw.NewWriter(buf).Write(tlvrw.NewTLV(RecordTypeTLV, seal(payload))); err != nil {
+		return 0, fmt.Errorf("error encoding record: %w", err)
+	}
+
+	n, err := writeFile(w.fd, buf.Bytes())
+	if err != nil {
+		// The replay would stop at the torn record and drop the
+		// records written after it
+		return 0, w.discard(w.size, fmt.Errorf("error writing record: %w", err))
+	}
+	w.size += int64(n)
+
+	return int64(n), nil
+}
+
+// sync makes the records written till now durable.
+func (w *wal) sync() error {
+	return syncFile(w.fd)
+}
+
+// discard discards the records written after the given size, whose
+// writes are reported as failed, and returns the given error.
+//
+// The log is broken if the records can't be discarded, they would either
+// come back on the next start or hide the records written after them.
+func (w *wal) discard(size int64, cause error) error {
+	if err := w.fd.Truncate(size); err != nil {
+		w.broken = fmt.Errorf("write-ahead log is broken: %w", err)
+		return cause
+	}
+
+	if _, err := w.fd.Seek(size, io.SeekStart); err != nil {
+		w.broken = fmt.Errorf("write-ahead log is broken: %w", err)
+		return cause
+	}
+	w.size = size
+
+	return cause
+}
+
+// close closes the log.
+func (w *wal) close() error {
+	return w.fd.Close()
+}
+
+// replayWAL executes the given function on the records of the log at the
+// given path in the order in which they were written.
+//
+// A record which is cut short or doesn't match its checksum was never
+// written completely, so it is the last record of the log. If fix is true
+// then the log is truncated right before such a record, otherwise the rest
+// of the log is ignored without modifying it.
+func replayWAL(path string, fix bool, fn func([]kv)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading write-ahead log: %w", err)
+	}
+
+	tr := tlvrw.NewReader(bytes.NewReader(data))
+	for pos := int64(0); pos < int64(len(data)); {
+		tlv := tlvrw.NewTLV(0, nil)
+
+		var entries []kv
+		err := tr.ReadLazy(tlv)
+		if err == nil && (tlv.Typ != RecordTypeTLV || pos+tlvrw.Size(tlv.Len) > int64(len(data))) {
+			err = ErrCorruptEntry
+		}
+
+		if err == nil {
+			err = tr.Fill(tlv)
+		}
+
+		if err == nil {
+			payload, ok := unseal(tlv.Val)
+			if !ok {
+				err = ErrCorruptEntry
+			} else {
+				entries, err = decodeEntries(payload)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			if !fix {
+				log.Warnln("Found corrupted data in the write-ahead log. Ignoring it...")
+				return nil
+			}
+
+			log.Warnln("Found corrupted data in the write-ahead log. Trying to fix it...")
+			if err := os.Truncate(path, pos); err != nil {
+				return fmt.Errorf("error truncating write-ahead log: %w", err)
+			}
+
+			log.Infoln("Successfully fixed the corrupted data in the write-ahead log")
+			return nil
+		}
+
+		fn(entries)
+		pos += tlvrw.Size(tlv.Len)
+	}
+
+	return nil
+}
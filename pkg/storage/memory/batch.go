@@ -0,0 +1,129 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// Batch is a group of writes which are applied under a single lock, so
+// the readers see either all of them or none of them.
+type Batch struct {
+	s   *Storage
+	ops []op
+
+	// err is the error of the first invalid write added to the batch,
+	// the batch isn't committed if it is set.
+	err error
+}
+
+// op is a write in a batch, it is nil for a delete.
+type op struct {
+	key string
+	it  *item
+}
+
+// NewBatch returns a new empty batch of writes.
+func (s *Storage) NewBatch() types.Batch {
+	return &Batch{s: s}
+}
+
+// Put adds setting the value for the given key to the batch.
+func (b *Batch) Put(key []byte, value []byte, opts ...types.SetOption) {
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+
+		return
+	}
+
+	b.ops = append(b.ops, op{
+		key: string(key),
+		it: &item{
+			key: string(key),
+			val: append([]byte{}, value...),
+			exp: expiry(o),
+		},
+	})
+}
+
+// Delete adds deleting the value for the given key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, op{key: string(key)})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the batch to the storage in one go.
+func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext writes the batch to the storage in one go, none of the
+// writes are applied once the given context is done.
+//
+// The keys are evicted as the writes are applied, so the keys written by
+// the batch may be evicted as well if the batch alone takes more than the
+// memory limit.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	s := b.s
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	for _, o := range b.ops {
+		if o.it == nil {
+			continue
+		}
+
+		if err := s.fits(o.it); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The context may have been done while waiting for the lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range b.ops {
+		if o.it == nil {
+			s.remove(o.key)
+			continue
+		}
+
+		// The batch may be committed again, the items are shared otherwise
+		it := *o.it
+		it.id = s.idgen.Next()
+		s.evict(&it)
+		s.put(&it)
+	}
+
+	b.ops = nil
+	return nil
+}
@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+)
+
+// Compact removes the expired keys from memory.
+//
+// The expired keys are absent for the readers already, but they take
+// memory all the same till they are overwritten, deleted or swept.
+func (s *Storage) Compact() error {
+	return s.CompactContext(context.Background())
+}
+
+// CompactContext removes the expired keys from memory like Compact, the
+// context is checked only before the keys are swept.
+func (s *Storage) CompactContext(ctx context.Context) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.sweep()
+	return nil
+}
+
+// sweepPeriodically removes the expired keys every sweepInterval till
+// done is closed.
+func (s *Storage) sweepPeriodically(done chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes the expired keys.
+func (s *Storage) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key := range s.expiring {
+		if it, ok := s.data.Get(key); ok && expired(it.exp) {
+			s.remove(key)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		log.Debugf("Removed %d expired keys", removed)
+	}
+}
@@ -0,0 +1,189 @@
+package memory
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+)
+
+// policy chooses the keys evicted once the storage is full.
+//
+// The policies are safe for concurrent use, the reads record the uses of
+// the keys while holding just the read lock of the storage.
+type policy interface {
+	// add starts tracking the given item.
+	add(it *item)
+	// replace tracks the given item in place of the old item of its key.
+	replace(old, it *item)
+	// touch records a use of the given item.
+	touch(it *item)
+	// remove stops tracking the given item.
+	remove(it *item)
+	// victim returns the item to evict next, nil if no item is tracked.
+	victim() *item
+}
+
+// newPolicy returns the policy of the given type.
+func newPolicy(typ config.EvictionType) (policy, error) {
+	switch typ {
+	case config.EvictionTypeLRU:
+		return &lru{l: list.New()}, nil
+	case config.EvictionTypeLFU:
+		return &lfu{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction type: %s", typ)
+	}
+}
+
+// lru evicts the least recently used item first.
+type lru struct {
+	mu sync.Mutex
+	// l holds the items from the most to the least recently used.
+	l *list.List
+}
+
+func (p *lru) add(it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	it.el = p.l.PushFront(it)
+}
+
+func (p *lru) replace(old, it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.l.Remove(old.el)
+	old.el = nil
+	it.el = p.l.PushFront(it)
+}
+
+func (p *lru) touch(it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The item may have been replaced or evicted meanwhile
+	if it.el != nil {
+		p.l.MoveToFront(it.el)
+	}
+}
+
+func (p *lru) remove(it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.l.Remove(it.el)
+	it.el = nil
+}
+
+func (p *lru) victim() *item {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el := p.l.Back(); el != nil {
+		return el.Value.(*item)
+	}
+
+	return nil
+}
+
+// lfu evicts the least frequently used item first, the ties are broken
+// in favor of the recently used items.
+type lfu struct {
+	mu sync.Mutex
+	h  itemHeap
+	// clock orders the uses of the items.
+	clock uint64
+}
+
+func (p *lfu) add(it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clock++
+	it.freq, it.used = 1, p.clock
+	heap.Push(&p.h, it)
+}
+
+func (p *lfu) replace(old, it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Writing a key is a use of the key as well
+	p.clock++
+	it.freq, it.used, it.index = old.freq+1, p.clock, old.index
+	p.h[it.index] = it
+	old.index = -1
+
+	heap.Fix(&p.h, it.index)
+}
+
+func (p *lfu) touch(it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The item may have been replaced or evicted meanwhile
+	if it.index < 0 {
+		return
+	}
+
+	p.clock++
+	it.freq, it.used = it.freq+1, p.clock
+	heap.Fix(&p.h, it.index)
+}
+
+func (p *lfu) remove(it *item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	heap.Remove(&p.h, it.index)
+}
+
+func (p *lfu) victim() *item {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.h) == 0 {
+		return nil
+	}
+
+	return p.h[0]
+}
+
+// itemHeap is a min-heap of the items by their frequency of use and
+// then by their last use, see heap.Interface.
+type itemHeap []*item
+
+func (h itemHeap) Len() int { return len(h) }
+
+func (h itemHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+
+	return h[i].used < h[j].used
+}
+
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *itemHeap) Push(x any) {
+	it := x.(*item)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *itemHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	it.index = -1
+	*h = old[:len(old)-1]
+
+	return it
+}
@@ -0,0 +1,593 @@
+// memory package implements a storage which keeps the keys in memory only.
+//
+// Nothing is written to the disk, the keys are lost once the storage is
+// closed. So the storage suits the tests and the caches, a memory limit
+// turns it into a cache which evicts the least recently or the least
+// frequently used keys to stay within the limit.
+package memory
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/id"
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage"
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/structures/skiplist"
+)
+
+const (
+	// itemOverhead is the approximate number of bytes an item takes on
+	// top of its key and its value.
+	itemOverhead = 64
+
+	// sweepInterval is the interval at which the expired keys are removed.
+	sweepInterval = 10 * time.Second
+)
+
+var (
+	// ErrAsOfUnsupported is returned when the storage is opened as of a
+	// write, the storage doesn't keep the overwritten values.
+	ErrAsOfUnsupported = fmt.Errorf("memory storage can't be opened as of a write")
+
+	// ErrTooLarge is returned when a key and its value alone take more
+	// than the memory limit.
+	ErrTooLarge = fmt.Errorf("key and value are larger than the memory limit")
+)
+
+// Storage is an in-memory storage.
+type Storage struct {
+	// Conditional implements the conditional writes over SetIf and
+	// DeleteIf.
+	types.Conditional
+
+	// mu guards the data, which isn't safe for concurrent use.
+	mu *sync.RWMutex
+	// data holds the items by their keys.
+	data *skiplist.SkipList[string, *item]
+	// size is the number of bytes taken by the items.
+	//
+	// size is guarded by the write lock.
+	size int64
+	// expiring is the set of the keys with an expiry.
+	//
+	// expiring is guarded by the write lock.
+	expiring map[string]struct{}
+
+	// policy chooses the keys to evict, nil if there is no memory limit.
+	policy policy
+
+	// idgen is the id generator.
+	idgen id.Gen
+
+	// initialized is true when the storage is initialized.
+	initialized *atomic.Bool
+
+	// cfg is the storage config.
+	cfg config.Config
+
+	// done is closed to stop the background workers.
+	done chan struct{}
+	// wg waits for the background workers to stop.
+	wg *sync.WaitGroup
+}
+
+// item is a key along with its value.
+//
+// The key, the value, the ID and the expiry of an item never change, a
+// write replaces the item. The rest of the fields belong to the policy.
+type item struct {
+	key string
+	val []byte
+	id  uint64
+	exp int64
+
+	// el is the element of the item in the lru list.
+	el *list.Element
+	// freq is the number of the uses of the item.
+	freq uint64
+	// used orders the last use of the item.
+	used uint64
+	// index is the index of the item in the lfu heap, -1 if removed.
+	index int
+}
+
+// size returns the approximate number of bytes taken by the item.
+func (it *item) size() int64 {
+	return int64(len(it.key)+len(it.val)) + itemOverhead
+}
+
+// init registers the storage, see storage.Register.
+func init() {
+	storage.Register(storage.MemoryStorageType, func(_ string, cfg config.Config) (storage.Storage, error) {
+		// The path is ignored, nothing is written to the disk
+		return New(cfg), nil
+	})
+}
+
+// New returns a new Storage instance.
+func New(cfg config.Config) *Storage {
+	s := &Storage{
+		mu:          &sync.RWMutex{},
+		data:        skiplist.New[string, *item](strings.Compare),
+		expiring:    make(map[string]struct{}),
+		idgen:       id.New(),
+		initialized: &atomic.Bool{},
+		cfg:         cfg,
+		wg:          &sync.WaitGroup{},
+	}
+	s.Conditional = types.NewConditional(s)
+
+	return s
+}
+
+// Init configures the storage.
+//
+// The storage always starts empty, a read-only storage stays empty.
+func (s *Storage) Init() error {
+	if s.cfg.AsOf > 0 {
+		return ErrAsOfUnsupported
+	}
+
+	if err := s.cfg.Options.Check(); err != nil {
+		return err
+	}
+
+	if s.cfg.MaxMemory > 0 {
+		p, err := newPolicy(s.cfg.Eviction)
+		if err != nil {
+			return err
+		}
+		s.policy = p
+	}
+
+	s.initialized.Store(true)
+
+	if s.cfg.ReadOnly {
+		return nil
+	}
+
+	done := make(chan struct{})
+	s.done = done
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.sweepPeriodically(done)
+	}()
+
+	return nil
+}
+
+// Get returns the value for the given key.
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value for the given key.
+func (s *Storage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	val, _, err := s.GetVersionedContext(ctx, key)
+	return val, err
+}
+
+// GetVersioned returns the value for the given key along with its
+// version, which is the ID of the write of the value.
+func (s *Storage) GetVersioned(key []byte) ([]byte, uint64, error) {
+	return s.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext returns the value for the given key along with its
+// version, which is the ID of the write of the value.
+func (s *Storage) GetVersionedContext(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if !s.isInit() {
+		return nil, 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	it, ok := s.lookup(string(key))
+	if !ok {
+		return nil, 0, errors.ErrKeyNotFound
+	}
+
+	if s.policy != nil {
+		s.policy.touch(it)
+	}
+
+	return append([]byte{}, it.val...), it.id, nil
+}
+
+// lookup returns the live item for the given key, it should be called
+// with the read lock held.
+func (s *Storage) lookup(key string) (*item, bool) {
+	it, ok := s.data.Get(key)
+	if !ok || expired(it.exp) {
+		return nil, false
+	}
+
+	return it, true
+}
+
+// version returns the version of the live item for the given key, it
+// should be called with the lock held.
+func (s *Storage) version(key string) (uint64, bool) {
+	it, ok := s.lookup(key)
+	if !ok {
+		return 0, false
+	}
+
+	return it.id, true
+}
+
+// Set sets the value for the given key.
+func (s *Storage) Set(key []byte, value []byte, opts ...types.SetOption) error {
+	return s.SetContext(context.Background(), key, value, opts...)
+}
+
+// SetContext sets the value for the given key.
+func (s *Storage) SetContext(ctx context.Context, key []byte, value []byte, opts ...types.SetOption) error {
+	_, err := s.SetIf(ctx, key, value, opts, nil)
+	return err
+}
+
+// SetIf sets the value for the given key if the given condition, if any,
+// holds and returns the version of the new value.
+func (s *Storage) SetIf(ctx context.Context, key []byte, value []byte, opts []types.SetOption, cond types.Condition) (uint64, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return 0, errors.ErrReadOnlyStorage
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	it := &item{
+		key: string(key),
+		val: append([]byte{}, value...),
+		exp: expiry(o),
+	}
+	if err := s.fits(it); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The condition is evaluated under the lock so that no other write
+	// to the key can sneak in before the value is written.
+	if cond != nil {
+		if err := cond(s.version(it.key)); err != nil {
+			return 0, err
+		}
+	}
+
+	it.id = s.idgen.Next()
+	s.evict(it)
+	s.put(it)
+
+	return it.id, nil
+}
+
+// Delete deletes the value for the given key.
+func (s *Storage) Delete(key []byte) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the value for the given key.
+func (s *Storage) DeleteContext(ctx context.Context, key []byte) error {
+	return s.DeleteIf(ctx, key, nil)
+}
+
+// DeleteIf deletes the value for the given key if the given condition,
+// if any, holds.
+func (s *Storage) DeleteIf(ctx context.Context, key []byte, cond types.Condition) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cond != nil {
+		if err := cond(s.version(string(key))); err != nil {
+			return err
+		}
+	}
+
+	s.remove(string(key))
+	return nil
+}
+
+// fits returns an error if the given item alone takes more than the
+// memory limit, as it would be evicted right away.
+func (s *Storage) fits(it *item) error {
+	if s.cfg.MaxMemory > 0 && it.size() > s.cfg.MaxMemory {
+		return ErrTooLarge
+	}
+
+	return nil
+}
+
+// put replaces the item of its key by the given item, it should be called
+// with the write lock held.
+func (s *Storage) put(it *item) {
+	old, ok := s.data.Get(it.key)
+	if ok {
+		s.size -= old.size()
+	}
+
+	if s.policy != nil {
+		// An expired item isn't a use of the key
+		if ok && !expired(old.exp) {
+			s.policy.replace(old, it)
+		} else {
+			if ok {
+				s.policy.remove(old)
+			}
+			s.policy.add(it)
+		}
+	}
+
+	s.data.Set(it.key, it)
+	s.size += it.size()
+
+	if it.exp != 0 {
+		s.expiring[it.key] = struct{}{}
+	} else {
+		delete(s.expiring, it.key)
+	}
+}
+
+// remove removes the item of the given key, if any, it should be called
+// with the write lock held.
+func (s *Storage) remove(key string) {
+	it, ok := s.data.Get(key)
+	if !ok {
+		return
+	}
+
+	s.data.Delete(key)
+	s.size -= it.size()
+	delete(s.expiring, key)
+
+	if s.policy != nil {
+		s.policy.remove(it)
+	}
+}
+
+// evict evicts the keys chosen by the policy till the given item fits in
+// the memory limit, it should be called with the write lock held before
+// the item is put. So the item itself is never evicted, which would be the
+// case for the lfu policy as the item is used the least so far.
+func (s *Storage) evict(it *item) {
+	if s.policy == nil {
+		return
+	}
+
+	evicted := 0
+	for {
+		need := it.size()
+		if old, ok := s.data.Get(it.key); ok {
+			need -= old.size()
+		}
+
+		if s.size+need <= s.cfg.MaxMemory {
+			break
+		}
+
+		victim := s.policy.victim()
+		if victim == nil {
+			break
+		}
+
+		s.remove(victim.key)
+		evicted++
+	}
+
+	if evicted > 0 {
+		log.Debugf("Evicted %d keys", evicted)
+	}
+}
+
+// Exists returns true if the given key exists.
+func (s *Storage) Exists(key []byte) (bool, error) {
+	return s.ExistsContext(context.Background(), key)
+}
+
+// ExistsContext returns true if the given key exists.
+func (s *Storage) ExistsContext(ctx context.Context, key []byte) (bool, error) {
+	if !s.isInit() {
+		return false, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.lookup(string(key))
+	return ok, nil
+}
+
+// TTL returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTL(key []byte) (time.Duration, error) {
+	return s.TTLContext(context.Background(), key)
+}
+
+// TTLContext returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTLContext(ctx context.Context, key []byte) (time.Duration, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	it, ok := s.lookup(string(key))
+	if !ok {
+		return 0, errors.ErrKeyNotFound
+	}
+
+	if it.exp == 0 {
+		return types.NoExpiry, nil
+	}
+
+	return time.Until(time.UnixMilli(it.exp)), nil
+}
+
+// Len returns the number of live keys in the storage.
+func (s *Storage) Len() (int, error) {
+	return s.LenContext(context.Background())
+}
+
+// LenContext returns the number of live keys in the storage.
+//
+// The expired keys stay in memory till they are swept, so only the keys
+// with an expiry are checked one by one.
+func (s *Storage) LenContext(ctx context.Context) (int, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := s.data.Len()
+	for key := range s.expiring {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if it, ok := s.data.Get(key); ok && expired(it.exp) {
+			n--
+		}
+	}
+
+	return n, nil
+}
+
+// LogicalSnapshot writes the live keys of the storage to the given
+// writer, see logical.Export.
+func (s *Storage) LogicalSnapshot(w io.Writer) error {
+	return s.LogicalSnapshotContext(context.Background(), w)
+}
+
+// LogicalSnapshotContext writes the live keys of the storage to the given
+// writer, see logical.ExportContext.
+func (s *Storage) LogicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	return logical.ExportContext(ctx, s, w)
+}
+
+// Restore writes the keys of the logical snapshot read from the given
+// reader to the storage, see logical.Restore.
+func (s *Storage) Restore(r io.Reader) error {
+	return s.RestoreContext(context.Background(), r)
+}
+
+// RestoreContext writes the keys of the logical snapshot read from the
+// given reader to the storage, see logical.RestoreContext.
+func (s *Storage) RestoreContext(ctx context.Context, r io.Reader) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	return logical.RestoreContext(ctx, s, r)
+}
+
+// Close closes the storage, the keys are dropped.
+func (s *Storage) Close() error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	// Stop the background workers, if any.
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.initialized.Store(false)
+
+	s.data = skiplist.New[string, *item](strings.Compare)
+	s.size = 0
+	s.expiring = make(map[string]struct{})
+	s.policy = nil
+
+	return nil
+}
+
+// isInit returns true if the storage is initialized.
+func (s *Storage) isInit() bool {
+	return s.initialized.Load()
+}
+
+// expiry returns the unix time in milliseconds at which a value written
+// with the given options expires, 0 if it never expires.
+func expiry(o types.SetOptions) int64 {
+	if o.TTL <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(o.TTL).UnixMilli()
+}
+
+// expired returns true if the given expiry time has passed.
+func expired(exp int64) bool {
+	return exp != 0 && exp <= time.Now().UnixMilli()
+}
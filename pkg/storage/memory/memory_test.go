@@ -0,0 +1,396 @@
+package memory
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/stupid"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+// itemSize is the size of the items set by the tests, whose keys and
+// values take 4 bytes each.
+const itemSize = 8 + itemOverhead
+
+// open returns an initialized storage with the given config.
+func open(t *testing.T, cfg config.Config) *Storage {
+	t.Helper()
+
+	s := New(cfg)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// key returns the i-th key of the tests.
+func key(i int) []byte {
+	return []byte("k" + strings.Repeat("0", 3-len(utils.IntToString(i))) + utils.IntToString(i))
+}
+
+func TestStorage_Eviction(t *testing.T) {
+	t.Run("lru", func(t *testing.T) {
+		s := open(t, config.DefaultConfig().WithMaxMemory(4*itemSize).WithLRUEviction())
+		defer s.Close()
+
+		for i := 0; i < 4; i++ {
+			if err := s.Set(key(i), []byte("val.")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// k000 is the most recently used now, k001 the least
+		if _, err := s.Get(key(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set(key(4), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, want := range []bool{true, false, true, true, true} {
+			if ok, err := s.Exists(key(i)); err != nil || ok != want {
+				t.Error("expected", want, "got", ok, err, "key", string(key(i)))
+			}
+		}
+
+		// An overwrite is a use of the key as well
+		if err := s.Set(key(2), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set(key(5), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, _ := s.Exists(key(3)); ok {
+			t.Error("expected", string(key(3)), "to be evicted")
+		}
+
+		if n, err := s.Len(); err != nil || n != 4 {
+			t.Error("expected", 4, "got", n, err)
+		}
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		s := open(t, config.DefaultConfig().WithMaxMemory(4*itemSize).WithLFUEviction())
+		defer s.Close()
+
+		for i := 0; i < 4; i++ {
+			if err := s.Set(key(i), []byte("val.")); err != nil {
+				t.Fatal(err)
+			}
+
+			// k000 is used the most, k003 the least
+			for j := i; j < 4; j++ {
+				if _, err := s.Get(key(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if err := s.Set(key(4), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+
+		// k004 is used the least now, but it is the most recent write
+		if err := s.Set(key(5), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, want := range []bool{true, true, true, false, false, true} {
+			if ok, err := s.Exists(key(i)); err != nil || ok != want {
+				t.Error("expected", want, "got", ok, err, "key", string(key(i)))
+			}
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		s := open(t, config.DefaultConfig().WithMaxMemory(4*itemSize))
+		defer s.Close()
+
+		b := s.NewBatch()
+		for i := 0; i < 10; i++ {
+			b.Put(key(i), []byte("val."))
+		}
+
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := s.Len(); err != nil || n != 4 {
+			t.Error("expected", 4, "got", n, err)
+		}
+
+		for i := 6; i < 10; i++ {
+			if ok, err := s.Exists(key(i)); err != nil || !ok {
+				t.Error("expected", true, "got", ok, err, "key", string(key(i)))
+			}
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		s := open(t, config.DefaultConfig().WithMaxMemory(itemSize))
+		defer s.Close()
+
+		if err := s.Set(key(0), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set(key(1), []byte("value")); err != ErrTooLarge {
+			t.Error("expected ErrTooLarge", "got", err)
+		}
+
+		b := s.NewBatch()
+		b.Put(key(1), []byte("val."))
+		b.Put(key(2), []byte("value"))
+		if err := b.Commit(); err != ErrTooLarge {
+			t.Error("expected ErrTooLarge", "got", err)
+		}
+
+		// Neither the write nor the batch evicted anything
+		if val, err := s.Get(key(0)); err != nil || string(val) != "val." {
+			t.Error("expected", "val.", "got", string(val), err)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		s := open(t, config.DefaultConfig())
+		defer s.Close()
+
+		for i := 0; i < 1000; i++ {
+			if err := s.Set(key(i), []byte("val.")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n, err := s.Len(); err != nil || n != 1000 {
+			t.Error("expected", 1000, "got", n, err)
+		}
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		s := New(config.Config{MaxMemory: itemSize, Eviction: "fifo"})
+		if err := s.Init(); err == nil {
+			t.Error("expected error for unknown eviction type")
+		}
+	})
+}
+
+func TestStorage_Size(t *testing.T) {
+	s := open(t, config.DefaultConfig())
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Set(key(i), []byte("val."), types.WithTTL(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := s.Set(key(i), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(key(9)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.RLock()
+	size, expiring := s.size, len(s.expiring)
+	s.mu.RUnlock()
+
+	if size != 9*itemSize {
+		t.Error("expected", 9*itemSize, "got", size)
+	}
+
+	if expiring != 4 {
+		t.Error("expected", 4, "got", expiring)
+	}
+}
+
+func TestStorage_Sweep(t *testing.T) {
+	s := open(t, config.DefaultConfig().WithMaxMemory(10*itemSize))
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		var opts []types.SetOption
+		if i%2 == 0 {
+			opts = append(opts, types.WithTTL(10*time.Millisecond))
+		}
+
+		if err := s.Set(key(i), []byte("val."), opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if n, err := s.Len(); err != nil || n != 5 {
+		t.Error("expected", 5, "got", n, err)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.RLock()
+	size, n := s.size, s.data.Len()
+	s.mu.RUnlock()
+
+	if size != 5*itemSize || n != 5 {
+		t.Error("expected", 5*itemSize, 5, "got", size, n)
+	}
+
+	// The expired keys don't hold on to the memory
+	for i := 10; i < 15; i++ {
+		if err := s.Set(key(i), []byte("val.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := s.Len(); err != nil || n != 10 {
+		t.Error("expected", 10, "got", n, err)
+	}
+}
+
+func TestStorage_PhysicalSnapshot(t *testing.T) {
+	s := open(t, config.DefaultConfig())
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := s.Set(key(i), []byte("val"+utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := s.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Set([]byte("expiring"), []byte("val"), types.WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set([]byte("expired"), []byte("val"), types.WithTTL(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	if err := s.PhysicalSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot is a segment of the stupid storage
+	dst := stupid.New(t.TempDir(), config.DefaultConfig())
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := dst.RestorePhysical(bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := dst.Len(); err != nil || n != 91 {
+		t.Error("expected", 91, "got", n, err)
+	}
+
+	for i := 0; i < 100; i++ {
+		val, version, err := dst.GetVersioned(key(i))
+		if i < 10 {
+			if err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+			continue
+		}
+
+		_, want, _ := s.GetVersioned(key(i))
+		if err != nil || string(val) != "val"+utils.IntToString(i) || version != want {
+			t.Error("expected", "val"+utils.IntToString(i), want, "got", string(val), version, err)
+		}
+	}
+
+	if ttl, err := dst.TTL([]byte("expiring")); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Error("expected TTL in (0, 1h] got", ttl, err)
+	}
+
+	if _, err := dst.Get([]byte("expired")); err != errors.ErrKeyNotFound {
+		t.Error("expected ErrKeyNotFound", "got", err)
+	}
+}
+
+func TestStorage_ReadOnly(t *testing.T) {
+	s := open(t, config.DefaultConfig().WithReadOnly())
+	defer s.Close()
+
+	if err := s.Set(key(0), []byte("val.")); err != errors.ErrReadOnlyStorage {
+		t.Error("expected ErrReadOnlyStorage", "got", err)
+	}
+
+	if n, err := s.Len(); err != nil || n != 0 {
+		t.Error("expected", 0, "got", n, err)
+	}
+
+	if err := New(config.DefaultConfig().WithAsOf(1)).Init(); err != ErrAsOfUnsupported {
+		t.Error("expected ErrAsOfUnsupported", "got", err)
+	}
+}
+
+func TestStorage_Concurrent(t *testing.T) {
+	for _, eviction := range []config.EvictionType{config.EvictionTypeLRU, config.EvictionTypeLFU} {
+		t.Run(string(eviction), func(t *testing.T) {
+			cfg := config.DefaultConfig().WithMaxMemory(50 * itemSize)
+			cfg.Eviction = eviction
+
+			s := open(t, cfg)
+			defer s.Close()
+
+			wg := &sync.WaitGroup{}
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+
+					for i := 0; i < 500; i++ {
+						k := key((i*7 + w) % 100)
+						switch i % 3 {
+						case 0:
+							if err := s.Set(k, []byte("val.")); err != nil {
+								t.Error(err)
+							}
+						case 1:
+							if _, err := s.Get(k); err != nil && err != errors.ErrKeyNotFound {
+								t.Error(err)
+							}
+						default:
+							if err := s.Delete(k); err != nil {
+								t.Error(err)
+							}
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			s.mu.RLock()
+			size, n := s.size, s.data.Len()
+			s.mu.RUnlock()
+
+			if size > cfg.MaxMemory || size != int64(n)*itemSize {
+				t.Error("expected", int64(n)*itemSize, "<=", cfg.MaxMemory, "got", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/stupid"
+)
+
+// PhysicalSnapshot writes the live keys of the storage to the given writer
+// as a segment of the stupid storage, holding a set packet per key with
+// the version of the key as its ID. So the snapshot can be restored to a
+// stupid storage, see stupid.Storage.RestorePhysical.
+//
+// The items are collected under the read lock and written without it, so
+// the writes are blocked only while the items are collected.
+func (s *Storage) PhysicalSnapshot(w io.Writer) error {
+	return s.PhysicalSnapshotContext(context.Background(), w)
+}
+
+// PhysicalSnapshotContext writes the live keys of the storage to the given
+// writer like PhysicalSnapshot, the snapshot stops between the keys once
+// the given context is done.
+func (s *Storage) PhysicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	items := make([]*item, 0, s.data.Len())
+	for n := s.data.First(); n != nil; n = n.Next() {
+		if it := n.Value(); !expired(it.exp) {
+			items = append(items, it)
+		}
+	}
+	s.mu.RUnlock()
+
+	sw, err := stupid.NewSegmentWriter(w)
+	if err != nil {
+		return fmt.Errorf("error generating snapshot: %w", err)
+	}
+
+	for _, it := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p := &stupid.Packet{
+			ID:  it.id,
+			Op:  stupid.SetOp,
+			Key: []byte(it.key),
+			Val: it.val,
+			Exp: it.exp,
+		}
+
+		if err := sw.Write(p); err != nil {
+			return fmt.Errorf("error generating snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
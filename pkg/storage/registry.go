@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+)
+
+// Factory returns a new storage at the given path with the given config.
+//
+// The storage isn't initialized yet, so the factory should leave the
+// parsing of the engine-specific options, see config.Options, to Init.
+type Factory func(path string, cfg config.Config) (Storage, error)
+
+var (
+	// registryMu guards the registry.
+	registryMu sync.RWMutex
+	// registry holds the factories of the storages by their type.
+	registry = make(map[StorageType]Factory)
+)
+
+// Register makes the storage of the given type available to New, so
+// that the storages can be added without modifying this package.
+//
+// Register panics if the factory is nil or if the type is registered
+// already, it is meant to be called from the init of the storage.
+func Register(t StorageType, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+
+	if _, dup := registry[t]; dup {
+		panic("storage: Register called twice for storage type " + t)
+	}
+
+	registry[t] = factory
+}
+
+// Types returns the registered storage types in the sorted order.
+func Types() []StorageType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]StorageType, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+// New returns a new Storage instance of the given type.
+func New(t StorageType, path string, config config.Config) (Storage, error) {
+	registryMu.RLock()
+	factory, ok := registry[t]
+	registryMu.RUnlock()
+
+	if !ok {
+		var names []string
+		for _, t := range Types() {
+			names = append(names, string(t))
+		}
+
+		return nil, fmt.Errorf("unknown storage type: %s, available: %s", t, strings.Join(names, ", "))
+	}
+
+	return factory(path, config)
+}
@@ -1,13 +1,45 @@
 package storage
 
 import (
-	"fmt"
+	"context"
 	"io"
+	"time"
 
-	"github.com/utkarsh-pro/use/pkg/storage/config"
-	"github.com/utkarsh-pro/use/pkg/storage/stupid"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
 )
 
+// Batch is a group of writes which are applied atomically.
+type Batch = types.Batch
+
+// Iterator iterates over the live keys in the lexicographic order.
+type Iterator = types.Iterator
+
+// IterOptions are the options of an iterator.
+type IterOptions = types.IterOptions
+
+// Revision is a single write recorded in the history of a key.
+type Revision = types.Revision
+
+// Event is a write published to the watches of its key.
+type Event = types.Event
+
+// WatchOptions are the options of a watch.
+type WatchOptions = types.WatchOptions
+
+// Watch delivers the events of the writes matching its options.
+type Watch = types.Watch
+
+// SetOption configures a single Set.
+type SetOption = types.SetOption
+
+// NoExpiry is the TTL reported for the keys which never expire.
+const NoExpiry = types.NoExpiry
+
+// WithTTL makes the key expire after the given duration.
+func WithTTL(ttl time.Duration) SetOption {
+	return types.WithTTL(ttl)
+}
+
 type Storage interface {
 	// Init configures the storage.
 	Init() error
@@ -15,39 +47,188 @@ type Storage interface {
 	// Get returns the value for the given key.
 	Get(key []byte) ([]byte, error)
 
+	// GetVersioned returns the value for the given key along with
+	// its version.
+	GetVersioned(key []byte) ([]byte, uint64, error)
+
 	// Set sets the value for the given key.
-	Set(key []byte, value []byte) error
+	Set(key []byte, value []byte, opts ...SetOption) error
 
 	// Delete deletes the value for the given key.
 	Delete(key []byte) error
 
+	// SetIfAbsent sets the value for the given key only if the key
+	// doesn't exist and returns the version of the new value.
+	SetIfAbsent(key []byte, value []byte, opts ...SetOption) (uint64, error)
+
+	// SetIfVersion sets the value for the given key only if the current
+	// value has the given version and returns the version of the new value.
+	SetIfVersion(key []byte, value []byte, version uint64, opts ...SetOption) (uint64, error)
+
+	// DeleteIfVersion deletes the value for the given key only if the
+	// current value has the given version.
+	DeleteIfVersion(key []byte, version uint64) error
+
 	// Exists returns true if the given key exists.
 	Exists(key []byte) (bool, error)
 
 	// Len returns the number of keys in the storage.
 	Len() (int, error)
 
+	// TTL returns the duration after which the given key expires,
+	// NoExpiry if the key never expires.
+	TTL(key []byte) (time.Duration, error)
+
+	// NewBatch returns a new empty batch of writes.
+	NewBatch() Batch
+
+	// NewIterator returns an iterator over the live keys matching
+	// the given options.
+	NewIterator(opts IterOptions) (Iterator, error)
+
 	// PhysicalSnapshot writes snapshot of the storage data to
 	// the given writer.
 	PhysicalSnapshot(w io.Writer) error
 
+	// LogicalSnapshot writes the live keys of the storage to the
+	// given writer in a format understood by every storage type.
+	LogicalSnapshot(w io.Writer) error
+
+	// Restore writes the keys of the logical snapshot read from
+	// the given reader to the storage.
+	Restore(r io.Reader) error
+
 	// Close closes the storage.
 	Close() error
 }
 
+// ContextStorage is a Storage whose methods take a context as well, they
+// return the error of the context once it is done. The methods going
+// through many keys stop midway, the rest check the context before they
+// start. A write is never stopped midway, it is either made or not.
+//
+// The built-in storages implement ContextStorage, the methods of Storage
+// are the methods with a context called with context.Background(). The
+// rest of the storages can be adapted by WithContext.
+type ContextStorage interface {
+	Storage
+
+	// GetContext returns the value for the given key.
+	GetContext(ctx context.Context, key []byte) ([]byte, error)
+
+	// GetVersionedContext returns the value for the given key along
+	// with its version.
+	GetVersionedContext(ctx context.Context, key []byte) ([]byte, uint64, error)
+
+	// SetContext sets the value for the given key.
+	SetContext(ctx context.Context, key []byte, value []byte, opts ...SetOption) error
+
+	// DeleteContext deletes the value for the given key.
+	DeleteContext(ctx context.Context, key []byte) error
+
+	// SetIfAbsentContext sets the value for the given key only if the
+	// key doesn't exist and returns the version of the new value.
+	SetIfAbsentContext(ctx context.Context, key []byte, value []byte, opts ...SetOption) (uint64, error)
+
+	// SetIfVersionContext sets the value for the given key only if the
+	// current value has the given version and returns the version of the
+	// new value.
+	SetIfVersionContext(ctx context.Context, key []byte, value []byte, version uint64, opts ...SetOption) (uint64, error)
+
+	// DeleteIfVersionContext deletes the value for the given key only if
+	// the current value has the given version.
+	DeleteIfVersionContext(ctx context.Context, key []byte, version uint64) error
+
+	// ExistsContext returns true if the given key exists.
+	ExistsContext(ctx context.Context, key []byte) (bool, error)
+
+	// LenContext returns the number of keys in the storage.
+	LenContext(ctx context.Context) (int, error)
+
+	// TTLContext returns the duration after which the given key
+	// expires, NoExpiry if the key never expires.
+	TTLContext(ctx context.Context, key []byte) (time.Duration, error)
+
+	// NewIteratorContext returns an iterator over the live keys matching
+	// the given options, the iterator stops once the context is done.
+	NewIteratorContext(ctx context.Context, opts IterOptions) (Iterator, error)
+
+	// PhysicalSnapshotContext writes snapshot of the storage data to
+	// the given writer.
+	PhysicalSnapshotContext(ctx context.Context, w io.Writer) error
+
+	// LogicalSnapshotContext writes the live keys of the storage to the
+	// given writer in a format understood by every storage type.
+	LogicalSnapshotContext(ctx context.Context, w io.Writer) error
+
+	// RestoreContext writes the keys of the logical snapshot read from
+	// the given reader to the storage.
+	RestoreContext(ctx context.Context, r io.Reader) error
+}
+
+// Compactor is implemented by the storages which can reclaim the
+// space taken by the overwritten and the deleted data.
+type Compactor interface {
+	// Compact rewrites the storage with only the live data in it.
+	Compact() error
+
+	// CompactContext is Compact which stops once the context is done,
+	// the storage is left as it was before the compaction.
+	CompactContext(ctx context.Context) error
+}
+
+// AsOfReader is implemented by the storages which keep the history
+// of the keys.
+type AsOfReader interface {
+	// GetAsOf returns the value the given key had as of the write with
+	// the given ID.
+	GetAsOf(key []byte, id uint64) ([]byte, error)
+
+	// GetAsOfContext is GetAsOf which stops once the context is done.
+	GetAsOfContext(ctx context.Context, key []byte, id uint64) ([]byte, error)
+}
+
+// HistoryReader is implemented by the storages which keep the history
+// of the keys.
+type HistoryReader interface {
+	// History returns the writes to the given key from the latest to
+	// the oldest, skipping the given number of the latest writes and
+	// returning at most limit writes.
+	History(key []byte, limit, offset int) ([]Revision, error)
+
+	// HistoryContext is History which stops once the context is done.
+	HistoryContext(ctx context.Context, key []byte, limit, offset int) ([]Revision, error)
+}
+
+// Watcher is implemented by the storages which publish their writes.
+type Watcher interface {
+	// Watch returns a new watch over the writes matching the given options.
+	Watch(opts WatchOptions) (Watch, error)
+}
+
+// PhysicalRestorer is implemented by the storages which can be restored
+// from their own physical snapshots.
+type PhysicalRestorer interface {
+	// RestorePhysical replaces the data of the storage by the data of the
+	// physical snapshot read from the given reader. The storage must be
+	// empty unless force is true.
+	RestorePhysical(r io.Reader, force bool) error
+
+	// RestorePhysicalContext is RestorePhysical which stops once the
+	// context is done, unless the snapshot has replaced the data already.
+	RestorePhysicalContext(ctx context.Context, r io.Reader, force bool) error
+}
+
 type StorageType string
 
+// The types of the built-in storages, each storage registers itself from
+// the init of its package, so the package has to be imported for the
+// storage to be available, e.g.
+//
+//	import _ "github.com/utkarsh-pro/use/pkg/storage/stupid"
 const (
 	StupidStorageType StorageType = "stupid"
+	LSMStorageType    StorageType = "lsm"
+	BTreeStorageType  StorageType = "btree"
+	MemoryStorageType StorageType = "memory"
 )
-
-// New returns a new Storage instance.
-func New(t StorageType, path string, config config.Config) (Storage, error) {
-	switch t {
-	case StupidStorageType:
-		storage := stupid.New(path, config)
-		return storage, nil
-	default:
-		return nil, fmt.Errorf("unknown storage type: %s", t)
-	}
-}
@@ -0,0 +1,1054 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+// storageTypes are the storage types every test runs against.
+var storageTypes = []StorageType{
+	StupidStorageType,
+	LSMStorageType,
+	BTreeStorageType,
+	MemoryStorageType,
+}
+
+// persistent returns true if the storages of the given type keep their
+// data once closed.
+func persistent(typ StorageType) bool {
+	return typ != MemoryStorageType
+}
+
+// forEachType runs the given test against every storage type.
+func forEachType(t *testing.T, test func(t *testing.T, typ StorageType)) {
+	for _, typ := range storageTypes {
+		typ := typ
+		t.Run(string(typ), func(t *testing.T) {
+			test(t, typ)
+		})
+	}
+}
+
+// open returns an initialized storage of the given type.
+func open(t *testing.T, typ StorageType, dir string, cfg config.Config) Storage {
+	t.Helper()
+
+	s, err := New(typ, dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("unknown", t.TempDir(), config.DefaultConfig())
+	if err == nil {
+		t.Fatal("expected error for unknown storage type")
+	}
+
+	// The error lists the available storage types
+	for _, typ := range storageTypes {
+		if !strings.Contains(err.Error(), string(typ)) {
+			t.Error("expected", typ, "in", err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	const typ StorageType = "test-registered"
+
+	var gotPath string
+	Register(typ, func(path string, cfg config.Config) (Storage, error) {
+		gotPath = path
+		return New(MemoryStorageType, path, cfg)
+	})
+
+	found := false
+	for _, tt := range Types() {
+		found = found || tt == typ
+	}
+	if !found {
+		t.Error("expected", typ, "in", Types())
+	}
+
+	s := open(t, typ, "some/path", config.DefaultConfig())
+	defer s.Close()
+
+	if gotPath != "some/path" {
+		t.Error("expected", "some/path", "got", gotPath)
+	}
+
+	if err := s.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, register := range map[string]func(){
+		"duplicate":   func() { Register(StupidStorageType, func(string, config.Config) (Storage, error) { return nil, nil }) },
+		"nil factory": func() { Register("test-nil", nil) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected Register to panic")
+				}
+			}()
+
+			register()
+		})
+	}
+}
+
+func TestStorage_Options(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		s, err := New(typ, t.TempDir(), config.DefaultConfig().WithOptions(config.Options{"no-such-option": "1"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Init(); err == nil || !strings.Contains(err.Error(), "no-such-option") {
+			t.Error("expected error for unknown option", "got", err)
+		}
+	})
+}
+
+func TestStorage_Lifecycle(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		cfgs := map[string]config.Config{
+			"nonesynccfg":  config.DefaultConfig(),
+			"synccfg":      config.DefaultConfig().WithSync(),
+			"asyncsynccfg": config.DefaultConfig().WithAsyncSync(),
+		}
+
+		for name, cfg := range cfgs {
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+
+				s, err := New(typ, dir, cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// uninitialized checks the errors of the storage which
+				// isn't initialized.
+				uninitialized := func(t *testing.T) {
+					if _, err := s.Get([]byte("foo")); err != errors.ErrStorageNotInitialized {
+						t.Error("expected ErrStorageNotInitialized", "got", err)
+					}
+
+					if err := s.Set([]byte("foo"), nil); err != errors.ErrStorageNotInitialized {
+						t.Error("expected ErrStorageNotInitialized", "got", err)
+					}
+
+					if err := s.Delete([]byte("foo")); err != errors.ErrStorageNotInitialized {
+						t.Error("expected ErrStorageNotInitialized", "got", err)
+					}
+
+					if _, err := s.Exists([]byte("foo")); err != errors.ErrStorageNotInitialized {
+						t.Error("expected ErrStorageNotInitialized", "got", err)
+					}
+
+					if _, err := s.Len(); err != errors.ErrStorageNotInitialized {
+						t.Error("expected ErrStorageNotInitialized", "got", err)
+					}
+
+					if err := s.Close(); err != errors.ErrStorageNotInitialized {
+						t.Error("expected ErrStorageNotInitialized", "got", err)
+					}
+				}
+
+				t.Run("uninitialized", uninitialized)
+
+				if err := s.Init(); err != nil {
+					t.Fatal(err)
+				}
+
+				vals := map[string][]byte{
+					"foo":           []byte("bar"),
+					"bar":           []byte("baz"),
+					"baz":           []byte("foo"),
+					"mr.big.empty":  make([]byte, 1024*1024*10),
+					"mr.big.random": utils.GenerateRandomBytes(1024 * 1024 * 10),
+				}
+
+				t.Run("Set", func(t *testing.T) {
+					for k, v := range vals {
+						if err := s.Set([]byte(k), v); err != nil {
+							t.Error(err)
+						}
+					}
+				})
+
+				t.Run("Get", func(t *testing.T) {
+					for k, v := range vals {
+						val, err := s.Get([]byte(k))
+						if err != nil {
+							t.Error(err)
+						}
+
+						if !bytes.Equal(val, v) {
+							t.Error("value mismatch", "key", k)
+						}
+					}
+
+					if _, err := s.Get([]byte("foo3")); err != errors.ErrKeyNotFound {
+						t.Error("expected ErrKeyNotFound", "got", err)
+					}
+				})
+
+				t.Run("Delete", func(t *testing.T) {
+					if err := s.Delete([]byte("foo")); err != nil {
+						t.Error(err)
+					}
+
+					if _, err := s.Get([]byte("foo")); err != errors.ErrKeyNotFound {
+						t.Error("expected ErrKeyNotFound", "got", err)
+					}
+
+					delete(vals, "foo")
+				})
+
+				t.Run("Exists", func(t *testing.T) {
+					for k := range vals {
+						if exists, err := s.Exists([]byte(k)); err != nil || !exists {
+							t.Error("expected", k, "to exist", err)
+						}
+					}
+
+					if exists, err := s.Exists([]byte("foo")); err != nil || exists {
+						t.Error("expected deleted key not to exist", err)
+					}
+				})
+
+				t.Run("Len", func(t *testing.T) {
+					if n, err := s.Len(); err != nil || n != len(vals) {
+						t.Error("expected", len(vals), "got", n, err)
+					}
+				})
+
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				t.Run("closed", uninitialized)
+
+				t.Run("reopen", func(t *testing.T) {
+					if !persistent(typ) {
+						t.Skip("storage doesn't keep its data")
+					}
+
+					s := open(t, typ, dir, cfg)
+					defer s.Close()
+
+					for k, v := range vals {
+						val, err := s.Get([]byte(k))
+						if err != nil || !bytes.Equal(val, v) {
+							t.Error("value mismatch", "key", k, err)
+						}
+					}
+
+					if _, err := s.Get([]byte("foo")); err != errors.ErrKeyNotFound {
+						t.Error("expected ErrKeyNotFound", "got", err)
+					}
+				})
+			})
+		}
+	})
+}
+
+func TestStorage_ExistsLen(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		dir := t.TempDir()
+
+		s := open(t, typ, dir, config.DefaultConfig().WithCompactionRatio(0))
+
+		for i := 0; i < 100; i++ {
+			if err := s.Set([]byte("key"+utils.IntToString(i%10)), []byte(utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 5; i++ {
+			if err := s.Delete([]byte("key" + utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		check := func(t *testing.T, s Storage) {
+			if n, err := s.Len(); err != nil || n != 5 {
+				t.Error("expected", 5, "got", n, err)
+			}
+
+			for i := 0; i < 10; i++ {
+				k := []byte("key" + utils.IntToString(i))
+
+				exists, err := s.Exists(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if exists != (i >= 5) {
+					t.Error("expected", i >= 5, "got", exists, "key", string(k))
+				}
+
+				val, err := s.Get(k)
+				if i >= 5 && (err != nil || string(val) != utils.IntToString(90+i)) {
+					t.Error("expected", utils.IntToString(90+i), "got", string(val), err)
+				}
+			}
+		}
+
+		t.Run("live", func(t *testing.T) {
+			check(t, s)
+		})
+
+		if c, ok := s.(Compactor); ok {
+			if err := c.Compact(); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("after compaction", func(t *testing.T) {
+				check(t, s)
+			})
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("after reopen", func(t *testing.T) {
+			if !persistent(typ) {
+				t.Skip("storage doesn't keep its data")
+			}
+
+			s := open(t, typ, dir, config.DefaultConfig())
+			defer s.Close()
+
+			check(t, s)
+		})
+	})
+}
+
+func TestStorage_ReadOnly(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		if !persistent(typ) {
+			t.Skip("storage doesn't keep its data")
+		}
+
+		dir := t.TempDir()
+
+		s := open(t, typ, dir, config.DefaultConfig())
+		if err := s.Set([]byte("key"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = open(t, typ, dir, config.DefaultConfig().WithReadOnly())
+		defer s.Close()
+
+		if val, err := s.Get([]byte("key")); err != nil || string(val) != "val" {
+			t.Error("expected", "val", "got", string(val), err)
+		}
+
+		if err := s.Set([]byte("key"), []byte("val2")); err != errors.ErrReadOnlyStorage {
+			t.Error("expected ErrReadOnlyStorage", "got", err)
+		}
+
+		if err := s.Delete([]byte("key")); err != errors.ErrReadOnlyStorage {
+			t.Error("expected ErrReadOnlyStorage", "got", err)
+		}
+
+		b := s.NewBatch()
+		b.Put([]byte("key"), []byte("val2"))
+		if err := b.Commit(); err != errors.ErrReadOnlyStorage {
+			t.Error("expected ErrReadOnlyStorage", "got", err)
+		}
+	})
+}
+
+func TestStorage_TTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		// setup writes a key which expires and a key which never expires
+		setup := func(t *testing.T, dir string) Storage {
+			s := open(t, typ, dir, config.DefaultConfig())
+
+			if err := s.Set([]byte("expiring"), []byte("val"), WithTTL(ttl)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Set([]byte("forever"), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+
+			return s
+		}
+
+		// check verifies whether the expiring key is present or not
+		check := func(t *testing.T, s Storage, present bool) {
+			t.Helper()
+
+			val, err := s.Get([]byte("expiring"))
+			if present && (err != nil || string(val) != "val") {
+				t.Error("expected", "val", "got", string(val), err)
+			}
+			if !present && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+
+			if exists, err := s.Exists([]byte("expiring")); err != nil || exists != present {
+				t.Error("expected", present, "got", exists, err)
+			}
+
+			expected := 1
+			if present {
+				expected = 2
+			}
+			if n, err := s.Len(); err != nil || n != expected {
+				t.Error("expected", expected, "got", n, err)
+			}
+
+			left, err := s.TTL([]byte("expiring"))
+			if present && (err != nil || left <= 0 || left > ttl) {
+				t.Error("expected TTL in (0, ", ttl, "] got", left, err)
+			}
+			if !present && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+
+			if left, err := s.TTL([]byte("forever")); err != nil || left != NoExpiry {
+				t.Error("expected", NoExpiry, "got", left, err)
+			}
+		}
+
+		t.Run("expiry", func(t *testing.T) {
+			s := setup(t, t.TempDir())
+			defer s.Close()
+
+			check(t, s, true)
+			time.Sleep(ttl)
+			check(t, s, false)
+
+			if err := s.Delete([]byte("expiring")); err != nil {
+				t.Fatal(err)
+			}
+			check(t, s, false)
+		})
+
+		t.Run("reopen", func(t *testing.T) {
+			if !persistent(typ) {
+				t.Skip("storage doesn't keep its data")
+			}
+
+			dir := t.TempDir()
+
+			s := setup(t, dir)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s = open(t, typ, dir, config.DefaultConfig())
+			defer s.Close()
+
+			check(t, s, true)
+			time.Sleep(ttl)
+			check(t, s, false)
+		})
+
+		t.Run("compaction", func(t *testing.T) {
+			s := setup(t, t.TempDir())
+			defer s.Close()
+
+			c, ok := s.(Compactor)
+			if !ok {
+				t.Skip("storage can't be compacted")
+			}
+
+			time.Sleep(ttl)
+			if err := c.Compact(); err != nil {
+				t.Fatal(err)
+			}
+
+			check(t, s, false)
+		})
+
+		t.Run("non-positive", func(t *testing.T) {
+			s := open(t, typ, t.TempDir(), config.DefaultConfig())
+			defer s.Close()
+
+			for _, d := range []time.Duration{0, -time.Second} {
+				if err := s.Set([]byte("key"), []byte("val"), WithTTL(d)); err != errors.ErrInvalidTTL {
+					t.Error("expected ErrInvalidTTL, got", err)
+				}
+
+				b := s.NewBatch()
+				b.Put([]byte("key"), []byte("val"), WithTTL(d))
+				if err := b.Commit(); err != errors.ErrInvalidTTL {
+					t.Error("expected ErrInvalidTTL, got", err)
+				}
+			}
+
+			if exists, err := s.Exists([]byte("key")); err != nil || exists {
+				t.Error("expected the key not to be written, got", exists, err)
+			}
+		})
+	})
+}
+
+func TestStorage_Conditional(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		s := open(t, typ, t.TempDir(), config.DefaultConfig())
+		defer s.Close()
+
+		key := []byte("key")
+
+		v1, err := s.SetIfAbsent(key, []byte("v1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.SetIfAbsent(key, []byte("v2")); err != errors.ErrKeyExists {
+			t.Error("expected ErrKeyExists", "got", err)
+		}
+
+		val, version, err := s.GetVersioned(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != "v1" || version != v1 {
+			t.Error("expected", "v1", v1, "got", string(val), version)
+		}
+
+		if _, err := s.SetIfVersion(key, []byte("v2"), v1+1); err != errors.ErrVersionMismatch {
+			t.Error("expected ErrVersionMismatch", "got", err)
+		}
+
+		v2, err := s.SetIfVersion(key, []byte("v2"), v1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v2 <= v1 {
+			t.Error("expected version greater than", v1, "got", v2)
+		}
+
+		if err := s.DeleteIfVersion(key, v1); err != errors.ErrVersionMismatch {
+			t.Error("expected ErrVersionMismatch", "got", err)
+		}
+
+		if err := s.DeleteIfVersion(key, v2); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.DeleteIfVersion(key, v2); err != errors.ErrVersionMismatch {
+			t.Error("expected ErrVersionMismatch", "got", err)
+		}
+
+		if _, err := s.SetIfVersion(key, []byte("v3"), v2); err != errors.ErrVersionMismatch {
+			t.Error("expected ErrVersionMismatch", "got", err)
+		}
+
+		t.Run("expired key is absent", func(t *testing.T) {
+			if _, err := s.SetIfAbsent([]byte("expiring"), []byte("v1"), WithTTL(10*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(20 * time.Millisecond)
+
+			if _, err := s.SetIfAbsent([]byte("expiring"), []byte("v2")); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("concurrent increments", func(t *testing.T) {
+			counter := []byte("counter")
+			if _, err := s.SetIfAbsent(counter, []byte("0")); err != nil {
+				t.Fatal(err)
+			}
+
+			wg := &sync.WaitGroup{}
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					for j := 0; j < 50; {
+						val, version, err := s.GetVersioned(counter)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						n := utils.StringToInt(string(val)) + 1
+						if _, err := s.SetIfVersion(counter, []byte(utils.IntToString(n)), version); err == errors.ErrVersionMismatch {
+							continue
+						} else if err != nil {
+							t.Error(err)
+							return
+						}
+
+						j++
+					}
+				}()
+			}
+			wg.Wait()
+
+			if val, err := s.Get(counter); err != nil || string(val) != "500" {
+				t.Error("expected", "500", "got", string(val), err)
+			}
+		})
+	})
+}
+
+func TestStorage_Iterator(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		s := open(t, typ, t.TempDir(), config.DefaultConfig())
+		defer s.Close()
+
+		for _, k := range []string{"b", "a", "ab", "abc", "b\xff", "ba", "c", "d", "e"} {
+			if err := s.Set([]byte(k), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Set([]byte(k), []byte("val-"+k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Delete([]byte("d")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("bb"), []byte("val-bb"), WithTTL(time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+
+		testCases := []struct {
+			name     string
+			opts     IterOptions
+			expected []string
+		}{
+			{
+				name:     "all",
+				expected: []string{"a", "ab", "abc", "b", "ba", "b\xff", "c", "e"},
+			},
+			{
+				name:     "range",
+				opts:     IterOptions{Start: []byte("ab"), End: []byte("c")},
+				expected: []string{"ab", "abc", "b", "ba", "b\xff"},
+			},
+			{
+				name:     "prefix",
+				opts:     IterOptions{Prefix: []byte("b")},
+				expected: []string{"b", "ba", "b\xff"},
+			},
+			{
+				name:     "reverse",
+				opts:     IterOptions{Reverse: true},
+				expected: []string{"e", "c", "b\xff", "ba", "b", "abc", "ab", "a"},
+			},
+			{
+				name:     "reverse range",
+				opts:     IterOptions{Start: []byte("ab"), End: []byte("c"), Reverse: true},
+				expected: []string{"b\xff", "ba", "b", "abc", "ab"},
+			},
+			{
+				name: "empty range",
+				opts: IterOptions{Start: []byte("f")},
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				it, err := s.NewIterator(tc.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer it.Close()
+
+				var keys []string
+				for it.Next() {
+					if string(it.Value()) != "val-"+string(it.Key()) {
+						t.Error("expected", "val-"+string(it.Key()), "got", string(it.Value()))
+					}
+
+					keys = append(keys, string(it.Key()))
+				}
+
+				if err := it.Err(); err != nil {
+					t.Fatal(err)
+				}
+
+				if strings.Join(keys, ",") != strings.Join(tc.expected, ",") {
+					t.Error("expected", tc.expected, "got", keys)
+				}
+			})
+		}
+
+		t.Run("seek", func(t *testing.T) {
+			it, err := s.NewIterator(IterOptions{Start: []byte("ab"), End: []byte("c")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+
+			if !it.Seek([]byte("abd")) || string(it.Key()) != "b" {
+				t.Error("expected", "b", "got", string(it.Key()))
+			}
+
+			if !it.Next() || string(it.Key()) != "ba" {
+				t.Error("expected", "ba", "got", string(it.Key()))
+			}
+
+			if it.Seek([]byte("c")) {
+				t.Error("expected no key beyond the range, got", string(it.Key()))
+			}
+
+			rit, err := s.NewIterator(IterOptions{End: []byte("c"), Reverse: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rit.Close()
+
+			if !rit.Seek([]byte("bz")) || string(rit.Key()) != "ba" {
+				t.Error("expected", "ba", "got", string(rit.Key()))
+			}
+		})
+	})
+}
+
+func TestStorage_Batch(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		dir := t.TempDir()
+
+		s := open(t, typ, dir, config.DefaultConfig())
+		if err := s.Set([]byte("before"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := s.NewBatch()
+		for i := 0; i < 10; i++ {
+			b.Put([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i)))
+		}
+		b.Delete([]byte("before"))
+
+		if b.Len() != 11 {
+			t.Error("expected", 11, "got", b.Len())
+		}
+
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Len() != 0 {
+			t.Error("expected empty batch after commit, got", b.Len())
+		}
+
+		check := func(t *testing.T, s Storage) {
+			if _, err := s.Get([]byte("before")); err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+
+			for i := 0; i < 10; i++ {
+				val, err := s.Get([]byte("key" + utils.IntToString(i)))
+				if err != nil || string(val) != "val"+utils.IntToString(i) {
+					t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+				}
+			}
+
+			if n, err := s.Len(); err != nil || n != 10 {
+				t.Error("expected", 10, "got", n, err)
+			}
+		}
+
+		check(t, s)
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !persistent(typ) {
+			return
+		}
+
+		s = open(t, typ, dir, config.DefaultConfig())
+		defer s.Close()
+
+		check(t, s)
+	})
+}
+
+func TestStorage_LogicalSnapshot(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		src := open(t, typ, t.TempDir(), config.DefaultConfig())
+		defer src.Close()
+
+		for i := 0; i < 100; i++ {
+			if err := src.Set([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := src.Delete([]byte("key" + utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := src.Set([]byte("expiring"), []byte("val"), WithTTL(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := src.LogicalSnapshot(buf); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := buf.Bytes()
+
+		// The snapshot of one storage type is restored to every other
+		for _, dstTyp := range storageTypes {
+			t.Run("to "+string(dstTyp), func(t *testing.T) {
+				dst := open(t, dstTyp, t.TempDir(), config.DefaultConfig())
+				defer dst.Close()
+
+				if err := dst.Restore(bytes.NewReader(snapshot)); err != nil {
+					t.Fatal(err)
+				}
+
+				if n, err := dst.Len(); err != nil || n != 91 {
+					t.Error("expected", 91, "got", n, err)
+				}
+
+				for i := 0; i < 100; i++ {
+					val, err := dst.Get([]byte("key" + utils.IntToString(i)))
+					if i < 10 && err != errors.ErrKeyNotFound {
+						t.Error("expected ErrKeyNotFound", "got", err)
+					}
+
+					if i >= 10 && (err != nil || string(val) != "val"+utils.IntToString(i)) {
+						t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+					}
+				}
+
+				if ttl, err := dst.TTL([]byte("expiring")); err != nil || ttl <= 0 || ttl > time.Hour {
+					t.Error("expected TTL in (0, 1h] got", ttl, err)
+				}
+			})
+		}
+
+		t.Run("corrupt snapshot", func(t *testing.T) {
+			dst := open(t, typ, t.TempDir(), config.DefaultConfig())
+			defer dst.Close()
+
+			data := append([]byte{}, snapshot...)
+			data[len(data)/2] ^= 1
+
+			if err := dst.Restore(bytes.NewReader(data)); !stderrors.Is(err, logical.ErrCorruptSnapshot) {
+				t.Error("expected ErrCorruptSnapshot", "got", err)
+			}
+
+			if n, err := dst.Len(); err != nil || n != 0 {
+				t.Error("expected", 0, "got", n, err)
+			}
+		})
+	})
+}
+
+func TestStorage_Context(t *testing.T) {
+	forEachType(t, func(t *testing.T, typ StorageType) {
+		s := open(t, typ, t.TempDir(), config.DefaultConfig())
+		defer s.Close()
+
+		cs, ok := s.(ContextStorage)
+		if !ok {
+			t.Fatal("expected", typ, "to implement ContextStorage")
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := cs.SetContext(context.Background(), []byte("key"+utils.IntToString(i)), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if val, err := cs.GetContext(context.Background(), []byte("key0")); err != nil || string(val) != "val" {
+			t.Error("expected", "val", "got", string(val), err)
+		}
+
+		t.Run("canceled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			if _, err := cs.GetContext(ctx, []byte("key0")); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if err := cs.SetContext(ctx, []byte("canceled"), []byte("val")); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if ok, err := s.Exists([]byte("canceled")); err != nil || ok {
+				t.Error("expected the canceled write to be skipped", "got", ok, err)
+			}
+
+			if err := cs.DeleteContext(ctx, []byte("key0")); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if _, err := cs.LenContext(ctx); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if _, err := cs.NewIteratorContext(ctx, IterOptions{}); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if err := cs.PhysicalSnapshotContext(ctx, &bytes.Buffer{}); !stderrors.Is(err, context.Canceled) {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if err := cs.LogicalSnapshotContext(ctx, &bytes.Buffer{}); !stderrors.Is(err, context.Canceled) {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			b := s.NewBatch()
+			b.Put([]byte("batched"), []byte("val"))
+			if err := b.CommitContext(ctx); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if err := s.(Compactor).CompactContext(ctx); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if n, err := s.Len(); err != nil || n != 10 {
+				t.Error("expected", 10, "got", n, err)
+			}
+		})
+
+		t.Run("deadline", func(t *testing.T) {
+			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			defer cancel()
+
+			if _, err := cs.GetContext(ctx, []byte("key0")); err != context.DeadlineExceeded {
+				t.Error("expected context.DeadlineExceeded", "got", err)
+			}
+		})
+
+		t.Run("iterator", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			it, err := cs.NewIteratorContext(ctx, IterOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+
+			if !it.Next() {
+				t.Fatal("expected a key", "got", it.Err())
+			}
+
+			cancel()
+
+			if it.Next() {
+				t.Error("expected the iterator to stop", "got", string(it.Key()))
+			}
+
+			if err := it.Err(); err != context.Canceled {
+				t.Error("expected context.Canceled", "got", err)
+			}
+		})
+
+		t.Run("snapshot", func(t *testing.T) {
+			// The snapshot takes more than a write
+			for i := 0; i < 10; i++ {
+				if err := s.Set([]byte("large"+utils.IntToString(i)), make([]byte, 64<<10)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			// The snapshot is aborted as soon as it starts writing
+			w := &cancelWriter{cancel: cancel}
+			if err := cs.PhysicalSnapshotContext(ctx, w); !stderrors.Is(err, context.Canceled) {
+				t.Error("expected context.Canceled", "got", err)
+			}
+
+			if w.writes != 1 {
+				t.Error("expected", 1, "write", "got", w.writes)
+			}
+
+			// The storage is usable once the snapshot is aborted
+			if err := s.Set([]byte("after"), []byte("val")); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+}
+
+func TestWithContext(t *testing.T) {
+	s := open(t, MemoryStorageType, t.TempDir(), config.DefaultConfig())
+	defer s.Close()
+
+	if cs := WithContext(s); cs != s {
+		t.Error("expected the ContextStorage to be returned as is")
+	}
+
+	// The wrapper hides the context-aware methods of the storage
+	cs := WithContext(struct{ Storage }{s})
+
+	if err := cs.SetContext(context.Background(), []byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := cs.GetContext(context.Background(), []byte("key")); err != nil || string(val) != "val" {
+		t.Error("expected", "val", "got", string(val), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := cs.GetContext(ctx, []byte("key")); err != context.Canceled {
+		t.Error("expected context.Canceled", "got", err)
+	}
+
+	if err := cs.SetContext(ctx, []byte("canceled"), []byte("val")); err != context.Canceled {
+		t.Error("expected context.Canceled", "got", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := cs.PhysicalSnapshotContext(ctx, &cancelWriter{cancel: cancel}); !stderrors.Is(err, context.Canceled) {
+		t.Error("expected context.Canceled", "got", err)
+	}
+}
+
+// cancelWriter is a writer which cancels its context on the first write.
+type cancelWriter struct {
+	cancel context.CancelFunc
+	writes int
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.cancel()
+	return len(p), nil
+}
@@ -0,0 +1,207 @@
+package stupid
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/id"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// ErrSnapshotAsOf is returned when a physical snapshot of a storage
+// opened as of a write is requested, the logical snapshot of such a
+// storage holds the data as of the write.
+var ErrSnapshotAsOf = fmt.Errorf("physical snapshot of a storage opened as of a write isn't supported")
+
+// GetAsOf returns the value the given key had as of the write with the
+// given ID, which is the value of the latest write to the key with an
+// ID <= asOf. The IDs are time ordered, so the ID for a point in time is
+// given by id.Max.
+//
+// The history is read from the log which holds the overwritten and the
+// deleted values only till they are compacted. The value as of a write
+// older than the latest write merged by a compaction is reported as
+// errors.ErrHistoryCompacted unless the key wasn't written since.
+func (s *Storage) GetAsOf(key []byte, asOf uint64) ([]byte, error) {
+	return s.GetAsOfContext(context.Background(), key, asOf)
+}
+
+// GetAsOfContext returns the value the given key had as of the write with
+// the given ID like GetAsOf, the log stops being replayed once the given
+// context is done.
+func (s *Storage) GetAsOfContext(ctx context.Context, key []byte, asOf uint64) ([]byte, error) {
+	if !s.isInit() {
+		return nil, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The writes ignored by the storage are out of reach
+	if s.cfg.AsOf > 0 && asOf > s.cfg.AsOf {
+		asOf = s.cfg.AsOf
+	}
+
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	// The latest write to the key is the one as of the given ID
+	// unless it was made later, in which case the log is replayed.
+	e, ok := s.kd.get(key)
+	if !ok || e.id > asOf {
+		if asOf < s.horizon.Load() {
+			return nil, errors.ErrHistoryCompacted
+		}
+
+		ok = false
+		if err := s.replay(ctx, asOf, func(p *Packet) error {
+			if bytes.Equal(p.Key, key) {
+				e, ok = entry(p), p.Op == SetOp
+			}
+
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// The value had expired by then
+	if !ok || (e.exp != 0 && e.exp <= id.Time(asOf).UnixMilli()) {
+		return nil, errors.ErrKeyNotFound
+	}
+
+	return s.read(e)
+}
+
+// History returns the writes to the given key from the latest to the
+// oldest, skipping the given number of the latest writes and returning at
+// most limit writes, limit <= 0 returns all of them. The value of a write
+// is returned by GetAsOf with the ID of the write.
+//
+// The history is read from the log which holds the overwritten and the
+// deleted values only till they are compacted, the compacted writes are
+// missing from the history. So the history older than the latest write
+// merged by a compaction may be incomplete, see GetAsOf.
+func (s *Storage) History(key []byte, limit, offset int) ([]types.Revision, error) {
+	return s.HistoryContext(context.Background(), key, limit, offset)
+}
+
+// HistoryContext returns the writes to the given key like History, the
+// log stops being replayed once the given context is done.
+func (s *Storage) HistoryContext(ctx context.Context, key []byte, limit, offset int) ([]types.Revision, error) {
+	if !s.isInit() {
+		return nil, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The writes ignored by the storage are out of reach
+	upto := uint64(math.MaxUint64)
+	if s.cfg.AsOf > 0 {
+		upto = s.cfg.AsOf
+	}
+
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	var revs []types.Revision
+	if err := s.replay(ctx, upto, func(p *Packet) error {
+		if !bytes.Equal(p.Key, key) {
+			return nil
+		}
+
+		rev := types.Revision{
+			ID:      p.ID,
+			Time:    id.Time(p.ID),
+			Deleted: p.Op == DelOp,
+			Size:    int(p.vlen()),
+		}
+		if p.Exp != 0 {
+			rev.Expiry = time.UnixMilli(p.Exp)
+		}
+
+		revs = append(revs, rev)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// The latest writes go first
+	for i, j := 0, len(revs)-1; i < j; i, j = i+1, j-1 {
+		revs[i], revs[j] = revs[j], revs[i]
+	}
+
+	if offset >= len(revs) {
+		return []types.Revision{}, nil
+	}
+
+	if offset > 0 {
+		revs = revs[offset:]
+	}
+
+	if limit > 0 && limit < len(revs) {
+		revs = revs[:limit]
+	}
+
+	return revs, nil
+}
+
+// replay goes through the writes in the log in the order in which they
+// were made and executes the given function on the SetOp and DelOp packets
+// of the writes with IDs <= upto, see replaySegment.
+//
+// replay should be called with the read lock held.
+func (s *Storage) replay(ctx context.Context, upto uint64, fn func(*Packet) error) error {
+	for _, seg := range s.segments {
+		if err := s.replaySegment(ctx, seg, upto, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaySegment goes through the writes in the given segment in the order
+// in which they were made and executes the given function on the SetOp and
+// DelOp packets of the writes with IDs <= upto. A batch is made as of its
+// frame and its packets are visited only if the batch was written completely.
+// The replay stops between the packets once the given context is done.
+//
+// replaySegment should be called with the read lock held.
+func (s *Storage) replaySegment(ctx context.Context, seg *segment, upto uint64, fn func(*Packet) error) error {
+	fr := &framer{}
+
+	return seg.forEachContext(ctx, func(pr *reader, p *Packet, err error) error {
+		var ready []*Packet
+		if err == nil {
+			ready, err = fr.add(pr, p)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+		}
+
+		if len(ready) == 0 || ready[0].ID > upto {
+			return nil
+		}
+
+		for _, p := range ready {
+			if p.Op == BatchOp {
+				continue
+			}
+
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
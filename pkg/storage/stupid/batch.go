@@ -0,0 +1,186 @@
+package stupid
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// BatchOp marks the packet which frames the packets of a batch.
+//
+// The value of a BatchOp packet is the number of packets in the batch,
+// which follow the BatchOp packet. A batch is applied only if all of its
+// packets are found intact.
+var BatchOp = byte(3)
+
+// Batch is a group of writes which are written to the storage as one
+// framed record.
+type Batch struct {
+	s   *Storage
+	ops []*Packet
+
+	// err is the error of the first invalid write added to the batch,
+	// the batch isn't committed if it is set.
+	err error
+}
+
+// NewBatch returns a new empty batch of writes.
+func (s *Storage) NewBatch() types.Batch {
+	return &Batch{s: s}
+}
+
+// Put adds setting the value for the given key to the batch.
+func (b *Batch) Put(key []byte, value []byte, opts ...types.SetOption) {
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+
+		return
+	}
+
+	b.ops = append(b.ops, &Packet{
+		Op:  SetOp,
+		Key: append([]byte{}, key...),
+		Val: append([]byte{}, value...),
+		Exp: expiry(o),
+	})
+}
+
+// Delete adds deleting the value for the given key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, &Packet{
+		Op:  DelOp,
+		Key: append([]byte{}, key...),
+	})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the batch to the storage in one go.
+func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext writes the batch to the storage in one go, none of the
+// writes are applied once the given context is done.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	s := b.s
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	s.wmu.Lock()
+
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		s.wmu.Unlock()
+		return err
+	}
+
+	packets := make([]*Packet, 0, len(b.ops)+1)
+	packets = append(packets, &Packet{
+		ID:  s.idgen.Next(),
+		Op:  BatchOp,
+		Val: binary.LittleEndian.AppendUint32(nil, uint32(len(b.ops))),
+	})
+
+	for _, op := range b.ops {
+		op.ID = s.idgen.Next()
+		packets = append(packets, op)
+	}
+
+	seq, err := s.append(packets...)
+	s.wmu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	b.ops = nil
+	return s.commit(seq)
+}
+
+// framer groups the packets read from a segment into the batches they
+// were written in so that a batch is indexed only once all of its
+// packets are read.
+type framer struct {
+	// hdr is the BatchOp packet of the batch being read, if any.
+	hdr *Packet
+	// n is the number of packets in the batch being read.
+	n int
+	// packets are the packets of the batch read so far.
+	packets []*Packet
+}
+
+// add adds the given packet and returns the packets which are
+// ready to be indexed, if any.
+func (f *framer) add(pr *reader, p *Packet) ([]*Packet, error) {
+	if p.Op == BatchOp {
+		// Batches don't nest
+		if f.hdr != nil {
+			return nil, ErrCorruptPacket
+		}
+
+		if err := pr.fill(p); err != nil {
+			return nil, err
+		}
+
+		if len(p.Val) != 4 {
+			return nil, ErrCorruptPacket
+		}
+
+		f.hdr, f.n = p, int(binary.LittleEndian.Uint32(p.Val))
+		if f.n == 0 {
+			return f.flush(), nil
+		}
+
+		return nil, nil
+	}
+
+	if f.hdr == nil {
+		return []*Packet{p}, nil
+	}
+
+	f.packets = append(f.packets, p)
+	if len(f.packets) < f.n {
+		return nil, nil
+	}
+
+	return f.flush(), nil
+}
+
+// flush returns the packets of the complete batch.
+func (f *framer) flush() []*Packet {
+	packets := append([]*Packet{f.hdr}, f.packets...)
+	f.hdr, f.n, f.packets = nil, 0, nil
+
+	return packets
+}
+
+// pending returns true if a batch has been read partially.
+func (f *framer) pending() bool {
+	return f.hdr != nil
+}
@@ -1,11 +1,52 @@
 package stupid
 
-import "sync"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/structures/bloom/dibf"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+const (
+	// BloomTypeTLV is the type of the bloom filter file TLV.
+	BloomTypeTLV = byte(9)
+
+	// bfFile is the name of the file the bloom filter is saved to.
+	bfFile = "stupid.bf"
+
+	// filterMinCap is the minimum number of items a bloom filter
+	// is sized for.
+	filterMinCap = 1e6
+
+	// filterDefaultFPR is the false positive rate of the bloom filter
+	// when the regeneration is disabled.
+	filterDefaultFPR = 0.01
+
+	// filterCheckInterval is the interval at which the bloom filter
+	// is checked for regeneration.
+	filterCheckInterval = 10 * time.Second
+)
+
+// ErrCorruptFilter is returned when the saved bloom filter doesn't
+// match its checksum or is malformed.
+var ErrCorruptFilter = fmt.Errorf("bloom filter file is corrupted")
 
 type bf interface {
 	Add([]byte)
 	Contains([]byte) bool
 	Delete([]byte)
+	MarshalBinary() ([]byte, error)
+	CurrentFalsePositiveRate() float64
+	ApproximateCount() int
 }
 
 type bfsync struct {
@@ -20,6 +61,16 @@ func newBfSync(bf bf) *bfsync {
 	}
 }
 
+// newFilter returns a new empty bloom filter sized for the given
+// number of items and the given false positive rate.
+func newFilter(n int, e float64) *bfsync {
+	if e <= 0 {
+		e = filterDefaultFPR
+	}
+
+	return newBfSync(dibf.NewWithEstimates(uint(utils.Max(n, filterMinCap)), e, 1, nil))
+}
+
 func (b *bfsync) Add(item []byte) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -37,3 +88,164 @@ func (b *bfsync) Delete(item []byte) {
 	defer b.mu.Unlock()
 	b.bf.Delete(item)
 }
+
+func (b *bfsync) MarshalBinary() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bf.MarshalBinary()
+}
+
+func (b *bfsync) CurrentFalsePositiveRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bf.CurrentFalsePositiveRate()
+}
+
+func (b *bfsync) ApproximateCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bf.ApproximateCount()
+}
+
+// saveFilter saves the given bloom filter to the given directory along
+// with the ID of the last packet the filter has seen.
+//
+// The filter is written to a temporary file first so that a valid
+// filter is never replaced by a partially written one.
+func saveFilter(dir string, f bf, lastID uint64) error {
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error encoding bloom filter: %w", err)
+	}
+
+	val := make([]byte, 0, 8+len(data))
+	val = binary.LittleEndian.AppendUint64(val, lastID)
+	val = append(val, data...)
+
+	buf := bytes.NewBuffer(make([]byte, 0, tlvrw.Size(uint32(len(val)))+tlvrw.Size(4)))
+	tw := tlvrw.NewWriter(buf)
+
+	// Writes to a buffer never fail
+	tw.Write(tlvrw.NewTLV(BloomTypeTLV, val))
+	tw.Write(tlvrw.NewTLV(CrcTypeTLV, binary.LittleEndian.AppendUint32(nil, crc32.Checksum(val, crcTable))))
+
+	path := filepath.Join(dir, bfFile)
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0666); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error writing bloom filter file: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error installing bloom filter file: %w", err)
+	}
+
+	return nil
+}
+
+// loadFilter loads the bloom filter saved in the given directory and
+// returns it along with the ID of the last packet the filter has seen.
+func loadFilter(dir string) (*bfsync, uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, bfFile))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tr := tlvrw.NewReader(bytes.NewReader(data))
+
+	val := tlvrw.NewTLV(BloomTypeTLV, nil)
+	if err := tr.ReadLazy(val); err != nil || val.Typ != BloomTypeTLV || val.Len < 8 ||
+		tlvrw.Size(val.Len)+tlvrw.Size(4) != int64(len(data)) {
+		return nil, 0, ErrCorruptFilter
+	}
+
+	if err := tr.Fill(val); err != nil {
+		return nil, 0, ErrCorruptFilter
+	}
+
+	crc := tlvrw.NewTLV(CrcTypeTLV, nil)
+	if err := tr.Read(crc); err != nil || crc.Typ != CrcTypeTLV || crc.Len != 4 {
+		return nil, 0, ErrCorruptFilter
+	}
+
+	if binary.LittleEndian.Uint32(crc.Val) != crc32.Checksum(val.Val, crcTable) {
+		return nil, 0, ErrCorruptFilter
+	}
+
+	f := dibf.New(1, 1, 1, nil)
+	if err := f.UnmarshalBinary(val.Val[8:]); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", ErrCorruptFilter, err)
+	}
+
+	return newBfSync(f), binary.LittleEndian.Uint64(val.Val[:8]), nil
+}
+
+// filter returns the current bloom filter of the storage.
+func (s *Storage) filter() *bfsync {
+	return s.bf.Load()
+}
+
+// watchFilter periodically checks whether the bloom filter needs to be
+// regenerated till the storage is closed.
+func (s *Storage) watchFilter(done <-chan struct{}) {
+	ticker := time.NewTicker(filterCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.maybeRegenerateFilter()
+		}
+	}
+}
+
+// maybeRegenerateFilter regenerates the bloom filter if it isn't
+// useful anymore and returns true if it did.
+//
+// The filter isn't useful once its false positive rate is more than
+// twice the configured rate, which happens when the storage outgrows
+// the filter. Or when the filter holds more than twice the number of
+// live keys, which happens when the deletes collide with the dirty
+// regions of the filter and leave their bits set.
+func (s *Storage) maybeRegenerateFilter() bool {
+	if s.cfg.FilterFalsePositiveRate <= 0 {
+		return false
+	}
+
+	f, live := s.filter(), s.kd.len()
+	if f.CurrentFalsePositiveRate() <= 2*s.cfg.FilterFalsePositiveRate &&
+		f.ApproximateCount() <= 2*utils.Max(live, filterMinCap/100) {
+		return false
+	}
+
+	log.Infoln("Regenerating the bloom filter, live keys: ", live)
+	s.regenerateFilter()
+
+	return true
+}
+
+// regenerateFilter replaces the bloom filter with a new filter sized
+// for twice the number of live keys.
+//
+// Reads keep using the old filter till the new one is complete.
+func (s *Storage) regenerateFilter() {
+	// Writes made while the new filter is being populated are
+	// recorded in both the filters, see append.
+	s.wmu.Lock()
+	f := newFilter(2*s.kd.len(), s.cfg.FilterFalsePositiveRate)
+	s.pending = f
+	s.wmu.Unlock()
+
+	// A key deleted after the snapshot may end up in the new filter,
+	// which is a false positive at worst.
+	for k := range s.kd.snapshot() {
+		f.Add([]byte(k))
+	}
+
+	s.wmu.Lock()
+	s.bf.Store(f)
+	s.pending = nil
+	s.wmu.Unlock()
+}
@@ -0,0 +1,192 @@
+package stupid
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/utkarsh-pro/use/pkg/storage/config"
+)
+
+// syncFile fsyncs the given file, the tests replace it to make the
+// fsyncs fail.
+var syncFile = (*os.File).Sync
+
+// groupCommit batches the fsyncs of the concurrent writers so that a
+// single fsync makes the packets of all of them durable.
+//
+// The writer which finds no fsync in progress leads the next one, the
+// writers which arrive while it is in progress wait for it and lead or
+// join the following one if it didn't cover their packets.
+type groupCommit struct {
+	mu *sync.Mutex
+	// synced is the sequence number of the latest durable write.
+	synced uint64
+	// advanced is closed and replaced whenever synced advances.
+	advanced chan struct{}
+	// cur is the fsync in progress, if any.
+	cur *syncRound
+}
+
+// syncRound is a single fsync shared by a group of writers.
+type syncRound struct {
+	// seq is the sequence number of the latest write covered by the fsync.
+	seq uint64
+	// err is the error returned by the fsync.
+	err error
+	// done is closed once the fsync is over.
+	done chan struct{}
+}
+
+// newGroupCommit returns a new groupCommit instance.
+func newGroupCommit() *groupCommit {
+	return &groupCommit{mu: &sync.Mutex{}, advanced: make(chan struct{})}
+}
+
+// wait blocks until the write with the given sequence number is durable.
+//
+// sync is called to fsync the writes, it returns the sequence number of
+// the latest write covered by the fsync.
+func (g *groupCommit) wait(seq uint64, sync func() (uint64, error)) error {
+	for {
+		g.mu.Lock()
+		if g.synced >= seq {
+			g.mu.Unlock()
+			return nil
+		}
+
+		if r := g.cur; r != nil {
+			g.mu.Unlock()
+
+			<-r.done
+			if r.seq >= seq {
+				return r.err
+			}
+
+			continue
+		}
+
+		r := &syncRound{done: make(chan struct{})}
+		g.cur = r
+		g.mu.Unlock()
+
+		r.seq, r.err = sync()
+
+		g.mu.Lock()
+		if r.err == nil && r.seq > g.synced {
+			g.synced = r.seq
+
+			close(g.advanced)
+			g.advanced = make(chan struct{})
+		}
+		g.cur = nil
+		g.mu.Unlock()
+
+		close(r.done)
+
+		// The write happened before the fsync started so it is covered
+		return r.err
+	}
+}
+
+// durable returns true if the write with the given sequence number is
+// durable, otherwise it returns a channel which is closed once synced
+// advances.
+func (g *groupCommit) durable(seq uint64) (bool, <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.synced >= seq {
+		return true, nil
+	}
+
+	return false, g.advanced
+}
+
+// commit waits for the write with the given sequence number to be
+// durable if the storage is configured to sync every write.
+func (s *Storage) commit(seq uint64) error {
+	if s.cfg.Sync != config.SyncTypeSync {
+		return nil
+	}
+
+	return s.gc.wait(seq, s.syncActive)
+}
+
+// waitCommitted blocks until the write with the given sequence number
+// is committed or done is closed, it returns false in the latter case.
+//
+// The write is committed once it is durable if the storage is configured
+// to sync every write, the writes whose fsync failed aren't committed till
+// a later fsync covers them.
+func (s *Storage) waitCommitted(seq uint64, done <-chan struct{}) bool {
+	if s.cfg.Sync != config.SyncTypeSync {
+		return true
+	}
+
+	for {
+		ok, advanced := s.gc.durable(seq)
+		if ok {
+			return true
+		}
+
+		select {
+		case <-advanced:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// syncActive fsyncs the active segment and returns the sequence number
+// of the latest write covered by the fsync.
+func (s *Storage) syncActive() (uint64, error) {
+	s.wmu.Lock()
+
+	// Close syncs the active segment before closing it
+	if s.wfd == nil {
+		defer s.wmu.Unlock()
+		return s.seq, nil
+	}
+	wfd, retired, m := s.wfd, s.retired, s.mark()
+
+	// The read lock keeps the rollover from closing wfd during the fsync,
+	// the rollover syncs the segment itself before closing it and retires
+	// it instead if the fsync fails.
+	s.rmu.RLock()
+	s.wmu.Unlock()
+
+	err := syncFiles(retired, wfd)
+	s.rmu.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(retired) > 0 {
+		s.wmu.Lock()
+		s.rmu.Lock()
+		s.dropRetired(len(retired))
+		s.rmu.Unlock()
+		s.wmu.Unlock()
+	}
+	s.markDurable(m)
+
+	return m.seq, nil
+}
+
+// syncFiles fsyncs the retired file descriptors and then the active
+// segment, the writes on wfd aren't durable till the ones before them are.
+func syncFiles(retired []*os.File, wfd *os.File) error {
+	for _, fd := range retired {
+		if err := syncFile(fd); err != nil {
+			return fmt.Errorf("error syncing retired file: %w", err)
+		}
+	}
+
+	if err := syncFile(wfd); err != nil {
+		return fmt.Errorf("error syncing file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,383 @@
+package stupid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+)
+
+const (
+	// compactionMinGarbage is the minimum number of garbage bytes that
+	// should be present in the store before it is compacted automatically.
+	compactionMinGarbage = 1 << 20 // 1MB
+
+	// compactFile is the name of the file the live packets are copied
+	// to during the compaction.
+	compactFile = "stupid.compact"
+
+	// mergeExt is the extension of a compaction file which is complete
+	// but hasn't replaced the segments it was generated from yet.
+	mergeExt = ".merge"
+)
+
+// Compact merges all the immutable segments of the store into a single
+// segment which holds only the live packets.
+//
+// The active segment is rolled over before the compaction so that all
+// the data written till now is compacted. Reads and writes are served
+// while the compaction is in progress and are blocked only for the
+// duration of the swap.
+func (s *Storage) Compact() error {
+	return s.CompactContext(context.Background())
+}
+
+// CompactContext merges the immutable segments of the store like Compact,
+// the live packets stop being copied once the given context is done and
+// the segments are left as they were.
+func (s *Storage) CompactContext(ctx context.Context) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !s.cmu.TryLock() {
+		return errors.ErrCompactionInProgress
+	}
+	defer s.cmu.Unlock()
+
+	return s.compact(ctx)
+}
+
+// maybeCompact starts a compaction in the background if the garbage
+// in the store has crossed the configured ratio.
+//
+// maybeCompact should be called with the write lock held.
+func (s *Storage) maybeCompact() {
+	if s.cfg.CompactionRatio <= 0 {
+		return
+	}
+
+	garbage, size := int64(0), int64(0)
+	for _, seg := range s.segments {
+		garbage += seg.garbage
+		size += seg.size.Load()
+	}
+
+	if garbage < compactionMinGarbage || float64(garbage)/float64(size) < s.cfg.CompactionRatio {
+		return
+	}
+
+	// Some other compaction is already in progress
+	if !s.cmu.TryLock() {
+		return
+	}
+
+	go func() {
+		defer s.cmu.Unlock()
+
+		if err := s.compact(context.Background()); err != nil {
+			log.Errorln("failed to compact the store: ", err)
+		}
+	}()
+}
+
+// compact does the actual compaction, it should be called with the
+// compaction lock held. The compaction stops before the merge file is
+// committed once the given context is done.
+//
+// The compaction happens in three phases:
+//  1. Live packets of the immutable segments are copied to a new file
+//     without blocking the reads and the writes.
+//  2. The new file is committed by renaming it to a merge file. From
+//     here on the compaction survives crashes, see recoverCompaction.
+//  3. The reads and writes are blocked and the merge file replaces the
+//     segments it was generated from.
+func (s *Storage) compact(ctx context.Context) error {
+	s.wmu.Lock()
+	// The active segment is left alone unless it holds packets beyond
+	// its header, an empty segment would be rolled over for nothing.
+	if active := s.active(); active.size.Load() > active.hdr.size() {
+		if err := s.rollover(); err != nil {
+			s.wmu.Unlock()
+			return fmt.Errorf("error rolling over the active segment: %w", err)
+		}
+	}
+
+	// Every write up to the latest one is in the merging segments
+	horizon := s.lastID
+	merging := append([]*segment{}, s.segments[:len(s.segments)-1]...)
+	byID := make(map[uint64]*segment, len(merging))
+	garbage := make(map[uint64]int64, len(merging))
+	for _, seg := range merging {
+		byID[seg.id] = seg
+		garbage[seg.id] = seg.garbage
+	}
+	entries := s.kd.snapshot()
+	s.wmu.Unlock()
+
+	if len(merging) == 0 {
+		return nil
+	}
+
+	log.Infoln("Compacting the store, segments: ", len(merging))
+
+	// The merged segment takes the place of the newest merged segment
+	// so that the order of the segments is preserved.
+	mergeID := merging[len(merging)-1].id
+
+	// Copy the live packets in the order in which they appear in the
+	// store so that the relative order of the packets is preserved.
+	// The expired packets are dropped, the older packets of their keys
+	// are being merged as well so they can't resurface.
+	keys := make([]string, 0, len(entries))
+	for k, e := range entries {
+		if e.seg > mergeID {
+			continue
+		}
+
+		if expired(e.exp) {
+			delete(entries, k)
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := entries[keys[i]], entries[keys[j]]
+		if a.seg != b.seg {
+			return a.seg < b.seg
+		}
+
+		return a.pos < b.pos
+	})
+
+	tmpfile := filepath.Join(s.dir, compactFile)
+	tmp, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("error creating compaction file: %w", err)
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpfile)
+		}
+	}()
+
+	hdr := newHeader()
+	if _, err := tmp.Write(hdr.encode()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing compaction file header: %w", err)
+	}
+
+	pos := hdr.size()
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			tmp.Close()
+			return err
+		}
+
+		e := entries[k]
+
+		// Only the compaction swaps the segments, so it is safe to use
+		// them without holding the read lock.
+		src := io.NewSectionReader(byID[e.seg].rfd, e.pos, e.size())
+		if _, err := io.Copy(tmp, src); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error copying packet: %w", err)
+		}
+
+		entries[k] = e.moved(mergeID, pos)
+		pos += e.size()
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing compaction file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing compaction file: %w", err)
+	}
+
+	// The horizon goes first so that it never falls behind the merged
+	// segment, the history up to it is lost once the merge is committed.
+	if horizon > s.horizon.Load() {
+		if err := saveHorizon(s.dir, horizon); err != nil {
+			return err
+		}
+		s.horizon.Store(horizon)
+	}
+
+	mergefile := segmentPath(s.dir, mergeID) + mergeExt
+	if err := os.Rename(tmpfile, mergefile); err != nil {
+		return fmt.Errorf("error committing compaction file: %w", err)
+	}
+	committed = true
+
+	if err := syncDir(s.dir); err != nil {
+		log.Warnln("failed to sync the storage directory: ", err)
+	}
+
+	merged, err := openSegment(mergefile, mergeID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.install(merged, merging, garbage, entries); err != nil {
+		return err
+	}
+
+	// The hint saves a scan of the merged segment on the next startup
+	h := &hint{ctime: hdr.ctime, size: pos}
+	for _, k := range keys {
+		h.entries = append(h.entries, hintEntry{op: SetOp, key: []byte(k), e: entries[k]})
+	}
+	if err := writeHint(s.dir, mergeID, h); err != nil {
+		log.Warnln("failed to write the hint of the merged segment: ", err)
+	} else {
+		s.wmu.Lock()
+		merged.hinted = h.size
+		s.wmu.Unlock()
+	}
+
+	log.Infoln("Successfully compacted the store, merged segment size: ", pos)
+	return nil
+}
+
+// install replaces the merging segments by the merged segment and
+// points the keydir to the new locations of the merged packets.
+//
+// garbage holds the garbage of the merging segments at the time the
+// compaction started.
+func (s *Storage) install(merged *segment, merging []*segment, garbage map[uint64]int64, entries map[string]keydirEntry) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	if err := installMerge(s.dir, merged.id); err != nil {
+		merged.close()
+		return err
+	}
+	merged.path = segmentPath(s.dir, merged.id)
+
+	// Only the garbage generated during the compaction is left
+	for _, seg := range merging {
+		merged.garbage += seg.garbage - garbage[seg.id]
+
+		if err := seg.close(); err != nil {
+			log.Warnln("failed to close merged segment: ", err)
+		}
+	}
+
+	s.segments = append([]*segment{merged}, s.segments[len(merging):]...)
+
+	// Point the keydir to the new locations of the packets, the packets
+	// written during the compaction are in the newer segments. The keys
+	// missing from the merged entries had expired and were dropped.
+	s.kd.remap(func(key string, e keydirEntry) (keydirEntry, bool) {
+		if e.seg <= merged.id {
+			ne, ok := entries[key]
+			return ne, ok
+		}
+
+		return e, true
+	})
+
+	return nil
+}
+
+// recoverCompaction completes the compaction which was committed but
+// couldn't replace the merged segments and discards the compaction which
+// wasn't committed.
+func recoverCompaction(dir string) error {
+	if err := os.Remove(filepath.Join(dir, compactFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale compaction file: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading storage directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentExt+mergeExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentExt+mergeExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		log.Infoln("Found committed compaction, installing it...")
+
+		if err := installMerge(dir, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installMerge replaces the segments with IDs <= id by the merge file
+// of the segment with the given ID.
+//
+// installMerge is idempotent so that it can be retried if interrupted.
+func installMerge(dir string, id uint64) error {
+	paths, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for segid, path := range paths {
+		if segid > id {
+			continue
+		}
+
+		// The hint goes first so that it never outlives its segment
+		if err := os.Remove(hintPath(dir, segid)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing hint of merged segment: %w", err)
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing merged segment: %w", err)
+		}
+	}
+
+	if err := os.Rename(segmentPath(dir, id)+mergeExt, segmentPath(dir, id)); err != nil {
+		return fmt.Errorf("error installing merged segment: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir fsyncs the given directory so that the renames
+// in the directory are persisted.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return fd.Sync()
+}
@@ -0,0 +1,104 @@
+package stupid
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// sweepInterval is the interval at which the expired keys are
+// removed from the in-memory indexes.
+const sweepInterval = 10 * time.Second
+
+// expiry returns the expiry time of a packet written now with the
+// given options, 0 if the packet never expires.
+func expiry(o types.SetOptions) int64 {
+	if o.TTL <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(o.TTL).UnixMilli()
+}
+
+// ensureExpirySegment rolls over the active segment unless it may hold
+// the packets with expiry.
+//
+// The segments written before the expiry was introduced are read by the
+// older versions of the storage which don't understand the expiry, so the
+// packets with expiry go to a new segment.
+//
+// ensureExpirySegment should be called with the write lock held.
+func (s *Storage) ensureExpirySegment() error {
+	if s.active().hdr.expiry() {
+		return nil
+	}
+
+	if err := s.rollover(); err != nil {
+		return fmt.Errorf("error rolling over the active segment: %w", err)
+	}
+
+	return nil
+}
+
+// sweepExpired removes the expired keys periodically till
+// done is closed.
+func (s *Storage) sweepExpired(done <-chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes the expired keys from the in-memory indexes and counts
+// their packets as garbage so that the compaction reclaims them.
+//
+// No tombstones are written for the expired keys, their packets are
+// found expired once again if the storage is reopened before the
+// compaction drops them.
+func (s *Storage) sweep() {
+	// The compaction drops the expired keys itself, racing with it would
+	// count the dropped packets as garbage of the merged segment.
+	if !s.cmu.TryLock() {
+		return
+	}
+
+	s.wmu.Lock()
+	n := 0
+	for _, k := range s.kd.expired() {
+		e, ok := s.kd.get([]byte(k))
+		if !ok || !expired(e.exp) {
+			continue
+		}
+
+		s.kd.delete([]byte(k))
+		s.segment(e.seg).garbage += e.size()
+
+		for _, f := range []*bfsync{s.filter(), s.pending} {
+			if f != nil {
+				f.Delete([]byte(k))
+			}
+		}
+		n++
+	}
+	s.wmu.Unlock()
+	s.cmu.Unlock()
+
+	if n == 0 {
+		return
+	}
+
+	log.Debugf("Swept %d expired keys", n)
+
+	s.wmu.Lock()
+	s.maybeCompact()
+	s.wmu.Unlock()
+}
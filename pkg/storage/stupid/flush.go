@@ -0,0 +1,124 @@
+package stupid
+
+import (
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+)
+
+// Position is the location in the storage right after a write.
+type Position struct {
+	// Segment is the ID of the segment the write went to.
+	Segment uint64
+	// Offset is the offset in the segment right after the write.
+	Offset int64
+}
+
+// mark is the state of the writes at some point in time.
+type mark struct {
+	// seq is the sequence number of the latest write.
+	seq uint64
+	// written is the number of bytes written since the storage was created.
+	written int64
+	// pos is the position right after the latest write.
+	pos Position
+}
+
+// mark returns the state of the writes, it should be called
+// with the write lock held.
+func (s *Storage) mark() *mark {
+	active := s.active()
+
+	return &mark{
+		seq:     s.seq,
+		written: s.written,
+		pos:     Position{Segment: active.id, Offset: active.size.Load()},
+	}
+}
+
+// markDurable records that the writes till the given mark are durable.
+func (s *Storage) markDurable(m *mark) {
+	for {
+		cur := s.durable.Load()
+		if cur != nil && cur.written > m.written {
+			return
+		}
+
+		if s.durable.CompareAndSwap(cur, m) {
+			return
+		}
+	}
+}
+
+// Durable returns the position till which the writes are known to be
+// durable, a crash can lose only the writes after it.
+//
+// The position is in the segment which was active at the time of the
+// latest sync, so it can point to a segment merged by a compaction since.
+func (s *Storage) Durable() Position {
+	if m := s.durable.Load(); m != nil {
+		return m.pos
+	}
+
+	return Position{}
+}
+
+// unsynced returns the number of bytes written which may not be durable
+// yet, it should be called with the write lock held.
+func (s *Storage) unsynced() int64 {
+	if m := s.durable.Load(); m != nil {
+		return s.written - m.written
+	}
+
+	return s.written
+}
+
+// flushAsync syncs the active segment periodically and whenever the
+// unsynced writes cross the configured threshold till done is closed.
+//
+// flushAsync is the only goroutine which syncs the writes in async mode
+// so that the number of concurrent fsyncs is bounded.
+func (s *Storage) flushAsync(done <-chan struct{}) {
+	var tick <-chan time.Time
+	if s.cfg.SyncInterval > 0 {
+		ticker := time.NewTicker(s.cfg.SyncInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+		case <-s.flush:
+		}
+
+		s.wmu.Lock()
+		pending := s.unsynced()
+		s.wmu.Unlock()
+
+		if pending == 0 {
+			continue
+		}
+
+		if _, err := s.syncActive(); err != nil {
+			log.Warnln("failed to sync the active segment: ", err)
+		}
+	}
+}
+
+// maybeFlush wakes up the flusher if the unsynced writes have crossed
+// the configured threshold, it should be called with the write lock held.
+func (s *Storage) maybeFlush() {
+	if s.cfg.SyncBytes <= 0 || s.unsynced() < s.cfg.SyncBytes {
+		return
+	}
+
+	// The flusher is already awake otherwise
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+}
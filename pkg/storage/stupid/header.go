@@ -0,0 +1,168 @@
+package stupid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	gconfig "github.com/utkarsh-pro/use/pkg/config"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+const (
+	// HdrTypeTLV is the type of the header TLV.
+	HdrTypeTLV = byte(6)
+
+	// FormatVersion is the current version of the segment file format.
+	//
+	// Version 0 is the format without any header, version 1 introduced
+	// the header and made the packet checksums mandatory.
+	FormatVersion = uint16(1)
+
+	// OptChecksums indicates that every packet in the segment
+	// has a checksum.
+	OptChecksums = uint32(1 << 0)
+
+	// OptExpiry indicates that the packets in the segment may
+	// have an expiry.
+	OptExpiry = uint32(1 << 1)
+
+	// supportedOpts are the options understood by this version
+	// of the storage.
+	supportedOpts = OptChecksums | OptExpiry
+
+	// hdrLen is the length of the header TLV value.
+	hdrLen = 5 + // magic
+		2 + // version
+		8 + // creation time
+		2 + // worker ID
+		4 // options
+)
+
+var (
+	// ErrUnknownFormat is returned when a segment file isn't
+	// recognized as a stupid data file.
+	ErrUnknownFormat = fmt.Errorf("unknown data file format")
+
+	// ErrUnsupportedFormat is returned when a segment file was written
+	// by a newer version of the storage.
+	ErrUnsupportedFormat = fmt.Errorf("unsupported data file format")
+
+	// magic are the bytes that every segment file starts with.
+	magic = []byte("USEDB")
+)
+
+// header is the header of a segment file.
+type header struct {
+	// version is the version of the segment file format.
+	version uint16
+	// ctime is the creation time of the segment in unix milliseconds.
+	ctime int64
+	// workerID is the ID of the worker that created the segment.
+	workerID uint16
+	// options are the options the segment was written with.
+	options uint32
+}
+
+// newHeader returns the header for a segment created now.
+func newHeader() *header {
+	return &header{
+		version:  FormatVersion,
+		ctime:    time.Now().UnixMilli(),
+		workerID: uint16(gconfig.WorkerID),
+		options:  OptChecksums | OptExpiry,
+	}
+}
+
+// checksums returns true if every packet of the segment has
+// a checksum.
+func (h *header) checksums() bool {
+	return h != nil && h.options&OptChecksums != 0
+}
+
+// expiry returns true if the packets of the segment may have
+// an expiry.
+func (h *header) expiry() bool {
+	return h != nil && h.options&OptExpiry != 0
+}
+
+// size returns the size of the encoded header, the size of a
+// missing header is 0.
+func (h *header) size() int64 {
+	if h == nil {
+		return 0
+	}
+
+	return tlvrw.Size(hdrLen)
+}
+
+// encode returns the header encoded as a TLV.
+func (h *header) encode() []byte {
+	val := make([]byte, 0, hdrLen)
+	val = append(val, magic...)
+	val = binary.LittleEndian.AppendUint16(val, h.version)
+	val = binary.LittleEndian.AppendUint64(val, uint64(h.ctime))
+	val = binary.LittleEndian.AppendUint16(val, h.workerID)
+	val = binary.LittleEndian.AppendUint32(val, h.options)
+
+	buf := bytes.NewBuffer(make([]byte, 0, h.size()))
+	// Writes to a buffer never fail
+	tlvrw.NewWriter(buf).Write(tlvrw.NewTLV(HdrTypeTLV, val))
+
+	return buf.Bytes()
+}
+
+// readHeader reads the header of the segment file.
+//
+// readHeader returns a nil header for the files written before the
+// header was introduced.
+func readHeader(r io.ReaderAt) (*header, error) {
+	tr := tlvrw.NewReader(r)
+
+	typ, err := tr.Peek()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files without a header start with a packet
+	if typ == IDTypeTLV {
+		return nil, nil
+	}
+
+	if typ != HdrTypeTLV {
+		return nil, ErrUnknownFormat
+	}
+
+	tlv := tlvrw.NewTLV(HdrTypeTLV, nil)
+	if err := tr.ReadLazy(tlv); err != nil {
+		return nil, err
+	}
+
+	if tlv.Len != hdrLen {
+		return nil, ErrUnknownFormat
+	}
+
+	if err := tr.Fill(tlv); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(tlv.Val[:len(magic)], magic) {
+		return nil, ErrUnknownFormat
+	}
+
+	val := tlv.Val[len(magic):]
+	h := &header{
+		version:  binary.LittleEndian.Uint16(val[0:2]),
+		ctime:    int64(binary.LittleEndian.Uint64(val[2:10])),
+		workerID: binary.LittleEndian.Uint16(val[10:12]),
+		options:  binary.LittleEndian.Uint32(val[12:16]),
+	}
+
+	if h.version > FormatVersion || h.options&^supportedOpts != 0 {
+		return nil, fmt.Errorf("%w: version %d, options %b", ErrUnsupportedFormat, h.version, h.options)
+	}
+
+	return h, nil
+}
@@ -0,0 +1,291 @@
+package stupid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+const (
+	// HintTypeTLV is the type of the hint file header TLV.
+	HintTypeTLV = byte(7)
+
+	// HintEntryTypeTLV is the type of the hint file entry TLV.
+	HintEntryTypeTLV = byte(8)
+
+	// HintExpEntryTypeTLV is the type of the hint file entry TLV of
+	// a packet which expires, the entry is prefixed with the expiry.
+	HintExpEntryTypeTLV = byte(11)
+
+	// hintExt is the extension of the hint file names.
+	hintExt = ".hint"
+
+	// hintHdrLen is the length of the hint file header TLV value.
+	hintHdrLen = 8 + // creation time of the segment
+		8 + // size of the segment
+		8 // garbage in the segment
+
+	// hintEntryLen is the length of the hint entry TLV value
+	// without the key.
+	hintEntryLen = 8 + // packet ID
+		1 + // operation
+		8 + // position
+		4 + // value length
+		4 // value checksum
+)
+
+// ErrCorruptHint is returned when a hint file doesn't match its
+// checksum or is malformed.
+var ErrCorruptHint = fmt.Errorf("hint file is corrupted")
+
+// hint is the summary of a segment which allows populating the
+// in-memory indexes without reading the segment.
+//
+// A hint holds the last packet of every key present in the segment
+// without the values.
+//
+// Based on: https://riak.com/assets/bitcask-intro.pdf
+type hint struct {
+	// ctime is the creation time of the segment, it tells apart
+	// the segments which reused the same ID.
+	ctime int64
+	// size is the size of the segment when the hint was generated.
+	size int64
+	// garbage is the number of bytes taken by the packets which
+	// aren't part of the hint.
+	garbage int64
+	// entries are ordered by their position in the segment.
+	entries []hintEntry
+}
+
+// hintEntry is the summary of a single packet.
+type hintEntry struct {
+	op  byte
+	key []byte
+	e   keydirEntry
+}
+
+// hintPath returns the path of the hint file of the segment
+// with the given ID.
+func hintPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d%s", segmentPrefix, id, hintExt))
+}
+
+// matches returns true if the hint was generated from the current
+// state of the given segment.
+//
+// Segments are append only so a hint stays valid as long as the
+// segment is the same size.
+func (h *hint) matches(seg *segment) bool {
+	return seg.hdr != nil &&
+		h.ctime == seg.hdr.ctime &&
+		h.size == seg.size.Load()
+}
+
+// buildHint generates the hint of the given segment by reading the
+// headers of its packets.
+func buildHint(seg *segment) (*hint, error) {
+	h := &hint{
+		ctime: seg.hdr.ctime,
+		size:  seg.size.Load(),
+	}
+
+	last := make(map[string]hintEntry)
+	if err := seg.forEach(func(pr *reader, p *Packet, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Batch frames are garbage once the batches are complete
+		if p.Op == BatchOp {
+			return nil
+		}
+
+		last[string(p.Key)] = hintEntry{
+			op:  p.Op,
+			key: p.Key,
+			e:   entry(p),
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Everything but the live packets is garbage
+	h.garbage = h.size - seg.hdr.size()
+	for _, he := range last {
+		if he.op == SetOp {
+			h.garbage -= he.e.size()
+		}
+
+		h.entries = append(h.entries, he)
+	}
+
+	sort.Slice(h.entries, func(i, j int) bool {
+		return h.entries[i].e.pos < h.entries[j].e.pos
+	})
+
+	return h, nil
+}
+
+// writeHint writes the given hint of the segment with the given ID.
+//
+// The hint is written to a temporary file first so that a valid
+// hint is never replaced by a partially written one.
+func writeHint(dir string, id uint64, h *hint) error {
+	path := hintPath(dir, id)
+	tmpfile := path + ".tmp"
+
+	f, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("error creating hint file: %w", err)
+	}
+
+	if err := h.encode(f); err != nil {
+		f.Close()
+		os.Remove(tmpfile)
+		return fmt.Errorf("error writing hint file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("error closing hint file: %w", err)
+	}
+
+	if err := os.Rename(tmpfile, path); err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("error installing hint file: %w", err)
+	}
+
+	return nil
+}
+
+// encode writes the hint followed by its checksum to the given writer.
+func (h *hint) encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	tw := tlvrw.NewWriter(io.MultiWriter(bw, crc))
+
+	hdr := make([]byte, 0, hintHdrLen)
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(h.ctime))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(h.size))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(h.garbage))
+	if err := tw.Write(tlvrw.NewTLV(HintTypeTLV, hdr)); err != nil {
+		return err
+	}
+
+	for _, he := range h.entries {
+		typ := HintEntryTypeTLV
+		val := make([]byte, 0, 8+hintEntryLen+len(he.key))
+		if he.e.exp != 0 {
+			typ = HintExpEntryTypeTLV
+			val = binary.LittleEndian.AppendUint64(val, uint64(he.e.exp))
+		}
+
+		val = binary.LittleEndian.AppendUint64(val, he.e.id)
+		val = append(val, he.op)
+		val = binary.LittleEndian.AppendUint64(val, uint64(he.e.pos))
+		val = binary.LittleEndian.AppendUint32(val, he.e.vlen)
+		val = binary.LittleEndian.AppendUint32(val, he.e.vcrc)
+		val = append(val, he.key...)
+		if err := tw.Write(tlvrw.NewTLV(typ, val)); err != nil {
+			return err
+		}
+	}
+
+	sum := binary.LittleEndian.AppendUint32(nil, crc.Sum32())
+	if err := tlvrw.NewWriter(bw).Write(tlvrw.NewTLV(CrcTypeTLV, sum)); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// readHint reads the hint of the segment with the given ID.
+func readHint(dir string, id uint64) (*hint, error) {
+	// Hints hold only the keys, they are small enough to be
+	// verified in memory.
+	data, err := os.ReadFile(hintPath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tlvrw.NewReader(bytes.NewReader(data))
+
+	tlv := tlvrw.NewTLV(HintTypeTLV, nil)
+	if err := tr.ReadLazy(tlv); err != nil || tlv.Typ != HintTypeTLV || tlv.Len != hintHdrLen {
+		return nil, ErrCorruptHint
+	}
+
+	if err := tr.Fill(tlv); err != nil {
+		return nil, ErrCorruptHint
+	}
+
+	h := &hint{
+		ctime:   int64(binary.LittleEndian.Uint64(tlv.Val[0:8])),
+		size:    int64(binary.LittleEndian.Uint64(tlv.Val[8:16])),
+		garbage: int64(binary.LittleEndian.Uint64(tlv.Val[16:24])),
+	}
+
+	for {
+		pos, _ := tr.Seek(0, io.SeekCurrent)
+
+		tlv := tlvrw.NewTLV(HintEntryTypeTLV, nil)
+		if err := tr.ReadLazy(tlv); err != nil || pos+tlvrw.Size(tlv.Len) > int64(len(data)) {
+			return nil, ErrCorruptHint
+		}
+
+		if err := tr.Fill(tlv); err != nil {
+			return nil, ErrCorruptHint
+		}
+
+		if tlv.Typ == CrcTypeTLV {
+			if tlv.Len != 4 || pos+tlvrw.Size(4) != int64(len(data)) {
+				return nil, ErrCorruptHint
+			}
+
+			if binary.LittleEndian.Uint32(tlv.Val) != crc32.Checksum(data[:pos], crcTable) {
+				return nil, ErrCorruptHint
+			}
+
+			return h, nil
+		}
+
+		var exp int64
+		val := tlv.Val
+		switch {
+		case tlv.Typ == HintEntryTypeTLV && tlv.Len >= hintEntryLen:
+		case tlv.Typ == HintExpEntryTypeTLV && tlv.Len >= 8+hintEntryLen:
+			exp = int64(binary.LittleEndian.Uint64(val[0:8]))
+			val = val[8:]
+		default:
+			return nil, ErrCorruptHint
+		}
+
+		he := hintEntry{
+			op:  val[8],
+			key: val[hintEntryLen:],
+			e: keydirEntry{
+				id:   binary.LittleEndian.Uint64(val[0:8]),
+				seg:  id,
+				pos:  int64(binary.LittleEndian.Uint64(val[9:17])),
+				vlen: binary.LittleEndian.Uint32(val[17:21]),
+				crc:  true,
+				vcrc: binary.LittleEndian.Uint32(val[21:25]),
+				exp:  exp,
+			},
+		}
+		he.e.vpos = (&Packet{pos: he.e.pos, Key: he.key}).valpos()
+
+		h.entries = append(h.entries, he)
+	}
+}
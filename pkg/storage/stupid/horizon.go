@@ -0,0 +1,69 @@
+package stupid
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// horizonFile is the name of the file holding the compaction horizon.
+//
+// The horizon is the ID of the latest write merged by a compaction. The
+// merged segment holds only the packets live as of the horizon, so the
+// state of the storage as of an earlier write is lost. A storage restored
+// from a physical snapshot has the latest write of the snapshot as its
+// horizon, the history of the snapshot isn't known.
+const horizonFile = "stupid.horizon"
+
+// saveHorizon durably saves the given horizon in the given directory.
+func saveHorizon(dir string, horizon uint64) error {
+	path := filepath.Join(dir, horizonFile)
+
+	fd, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating horizon file: %w", err)
+	}
+
+	if _, err := fd.Write(encodeid(horizon)); err != nil {
+		fd.Close()
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error writing horizon file: %w", err)
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error syncing horizon file: %w", err)
+	}
+
+	if err := fd.Close(); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error closing horizon file: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error installing horizon file: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// loadHorizon returns the horizon saved in the given directory, 0 if the
+// storage was never compacted.
+func loadHorizon(dir string) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, horizonFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("error reading horizon file: %w", err)
+	}
+
+	if len(b) != 8 {
+		return 0, fmt.Errorf("invalid horizon file size: %d", len(b))
+	}
+
+	return decodeid(b), nil
+}
@@ -0,0 +1,221 @@
+package stupid
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// Iterator iterates over the live keys of the storage in the
+// lexicographic order.
+//
+// The iterator doesn't hold any lock between the moves, every move
+// looks up the key following the current one. So the writes made
+// during the iteration may or may not be seen by the iterator.
+type Iterator struct {
+	s *Storage
+
+	// lo is the smallest key in the range, inclusive, nil if unbounded.
+	lo []byte
+	// hi is the largest key in the range, exclusive, nil if unbounded.
+	hi []byte
+	// reverse is true if the keys are iterated in the descending order.
+	reverse bool
+
+	// started is true once the iterator has been positioned.
+	started bool
+	// closed is true once the iterator has been closed.
+	closed bool
+	// valid is true if the iterator is positioned at a key.
+	valid bool
+	key   []byte
+	val   []byte
+	err   error
+}
+
+// NewIterator returns an iterator over the live keys matching
+// the given options.
+func (s *Storage) NewIterator(opts types.IterOptions) (types.Iterator, error) {
+	return s.NewIteratorContext(context.Background(), opts)
+}
+
+// NewIteratorContext returns an iterator over the live keys matching
+// the given options, the iterator stops once the given context is done.
+func (s *Storage) NewIteratorContext(ctx context.Context, opts types.IterOptions) (types.Iterator, error) {
+	if !s.isInit() {
+		return nil, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	it := &Iterator{
+		s:       s,
+		lo:      opts.Start,
+		hi:      opts.End,
+		reverse: opts.Reverse,
+	}
+
+	// The keys with a prefix form a range of their own
+	if len(opts.Prefix) > 0 {
+		if it.lo == nil || bytes.Compare(opts.Prefix, it.lo) > 0 {
+			it.lo = opts.Prefix
+		}
+
+		if end := prefixEnd(opts.Prefix); end != nil && (it.hi == nil || bytes.Compare(end, it.hi) < 0) {
+			it.hi = end
+		}
+	}
+
+	return types.IteratorWithContext(ctx, it), nil
+}
+
+// Seek moves the iterator to the smallest key >= the given key, or the
+// largest key <= the given key when iterating in reverse.
+func (it *Iterator) Seek(key []byte) bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	it.started = true
+
+	// Keep the iterator within the range
+	if !it.reverse && it.lo != nil && bytes.Compare(key, it.lo) < 0 {
+		key = it.lo
+	}
+
+	if it.reverse && it.hi != nil && bytes.Compare(key, it.hi) >= 0 {
+		return it.move(string(it.hi), false)
+	}
+
+	return it.move(string(key), true)
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	if !it.started {
+		it.started = true
+		return it.first()
+	}
+
+	if !it.valid {
+		return false
+	}
+
+	return it.move(string(it.key), false)
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+
+	return it.key
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+
+	return it.val
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator.
+func (it *Iterator) Close() error {
+	it.closed, it.valid = true, false
+	it.key, it.val = nil, nil
+
+	return nil
+}
+
+// first moves the iterator to the first key of the range.
+func (it *Iterator) first() bool {
+	if !it.reverse {
+		return it.move(string(it.lo), true)
+	}
+
+	if it.hi == nil {
+		key, _, ok := it.s.kd.last()
+		if !ok {
+			it.valid = false
+			return false
+		}
+
+		return it.move(key, true)
+	}
+
+	// hi itself is out of the range
+	return it.move(string(it.hi), false)
+}
+
+// move moves the iterator to the first live key in the range starting
+// from the given key.
+func (it *Iterator) move(key string, inclusive bool) bool {
+	s := it.s
+
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	for {
+		k, e, ok := s.kd.seek(key, inclusive, it.reverse)
+		if !ok || !it.contains([]byte(k)) {
+			it.valid = false
+			return false
+		}
+
+		key, inclusive = k, false
+
+		// The expired keys are absent
+		if expired(e.exp) {
+			continue
+		}
+
+		val, err := s.read(e)
+		if err != nil {
+			it.err = err
+			it.valid = false
+			return false
+		}
+
+		it.key, it.val, it.valid = []byte(k), val, true
+		return true
+	}
+}
+
+// contains returns true if the given key falls in the range of the
+// iterator, in the direction of the iteration.
+func (it *Iterator) contains(key []byte) bool {
+	if it.reverse {
+		return it.lo == nil || bytes.Compare(key, it.lo) >= 0
+	}
+
+	return it.hi == nil || bytes.Compare(key, it.hi) < 0
+}
+
+// prefixEnd returns the smallest key greater than every key with the
+// given prefix, nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
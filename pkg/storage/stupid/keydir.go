@@ -0,0 +1,251 @@
+package stupid
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/utkarsh-pro/use/pkg/structures/skiplist"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+)
+
+// keydirEntry holds the location of the latest SetOp packet of a key.
+type keydirEntry struct {
+	// id is the ID of the packet.
+	id uint64
+	// seg is the ID of the segment holding the packet.
+	seg uint64
+	// pos is the position of the packet in the segment.
+	pos int64
+	// vpos is the position of the value bytes in the segment.
+	vpos int64
+	// vlen is the length of the value in bytes.
+	vlen uint32
+	// crc is true if the packet has a checksum.
+	crc bool
+	// vcrc is the checksum of the value.
+	vcrc uint32
+	// exp is the expiry time of the packet in unix milliseconds,
+	// 0 means that the packet never expires.
+	exp int64
+}
+
+// size returns the size of the packet in bytes.
+func (e keydirEntry) size() int64 {
+	size := e.vpos + int64(e.vlen) - e.pos
+	if e.exp != 0 {
+		size += tlvrw.Size(8) // Exp TLV
+	}
+	if e.crc {
+		size += tlvrw.Size(8) // Crc TLV
+	}
+
+	return size
+}
+
+// moved returns a copy of the entry as if the packet was
+// located at the given position of the given segment.
+func (e keydirEntry) moved(seg uint64, pos int64) keydirEntry {
+	e.vpos += pos - e.pos
+	e.pos = pos
+	e.seg = seg
+	return e
+}
+
+// keydir is an in-memory index which maps every live key to the
+// position of its latest value on disk.
+//
+// Based on: https://riak.com/assets/bitcask-intro.pdf
+type keydir struct {
+	mu *sync.RWMutex
+	m  map[string]keydirEntry
+	// exp holds the expiry times of the keys which expire so that
+	// the expired keys can be found without going through every key.
+	exp map[string]int64
+	// keys holds the keys in order for the ordered iteration.
+	keys *skiplist.SkipList[string, struct{}]
+}
+
+// newKeydir returns a new empty keydir.
+func newKeydir() *keydir {
+	return &keydir{
+		mu:   &sync.RWMutex{},
+		m:    make(map[string]keydirEntry),
+		exp:  make(map[string]int64),
+		keys: skiplist.New[string, struct{}](strings.Compare),
+	}
+}
+
+// get returns the entry for the given key.
+func (kd *keydir) get(key []byte) (keydirEntry, bool) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	e, ok := kd.m[string(key)]
+	return e, ok
+}
+
+// put sets the entry for the given key and returns the
+// entry it replaced, if any.
+func (kd *keydir) put(key []byte, e keydirEntry) (keydirEntry, bool) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	old, ok := kd.m[string(key)]
+	kd.m[string(key)] = e
+	kd.track(string(key), e)
+	if !ok {
+		kd.keys.Set(string(key), struct{}{})
+	}
+	return old, ok
+}
+
+// delete removes the entry for the given key and returns the
+// removed entry, if any.
+func (kd *keydir) delete(key []byte) (keydirEntry, bool) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	old, ok := kd.m[string(key)]
+	delete(kd.m, string(key))
+	delete(kd.exp, string(key))
+	if ok {
+		kd.keys.Delete(string(key))
+	}
+	return old, ok
+}
+
+// reset removes every entry from the keydir.
+func (kd *keydir) reset() {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	kd.m = make(map[string]keydirEntry)
+	kd.exp = make(map[string]int64)
+	kd.keys = skiplist.New[string, struct{}](strings.Compare)
+}
+
+// snapshot returns a copy of the keydir.
+func (kd *keydir) snapshot() map[string]keydirEntry {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	m := make(map[string]keydirEntry, len(kd.m))
+	for k, e := range kd.m {
+		m[k] = e
+	}
+
+	return m
+}
+
+// remap replaces every entry in the keydir with the one returned by
+// the given function, the entry is removed if the function returns false.
+func (kd *keydir) remap(fn func(key string, e keydirEntry) (keydirEntry, bool)) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	for k, e := range kd.m {
+		ne, ok := fn(k, e)
+		if !ok {
+			delete(kd.m, k)
+			delete(kd.exp, k)
+			kd.keys.Delete(k)
+			continue
+		}
+
+		kd.m[k] = ne
+		kd.track(k, ne)
+	}
+}
+
+// track records the expiry time of the given entry, it should be
+// called with the lock held.
+func (kd *keydir) track(key string, e keydirEntry) {
+	if e.exp != 0 {
+		kd.exp[key] = e.exp
+	} else {
+		delete(kd.exp, key)
+	}
+}
+
+// expired returns the keys which have expired.
+func (kd *keydir) expired() []string {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	var keys []string
+	for k, exp := range kd.exp {
+		if expired(exp) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// forEach executes the given function on every entry of the keydir.
+//
+// The keydir must not be modified by the given function.
+func (kd *keydir) forEach(fn func(key string, e keydirEntry)) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	for k, e := range kd.m {
+		fn(k, e)
+	}
+}
+
+// seek returns the smallest key >= the given key, or the largest
+// key <= the given key if reverse is true, along with its entry.
+//
+// The given key itself is skipped if inclusive is false.
+func (kd *keydir) seek(key string, inclusive, reverse bool) (string, keydirEntry, bool) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	var n *skiplist.Node[string, struct{}]
+	if reverse {
+		n = kd.keys.SeekLE(key)
+		if n != nil && !inclusive && n.Key() == key {
+			n = n.Prev()
+		}
+	} else {
+		n = kd.keys.Seek(key)
+		if n != nil && !inclusive && n.Key() == key {
+			n = n.Next()
+		}
+	}
+
+	if n == nil {
+		return "", keydirEntry{}, false
+	}
+
+	return n.Key(), kd.m[n.Key()], true
+}
+
+// last returns the largest key along with its entry.
+func (kd *keydir) last() (string, keydirEntry, bool) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	n := kd.keys.Last()
+	if n == nil {
+		return "", keydirEntry{}, false
+	}
+
+	return n.Key(), kd.m[n.Key()], true
+}
+
+// len returns the number of keys in the keydir which haven't expired.
+func (kd *keydir) len() int {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	n := len(kd.m)
+	for _, exp := range kd.exp {
+		if expired(exp) {
+			n--
+		}
+	}
+
+	return n
+}
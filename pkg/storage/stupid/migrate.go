@@ -0,0 +1,152 @@
+package stupid
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+)
+
+// migrateExt is the extension of the file an outdated segment is
+// rewritten to during the migration.
+const migrateExt = ".migrate"
+
+// Migrate upgrades the segments present in the given directory which
+// were written in an older format to the current format.
+//
+// Every outdated segment is rewritten to a new file which then replaces
+// the segment. Corrupted data found in an outdated segment is dropped
+// the same way as DetectAndFix would drop it. Migrate is idempotent so
+// that it can be retried if interrupted.
+func Migrate(dir string) error {
+	// The legacy file is removed only after segment 0 replaces it, so
+	// if both of them are present then the legacy file is outdated.
+	if _, err := os.Stat(segmentPath(dir, 0)); err == nil {
+		if err := os.Remove(filepath.Join(dir, legacyFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing migrated legacy file: %w", err)
+		}
+	}
+
+	paths, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for id, path := range paths {
+		if err := migrateSegment(dir, id, path); err != nil {
+			return fmt.Errorf("error migrating segment %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateSegment rewrites the segment at the given path in the current
+// format if it is outdated.
+func migrateSegment(dir string, id uint64, path string) error {
+	dst := segmentPath(dir, id)
+	tmpfile := dst + migrateExt
+
+	// Discard the interrupted migration, if any
+	if err := os.Remove(tmpfile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale migration file: %w", err)
+	}
+
+	seg, err := openSegment(path, id)
+	if err != nil {
+		return err
+	}
+	defer seg.close()
+
+	if seg.hdr != nil && seg.hdr.version == FormatVersion {
+		return nil
+	}
+
+	// Empty segments get their header when they are opened for writing
+	if seg.hdr == nil && seg.size.Load() == 0 && path == dst {
+		return nil
+	}
+
+	log.Infof("Migrating segment %d to format version %d...", id, FormatVersion)
+
+	tmp, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("error creating migration file: %w", err)
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpfile)
+		}
+	}()
+
+	bw := bufio.NewWriter(tmp)
+	if _, err := bw.Write(newHeader().encode()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing migration file header: %w", err)
+	}
+
+	pw := newwriter(bw)
+	err = seg.forEach(func(pr *reader, p *Packet, err error) error {
+		if err == nil {
+			err = pr.fill(p)
+		}
+
+		if err != nil {
+			if err == io.ErrUnexpectedEOF || err == ErrCorruptPacket {
+				log.Warnf("Found corrupted data in segment %d at position %d, dropping it", id, p.pos)
+
+				// Stop reading the segment
+				seg.size.Store(p.pos)
+				return nil
+			}
+
+			return err
+		}
+
+		// The packets are written without the position so that
+		// the writer computes the new checksums.
+		return pw.write(&Packet{ID: p.ID, Op: p.Op, Key: p.Key, Val: p.Val, Exp: p.Exp})
+	})
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("error rewriting packets: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing migration file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing migration file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing migration file: %w", err)
+	}
+
+	if err := os.Rename(tmpfile, dst); err != nil {
+		return fmt.Errorf("error replacing segment: %w", err)
+	}
+	committed = true
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	// The legacy file has been replaced by segment 0
+	if path != dst {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing migrated legacy file: %w", err)
+		}
+	}
+
+	log.Infof("Successfully migrated segment %d", id)
+	return nil
+}
@@ -2,7 +2,11 @@ package stupid
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"time"
 
 	"github.com/utkarsh-pro/use/pkg/tlvrw"
 )
@@ -19,6 +23,21 @@ const (
 
 	// ValTypeTLV is the type of the value TLV.
 	ValTypeTLV = byte(4)
+
+	// CrcTypeTLV is the type of the checksum TLV.
+	CrcTypeTLV = byte(5)
+
+	// ExpTypeTLV is the type of the expiry TLV.
+	ExpTypeTLV = byte(10)
+)
+
+var (
+	// ErrCorruptPacket is returned when a packet doesn't match its
+	// checksum or is malformed.
+	ErrCorruptPacket = fmt.Errorf("packet is corrupted")
+
+	// crcTable is the table used to calculate the packet checksums.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 // Packet is the basic unit of data transfer between the engine
@@ -28,14 +47,46 @@ type Packet struct {
 	Op  byte
 	Key []byte
 	Val []byte
+	// Exp is the time at which the packet expires in unix milliseconds,
+	// 0 means that the packet never expires.
+	Exp int64
+
+	// seg is the ID of the segment holding the packet.
+	seg uint64
+	// pos is the position of the packet in the segment.
+	pos int64
+	// crc is the checksum of the packet, it is nil for the packets
+	// which were written before the checksums were introduced.
+	crc *checksum
 
 	vtlv *tlvrw.TLV
 }
 
+// checksum holds the checksums of a packet.
+//
+// The header and the value are checksummed separately so that the
+// header can be verified without reading the value.
+type checksum struct {
+	// hdr is the checksum of the ID, Op, Key TLVs, the type and
+	// the length of the Val TLV and the Exp TLV, if any.
+	hdr uint32
+	// val is the checksum of the value bytes.
+	val uint32
+}
+
 // reader is a packet reader
 type reader struct {
 	// r is the underlying TLV reader
 	r *tlvrw.Reader
+	// ra is the resource underlying the TLV reader
+	ra io.ReaderAt
+
+	// limit is the position beyond which the reader doesn't read,
+	// limit <= 0 means that there is no limit.
+	limit int64
+
+	// checksums is true if every packet is expected to have a checksum.
+	checksums bool
 }
 
 // writer is a packet writer
@@ -47,7 +98,8 @@ type writer struct {
 // newreader returns a new packet reader
 func newreader(r io.ReaderAt) *reader {
 	return &reader{
-		r: tlvrw.NewReader(r),
+		r:  tlvrw.NewReader(r),
+		ra: r,
 	}
 }
 
@@ -58,11 +110,35 @@ func newwriter(w io.Writer) *writer {
 	}
 }
 
+// SegmentWriter writes packets in the segment format, so that the other
+// storages can generate physical snapshots which a stupid storage can be
+// restored from, see RestorePhysical.
+type SegmentWriter struct {
+	w *writer
+}
+
+// NewSegmentWriter writes the header of a new segment to the given
+// writer and returns a writer for the packets of the segment.
+func NewSegmentWriter(w io.Writer) (*SegmentWriter, error) {
+	if _, err := w.Write(newHeader().encode()); err != nil {
+		return nil, err
+	}
+
+	return &SegmentWriter{w: newwriter(w)}, nil
+}
+
+// Write writes the given packet along with its checksum.
+func (sw *SegmentWriter) Write(p *Packet) error {
+	return sw.w.write(p)
+}
+
 // lread is a lazy reader which reads the packet
 func (r *reader) lread(p *Packet) error {
+	p.pos = r.pos()
+
 	// read the ID type TLV
-	idtlv := tlvrw.NewTLV(IDTypeTLV, nil)
-	if err := r.r.Read(idtlv); err != nil {
+	idtlv, err := r.next(IDTypeTLV, false)
+	if err != nil {
 		// EOF indicates that there are no more packets to read
 		if err == io.EOF {
 			return io.EOF
@@ -70,11 +146,14 @@ func (r *reader) lread(p *Packet) error {
 
 		return err
 	}
+	if idtlv.Len != 8 {
+		return ErrCorruptPacket
+	}
 	p.ID = decodeid(idtlv.Val)
 
 	// read the operation type TLV
-	optlv := tlvrw.NewTLV(OpTypeTLV, nil)
-	if err := r.r.Read(optlv); err != nil {
+	optlv, err := r.next(OpTypeTLV, false)
+	if err != nil {
 		if err == io.EOF {
 			// packets are set of 4 TLVs and we don't expect
 			// EOF on the second TLV read
@@ -83,11 +162,14 @@ func (r *reader) lread(p *Packet) error {
 
 		return err
 	}
+	if optlv.Len != 1 {
+		return ErrCorruptPacket
+	}
 	p.Op = optlv.Val[0]
 
 	// read the key type TLV
-	keytlv := tlvrw.NewTLV(KeyTypeTLV, nil)
-	if err := r.r.Read(keytlv); err != nil {
+	keytlv, err := r.next(KeyTypeTLV, false)
+	if err != nil {
 		if err == io.EOF {
 			// packets are set of 4 TLVs and we don't expect
 			// EOF on the third TLV read
@@ -99,8 +181,8 @@ func (r *reader) lread(p *Packet) error {
 	p.Key = keytlv.Val
 
 	// read the value type TLV lazily
-	valtlv := tlvrw.NewTLV(ValTypeTLV, nil)
-	if err := r.r.ReadLazy(valtlv); err != nil {
+	valtlv, err := r.next(ValTypeTLV, true)
+	if err != nil {
 		if err == io.EOF {
 			// packets are set of 4 TLVs and we don't expect
 			// EOF on the fourth TLV read because TLV readers
@@ -112,9 +194,143 @@ func (r *reader) lread(p *Packet) error {
 	}
 	p.vtlv = valtlv
 
+	if err := r.lreadExpiry(p); err != nil {
+		return err
+	}
+
+	return r.lreadChecksum(p)
+}
+
+// lreadExpiry reads the expiry TLV of the packet, if any.
+//
+// The expiry TLV is optional, the packets which never expire don't
+// have it in which case the next TLV is the checksum TLV, if any.
+func (r *reader) lreadExpiry(p *Packet) error {
+	if r.limit > 0 && r.pos() >= r.limit {
+		return nil
+	}
+
+	typ, err := r.r.Peek()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+
+		return err
+	}
+
+	if typ != ExpTypeTLV {
+		return nil
+	}
+
+	exptlv, err := r.next(ExpTypeTLV, false)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+	if exptlv.Len != 8 {
+		return ErrCorruptPacket
+	}
+	p.Exp = int64(binary.LittleEndian.Uint64(exptlv.Val))
+
 	return nil
 }
 
+// lreadChecksum reads the checksum TLV of the packet, if any, and
+// verifies the header of the packet against it.
+//
+// Packets written before the checksums were introduced don't have the
+// checksum TLV in which case the next TLV belongs to the next packet.
+// Unless the reader expects every packet to have a checksum, in which
+// case a missing checksum means that the packet is incomplete.
+func (r *reader) lreadChecksum(p *Packet) error {
+	// The next packet, if any, lies beyond the limit
+	if r.limit > 0 && r.pos() >= r.limit {
+		if r.checksums {
+			return io.ErrUnexpectedEOF
+		}
+
+		return nil
+	}
+
+	typ, err := r.r.Peek()
+	if err != nil {
+		if err == io.EOF {
+			if r.checksums {
+				return io.ErrUnexpectedEOF
+			}
+
+			return nil
+		}
+
+		return err
+	}
+
+	if typ != CrcTypeTLV {
+		if r.checksums {
+			return ErrCorruptPacket
+		}
+
+		return nil
+	}
+
+	crctlv, err := r.next(CrcTypeTLV, false)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+	if crctlv.Len != 8 {
+		return ErrCorruptPacket
+	}
+
+	p.crc = &checksum{
+		hdr: binary.LittleEndian.Uint32(crctlv.Val[:4]),
+		val: binary.LittleEndian.Uint32(crctlv.Val[4:]),
+	}
+
+	if p.crc.hdr != hdrChecksum(p.ID, p.Op, p.Key, p.vlen(), p.Exp) {
+		return ErrCorruptPacket
+	}
+
+	return nil
+}
+
+// next reads the next TLV which is expected to be of the given type.
+//
+// If lazy is true then the value of the TLV is not read.
+func (r *reader) next(typ byte, lazy bool) (*tlvrw.TLV, error) {
+	tlv := tlvrw.NewTLV(typ, nil)
+	if err := r.r.ReadLazy(tlv); err != nil {
+		return nil, err
+	}
+
+	if tlv.Typ != typ {
+		return nil, ErrCorruptPacket
+	}
+
+	// A TLV which doesn't fit before the limit is either partially
+	// written or has a garbage length, either way it is incomplete.
+	if r.limit > 0 && tlv.ValuePos()+int64(tlv.Len) > r.limit {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if lazy {
+		return tlv, nil
+	}
+
+	if err := r.r.Fill(tlv); err != nil {
+		return nil, err
+	}
+
+	return tlv, nil
+}
+
 // fill fills the value type TLV with the value
 func (r *reader) fill(p *Packet) error {
 	if p.vtlv == nil {
@@ -125,11 +341,67 @@ func (r *reader) fill(p *Packet) error {
 		return err
 	}
 
+	if p.crc != nil && crc32.Checksum(p.vtlv.Val, crcTable) != p.crc.val {
+		return ErrCorruptPacket
+	}
+
 	p.Val = p.vtlv.Val
 	p.vtlv = nil
 	return nil
 }
 
+// verify verifies the value of the packet against its checksum without
+// holding the value in memory.
+func (r *reader) verify(p *Packet) error {
+	if p.crc == nil || p.vtlv == nil {
+		return nil
+	}
+
+	h := crc32.New(crcTable)
+	if _, err := io.Copy(h, io.NewSectionReader(r.ra, p.vtlv.ValuePos(), int64(p.vtlv.Len))); err != nil {
+		return err
+	}
+
+	if h.Sum32() != p.crc.val {
+		return ErrCorruptPacket
+	}
+
+	return nil
+}
+
+// vlen returns the length of the value of the packet regardless
+// of whether the value has been filled or not.
+func (p *Packet) vlen() uint32 {
+	if p.vtlv != nil {
+		return p.vtlv.Len
+	}
+
+	return uint32(len(p.Val))
+}
+
+// valpos returns the position of the value bytes of the packet
+// assuming that the packet starts at p.pos.
+func (p *Packet) valpos() int64 {
+	return p.pos +
+		tlvrw.Size(8) + // ID TLV
+		tlvrw.Size(1) + // Op TLV
+		tlvrw.Size(uint32(len(p.Key))) + // Key TLV
+		tlvrw.Size(0) // Type and length of the Val TLV
+}
+
+// size returns the size of the packet in bytes.
+func (p *Packet) size() int64 {
+	size := p.valpos() + int64(p.vlen()) - p.pos
+	if p.Exp != 0 {
+		size += tlvrw.Size(8) // Exp TLV
+	}
+	if p.crc != nil {
+		size += tlvrw.Size(8) // Crc TLV
+	}
+
+	return size
+}
+
 // pos returns the current position of the reader
 func (r *reader) pos() int64 {
 	pos, _ := r.r.Seek(0, io.SeekCurrent)
@@ -141,14 +413,18 @@ func (r *reader) pos() int64 {
 // write will copy the packet to a buffer and write the buffer
 // to the underlying writer in one go. This is to ensure that the
 // packet is written in one go and is not broken in between.
+//
+// write sets the checksum of the packet.
 func (w *writer) write(p *Packet) error {
 	// get estimate size of the packet
 	sizeOfIDInBytes := uint32(8) // 8 bytes for uint64
 	sizeOfOpInBytes := uint32(1) // 1 byte for byte
 	sizeOfKeyInBytes := uint32(len(p.Key))
 	sizeOfValInBytes := uint32(len(p.Val))
+	sizeOfExpInBytes := uint32(8) // 8 bytes for int64
+	sizeOfCrcInBytes := uint32(8) // 4 bytes for each uint32
 
-	size := sizeOfIDInBytes + sizeOfOpInBytes + sizeOfKeyInBytes + sizeOfValInBytes
+	size := sizeOfIDInBytes + sizeOfOpInBytes + sizeOfKeyInBytes + sizeOfValInBytes + sizeOfExpInBytes + sizeOfCrcInBytes
 
 	// buffer data and write it in one go
 	buf := bytes.NewBuffer(make([]byte, 0, size))
@@ -176,6 +452,26 @@ func (w *writer) write(p *Packet) error {
 		return err
 	}
 
+	// Write an expiry type TLV if the packet expires
+	if p.Exp != 0 {
+		if err := tw.Write(tlvrw.NewTLV(ExpTypeTLV, encodeExp(p.Exp))); err != nil {
+			return err
+		}
+	}
+
+	// Write a checksum type TLV
+	p.crc = &checksum{
+		hdr: hdrChecksum(p.ID, p.Op, p.Key, uint32(len(p.Val)), p.Exp),
+		val: crc32.Checksum(p.Val, crcTable),
+	}
+
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint32(crc[:4], p.crc.hdr)
+	binary.LittleEndian.PutUint32(crc[4:], p.crc.val)
+	if err := tw.Write(tlvrw.NewTLV(CrcTypeTLV, crc)); err != nil {
+		return err
+	}
+
 	// write the buffer to the underlying writer
 	if _, err := w.w.Write(buf.Bytes()); err != nil {
 		return err
@@ -183,3 +479,32 @@ func (w *writer) write(p *Packet) error {
 
 	return nil
 }
+
+// hdrChecksum returns the checksum of the header of a packet with
+// the given fields.
+func hdrChecksum(id uint64, op byte, key []byte, vlen uint32, exp int64) uint32 {
+	h := crc32.New(crcTable)
+	tw := tlvrw.NewWriter(h)
+
+	// Writes to a hash never fail
+	tw.Write(tlvrw.NewTLV(IDTypeTLV, encodeid(id)))
+	tw.Write(tlvrw.NewTLV(OpTypeTLV, []byte{op}))
+	tw.Write(tlvrw.NewTLV(KeyTypeTLV, key))
+	binary.Write(h, binary.LittleEndian, ValTypeTLV)
+	binary.Write(h, binary.LittleEndian, vlen)
+	if exp != 0 {
+		tw.Write(tlvrw.NewTLV(ExpTypeTLV, encodeExp(exp)))
+	}
+
+	return h.Sum32()
+}
+
+// encodeExp encodes the given expiry time.
+func encodeExp(exp int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(exp))
+}
+
+// expired returns true if the given expiry time has passed.
+func expired(exp int64) bool {
+	return exp != 0 && exp <= time.Now().UnixMilli()
+}
@@ -0,0 +1,416 @@
+package stupid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
+	"github.com/utkarsh-pro/use/pkg/utils"
+)
+
+const (
+	// restoreDir is the directory the physical snapshot being restored
+	// is staged in.
+	restoreDir = "stupid.restore"
+
+	// commitExt is the extension of the staging directory which is
+	// verified but hasn't replaced the segments yet.
+	commitExt = ".commit"
+
+	// doneExt is the extension of the staging directory which has
+	// replaced the segments and is yet to be removed.
+	doneExt = ".done"
+
+	// snapshotFile is the name of the file the physical snapshot is
+	// received in before it is split into segments.
+	snapshotFile = "snapshot"
+)
+
+// RestorePhysical replaces the data of the storage by the data of the
+// given physical snapshot, see PhysicalSnapshot.
+//
+// The snapshot is received and verified completely before it replaces
+// anything, a snapshot which doesn't parse fully is rejected with
+// errors.ErrCorruptSnapshot. The storage must not hold any key unless
+// force is true, otherwise errors.ErrStorageNotEmpty is returned.
+//
+// The restore happens in three phases:
+//  1. The snapshot is split into segments in a staging directory without
+//     blocking the reads and the writes.
+//  2. The staging directory is committed by renaming it. From here on the
+//     restore survives crashes, see recoverRestore.
+//  3. The reads and writes are blocked, the staged segments replace the
+//     segments of the storage and the in-memory indexes are rebuilt.
+func (s *Storage) RestorePhysical(r io.Reader, force bool) error {
+	return s.RestorePhysicalContext(context.Background(), r, force)
+}
+
+// RestorePhysicalContext replaces the data of the storage by the data of
+// the given physical snapshot like RestorePhysical. The restore stops once
+// the given context is done unless the staging directory is committed
+// already, the storage is left as it was then.
+func (s *Storage) RestorePhysicalContext(ctx context.Context, r io.Reader, force bool) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The segments are swapped only by a compaction or by a restore
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	if !force && s.kd.len() > 0 {
+		return errors.ErrStorageNotEmpty
+	}
+
+	staging := filepath.Join(s.dir, restoreDir)
+	if err := stageSnapshot(ctx, staging, r); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// The keys could have been written while the snapshot was staged
+	if !force && s.kd.len() > 0 {
+		os.RemoveAll(staging)
+		return errors.ErrStorageNotEmpty
+	}
+
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	if err := os.Rename(staging, staging+commitExt); err != nil {
+		os.RemoveAll(staging)
+		return fmt.Errorf("error committing snapshot: %w", err)
+	}
+
+	if err := syncDir(s.dir); err != nil {
+		log.Warnln("failed to sync the storage directory: ", err)
+	}
+
+	if err := s.installSnapshot(); err != nil {
+		return err
+	}
+
+	if err := s.ensureExpirySegment(); err != nil {
+		return err
+	}
+
+	f := newFilter(2*s.kd.len(), s.cfg.FilterFalsePositiveRate)
+	s.kd.forEach(func(key string, _ keydirEntry) {
+		f.Add([]byte(key))
+
+		// The filter being regenerated may have missed the restored keys
+		if s.pending != nil {
+			s.pending.Add([]byte(key))
+		}
+	})
+	s.bf.Store(f)
+
+	s.markDurable(s.mark())
+
+	log.Infoln("Successfully restored the physical snapshot, keys: ", s.kd.len())
+	return nil
+}
+
+// installSnapshot replaces the segments of the storage by the committed
+// staged segments and rebuilds the in-memory indexes from them.
+//
+// installSnapshot should be called with the write lock held.
+func (s *Storage) installSnapshot() error {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for _, seg := range s.segments {
+		if err := seg.close(); err != nil {
+			log.Warnln("failed to close replaced segment: ", err)
+		}
+	}
+
+	if err := s.wfd.Close(); err != nil {
+		log.Warnln("failed to close the active segment write fd: ", err)
+	}
+	s.dropRetired(len(s.retired))
+
+	// The storage is unusable till the restore is completed on
+	// the next start, see recoverRestore.
+	fail := func(err error) error {
+		s.segments, s.wfd = nil, nil
+		s.initialized.Store(false)
+		return fmt.Errorf("error installing snapshot, it is installed on the next start: %w", err)
+	}
+
+	if err := installRestore(s.dir); err != nil {
+		return fail(err)
+	}
+
+	segments, wfd, err := s.open()
+	if err != nil {
+		return fail(err)
+	}
+
+	s.segments = segments
+	s.wfd = wfd
+	s.kd.reset()
+	s.lastID = 0
+
+	horizon, err := loadHorizon(s.dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+	}
+	s.horizon.Store(horizon)
+
+	if err := s.scanSegments(true); err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+	}
+
+	return nil
+}
+
+// stageSnapshot splits the given physical snapshot into segments in the
+// given staging directory and verifies every packet of them. The staging
+// stops once the given context is done.
+func stageSnapshot(ctx context.Context, staging string, r io.Reader) error {
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("error removing stale staging directory: %w", err)
+	}
+
+	if err := os.Mkdir(staging, 0777); err != nil {
+		return fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	path := filepath.Join(staging, snapshotFile)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot file: %w", err)
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, types.ReaderWithContext(ctx, r))
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+
+	// The history before the latest write of the snapshot isn't known
+	var horizon uint64
+
+	// Every segment of the snapshot starts with a header except for the
+	// segment written before the header was introduced.
+	var starts []int64
+	tr := tlvrw.NewReader(f)
+	for pos := int64(0); pos < size; {
+		tlv := tlvrw.NewTLV(0, nil)
+		if err := tr.ReadLazy(tlv); err != nil || pos+tlvrw.Size(tlv.Len) > size {
+			return errors.ErrCorruptSnapshot
+		}
+
+		if tlv.Typ == HdrTypeTLV || pos == 0 {
+			starts = append(starts, pos)
+		}
+
+		pos += tlvrw.Size(tlv.Len)
+	}
+
+	if len(starts) == 0 {
+		return errors.ErrCorruptSnapshot
+	}
+
+	for i, start := range starts {
+		end := size
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+
+		latest, err := stageSegment(ctx, staging, uint64(i), io.NewSectionReader(f, start, end-start))
+		if err != nil {
+			return err
+		}
+		horizon = utils.Max(horizon, latest)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing snapshot file: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error removing snapshot file: %w", err)
+	}
+
+	// Upgrade the segments written in an older format, if any.
+	if err := Migrate(staging); err != nil {
+		return fmt.Errorf("error migrating snapshot: %w", err)
+	}
+
+	return saveHorizon(staging, horizon)
+}
+
+// stageSegment writes the segment with the given ID read from the
+// given reader to the staging directory, verifies it and returns the ID
+// of its latest write.
+func stageSegment(ctx context.Context, staging string, id uint64, r io.Reader) (uint64, error) {
+	path := segmentPath(staging, id)
+	fd, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("error creating staged segment: %w", err)
+	}
+
+	if _, err := io.Copy(fd, r); err != nil {
+		fd.Close()
+		return 0, fmt.Errorf("error writing staged segment: %w", err)
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return 0, fmt.Errorf("error syncing staged segment: %w", err)
+	}
+
+	if err := fd.Close(); err != nil {
+		return 0, fmt.Errorf("error closing staged segment: %w", err)
+	}
+
+	seg, err := openSegment(path, id)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errors.ErrCorruptSnapshot, err)
+	}
+	defer seg.close()
+
+	// The snapshot holds only the successful writes, so unlike a scan
+	// nothing is expected to be corrupt or cut short.
+	var latest uint64
+	fr := &framer{}
+	if err := seg.forEachContext(ctx, func(pr *reader, p *Packet, err error) error {
+		if err == nil {
+			err = pr.verify(p)
+		}
+
+		if err == nil {
+			_, err = fr.add(pr, p)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: segment %d: %s", errors.ErrCorruptSnapshot, id, err)
+		}
+
+		latest = utils.Max(latest, p.ID)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if fr.pending() {
+		return 0, fmt.Errorf("%w: segment %d: incomplete batch", errors.ErrCorruptSnapshot, id)
+	}
+
+	return latest, nil
+}
+
+// recoverRestore completes the restore which was committed but couldn't
+// replace the segments and discards the restore which wasn't committed.
+func recoverRestore(dir string) error {
+	staging := filepath.Join(dir, restoreDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("error removing stale staging directory: %w", err)
+	}
+
+	if _, err := os.Stat(staging + commitExt); err == nil {
+		log.Infoln("Found committed restore, installing it...")
+
+		if err := installRestore(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(staging + doneExt); err != nil {
+		return fmt.Errorf("error removing installed staging directory: %w", err)
+	}
+
+	return nil
+}
+
+// installRestore replaces the segments present in the given directory
+// by the segments of the committed staging directory.
+//
+// The staged segments are linked rather than moved so that the staging
+// directory stays intact till it is installed completely, which makes
+// installRestore idempotent so that it can be retried if interrupted.
+func installRestore(dir string) error {
+	staging := filepath.Join(dir, restoreDir)
+
+	staged, err := listSegments(staging + commitExt)
+	if err != nil {
+		return err
+	}
+
+	paths, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for id, path := range paths {
+		// The hint goes first so that it never outlives its segment
+		if err := os.Remove(hintPath(dir, id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing hint of replaced segment: %w", err)
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing replaced segment: %w", err)
+		}
+	}
+
+	// The filter has seen the keys of the replaced segments
+	if err := os.Remove(filepath.Join(dir, bfFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing bloom filter file: %w", err)
+	}
+
+	// The horizon of the replaced segments gives way to the one of the
+	// snapshot, a snapshot staged by an older version has none.
+	if err := os.Remove(filepath.Join(dir, horizonFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing horizon file: %w", err)
+	}
+
+	if err := os.Link(filepath.Join(staging+commitExt, horizonFile), filepath.Join(dir, horizonFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error installing restored horizon file: %w", err)
+	}
+
+	for id, path := range staged {
+		if err := os.Link(path, segmentPath(dir, id)); err != nil {
+			return fmt.Errorf("error installing restored segment: %w", err)
+		}
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	if err := os.Rename(staging+commitExt, staging+doneExt); err != nil {
+		return fmt.Errorf("error completing restore: %w", err)
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(staging + doneExt); err != nil {
+		log.Warnln("failed to remove the installed staging directory: ", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package stupid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/utkarsh-pro/use/pkg/log"
+)
+
+const (
+	// segmentPrefix is the prefix of the segment file names.
+	segmentPrefix = "stupid-"
+	// segmentExt is the extension of the segment file names.
+	segmentExt = ".db"
+	// legacyFile is the name of the data file used before the
+	// storage was split into segments. It is treated as segment 0.
+	legacyFile = "stupid.db"
+)
+
+// segment is a single data file of the storage.
+//
+// Only the last segment of the storage is written to, rest of the
+// segments are immutable.
+type segment struct {
+	// id is the ID of the segment, segments are ordered by their IDs.
+	id uint64
+	// path is the path to the segment file.
+	path string
+	// rfd is the reading file descriptor.
+	rfd *os.File
+	// hdr is the header of the segment, it is nil if the segment
+	// doesn't have a header yet or was written before the header
+	// was introduced.
+	hdr *header
+	// size is the last successful write position in the segment.
+	size *atomic.Int64
+	// garbage is the number of bytes taken by the overwritten and
+	// deleted packets in the segment.
+	//
+	// garbage is guarded by the write lock of the storage.
+	garbage int64
+	// hinted is the size of the segment covered by its hint file,
+	// it is 0 if the segment doesn't have a hint file.
+	//
+	// hinted is guarded by the write lock of the storage.
+	hinted int64
+}
+
+// segmentPath returns the path of the segment with the given ID.
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d%s", segmentPrefix, id, segmentExt))
+}
+
+// openSegment opens the segment file at the given path for reading.
+func openSegment(path string, id uint64) (*segment, error) {
+	rfd, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error opening segment for read fd: %w", err)
+	}
+
+	fi, err := rfd.Stat()
+	if err != nil {
+		rfd.Close()
+		return nil, fmt.Errorf("error reading segment size: %w", err)
+	}
+
+	seg := &segment{
+		id:   id,
+		path: path,
+		rfd:  rfd,
+		size: &atomic.Int64{},
+	}
+	seg.size.Store(fi.Size())
+
+	if fi.Size() == 0 {
+		return seg, nil
+	}
+
+	hdr, err := readHeader(rfd)
+	if err != nil {
+		// The segment was created but its header couldn't be written
+		// completely, which makes it as good as an empty segment.
+		if err == io.ErrUnexpectedEOF {
+			log.Warnln("Found segment with incomplete header, treating it as empty: ", path)
+			seg.size.Store(0)
+			return seg, nil
+		}
+
+		rfd.Close()
+		return nil, fmt.Errorf("error reading segment header %s: %w", path, err)
+	}
+
+	seg.hdr = hdr
+
+	return seg, nil
+}
+
+// openSegments opens all the segments present in the given directory
+// ordered by their IDs.
+func openSegments(dir string) ([]*segment, error) {
+	paths, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(paths))
+	for id := range paths {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	segments := make([]*segment, 0, len(ids))
+	for _, id := range ids {
+		seg, err := openSegment(paths[id], id)
+		if err != nil {
+			for _, seg := range segments {
+				seg.rfd.Close()
+			}
+
+			return nil, err
+		}
+
+		segments = append(segments, seg)
+	}
+
+	return segments, nil
+}
+
+// listSegments returns the paths of all the segments present in the
+// given directory keyed by their IDs.
+func listSegments(dir string) (map[uint64]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage directory: %w", err)
+	}
+
+	paths := make(map[uint64]string)
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if name == legacyFile {
+			// The segment 0 takes precedence over the legacy file, see Migrate
+			if _, ok := paths[0]; !ok {
+				paths[0] = filepath.Join(dir, name)
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		paths[id] = filepath.Join(dir, name)
+	}
+
+	return paths, nil
+}
+
+// openWriter opens the segment for writing and positions the
+// returned file descriptor at the end of the segment.
+func (seg *segment) openWriter() (*os.File, error) {
+	wfd, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error opening segment for write fd: %w", err)
+	}
+
+	if _, err := wfd.Seek(seg.size.Load(), io.SeekStart); err != nil {
+		wfd.Close()
+		return nil, fmt.Errorf("error seeking to end of segment: %w", err)
+	}
+
+	return wfd, nil
+}
+
+// writeHeader writes a new header to the empty segment using the
+// given writing file descriptor.
+func (seg *segment) writeHeader(wfd *os.File) error {
+	hdr := newHeader()
+
+	// Discard the incomplete header, if any
+	if err := wfd.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating segment: %w", err)
+	}
+
+	if _, err := wfd.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking to start of segment: %w", err)
+	}
+
+	if _, err := wfd.Write(hdr.encode()); err != nil {
+		return fmt.Errorf("error writing segment header: %w", err)
+	}
+
+	seg.hdr = hdr
+	seg.size.Store(hdr.size())
+
+	return nil
+}
+
+// forEach goes through the segment and executes the given function on
+// each packet that it reads.
+func (seg *segment) forEach(fn func(*reader, *Packet, error) error) error {
+	return seg.forEachContext(context.Background(), fn)
+}
+
+// forEachContext is forEach which stops between the packets once the
+// given context is done and returns the error of the context.
+func (seg *segment) forEachContext(ctx context.Context, fn func(*reader, *Packet, error) error) error {
+	pr := newreader(seg.rfd)
+	pr.checksums = seg.hdr.checksums()
+
+	// Packets start right after the header
+	pr.r.Seek(seg.hdr.size(), io.SeekStart)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// don't read beyond the last successful write position
+		pr.limit = seg.size.Load()
+		if pr.pos() >= pr.limit {
+			break
+		}
+
+		packet := &Packet{seg: seg.id}
+		err := pr.lread(packet)
+		if err != nil {
+			// If we reach the end of the file, break.
+			//
+			// We don't call the function with the packet
+			// because we know that the packet has to be invalid.
+			//
+			// Due to the design of TLV, it is impossible to encounter
+			// EOF while reading a packet (even at the end).
+			if err == io.EOF {
+				break
+			}
+		}
+
+		if _err := fn(pr, packet, err); _err != nil {
+			return _err
+		}
+	}
+
+	return nil
+}
+
+// close closes the segment.
+func (seg *segment) close() error {
+	return seg.rfd.Close()
+}
@@ -1,18 +1,25 @@
 package stupid
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
-	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	gconfig "github.com/utkarsh-pro/use/pkg/config"
 	"github.com/utkarsh-pro/use/pkg/id"
 	"github.com/utkarsh-pro/use/pkg/log"
+	"github.com/utkarsh-pro/use/pkg/storage"
 	"github.com/utkarsh-pro/use/pkg/storage/config"
 	"github.com/utkarsh-pro/use/pkg/storage/errors"
-	"github.com/utkarsh-pro/use/pkg/structures/bloom/dibf"
-	"github.com/utkarsh-pro/use/pkg/utils"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
 )
 
 var (
@@ -23,181 +30,435 @@ var (
 
 // Storage is a stupid storage.
 type Storage struct {
-	// file is path to the storage file.
-	file string
-
-	// rfd is the reading file descriptor.
-	rfd *os.File
+	// Conditional implements the conditional writes over SetIf and
+	// DeleteIf.
+	types.Conditional
+
+	// dir is path to the storage directory.
+	dir string
+
+	// rmu guards the segments against being swapped while
+	// they are in use.
+	rmu *sync.RWMutex
+	// segments are the data files of the storage ordered by their IDs.
+	//
+	// The last segment is the active segment which is the only one that
+	// is written to, rest of the segments are immutable.
+	segments []*segment
 
 	// idgen is the id generator.
 	idgen id.Gen
 
 	// wmu is the write mutex.
 	wmu *sync.Mutex
-	// wfd is the writing file descriptor.
+	// wfd is the writing file descriptor of the active segment.
 	wfd *os.File
-	// lastSuccessWritePos is the last successful write position.
-	lastSuccessWritePos int64
+	// retired are the writing file descriptors of the previous active
+	// segments whose fsync failed on the rollover, they are kept open so
+	// that the next sync retries the fsync, see syncActive.
+	//
+	// retired is guarded by the write lock.
+	retired []*os.File
+	// seq is the sequence number of the latest write.
+	//
+	// seq is guarded by the write lock.
+	seq uint64
+	// written is the number of bytes written since the storage was created.
+	//
+	// written is guarded by the write lock.
+	written int64
+	// durable is the latest state of the writes known to be durable.
+	durable *atomic.Pointer[mark]
+
+	// gc groups the fsyncs of the concurrent writers.
+	gc *groupCommit
+	// flush wakes up the async flusher.
+	flush chan struct{}
+
+	// cmu is the compaction mutex.
+	cmu *sync.Mutex
+
+	// initialized is true when the storage is initialized.
+	initialized *atomic.Bool
 
 	// cfg is the storage config.
 	cfg config.Config
 
-	// bf is the bloom bf.
-	bf bf
+	// bf is the bloom bf, it is swapped when the filter is regenerated.
+	bf *atomic.Pointer[bfsync]
+	// pending is the filter being regenerated, if any.
+	//
+	// pending is guarded by the write lock.
+	pending *bfsync
+	// lastID is the ID of the latest packet in the storage.
+	//
+	// lastID is guarded by the write lock.
+	lastID uint64
+	// horizon is the ID of the latest write merged by a compaction, the
+	// state of the storage as of an earlier write is lost, see horizonFile.
+	horizon *atomic.Uint64
+
+	// kd is the in-memory key directory.
+	kd *keydir
+
+	// watches are the active watches over the writes.
+	//
+	// watches are guarded by the write lock.
+	watches map[*watch]struct{}
+
+	// done is closed to stop the background workers.
+	done chan struct{}
+	// wg waits for the background workers to stop.
+	wg *sync.WaitGroup
+}
+
+// init registers the storage, see storage.Register.
+func init() {
+	storage.Register(storage.StupidStorageType, func(path string, cfg config.Config) (storage.Storage, error) {
+		return New(path, cfg), nil
+	})
 }
 
 // New returns a new Storage instance.
 func New(dir string, cfg config.Config) *Storage {
-	return &Storage{
-		file:  filepath.Join(dir, "stupid.db"),
-		wmu:   &sync.Mutex{},
-		idgen: id.New(),
-		cfg:   cfg,
-		bf:    newBfSync(dibf.NewWithEstimates(1e6, 0.01, 1, nil)),
+	// A segment would be rolled over on every write otherwise
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = config.DefaultSegmentSize
+	}
+
+	s := &Storage{
+		dir:         dir,
+		rmu:         &sync.RWMutex{},
+		wmu:         &sync.Mutex{},
+		cmu:         &sync.Mutex{},
+		initialized: &atomic.Bool{},
+		idgen:       id.New(),
+		cfg:         cfg,
+		bf:          &atomic.Pointer[bfsync]{},
+		kd:          newKeydir(),
+		horizon:     &atomic.Uint64{},
+		watches:     make(map[*watch]struct{}),
+		durable:     &atomic.Pointer[mark]{},
+		gc:          newGroupCommit(),
+		flush:       make(chan struct{}, 1),
+		wg:          &sync.WaitGroup{},
 	}
+	s.bf.Store(newFilter(0, cfg.FilterFalsePositiveRate))
+	s.Conditional = types.NewConditional(s)
+
+	return s
 }
 
 // Init configures the storage.
 func (s *Storage) Init() error {
-	wfd, err := os.OpenFile(s.file, os.O_CREATE|os.O_WRONLY, 0666)
+	if err := s.cfg.Options.Check(); err != nil {
+		return err
+	}
+
+	if !s.cfg.ReadOnly {
+		// Finish or discard the interrupted restore, if any.
+		if err := recoverRestore(s.dir); err != nil {
+			return fmt.Errorf("error recovering restore: %w", err)
+		}
+
+		// Finish or discard the interrupted compaction, if any.
+		if err := recoverCompaction(s.dir); err != nil {
+			return fmt.Errorf("error recovering compaction: %w", err)
+		}
+
+		// Upgrade the segments written in an older format, if any.
+		if err := Migrate(s.dir); err != nil {
+			return fmt.Errorf("error migrating storage: %w", err)
+		}
+	}
+
+	horizon, err := loadHorizon(s.dir)
 	if err != nil {
-		return fmt.Errorf("error opening file for write fd: %w", err)
+		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
 	}
-	// Move to the end of the file.
-	if pos, err := wfd.Seek(0, io.SeekEnd); err != nil {
-		return fmt.Errorf("error seeking to end of file: %w", err)
-	} else {
-		s.lastSuccessWritePos = pos
+
+	// The writes the storage would be opened as of were compacted away
+	if s.cfg.AsOf > 0 && s.cfg.AsOf < horizon {
+		return fmt.Errorf("%w: as of %d, compacted up to %d", errors.ErrHistoryCompacted, s.cfg.AsOf, horizon)
 	}
+	s.horizon.Store(horizon)
 
-	rfd, err := os.OpenFile(s.file, os.O_RDONLY, 0666)
+	segments, wfd, err := s.open()
 	if err != nil {
-		return fmt.Errorf("error opening file for read fd: %w", err)
+		return err
 	}
 
-	s.rfd = rfd
+	s.segments = segments
 	s.wfd = wfd
+	s.initialized.Store(true)
 
 	// Don't perform any recovery if the storage is read-only.
 	if s.cfg.ReadOnly {
 		log.Infoln("storage is read-only, skipping recovery")
-		return nil
+		if s.cfg.AsOf > 0 {
+			log.Infoln("storage is opened as of write: ", s.cfg.AsOf)
+		}
+		if err := s.scan(false); err != nil {
+			return err
+		}
+	} else if err := s.DetectAndFix(); err != nil {
+		// Fix the corrupt data if there is any
+		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
 	}
 
-	// Fix the corrupt data if there is any
-	if err := s.DetectAndFix(); err != nil {
-		return fmt.Errorf("%s: %w", errors.ErrCorruptStorage, err)
+	if !s.cfg.ReadOnly {
+		if err := s.ensureExpirySegment(); err != nil {
+			return err
+		}
+	}
+
+	s.initFilter()
+
+	// Whatever survived till now is durable
+	s.markDurable(s.mark())
+
+	if !s.cfg.ReadOnly {
+		done := make(chan struct{})
+		s.done = done
+
+		if s.cfg.FilterFalsePositiveRate > 0 {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.watchFilter(done)
+			}()
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.sweepExpired(done)
+		}()
+
+		if s.cfg.Sync == config.SyncTypeAsync {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.flushAsync(done)
+			}()
+		}
 	}
 
 	return nil
 }
 
-// Get returns the value for the given key.
-func (s *Storage) Get(key []byte) ([]byte, error) {
-	if !s.isInit() {
-		return nil, errors.ErrStorageNotInitialized
+// open opens the segments of the storage along with the writing file
+// descriptor of the active segment.
+func (s *Storage) open() ([]*segment, *os.File, error) {
+	segments, err := openSegments(s.dir)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if !s.bf.Contains(key) {
-		return nil, errors.ErrKeyNotFound
-	}
+	// Start with an empty segment if the storage is new
+	if len(segments) == 0 {
+		seg, err := openSegment(segmentPath(s.dir, 0), 0)
+		if err != nil {
+			return nil, nil, err
+		}
 
-	var candidate *Packet = nil
-	var pr *reader = nil
+		segments = append(segments, seg)
+	}
 
-	err := s.ForEach(func(r *reader, p *Packet, err error) error {
-		// get the reader
-		if pr == nil {
-			pr = r
+	active := segments[len(segments)-1]
+	wfd, err := active.openWriter()
+	if err != nil {
+		for _, seg := range segments {
+			seg.close()
 		}
 
-		if err != nil {
-			// Although this should NEVER happen. NEVER.
-			if err == io.EOF {
-				return nil
-			}
-		}
+		return nil, nil, err
+	}
 
-		if utils.Equal(p.Key, key, func(a, b byte) bool { return a == b }) {
-			if p.Op == DelOp {
-				candidate = nil
-				return nil
+	// Every new segment starts with a header
+	if !s.cfg.ReadOnly && active.size.Load() == 0 {
+		if err := active.writeHeader(wfd); err != nil {
+			wfd.Close()
+			for _, seg := range segments {
+				seg.close()
 			}
 
-			if p.Op == SetOp {
-				candidate = p
-				return nil
-			}
+			return nil, nil, err
 		}
+	}
 
-		return nil
+	for _, seg := range segments {
+		if seg.hdr != nil && seg.hdr.workerID != uint16(gconfig.WorkerID) {
+			log.Warnf("segment %d was created by worker %d", seg.id, seg.hdr.workerID)
+		}
+	}
+
+	return segments, wfd, nil
+}
+
+// initFilter loads the saved bloom filter if it has seen every packet
+// in the storage, otherwise it rebuilds the filter from the keydir.
+func (s *Storage) initFilter() {
+	f, lastID, err := loadFilter(s.dir)
+	if err == nil && lastID == s.lastID {
+		s.bf.Store(f)
+		return
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnln("failed to load the bloom filter, rebuilding it: ", err)
+	}
+
+	f = newFilter(2*s.kd.len(), s.cfg.FilterFalsePositiveRate)
+	s.kd.forEach(func(key string, _ keydirEntry) {
+		f.Add([]byte(key))
 	})
+	s.bf.Store(f)
+}
+
+// Get returns the value for the given key.
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value for the given key.
+func (s *Storage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	val, _, err := s.GetVersionedContext(ctx, key)
+	return val, err
+}
+
+// GetVersioned returns the value for the given key along with its
+// version, which is the ID of the packet holding the value.
+func (s *Storage) GetVersioned(key []byte) ([]byte, uint64, error) {
+	return s.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext returns the value for the given key along with its
+// version, which is the ID of the packet holding the value.
+func (s *Storage) GetVersionedContext(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if !s.isInit() {
+		return nil, 0, errors.ErrStorageNotInitialized
+	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if !s.filter().Contains(key) {
+		return nil, 0, errors.ErrKeyNotFound
+	}
+
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	e, ok := s.live(key)
+	if !ok {
+		return nil, 0, errors.ErrKeyNotFound
+	}
+
+	val, err := s.read(e)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	if candidate == nil {
-		return nil, errors.ErrKeyNotFound
+	return val, e.id, nil
+}
+
+// read reads the value of the given entry, it should be called with
+// the read lock held so that the segment isn't swapped meanwhile.
+func (s *Storage) read(e keydirEntry) ([]byte, error) {
+	val := make([]byte, e.vlen)
+	if _, err := s.segment(e.seg).rfd.ReadAt(val, e.vpos); err != nil {
+		return nil, fmt.Errorf("error reading value: %w", err)
 	}
 
-	if err := pr.fill(candidate); err != nil {
-		return nil, err
+	if e.crc && crc32.Checksum(val, crcTable) != e.vcrc {
+		return nil, fmt.Errorf("%s: %w", errors.ErrCorruptStorage, ErrCorruptPacket)
 	}
 
-	return candidate.Val, nil
+	return val, nil
 }
 
 // Set sets the value for the given key.
-func (s *Storage) Set(key []byte, value []byte) error {
+func (s *Storage) Set(key []byte, value []byte, opts ...types.SetOption) error {
+	return s.SetContext(context.Background(), key, value, opts...)
+}
+
+// SetContext sets the value for the given key.
+func (s *Storage) SetContext(ctx context.Context, key []byte, value []byte, opts ...types.SetOption) error {
+	_, err := s.SetIf(ctx, key, value, opts, nil)
+	return err
+}
+
+// SetIf sets the value for the given key if the given condition, if any,
+// holds and returns the version of the new value.
+func (s *Storage) SetIf(ctx context.Context, key []byte, value []byte, opts []types.SetOption, cond types.Condition) (uint64, error) {
 	if !s.isInit() {
-		return errors.ErrStorageNotInitialized
+		return 0, errors.ErrStorageNotInitialized
 	}
 
 	if s.cfg.ReadOnly {
-		return errors.ErrReadOnlyStorage
+		return 0, errors.ErrReadOnlyStorage
+	}
+
+	o, err := types.NewSetOptions(opts...)
+	if err != nil {
+		return 0, err
 	}
+	exp := expiry(o)
 
 	s.wmu.Lock()
-	defer s.wmu.Unlock()
 
-	pw := newwriter(s.wfd)
-	if err := pw.write(
-		&Packet{
-			ID:  s.idgen.Next(),
-			Op:  SetOp,
-			Key: key,
-			Val: value,
-		},
-	); err != nil {
-		return fmt.Errorf("error writing packet: %w", err)
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		s.wmu.Unlock()
+		return 0, err
 	}
 
-	if s.cfg.Sync == config.SyncTypeSync {
-		if err := s.wfd.Sync(); err != nil {
-			return fmt.Errorf("error syncing file: %w", err)
+	// The condition is evaluated under the write lock so that no other
+	// write to the key can sneak in before the packet is appended.
+	if cond != nil {
+		e, ok := s.live(key)
+		if err := cond(e.id, ok); err != nil {
+			s.wmu.Unlock()
+			return 0, err
 		}
-	} else if s.cfg.Sync == config.SyncTypeAsync {
-		go s.wfd.Sync()
 	}
 
-	// record the last successful write position
-	pos, err := s.wfd.Seek(0, io.SeekCurrent)
-	if err != nil {
-		log.Warnln("failed to get current write position: ", err)
-		return nil
+	p := &Packet{
+		ID:  s.idgen.Next(),
+		Op:  SetOp,
+		Key: key,
+		Val: value,
+		Exp: exp,
 	}
+	seq, err := s.append(p)
+	s.wmu.Unlock()
 
-	s.lastSuccessWritePos = pos
+	if err != nil {
+		return 0, err
+	}
 
-	// add to bloom filter
-	s.bf.Add(key)
+	if err := s.commit(seq); err != nil {
+		return 0, err
+	}
 
-	return nil
+	return p.ID, nil
 }
 
 // Delete deletes the value for the given key.
 func (s *Storage) Delete(key []byte) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the value for the given key.
+func (s *Storage) DeleteContext(ctx context.Context, key []byte) error {
+	return s.DeleteIf(ctx, key, nil)
+}
+
+// DeleteIf deletes the value for the given key if the given condition,
+// if any, holds.
+func (s *Storage) DeleteIf(ctx context.Context, key []byte, cond types.Condition) error {
 	if !s.isInit() {
 		return errors.ErrStorageNotInitialized
 	}
@@ -206,76 +467,292 @@ func (s *Storage) Delete(key []byte) error {
 		return errors.ErrReadOnlyStorage
 	}
 
-	if !s.bf.Contains(key) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !s.filter().Contains(key) {
+		if cond != nil {
+			return cond(0, false)
+		}
+
 		return nil
 	}
 
 	s.wmu.Lock()
-	defer s.wmu.Unlock()
 
-	pw := newwriter(s.wfd)
-	if err := pw.write(
-		&Packet{
-			ID:  s.idgen.Next(),
-			Op:  DelOp,
-			Key: key,
-			Val: nil,
-		},
-	); err != nil {
-		return fmt.Errorf("error writing packet: %w", err)
+	// The context may have been done while waiting for the write lock
+	if err := ctx.Err(); err != nil {
+		s.wmu.Unlock()
+		return err
 	}
 
-	if s.cfg.Sync == config.SyncTypeSync {
-		if err := s.wfd.Sync(); err != nil {
-			return fmt.Errorf("error syncing file: %w", err)
+	e, ok := s.live(key)
+	if cond != nil {
+		if err := cond(e.id, ok); err != nil {
+			s.wmu.Unlock()
+			return err
 		}
-	} else if s.cfg.Sync == config.SyncTypeAsync {
-		go s.wfd.Sync()
+	}
+
+	// Writing a tombstone for a key which isn't live is a waste of space
+	if !ok {
+		s.wmu.Unlock()
+		return nil
+	}
+
+	seq, err := s.append(&Packet{
+		ID:  s.idgen.Next(),
+		Op:  DelOp,
+		Key: key,
+		Val: nil,
+	})
+	s.wmu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.commit(seq)
+}
+
+// live returns the entry of the given key if the key exists
+// and hasn't expired.
+func (s *Storage) live(key []byte) (keydirEntry, bool) {
+	e, ok := s.kd.get(key)
+	if !ok || expired(e.exp) {
+		return keydirEntry{}, false
+	}
+
+	return e, true
+}
+
+// append writes the given packets to the active segment in one go and
+// records them in the in-memory indexes. It returns the sequence number
+// of the write which is to be passed to commit once the write lock is
+// released.
+//
+// append should be called with the write lock held.
+func (s *Storage) append(packets ...*Packet) (uint64, error) {
+	// A single packet is buffered by the packet writer itself
+	var w io.Writer = s.wfd
+	buf := &bytes.Buffer{}
+	if len(packets) > 1 {
+		w = buf
+	}
+
+	pw := newwriter(w)
+	for _, p := range packets {
+		if err := pw.write(p); err != nil {
+			return 0, fmt.Errorf("error writing packet: %w", err)
+		}
+	}
+
+	if len(packets) > 1 {
+		if _, err := s.wfd.Write(buf.Bytes()); err != nil {
+			return 0, fmt.Errorf("error writing packets: %w", err)
+		}
+	}
+	s.seq++
+	for _, p := range packets {
+		s.written += p.size()
+	}
+
+	// The writes in sync mode are synced in groups by commit and
+	// the writes in async mode by the flusher.
+	if s.cfg.Sync == config.SyncTypeAsync {
+		s.maybeFlush()
 	}
 
 	// record the last successful write position
 	pos, err := s.wfd.Seek(0, io.SeekCurrent)
 	if err != nil {
 		log.Warnln("failed to get current write position: ", err)
-		return nil
+		return s.seq, nil
 	}
 
-	s.lastSuccessWritePos = pos
+	active := s.active()
+	active.size.Store(pos)
 
-	// remove from bloom filter
-	s.bf.Delete(key)
-	return nil
+	// add to the indexes
+	for _, p := range packets {
+		pos -= p.size()
+	}
+
+	for _, p := range packets {
+		p.seg = active.id
+		p.pos = pos
+		pos += p.size()
+		s.index(p)
+
+		for _, f := range []*bfsync{s.filter(), s.pending} {
+			if f == nil {
+				continue
+			}
+
+			switch p.Op {
+			case SetOp:
+				f.Add(p.Key)
+			case DelOp:
+				f.Delete(p.Key)
+			}
+		}
+	}
+	s.publish(s.seq, packets)
+
+	if pos >= s.cfg.SegmentSize {
+		if err := s.rollover(); err != nil {
+			log.Warnln("failed to roll over the active segment: ", err)
+		}
+	}
+
+	s.maybeCompact()
+
+	return s.seq, nil
+}
+
+// rollover makes the active segment immutable and starts a new
+// active segment.
+//
+// rollover should be called with the write lock held.
+func (s *Storage) rollover() error {
+	active := s.active()
+
+	seg, err := openSegment(segmentPath(s.dir, active.id+1), active.id+1)
+	if err != nil {
+		return err
+	}
+
+	wfd, err := seg.openWriter()
+	if err != nil {
+		seg.close()
+		return err
+	}
+
+	if err := seg.writeHeader(wfd); err != nil {
+		wfd.Close()
+		seg.close()
+		return err
+	}
+
+	// The segment won't be written to ever again, the writes on it
+	// aren't durable till the fsync is retried if it fails.
+	var syncErr error
+	if err := syncFile(s.wfd); err != nil {
+		syncErr = fmt.Errorf("error syncing the active segment: %w", err)
+	} else if len(s.retired) == 0 {
+		s.markDurable(s.mark())
+	}
+
+	// The segments lock waits for the fsync by commit in progress, if any
+	s.rmu.Lock()
+	if syncErr != nil {
+		s.retired = append(s.retired, s.wfd)
+	} else if err := s.wfd.Close(); err != nil {
+		log.Warnln("failed to close the active segment write fd: ", err)
+	}
+	s.segments = append(s.segments, seg)
+	s.rmu.Unlock()
+
+	s.wfd = wfd
+
+	return syncErr
+}
+
+// dropRetired closes the first n retired file descriptors, it should
+// be called with the write lock and the segments lock held.
+func (s *Storage) dropRetired(n int) {
+	// Close may have dropped them already
+	if n > len(s.retired) {
+		n = len(s.retired)
+	}
+
+	for _, fd := range s.retired[:n] {
+		if err := fd.Close(); err != nil {
+			log.Warnln("failed to close the retired segment write fd: ", err)
+		}
+	}
+	s.retired = s.retired[n:]
 }
 
 // Exists returns true if the given key exists.
 func (s *Storage) Exists(key []byte) (bool, error) {
+	return s.ExistsContext(context.Background(), key)
+}
+
+// ExistsContext returns true if the given key exists.
+//
+// The bloom filter rules out most of the missing keys, its hits are
+// confirmed against the keydir.
+func (s *Storage) ExistsContext(ctx context.Context, key []byte) (bool, error) {
 	if !s.isInit() {
 		return false, errors.ErrStorageNotInitialized
 	}
 
-	return s.bf.Contains(key), nil
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	if !s.filter().Contains(key) {
+		return false, nil
+	}
+
+	_, ok := s.live(key)
+	return ok, nil
 }
 
-// Len returns the number of keys in the storage.
-func (s *Storage) Len() (int, error) {
+// TTL returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTL(key []byte) (time.Duration, error) {
+	return s.TTLContext(context.Background(), key)
+}
+
+// TTLContext returns the duration after which the given key expires,
+// types.NoExpiry if the key never expires.
+func (s *Storage) TTLContext(ctx context.Context, key []byte) (time.Duration, error) {
 	if !s.isInit() {
 		return 0, errors.ErrStorageNotInitialized
 	}
 
-	set := make(map[string]struct{})
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
-	if err := s.ForEach(func(r *reader, p *Packet, err error) error {
-		if err != nil {
-			return err
-		}
+	if !s.filter().Contains(key) {
+		return 0, errors.ErrKeyNotFound
+	}
 
-		set[string(p.Key)] = struct{}{}
-		return nil
-	}); err != nil {
+	e, ok := s.live(key)
+	if !ok {
+		return 0, errors.ErrKeyNotFound
+	}
+
+	if e.exp == 0 {
+		return types.NoExpiry, nil
+	}
+
+	return time.Until(time.UnixMilli(e.exp)), nil
+}
+
+// Len returns the number of live keys in the storage.
+func (s *Storage) Len() (int, error) {
+	return s.LenContext(context.Background())
+}
+
+// LenContext returns the number of live keys in the storage.
+//
+// The keydir tracks the number of keys, so the context is checked
+// only before the keys are counted.
+func (s *Storage) LenContext(ctx context.Context) (int, error) {
+	if !s.isInit() {
+		return 0, errors.ErrStorageNotInitialized
+	}
+
+	if err := ctx.Err(); err != nil {
 		return 0, err
 	}
 
-	return len(set), nil
+	return s.kd.len(), nil
 }
 
 // PhysicalSnapshot writes the current state of the storage to the given writer.
@@ -283,59 +760,103 @@ func (s *Storage) Len() (int, error) {
 //
 // Note: The DB is locked for writes while the snapshot is being generated.
 func (s *Storage) PhysicalSnapshot(w io.Writer) error {
+	return s.PhysicalSnapshotContext(context.Background(), w)
+}
+
+// PhysicalSnapshotContext writes the current state of the storage to the
+// given writer like PhysicalSnapshot, the copy stops once the given
+// context is done which unlocks the DB for writes.
+func (s *Storage) PhysicalSnapshotContext(ctx context.Context, w io.Writer) error {
 	if !s.isInit() {
 		return errors.ErrStorageNotInitialized
 	}
 
-	// Get the last successful write position
-	lastSuccessWritePos := s.lastSuccessWritePos
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w = types.WriterWithContext(ctx, w)
 
-	// Create a new reader for the file.
-	tempfd, err := os.Open(s.file)
-	if err != nil {
-		return fmt.Errorf("error opening file for read fd: %w", err)
+	// The segments hold the writes ignored by the storage
+	if s.cfg.AsOf > 0 {
+		return ErrSnapshotAsOf
 	}
 
-	if _, err := io.CopyN(w, tempfd, lastSuccessWritePos); err != nil {
-		return fmt.Errorf("error generating snapshot: %w", err)
+	// Make sure that the segments aren't swapped by a compaction
+	// while the snapshot is being generated.
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	for _, seg := range s.segments {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Copy the segment up to its last successful write position
+		if _, err := io.Copy(w, io.NewSectionReader(seg.rfd, 0, seg.size.Load())); err != nil {
+			return fmt.Errorf("error generating snapshot: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// LogicalSnapshot writes the live keys of the storage to the given
+// writer, see logical.Export.
+func (s *Storage) LogicalSnapshot(w io.Writer) error {
+	return s.LogicalSnapshotContext(context.Background(), w)
+}
+
+// LogicalSnapshotContext writes the live keys of the storage to the given
+// writer, see logical.ExportContext.
+func (s *Storage) LogicalSnapshotContext(ctx context.Context, w io.Writer) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	return logical.ExportContext(ctx, s, w)
+}
+
+// Restore writes the keys of the logical snapshot read from the given
+// reader to the storage, see logical.Restore.
+func (s *Storage) Restore(r io.Reader) error {
+	return s.RestoreContext(context.Background(), r)
+}
+
+// RestoreContext writes the keys of the logical snapshot read from the
+// given reader to the storage, see logical.RestoreContext.
+func (s *Storage) RestoreContext(ctx context.Context, r io.Reader) error {
+	if !s.isInit() {
+		return errors.ErrStorageNotInitialized
+	}
+
+	if s.cfg.ReadOnly {
+		return errors.ErrReadOnlyStorage
+	}
+
+	return logical.RestoreContext(ctx, s, r)
+}
+
 // ForEach goes through the entire store and executes the given function
 // on each packet that it reads.
 func (s *Storage) ForEach(fn func(*reader, *Packet, error) error) error {
+	return s.ForEachContext(context.Background(), fn)
+}
+
+// ForEachContext goes through the entire store like ForEach, it stops
+// between the packets once the given context is done and returns the
+// error of the context.
+func (s *Storage) ForEachContext(ctx context.Context, fn func(*reader, *Packet, error) error) error {
 	// Fail silently if the storage hasn't been initialized yet
 	if !s.isInit() {
 		return errors.ErrStorageNotInitialized
 	}
 
-	pr := newreader(s.rfd)
-
-	for {
-		// don't read beyond the last successful write position
-		if pr.pos() >= s.lastSuccessWritePos {
-			break
-		}
-
-		packet := &Packet{}
-		err := pr.lread(packet)
-		if err != nil {
-			// If we reach the end of the file, break.
-			//
-			// We don't call the function with the packet
-			// because we know that the packet has to be invalid.
-			//
-			// Due to the design of TLV, it is impossible to encounter
-			// EOF while reading a packet (even at the end).
-			if err == io.EOF {
-				break
-			}
-		}
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
 
-		if _err := fn(pr, packet, err); _err != nil {
-			return _err
+	for _, seg := range s.segments {
+		if err := seg.forEachContext(ctx, fn); err != nil {
+			return err
 		}
 	}
 
@@ -353,44 +874,242 @@ func (s *Storage) DetectAndFix() error {
 		return errors.ErrStorageNotInitialized
 	}
 
-	lastSuccessRead := int64(0)
+	return s.scan(true)
+}
 
-	// Go through the entire store and try to see if we can get valid
-	// packet reads from the store
-	return s.ForEach(func(pr *reader, p *Packet, err error) error {
-		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				log.Warnln("Found corrupted data in the store. Trying to fix it...")
+// scan goes through all the segments and populates the in-memory indexes.
+//
+// Segments with a hint matching them are populated from their hints
+// without being read. Rest of the segments are read entirely.
+//
+// If fix is true then the corrupt data found in a segment is removed from
+// it, otherwise the corrupt data is ignored without modifying the segment.
+// Not modifying the segments makes scan suitable for read-only stores.
+func (s *Storage) scan(fix bool) error {
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	return s.scanSegments(fix)
+}
+
+// scanSegments does the actual scan, it should be called with either
+// of the read or write locks held.
+func (s *Storage) scanSegments(fix bool) error {
+	for _, seg := range s.segments {
+		// The hints hold only the latest writes, which may have
+		// been made after the write the storage is opened as of.
+		if s.cfg.AsOf == 0 && s.loadHint(seg) {
+			continue
+		}
+
+		lastSuccessRead := seg.hdr.size()
+
+		// discard handles the corrupt data found after the last
+		// successful read position.
+		discard := func() error {
+			if !fix {
+				log.Warnln("Found corrupted data in the store. Ignoring it...")
+
+				// Pretend that the segment ends at the last successful read position
+				seg.size.Store(lastSuccessRead)
+				return nil
+			}
+
+			log.Warnln("Found corrupted data in the store. Trying to fix it...")
+
+			if err := s.truncate(seg, lastSuccessRead); err != nil {
+				return err
+			}
+
+			log.Infoln("Successfully fixed the corrupted data in the store")
+			return nil
+		}
+
+		fr := &framer{}
+
+		// Go through the entire segment and try to see if we can get valid
+		// packet reads from the segment
+		if err := seg.forEach(func(pr *reader, p *Packet, err error) error {
+			// Make sure that the value isn't corrupt either
+			if err == nil {
+				err = pr.verify(p)
+			}
 
-				// Discard the rest of the file
-				if err := s.wfd.Truncate(lastSuccessRead); err != nil {
-					return fmt.Errorf("error truncating file: %w", err)
+			var ready []*Packet
+			if err == nil {
+				ready, err = fr.add(pr, p)
+			}
+
+			if err != nil {
+				if err == io.ErrUnexpectedEOF || err == ErrCorruptPacket {
+					return discard()
 				}
 
-				// No need to update the read position since we only rely on ReadAt
-				// and that doesn't changes os.File read position
+				return err
+			}
 
-				// Move the write position to the last successful read position
-				s.wfd.Seek(lastSuccessRead, io.SeekStart)
+			if len(ready) == 0 {
+				return nil
+			}
 
-				// Update the last successful write position
-				s.lastSuccessWritePos = lastSuccessRead
+			// Update the last successful read position, a partially
+			// read batch isn't successful yet.
+			lastSuccessRead = pr.pos()
 
-				log.Infoln("Successfully fixed the corrupted data in the store")
+			// The writes made after the write the storage is opened as
+			// of are ignored, a batch is made as of its frame.
+			if s.cfg.AsOf > 0 && ready[0].ID > s.cfg.AsOf {
 				return nil
 			}
 
+			// Insert the packets into the indexes
+			for _, p := range ready {
+				s.index(p)
+			}
+
+			return nil
+		}); err != nil {
 			return err
 		}
 
-		// Update the last successful read position
-		lastSuccessRead = pr.pos()
+		// The batch cut short by the end of the segment was never
+		// written completely.
+		if fr.pending() {
+			if err := discard(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadHint populates the in-memory indexes from the hint of the given
+// segment and returns true if the hint exists and matches the segment.
+func (s *Storage) loadHint(seg *segment) bool {
+	h, err := readHint(s.dir, seg.id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read the hint of segment %d, ignoring it: %s", seg.id, err)
+		}
+
+		return false
+	}
+
+	if !h.matches(seg) {
+		return false
+	}
+
+	for _, he := range h.entries {
+		s.indexEntry(he.op, he.key, he.e)
+	}
+	seg.garbage += h.garbage
+	seg.hinted = h.size
+
+	return true
+}
+
+// writeHints writes the hints of the segments which don't have a
+// hint matching them.
+//
+// writeHints should be called with the write lock held.
+func (s *Storage) writeHints() {
+	for _, seg := range s.segments {
+		if seg.hdr == nil || seg.hinted == seg.size.Load() {
+			continue
+		}
+
+		h, err := buildHint(seg)
+		if err != nil {
+			log.Warnf("failed to generate the hint of segment %d: %s", seg.id, err)
+			continue
+		}
+
+		if err := writeHint(s.dir, seg.id, h); err != nil {
+			log.Warnf("failed to write the hint of segment %d: %s", seg.id, err)
+			continue
+		}
+		seg.hinted = h.size
+	}
+}
 
-		// Insert the packet into the bloom filter
-		s.bf.Add(p.Key)
+// truncate discards the data of the given segment beyond the given
+// position.
+func (s *Storage) truncate(seg *segment, pos int64) error {
+	if seg != s.active() {
+		if err := os.Truncate(seg.path, pos); err != nil {
+			return fmt.Errorf("error truncating file: %w", err)
+		}
 
+		seg.size.Store(pos)
 		return nil
-	})
+	}
+
+	// Discard the rest of the file
+	if err := s.wfd.Truncate(pos); err != nil {
+		return fmt.Errorf("error truncating file: %w", err)
+	}
+
+	// No need to update the read position since we only rely on ReadAt
+	// and that doesn't changes os.File read position
+
+	// Move the write position to the last successful read position
+	s.wfd.Seek(pos, io.SeekStart)
+
+	// Update the last successful write position
+	seg.size.Store(pos)
+
+	return nil
+}
+
+// index records the given packet in the keydir.
+func (s *Storage) index(p *Packet) {
+	s.indexEntry(p.Op, p.Key, entry(p))
+
+	// tombstones and batch frames themselves are garbage as well
+	if p.Op == DelOp || p.Op == BatchOp {
+		s.segment(p.seg).garbage += p.size()
+	}
+}
+
+// indexEntry records the packet with the given operation, key and
+// location in the keydir.
+//
+// The bloom filter isn't updated so that the filter saved on the last
+// shutdown can be reused, see initFilter.
+func (s *Storage) indexEntry(op byte, key []byte, e keydirEntry) {
+	switch op {
+	case SetOp:
+		if old, ok := s.kd.put(key, e); ok {
+			s.segment(old.seg).garbage += old.size()
+		}
+	case DelOp:
+		if old, ok := s.kd.delete(key); ok {
+			s.segment(old.seg).garbage += old.size()
+		}
+	}
+
+	if e.id > s.lastID {
+		s.lastID = e.id
+	}
+}
+
+// entry returns the keydir entry pointing to the given packet.
+func entry(p *Packet) keydirEntry {
+	e := keydirEntry{
+		id:   p.ID,
+		seg:  p.seg,
+		pos:  p.pos,
+		vpos: p.valpos(),
+		vlen: p.vlen(),
+		exp:  p.Exp,
+	}
+	if p.crc != nil {
+		e.crc = true
+		e.vcrc = p.crc.val
+	}
+
+	return e
 }
 
 // Close closes the storage.
@@ -399,15 +1118,52 @@ func (s *Storage) Close() error {
 		return errors.ErrStorageNotInitialized
 	}
 
-	if err := s.rfd.Close(); err != nil {
-		return fmt.Errorf("error closing read fd: %w", err)
+	// Stop the background workers, if any.
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
 	}
-	s.rfd = nil
+
+	// Wait for the running compaction, if any.
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.endWatches(errors.ErrStorageClosed)
+
+	// The hints save a full scan of the segments on the next startup
+	if !s.cfg.ReadOnly {
+		if err := syncFiles(s.retired, s.wfd); err != nil {
+			log.Warnln("failed to sync the active segment: ", err)
+		} else {
+			s.markDurable(s.mark())
+			s.writeHints()
+		}
+
+		if err := saveFilter(s.dir, s.filter(), s.lastID); err != nil {
+			log.Warnln("failed to save the bloom filter: ", err)
+		}
+	}
+
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for _, seg := range s.segments {
+		if err := seg.close(); err != nil {
+			return fmt.Errorf("error closing read fd: %w", err)
+		}
+	}
+	s.segments = nil
+	s.dropRetired(len(s.retired))
 
 	if err := s.wfd.Close(); err != nil {
 		return fmt.Errorf("error closing write fd: %w", err)
 	}
 	s.wfd = nil
+	s.initialized.Store(false)
 
 	return nil
 }
@@ -416,6 +1172,14 @@ func (s *Storage) Close() error {
 //
 // This is a low level API and should not be used by the user.
 func (s *Storage) GetByID(id uint64) (*Packet, error) {
+	return s.GetByIDContext(context.Background(), id)
+}
+
+// GetByIDContext returns a packet corresponding to the given ID, the
+// search stops between the packets once the given context is done.
+//
+// This is a low level API and should not be used by the user.
+func (s *Storage) GetByIDContext(ctx context.Context, id uint64) (*Packet, error) {
 	if !s.isInit() {
 		return nil, errors.ErrStorageNotInitialized
 	}
@@ -423,7 +1187,7 @@ func (s *Storage) GetByID(id uint64) (*Packet, error) {
 	var packet *Packet
 	desiredErr := fmt.Errorf("desired")
 
-	if err := s.ForEach(func(r *reader, p *Packet, err error) error {
+	if err := s.ForEachContext(ctx, func(r *reader, p *Packet, err error) error {
 		if err != nil {
 			return err
 		}
@@ -445,7 +1209,36 @@ func (s *Storage) GetByID(id uint64) (*Packet, error) {
 	return nil, errors.ErrKeyNotFound
 }
 
+// active returns the active segment.
+func (s *Storage) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+// segment returns the segment with the given ID.
+//
+// segment should be called with either of the read or write locks held.
+func (s *Storage) segment(id uint64) *segment {
+	i := sort.Search(len(s.segments), func(i int) bool {
+		return s.segments[i].id >= id
+	})
+
+	return s.segments[i]
+}
+
+// size returns the total size of the storage in bytes.
+func (s *Storage) size() int64 {
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	size := int64(0)
+	for _, seg := range s.segments {
+		size += seg.size.Load()
+	}
+
+	return size
+}
+
 // isInit returns true if the storage is initialized.
 func (s *Storage) isInit() bool {
-	return s.rfd != nil && s.wfd != nil
+	return s.initialized.Load()
 }
@@ -2,12 +2,24 @@ package stupid
 
 import (
 	"bytes"
+	"context"
+	stderrors "errors"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/utkarsh-pro/use/pkg/id"
 	"github.com/utkarsh-pro/use/pkg/storage/config"
 	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+	"github.com/utkarsh-pro/use/pkg/structures/bloom/dibf"
+	"github.com/utkarsh-pro/use/pkg/tlvrw"
 	"github.com/utkarsh-pro/use/pkg/utils"
 )
 
@@ -167,10 +179,11 @@ func TestAll(t *testing.T) {
 
 			t.Run("Len", func(t *testing.T) {
 				t.Run("Valid Len", func(t *testing.T) {
+					// The deleted key isn't counted
 					if n, err := s.Len(); err != nil {
 						t.Error(err)
-					} else if n != setLength {
-						t.Error("expected", setLength, "got", n)
+					} else if n != setLength-1 {
+						t.Error("expected", setLength-1, "got", n)
 					}
 
 					if err := s.Set([]byte("foo3"), []byte("bazz")); err != nil {
@@ -179,8 +192,8 @@ func TestAll(t *testing.T) {
 
 					if n, err := s.Len(); err != nil {
 						t.Error(err)
-					} else if n != setLength+1 {
-						t.Error("expected", setLength+1, "got", n)
+					} else if n != setLength {
+						t.Error("expected", setLength, "got", n)
 					}
 				})
 			})
@@ -253,73 +266,2783 @@ func TestStorage_DetectAndFix(t *testing.T) {
 
 	// Write huge chunk of data to the storage
 	for i := 0; i < 1e5; i++ {
-		// A packet is going to be made up of 4 TLVs
+		// A packet is going to be made up of 5 TLVs
 		// 1st TLV size => 1 + 4 + 8 = 13
 		// 2nd TLV size => 1 + 4 + 1 = 6
 		// 3rd TLV size => 1 + 4 + 5 = 10
 		// 4th TLV size => 1 + 4 + 5 = 10
-		// Total size => 13 + 6 + 10 + 10 = 39
+		// 5th TLV size => 1 + 4 + 8 = 13
+		// Total size => 13 + 6 + 10 + 10 + 13 = 52
 		if err := s.Set(utils.GenerateRandomBytes(5), utils.GenerateRandomBytes(5)); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	// Close the storage
-	if err := s.Close(); err != nil {
+	// Close the storage
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		corruptBytes int
+	}{
+		{
+			name:         "corrupt last byte",
+			corruptBytes: 1,
+		},
+		{
+			name:         "corrupt last 2 bytes",
+			corruptBytes: 2,
+		},
+		{
+			name:         "corrupt random bytes [1, 40)",
+			corruptBytes: utils.GetRandomInRange(1, 40),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Corrupt the storage by removing the last byte of the file
+			f, err := os.OpenFile(segmentPath(dir, 0), os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Get position of the last byte
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Remove the random number of bytes from the end of the file
+			if err := f.Truncate(fi.Size() - int64(utils.GetRandomInRange(1, 40))); err != nil {
+				t.Fatal(err)
+			}
+
+			// Close the file
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// create the store again
+			s = New(dir, config.DefaultConfig())
+
+			// Detect and fix the storage
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStorage_Keydir(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(dir, config.DefaultConfig())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the same keys multiple times so that the keydir
+	// has to track the latest packet.
+	for i := 0; i < 10; i++ {
+		for _, k := range []string{"foo", "bar", "baz"} {
+			if err := s.Set([]byte(k), []byte(k+utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := s.Delete([]byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfgs := map[string]config.Config{
+		"readwrite": config.DefaultConfig(),
+		"readonly":  config.DefaultConfig().WithReadOnly(),
+	}
+
+	for name, cfg := range cfgs {
+		t.Run(name, func(t *testing.T) {
+			s := New(dir, cfg)
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			for _, k := range []string{"foo", "bar"} {
+				val, err := s.Get([]byte(k))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(val) != k+"9" {
+					t.Error("expected", k+"9", "got", string(val))
+				}
+			}
+
+			if _, err := s.Get([]byte("baz")); err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+		})
+	}
+}
+
+func TestStorage_Compact(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(dir, config.DefaultConfig().WithCompactionRatio(0))
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			k, v := "key"+utils.IntToString(j), utils.IntToString(i)
+			if err := s.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			expected[k] = v
+		}
+	}
+
+	for j := 0; j < 5; j++ {
+		k := "key" + utils.IntToString(j)
+		if err := s.Delete([]byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, k)
+	}
+
+	sizeBefore := s.size()
+
+	// Keep writing while the compaction is in progress
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := s.Set([]byte("concurrent"), []byte(utils.IntToString(i))); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	expected["concurrent"] = "99"
+
+	if s.size() >= sizeBefore {
+		t.Error("expected compaction to shrink the store", "before", sizeBefore, "after", s.size())
+	}
+
+	check := func(t *testing.T, s *Storage) {
+		for k, v := range expected {
+			val, err := s.Get([]byte(k))
+			if err != nil {
+				t.Fatal(k, err)
+			}
+
+			if string(val) != v {
+				t.Error("expected", v, "got", string(val))
+			}
+		}
+
+		for j := 0; j < 5; j++ {
+			if _, err := s.Get([]byte("key" + utils.IntToString(j))); err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+		}
+	}
+
+	t.Run("after compaction", func(t *testing.T) {
+		check(t, s)
+	})
+
+	// The store should still be writable after the compaction
+	if err := s.Set([]byte("after"), []byte("compaction")); err != nil {
+		t.Fatal(err)
+	}
+	expected["after"] = "compaction"
+
+	t.Run("nothing written", func(t *testing.T) {
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		active := s.active().id
+
+		// The active segment holds no packets, so it isn't rolled over
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		if s.active().id != active {
+			t.Error("expected the active segment", active, "got", s.active().id)
+		}
+	})
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("after reopen", func(t *testing.T) {
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s)
+	})
+}
+
+func TestStorage_Segments(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.DefaultConfig().WithCompactionRatio(0).WithSegmentSize(1024)
+
+	s := New(dir, cfg)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 10; j++ {
+			k, v := "key"+utils.IntToString(j), utils.IntToString(i)
+			if err := s.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			expected[k] = v
+		}
+	}
+
+	if len(s.segments) < 2 {
+		t.Fatal("expected the active segment to roll over", "segments", len(s.segments))
+	}
+
+	check := func(t *testing.T, s *Storage) {
+		for k, v := range expected {
+			val, err := s.Get([]byte(k))
+			if err != nil {
+				t.Fatal(k, err)
+			}
+
+			if string(val) != v {
+				t.Error("expected", v, "got", string(val))
+			}
+		}
+	}
+
+	t.Run("rollover", func(t *testing.T) {
+		check(t, s)
+	})
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s)
+	})
+
+	t.Run("interrupted compaction", func(t *testing.T) {
+		// A compaction file which wasn't committed has to be discarded
+		if err := os.WriteFile(filepath.Join(dir, compactFile), []byte("garbage"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, compactFile)); !os.IsNotExist(err) {
+			t.Error("expected the compaction file to be removed")
+		}
+
+		check(t, s)
+
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.segments) != 2 {
+			t.Error("expected a merged and an active segment", "segments", len(s.segments))
+		}
+
+		check(t, s)
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("legacy file", func(t *testing.T) {
+		legacy := t.TempDir()
+
+		// Write the data file the way it was written before the storage
+		// was split into segments and the packets got checksums.
+		buf := &bytes.Buffer{}
+		tw := tlvrw.NewWriter(buf)
+		id := uint64(0)
+		for k, v := range expected {
+			id++
+			tw.Write(tlvrw.NewTLV(IDTypeTLV, encodeid(id)))
+			tw.Write(tlvrw.NewTLV(OpTypeTLV, []byte{SetOp}))
+			tw.Write(tlvrw.NewTLV(KeyTypeTLV, []byte(k)))
+			tw.Write(tlvrw.NewTLV(ValTypeTLV, []byte(v)))
+		}
+
+		if err := os.WriteFile(filepath.Join(legacy, legacyFile), buf.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(legacy, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s)
+
+		if _, err := os.Stat(filepath.Join(legacy, legacyFile)); !os.IsNotExist(err) {
+			t.Error("expected the legacy file to be replaced by segment 0")
+		}
+	})
+}
+
+func TestStorage_Header(t *testing.T) {
+	// v0 returns a data file without the header holding n packets
+	// without checksums.
+	v0 := func(n int) []byte {
+		buf := &bytes.Buffer{}
+		tw := tlvrw.NewWriter(buf)
+		for i := 0; i < n; i++ {
+			tw.Write(tlvrw.NewTLV(IDTypeTLV, encodeid(uint64(i))))
+			tw.Write(tlvrw.NewTLV(OpTypeTLV, []byte{SetOp}))
+			tw.Write(tlvrw.NewTLV(KeyTypeTLV, []byte("k0"+utils.IntToString(i))))
+			tw.Write(tlvrw.NewTLV(ValTypeTLV, []byte("v0"+utils.IntToString(i))))
+		}
+
+		return buf.Bytes()
+	}
+
+	check := func(t *testing.T, s *Storage, n int) {
+		for i := 0; i < n; i++ {
+			val, err := s.Get([]byte("k0" + utils.IntToString(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(val) != "v0"+utils.IntToString(i) {
+				t.Error("expected", "v0"+utils.IntToString(i), "got", string(val))
+			}
+		}
+	}
+
+	t.Run("new segment", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		hdr := s.active().hdr
+		if hdr == nil {
+			t.Fatal("expected the segment to have a header")
+		}
+
+		if hdr.version != FormatVersion || !hdr.checksums() {
+			t.Error("unexpected header", "version", hdr.version, "options", hdr.options)
+		}
+
+		if size := s.size(); size != hdr.size() {
+			t.Error("expected", hdr.size(), "got", size)
+		}
+	})
+
+	t.Run("migration", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(segmentPath(dir, 0), v0(10), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if hdr := s.active().hdr; hdr == nil || hdr.version != FormatVersion {
+			t.Fatal("expected the segment to be migrated")
+		}
+
+		check(t, s, 10)
+	})
+
+	t.Run("migration of corrupt segment", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// Drop the last byte of the last packet
+		data := v0(10)
+		if err := os.WriteFile(segmentPath(dir, 0), data[:len(data)-1], 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s, 9)
+
+		if _, err := s.Get([]byte("k09")); err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		dir := t.TempDir()
+		data := v0(10)
+		if err := os.WriteFile(filepath.Join(dir, legacyFile), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig().WithReadOnly())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s, 10)
+
+		// The files are left untouched in the read only mode
+		got, err := os.ReadFile(filepath.Join(dir, legacyFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Error("expected the legacy file to be untouched")
+		}
+	})
+
+	t.Run("interrupted migration", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, legacyFile), v0(10), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(segmentPath(dir, 0)+migrateExt, []byte("garbage"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s, 10)
+
+		for _, name := range []string{legacyFile, filepath.Base(segmentPath(dir, 0)) + migrateExt} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Error("expected the file to be removed", "file", name)
+			}
+		}
+	})
+
+	t.Run("incomplete header", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(segmentPath(dir, 0), newHeader().encode()[:10], 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := s.Set([]byte("k00"), []byte("v00")); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, s, 1)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(segmentPath(dir, 0), []byte("not a data file"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); !stderrors.Is(err, ErrUnknownFormat) {
+			t.Error("expected ErrUnknownFormat", "got", err)
+		}
+	})
+
+	t.Run("newer format", func(t *testing.T) {
+		dir := t.TempDir()
+
+		hdr := newHeader()
+		hdr.version = FormatVersion + 1
+		if err := os.WriteFile(segmentPath(dir, 0), hdr.encode(), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); !stderrors.Is(err, ErrUnsupportedFormat) {
+			t.Error("expected ErrUnsupportedFormat", "got", err)
+		}
+	})
+}
+
+func TestStorage_Hint(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.DefaultConfig().WithCompactionRatio(0).WithSegmentSize(1024)
+
+	s := New(dir, cfg)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 10; j++ {
+			if err := s.Set([]byte("key"+utils.IntToString(j)), []byte(utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Delete([]byte("key" + utils.IntToString(i%10))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// state returns the keydir and the garbage of every segment
+	state := func(s *Storage) (map[string]keydirEntry, map[uint64]int64) {
+		garbage := make(map[uint64]int64)
+		for _, seg := range s.segments {
+			garbage[seg.id] = seg.garbage
+		}
+
+		return s.kd.snapshot(), garbage
+	}
+
+	expectedKd, expectedGarbage := state(s)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, s *Storage) {
+		kd, garbage := state(s)
+		if len(kd) != len(expectedKd) {
+			t.Error("expected", len(expectedKd), "keys", "got", len(kd))
+		}
+
+		for k, e := range expectedKd {
+			if kd[k] != e {
+				t.Error("expected", e, "got", kd[k], "key", k)
+			}
+		}
+
+		for id, g := range expectedGarbage {
+			if garbage[id] != g {
+				t.Error("expected", g, "garbage", "got", garbage[id], "segment", id)
+			}
+		}
+	}
+
+	t.Run("clean shutdown", func(t *testing.T) {
+		paths, err := listSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for id := range paths {
+			if _, err := os.Stat(hintPath(dir, id)); err != nil {
+				t.Error("expected a hint file", "segment", id, "err", err)
+			}
+		}
+
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, seg := range s.segments {
+			h, err := readHint(dir, seg.id)
+			if err != nil || !h.matches(seg) {
+				t.Error("expected a matching hint", "segment", seg.id, "err", err)
+			}
+		}
+
+		check(t, s)
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("corrupt hint", func(t *testing.T) {
+		path := hintPath(dir, 0)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data[len(data)/2] ^= 1
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := readHint(dir, 0); err != ErrCorruptHint {
+			t.Error("expected ErrCorruptHint", "got", err)
+		}
+
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, s)
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The hint is regenerated on the shutdown
+		if _, err := readHint(dir, 0); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("stale hint", func(t *testing.T) {
+		paths, err := listSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Losing the tail of the active segment makes its hint stale
+		active := uint64(0)
+		for id := range paths {
+			if id > active {
+				active = id
+			}
+		}
+
+		fi, err := os.Stat(paths[active])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Truncate(paths[active], fi.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if h, err := readHint(dir, active); err != nil || h.matches(s.active()) {
+			t.Error("expected the hint to be stale", "err", err)
+		}
+
+		// Only the last packet, the tombstone of key9, is gone
+		for i := 0; i < 9; i++ {
+			k := "key" + utils.IntToString(i)
+			if _, ok := expectedKd[k]; !ok {
+				continue
+			}
+
+			if _, err := s.Get([]byte(k)); err != nil {
+				t.Error(k, err)
+			}
+		}
+
+		if _, err := s.Get([]byte("key9")); err != nil {
+			t.Error("expected the deletion of key9 to be lost", "got", err)
+		}
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		for i := 0; i < 100; i++ {
+			if err := s.Set([]byte("key"+utils.IntToString(i%10)), []byte(utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		merged := s.segments[0]
+		h, err := readHint(dir, merged.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !h.matches(merged) || len(h.entries) != 10 || h.garbage != 0 {
+			t.Error("unexpected hint of the merged segment", "entries", len(h.entries), "garbage", h.garbage)
+		}
+	})
+}
+
+func TestStorage_Bloom(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(dir, config.DefaultConfig())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := s.Set([]byte("k0"+utils.IntToString(i)), []byte("v0"+utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastID := s.lastID
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, id, err := loadFilter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != lastID {
+		t.Error("expected", lastID, "got", id)
+	}
+
+	for i := 0; i < 10; i++ {
+		if !f.Contains([]byte("k0" + utils.IntToString(i))) {
+			t.Error("expected the saved filter to contain", "k0"+utils.IntToString(i))
+		}
+	}
+
+	// exists reopens the storage and reports whether k00 exists
+	exists := func(t *testing.T) bool {
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		ok, err := s.Exists([]byte("k00"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ok
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		// An empty filter which has seen every packet is reused as is
+		if err := saveFilter(dir, newFilter(0, 0.01), lastID); err != nil {
+			t.Fatal(err)
+		}
+
+		if exists(t) {
+			t.Error("expected the saved filter to be reused")
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		if err := saveFilter(dir, newFilter(0, 0.01), lastID-1); err != nil {
+			t.Fatal(err)
+		}
+
+		if !exists(t) {
+			t.Error("expected the filter to be rebuilt")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		path := filepath.Join(dir, bfFile)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data[len(data)/2] ^= 1
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := loadFilter(dir); !stderrors.Is(err, ErrCorruptFilter) {
+			t.Error("expected ErrCorruptFilter", "got", err)
+		}
+
+		if !exists(t) {
+			t.Error("expected the filter to be rebuilt")
+		}
+	})
+}
+
+func TestStorage_FilterRegeneration(t *testing.T) {
+	setup := func(t *testing.T) *Storage {
+		s := New(t.TempDir(), config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 5000; i++ {
+			if err := s.Set([]byte("key"+utils.IntToString(i)), []byte(utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if s.maybeRegenerateFilter() {
+			t.Error("expected the filter to be useful")
+		}
+
+		return s
+	}
+
+	// check makes sure that every key is found through the filter
+	check := func(t *testing.T, s *Storage) {
+		for i := 0; i < 5000; i++ {
+			val, err := s.Get([]byte("key" + utils.IntToString(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(val) != utils.IntToString(i) {
+				t.Error("expected", utils.IntToString(i), "got", string(val))
+			}
+		}
+	}
+
+	t.Run("outgrown filter", func(t *testing.T) {
+		s := setup(t)
+		defer s.Close()
+
+		// A filter which is too small for the store
+		small := newBfSync(dibf.New(1000, 7, 1000, nil))
+		s.kd.forEach(func(key string, _ keydirEntry) {
+			small.Add([]byte(key))
+		})
+		s.bf.Store(small)
+
+		// Keep reading and writing while the filter is regenerated
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				k := []byte("concurrent" + utils.IntToString(i))
+				if err := s.Set(k, k); err != nil {
+					t.Error(err)
+				}
+
+				if _, err := s.Get(k); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+
+		if !s.maybeRegenerateFilter() {
+			t.Error("expected the filter to be regenerated")
+		}
+		<-done
+
+		if s.filter() == small {
+			t.Fatal("expected the filter to be swapped")
+		}
+
+		if fpr := s.filter().CurrentFalsePositiveRate(); fpr > 0.01 {
+			t.Error("expected the false positive rate to drop", "got", fpr)
+		}
+
+		check(t, s)
+
+		for i := 0; i < 1000; i++ {
+			if !s.filter().Contains([]byte("concurrent" + utils.IntToString(i))) {
+				t.Error("expected the concurrent write to be in the filter", i)
+			}
+		}
+	})
+
+	t.Run("stale bits", func(t *testing.T) {
+		s := setup(t)
+		defer s.Close()
+
+		// Keys which were deleted but whose bits were left behind
+		for i := 0; i < 50000; i++ {
+			s.filter().Add([]byte("deleted" + utils.IntToString(i)))
+		}
+
+		if !s.maybeRegenerateFilter() {
+			t.Error("expected the filter to be regenerated")
+		}
+
+		check(t, s)
+
+		if count := s.filter().ApproximateCount(); count > 2*5000 {
+			t.Error("expected the stale bits to be gone", "count", count)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s := New(t.TempDir(), config.DefaultConfig().WithFilterFalsePositiveRate(0))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		s.bf.Store(newBfSync(dibf.New(10, 1, 10, nil)))
+		for i := 0; i < 100; i++ {
+			s.filter().Add([]byte(utils.IntToString(i)))
+		}
+
+		if s.maybeRegenerateFilter() {
+			t.Error("expected the regeneration to be disabled")
+		}
+	})
+}
+
+func TestStorage_ExistsLen(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(dir, config.DefaultConfig().WithCompactionRatio(0))
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := s.Set([]byte("key"+utils.IntToString(i%10)), []byte(utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := s.Delete([]byte("key" + utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T, s *Storage) {
+		if n, err := s.Len(); err != nil {
+			t.Fatal(err)
+		} else if n != 5 {
+			t.Error("expected", 5, "got", n)
+		}
+
+		for i := 0; i < 10; i++ {
+			k := []byte("key" + utils.IntToString(i))
+
+			// Pretend that the deletes collided with a dirty region of the
+			// filter and the bits of the deleted keys were left behind.
+			s.filter().Add(k)
+
+			exists, err := s.Exists(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if exists != (i >= 5) {
+				t.Error("expected", i >= 5, "got", exists, "key", string(k))
+			}
+		}
+	}
+
+	t.Run("live", func(t *testing.T) {
+		check(t, s)
+	})
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("after compaction", func(t *testing.T) {
+		check(t, s)
+	})
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("after reopen", func(t *testing.T) {
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s)
+	})
+}
+
+func TestStorage_Checksum(t *testing.T) {
+	// Every packet is made up of a 3 byte key and a 3 byte value
+	// which makes every packet 13 + 6 + 8 + 8 + 13 = 48 bytes long.
+	const packetSize = 48
+
+	// Packets start right after the segment header
+	start := int(tlvrw.Size(hdrLen))
+
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := s.Set([]byte("k0"+utils.IntToString(i)), []byte("v0"+utils.IntToString(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The segments with hints aren't read on startup, the corruption
+		// in them is detected only when the corrupt packet is read.
+		if err := os.Remove(hintPath(dir, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		return dir
+	}
+
+	testCases := []struct {
+		name    string
+		corrupt func(data []byte)
+	}{
+		{
+			name: "flipped bit in key",
+			corrupt: func(data []byte) {
+				data[start+5*packetSize+13+6+5] ^= 1
+			},
+		},
+		{
+			name: "flipped bit in value",
+			corrupt: func(data []byte) {
+				data[start+5*packetSize+13+6+8+5] ^= 1
+			},
+		},
+		{
+			name: "flipped bit in checksum",
+			corrupt: func(data []byte) {
+				data[start+5*packetSize+13+6+8+8+5] ^= 1
+			},
+		},
+		{
+			name: "garbage key length",
+			corrupt: func(data []byte) {
+				copy(data[start+5*packetSize+13+6+1:], []byte{0xf0, 0xff, 0xff, 0xff})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := setup(t)
+
+			data, err := os.ReadFile(segmentPath(dir, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tc.corrupt(data)
+
+			if err := os.WriteFile(segmentPath(dir, 0), data, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			s := New(dir, config.DefaultConfig())
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Everything starting from the corrupt packet should be gone
+			if size := s.size(); size != int64(start+5*packetSize) {
+				t.Error("expected", start+5*packetSize, "got", size)
+			}
+
+			for i := 0; i < 10; i++ {
+				_, err := s.Get([]byte("k0" + utils.IntToString(i)))
+				if i < 5 && err != nil {
+					t.Error(err)
+				}
+
+				if i >= 5 && err != errors.ErrKeyNotFound {
+					t.Error("expected ErrKeyNotFound", "got", err)
+				}
+			}
+		})
+	}
+
+	t.Run("packets without checksum", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// Write the packets the way they were written before
+		// the checksums were introduced.
+		buf := &bytes.Buffer{}
+		tw := tlvrw.NewWriter(buf)
+		for i := 0; i < 10; i++ {
+			tw.Write(tlvrw.NewTLV(IDTypeTLV, encodeid(uint64(i))))
+			tw.Write(tlvrw.NewTLV(OpTypeTLV, []byte{SetOp}))
+			tw.Write(tlvrw.NewTLV(KeyTypeTLV, []byte("k0"+utils.IntToString(i))))
+			tw.Write(tlvrw.NewTLV(ValTypeTLV, []byte("v0"+utils.IntToString(i))))
+		}
+
+		if err := os.WriteFile(segmentPath(dir, 0), buf.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// The packets without checksums get them during the migration
+		if err := s.Set([]byte("k10"), []byte("v10")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			val, err := s.Get([]byte("k0" + utils.IntToString(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(val) != "v0"+utils.IntToString(i) {
+				t.Error("expected", "v0"+utils.IntToString(i), "got", string(val))
+			}
+		}
+
+		if val, err := s.Get([]byte("k10")); err != nil {
+			t.Fatal(err)
+		} else if string(val) != "v10" {
+			t.Error("expected", "v10", "got", string(val))
+		}
+	})
+}
+
+func TestStorage_GroupCommit(t *testing.T) {
+	t.Run("groups the fsyncs", func(t *testing.T) {
+		g := newGroupCommit()
+
+		var seq, syncs atomic.Uint64
+		fsync := func() (uint64, error) {
+			syncs.Add(1)
+			covered := seq.Load()
+			time.Sleep(10 * time.Millisecond)
+			return covered, nil
+		}
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if err := g.wait(seq.Add(1), fsync); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := syncs.Load(); n >= 100 {
+			t.Error("expected the fsyncs to be grouped, got", n, "fsyncs")
+		}
+	})
+
+	t.Run("reports the error to the group", func(t *testing.T) {
+		g := newGroupCommit()
+
+		fail := stderrors.New("fsync failed")
+		if err := g.wait(1, func() (uint64, error) { return 1, fail }); err != fail {
+			t.Error("expected", fail, "got", err)
+		}
+
+		// The failed write isn't durable, the next fsync retries it
+		if err := g.wait(1, func() (uint64, error) { return 1, nil }); err != nil {
+			t.Error(err)
+		}
+
+		if err := g.wait(1, func() (uint64, error) {
+			t.Error("expected durable write not to be synced again")
+			return 1, nil
+		}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("retries a failed rollover fsync", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := New(dir, config.DefaultConfig().WithSync().WithSegmentSize(1024))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := s.Set([]byte("key1"), []byte("value1")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the fsyncs of the segment being rolled over fail
+		var failing atomic.Bool
+		old := s.wfd
+		syncFile = func(f *os.File) error {
+			if f == old && failing.Load() {
+				return stderrors.New("fsync failed")
+			}
+
+			return f.Sync()
+		}
+		defer func() { syncFile = (*os.File).Sync }()
+
+		failing.Store(true)
+		if err := s.Set([]byte("key2"), bytes.Repeat([]byte("v"), 2048)); err == nil {
+			t.Fatal("expected the write on the unsynced segment to fail")
+		}
+
+		if n := len(s.retired); n != 1 {
+			t.Fatal("expected the segment to be retired, got", n, "retired")
+		}
+
+		if s.gc.synced >= s.seq {
+			t.Error("expected the durable writes to stop before the unsynced segment, got", s.gc.synced)
+		}
+
+		// The next commit retries the fsync of the retired segment
+		failing.Store(false)
+		if err := s.Set([]byte("key3"), []byte("value3")); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := len(s.retired); n != 0 {
+			t.Error("expected the retired segment to be closed, got", n, "retired")
+		}
+
+		if s.gc.synced != s.seq {
+			t.Error("expected", s.seq, "got", s.gc.synced)
+		}
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// Small segments make the writers race with the rollovers
+		s := New(dir, config.DefaultConfig().WithSync().WithSegmentSize(4096))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 50; j++ {
+					k := "key" + utils.IntToString(i) + "-" + utils.IntToString(j)
+					if err := s.Set([]byte(k), []byte(k)); err != nil {
+						t.Error(err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if n, err := s.Len(); err != nil {
+			t.Fatal(err)
+		} else if n != 500 {
+			t.Error("expected", 500, "got", n)
+		}
+	})
+}
+
+func TestStorage_AsyncFlush(t *testing.T) {
+	// eventually waits for the writes to be durable
+	eventually := func(t *testing.T, s *Storage) {
+		t.Helper()
+
+		expected := Position{Segment: s.active().id, Offset: s.size()}
+		for i := 0; i < 100; i++ {
+			if s.Durable() == expected {
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Error("expected", expected, "got", s.Durable())
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		s := New(t.TempDir(), config.DefaultConfig().WithAsyncSync().WithSyncInterval(10*time.Millisecond).WithSyncBytes(0))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if d := s.Durable(); d.Offset != s.size() {
+			t.Error("expected", s.size(), "got", d.Offset)
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := s.Set([]byte("key"+utils.IntToString(i)), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		eventually(t, s)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		s := New(t.TempDir(), config.DefaultConfig().WithAsyncSync().WithSyncInterval(0).WithSyncBytes(1024))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		start := s.Durable()
+		if err := s.Set([]byte("key"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		// The write is below the threshold
+		time.Sleep(50 * time.Millisecond)
+		if d := s.Durable(); d != start {
+			t.Error("expected", start, "got", d)
+		}
+
+		if err := s.Set([]byte("key"), []byte(strings.Repeat(" ", 1024))); err != nil {
+			t.Fatal(err)
+		}
+
+		eventually(t, s)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		s := New(t.TempDir(), config.DefaultConfig().WithAsyncSync().WithSyncInterval(time.Hour).WithSyncBytes(0))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("key"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		expected := Position{Segment: s.active().id, Offset: s.size()}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if d := s.Durable(); d != expected {
+			t.Error("expected", expected, "got", d)
+		}
+
+		// The flusher is gone
+		if s.done != nil {
+			t.Error("expected the background workers to be stopped")
+		}
+	})
+}
+
+func TestStorage_TTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+
+	// setup writes a key which expires and a key which never expires
+	setup := func(t *testing.T, dir string) *Storage {
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("expiring"), []byte("val"), types.WithTTL(ttl)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("forever"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	// check verifies whether the expiring key is present or not
+	check := func(t *testing.T, s *Storage, present bool) {
+		t.Helper()
+
+		val, err := s.Get([]byte("expiring"))
+		if present && (err != nil || string(val) != "val") {
+			t.Error("expected", "val", "got", string(val), err)
+		}
+		if !present && err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+
+		if exists, err := s.Exists([]byte("expiring")); err != nil {
+			t.Fatal(err)
+		} else if exists != present {
+			t.Error("expected", present, "got", exists)
+		}
+
+		expected := 1
+		if present {
+			expected = 2
+		}
+		if n, err := s.Len(); err != nil {
+			t.Fatal(err)
+		} else if n != expected {
+			t.Error("expected", expected, "got", n)
+		}
+
+		left, err := s.TTL([]byte("expiring"))
+		if present && (err != nil || left <= 0 || left > ttl) {
+			t.Error("expected TTL in (0, ", ttl, "] got", left, err)
+		}
+		if !present && err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+
+		if left, err := s.TTL([]byte("forever")); err != nil || left != types.NoExpiry {
+			t.Error("expected", types.NoExpiry, "got", left, err)
+		}
+	}
+
+	t.Run("expiry", func(t *testing.T) {
+		s := setup(t, t.TempDir())
+		defer s.Close()
+
+		check(t, s, true)
+		time.Sleep(ttl)
+		check(t, s, false)
+
+		// Deleting an expired key is a no-op
+		size := s.size()
+		if err := s.Delete([]byte("expiring")); err != nil {
+			t.Fatal(err)
+		}
+		if s.size() != size {
+			t.Error("expected no tombstone for the expired key")
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		for _, hints := range []bool{true, false} {
+			dir := t.TempDir()
+
+			s := setup(t, dir)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !hints {
+				if err := os.Remove(hintPath(dir, 0)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s = New(dir, config.DefaultConfig())
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+
+			check(t, s, true)
+			time.Sleep(ttl)
+			check(t, s, false)
+
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		s := setup(t, t.TempDir())
+		defer s.Close()
+
+		time.Sleep(ttl)
+		s.sweep()
+
+		if _, ok := s.kd.get([]byte("expiring")); ok {
+			t.Error("expected the expired key to be swept")
+		}
+
+		if garbage := s.active().garbage; garbage == 0 {
+			t.Error("expected the expired packet to be garbage")
+		}
+
+		check(t, s, false)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := setup(t, dir)
+		time.Sleep(ttl)
+
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, s, false)
+
+		// Only the 13 + 6 + 12 + 8 + 13 = 52 bytes long packet of the
+		// key which never expires is left
+		if size := s.segments[0].size.Load(); size != s.segments[0].hdr.size()+52 {
+			t.Error("expected", s.segments[0].hdr.size()+52, "got", size)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		check(t, s, false)
+	})
+
+	t.Run("corrupt expiry", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := setup(t, dir)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(hintPath(dir, 0))
+
+		data, err := os.ReadFile(segmentPath(dir, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The expiry of the first packet follows its 8 byte key
+		// and 3 byte value
+		start := int(tlvrw.Size(hdrLen))
+		data[start+13+6+13+8+5] ^= 1
+		if err := os.WriteFile(segmentPath(dir, 0), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s = New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if n, err := s.Len(); err != nil || n != 0 {
+			t.Error("expected", 0, "got", n, err)
+		}
+	})
+
+	t.Run("segments without expiry", func(t *testing.T) {
+		dir := t.TempDir()
+
+		h := newHeader()
+		h.options = OptChecksums
+		if err := os.WriteFile(segmentPath(dir, 0), h.encode(), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if len(s.segments) != 2 || !s.active().hdr.expiry() {
+			t.Error("expected the packets with expiry to go to a new segment")
+		}
+	})
+}
+
+func TestStorage_Conditional(t *testing.T) {
+	s := New(t.TempDir(), config.DefaultConfig())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	key := []byte("key")
+
+	v1, err := s.SetIfAbsent(key, []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.SetIfAbsent(key, []byte("v2")); err != errors.ErrKeyExists {
+		t.Error("expected ErrKeyExists", "got", err)
+	}
+
+	val, version, err := s.GetVersioned(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "v1" || version != v1 {
+		t.Error("expected", "v1", v1, "got", string(val), version)
+	}
+
+	if _, err := s.SetIfVersion(key, []byte("v2"), v1+1); err != errors.ErrVersionMismatch {
+		t.Error("expected ErrVersionMismatch", "got", err)
+	}
+
+	v2, err := s.SetIfVersion(key, []byte("v2"), v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Error("expected version greater than", v1, "got", v2)
+	}
+
+	if err := s.DeleteIfVersion(key, v1); err != errors.ErrVersionMismatch {
+		t.Error("expected ErrVersionMismatch", "got", err)
+	}
+
+	if err := s.DeleteIfVersion(key, v2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteIfVersion(key, v2); err != errors.ErrVersionMismatch {
+		t.Error("expected ErrVersionMismatch", "got", err)
+	}
+
+	if _, err := s.SetIfVersion(key, []byte("v3"), v2); err != errors.ErrVersionMismatch {
+		t.Error("expected ErrVersionMismatch", "got", err)
+	}
+
+	t.Run("expired key is absent", func(t *testing.T) {
+		if _, err := s.SetIfAbsent([]byte("expiring"), []byte("v1"), types.WithTTL(10*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		if _, err := s.SetIfAbsent([]byte("expiring"), []byte("v2")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		counter := []byte("counter")
+		if _, err := s.SetIfAbsent(counter, []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 50; {
+					val, version, err := s.GetVersioned(counter)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					n := utils.StringToInt(string(val)) + 1
+					if _, err := s.SetIfVersion(counter, []byte(utils.IntToString(n)), version); err == errors.ErrVersionMismatch {
+						continue
+					} else if err != nil {
+						t.Error(err)
+						return
+					}
+
+					j++
+				}
+			}()
+		}
+		wg.Wait()
+
+		if val, err := s.Get(counter); err != nil || string(val) != "500" {
+			t.Error("expected", "500", "got", string(val), err)
+		}
+	})
+}
+
+func TestStorage_Iterator(t *testing.T) {
+	s := New(t.TempDir(), config.DefaultConfig())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, k := range []string{"b", "a", "ab", "abc", "b\xff", "ba", "c", "d", "e"} {
+		if err := s.Set([]byte(k), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte(k), []byte("val-"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set([]byte("bb"), []byte("val-bb"), types.WithTTL(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// collect returns the keys the iterator goes over
+	collect := func(t *testing.T, it types.Iterator) []string {
+		t.Helper()
+
+		var keys []string
+		for it.Next() {
+			if string(it.Value()) != "val-"+string(it.Key()) {
+				t.Error("expected", "val-"+string(it.Key()), "got", string(it.Value()))
+			}
+
+			keys = append(keys, string(it.Key()))
+		}
+
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		return keys
+	}
+
+	testCases := []struct {
+		name     string
+		opts     types.IterOptions
+		expected []string
+	}{
+		{
+			name:     "all",
+			expected: []string{"a", "ab", "abc", "b", "ba", "b\xff", "c", "e"},
+		},
+		{
+			name:     "range",
+			opts:     types.IterOptions{Start: []byte("ab"), End: []byte("c")},
+			expected: []string{"ab", "abc", "b", "ba", "b\xff"},
+		},
+		{
+			name:     "prefix",
+			opts:     types.IterOptions{Prefix: []byte("b")},
+			expected: []string{"b", "ba", "b\xff"},
+		},
+		{
+			name:     "prefix and range",
+			opts:     types.IterOptions{Prefix: []byte("a"), Start: []byte("ab"), End: []byte("abc")},
+			expected: []string{"ab"},
+		},
+		{
+			name:     "reverse",
+			opts:     types.IterOptions{Reverse: true},
+			expected: []string{"e", "c", "b\xff", "ba", "b", "abc", "ab", "a"},
+		},
+		{
+			name:     "reverse range",
+			opts:     types.IterOptions{Start: []byte("ab"), End: []byte("c"), Reverse: true},
+			expected: []string{"b\xff", "ba", "b", "abc", "ab"},
+		},
+		{
+			name:     "reverse prefix",
+			opts:     types.IterOptions{Prefix: []byte("b"), Reverse: true},
+			expected: []string{"b\xff", "ba", "b"},
+		},
+		{
+			name: "empty range",
+			opts: types.IterOptions{Start: []byte("f")},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			it, err := s.NewIterator(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+
+			keys := collect(t, it)
+			if strings.Join(keys, ",") != strings.Join(tc.expected, ",") {
+				t.Error("expected", tc.expected, "got", keys)
+			}
+		})
+	}
+
+	t.Run("seek", func(t *testing.T) {
+		it, err := s.NewIterator(types.IterOptions{Start: []byte("ab"), End: []byte("c")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+
+		if !it.Seek([]byte("abd")) || string(it.Key()) != "b" {
+			t.Error("expected", "b", "got", string(it.Key()))
+		}
+
+		if !it.Next() || string(it.Key()) != "ba" {
+			t.Error("expected", "ba", "got", string(it.Key()))
+		}
+
+		// Seeking before the range starts at the range
+		if !it.Seek([]byte("a")) || string(it.Key()) != "ab" {
+			t.Error("expected", "ab", "got", string(it.Key()))
+		}
+
+		if it.Seek([]byte("c")) {
+			t.Error("expected no key beyond the range, got", string(it.Key()))
+		}
+
+		rit, err := s.NewIterator(types.IterOptions{End: []byte("c"), Reverse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rit.Close()
+
+		if !rit.Seek([]byte("bz")) || string(rit.Key()) != "ba" {
+			t.Error("expected", "ba", "got", string(rit.Key()))
+		}
+
+		if !rit.Seek([]byte("z")) || string(rit.Key()) != "b\xff" {
+			t.Error("expected", "b\xff", "got", string(rit.Key()))
+		}
+	})
+
+	t.Run("writes during iteration", func(t *testing.T) {
+		it, err := s.NewIterator(types.IterOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+
+		if !it.Next() || string(it.Key()) != "a" {
+			t.Fatal("expected", "a", "got", string(it.Key()))
+		}
+
+		if err := s.Delete([]byte("ab")); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Set([]byte("ab"), []byte("val-ab"))
+
+		if !it.Next() || string(it.Key()) != "abc" {
+			t.Error("expected", "abc", "got", string(it.Key()))
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		it, err := s.NewIterator(types.IterOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if it.Next() {
+			t.Error("expected closed iterator not to move")
+		}
+	})
+}
+
+func TestStorage_LogicalSnapshot(t *testing.T) {
+	src := New(t.TempDir(), config.DefaultConfig())
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := src.Set([]byte("key"+utils.IntToString(i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := src.Set([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := src.Delete([]byte("key" + utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := src.Set([]byte("expiring"), []byte("val"), types.WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Set([]byte("expired"), []byte("val"), types.WithTTL(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	if err := src.LogicalSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	// restore restores the given snapshot to a new storage
+	restore := func(t *testing.T, snapshot []byte) (*Storage, error) {
+		dst := New(t.TempDir(), config.DefaultConfig())
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dst.Close() })
+
+		return dst, dst.Restore(bytes.NewReader(snapshot))
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		dst, err := restore(t, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := dst.Len(); err != nil || n != 91 {
+			t.Error("expected", 91, "got", n, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			val, err := dst.Get([]byte("key" + utils.IntToString(i)))
+			if i < 10 && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+
+			if i >= 10 && (err != nil || string(val) != "val"+utils.IntToString(i)) {
+				t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+			}
+		}
+
+		if ttl, err := dst.TTL([]byte("expiring")); err != nil || ttl <= 0 || ttl > time.Hour {
+			t.Error("expected TTL in (0, 1h] got", ttl, err)
+		}
+
+		if _, err := dst.Get([]byte("expired")); err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+	})
+
+	t.Run("corrupt snapshot", func(t *testing.T) {
+		for _, corrupt := range []func() []byte{
+			// flipped bit in an entry
+			func() []byte {
+				data := append([]byte{}, snapshot...)
+				data[len(data)/2] ^= 1
+				return data
+			},
+			// truncated snapshot
+			func() []byte {
+				return snapshot[:len(snapshot)-1]
+			},
+			// missing trailer
+			func() []byte {
+				return snapshot[:len(snapshot)-int(tlvrw.Size(12))]
+			},
+		} {
+			dst, err := restore(t, corrupt())
+			if !stderrors.Is(err, logical.ErrCorruptSnapshot) {
+				t.Error("expected ErrCorruptSnapshot", "got", err)
+			}
+
+			// Nothing is restored from a corrupt snapshot
+			if n, err := dst.Len(); err != nil || n != 0 {
+				t.Error("expected", 0, "got", n, err)
+			}
+		}
+	})
+}
+
+func TestStorage_RestorePhysical(t *testing.T) {
+	cfg := config.DefaultConfig().WithCompactionRatio(0).WithSegmentSize(1024)
+
+	src := New(t.TempDir(), cfg)
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := src.Set([]byte("key"+utils.IntToString(i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := src.Set([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := src.Delete([]byte("key" + utils.IntToString(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := src.NewBatch()
+	b.Put([]byte("batch1"), []byte("val"))
+	b.Put([]byte("batch2"), []byte("val"), types.WithTTL(time.Hour))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(src.segments) < 2 {
+		t.Fatal("expected multiple segments, got", len(src.segments))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := src.PhysicalSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	// verify verifies that the given storage holds the data of src
+	verify := func(t *testing.T, s *Storage) {
+		t.Helper()
+
+		if n, err := s.Len(); err != nil || n != 92 {
+			t.Error("expected", 92, "got", n, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			key := []byte("key" + utils.IntToString(i))
+
+			val, err := s.Get(key)
+			if i < 10 && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+
+			if i >= 10 && (err != nil || string(val) != "val"+utils.IntToString(i)) {
+				t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+			}
+
+			// The filter is rebuilt from the restored keys
+			if ok, err := s.Exists(key); err != nil || ok != (i >= 10) {
+				t.Error("expected", i >= 10, "got", ok, err)
+			}
+		}
+
+		if ttl, err := s.TTL([]byte("batch2")); err != nil || ttl <= 0 || ttl > time.Hour {
+			t.Error("expected TTL in (0, 1h] got", ttl, err)
+		}
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		dir := t.TempDir()
+		dst := New(dir, cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.RestorePhysical(bytes.NewReader(snapshot), false); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, dst)
+
+		// The restored storage takes writes and survives restarts
+		if err := dst.Set([]byte("new"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, restoreDir+doneExt)); !os.IsNotExist(err) {
+			t.Error("expected the staging directory to be removed, got", err)
+		}
+
+		dst = New(dir, cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		if val, err := dst.Get([]byte("new")); err != nil || string(val) != "val" {
+			t.Error("expected", "val", "got", string(val), err)
+		}
+
+		if err := dst.Delete([]byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, dst)
+	})
+
+	t.Run("non-empty storage", func(t *testing.T) {
+		dst := New(t.TempDir(), cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		if err := dst.Set([]byte("existing"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.RestorePhysical(bytes.NewReader(snapshot), false); err != errors.ErrStorageNotEmpty {
+			t.Fatal("expected ErrStorageNotEmpty", "got", err)
+		}
+
+		if err := dst.RestorePhysical(bytes.NewReader(snapshot), true); err != nil {
+			t.Fatal(err)
+		}
+
+		// The existing data is replaced by the snapshot
+		if _, err := dst.Get([]byte("existing")); err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+		verify(t, dst)
+	})
+
+	t.Run("corrupt snapshot", func(t *testing.T) {
+		dst := New(t.TempDir(), cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		if err := dst.Set([]byte("existing"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, corrupt := range [][]byte{
+			// empty snapshot
+			{},
+			// flipped bit in a value
+			func() []byte {
+				data := append([]byte{}, snapshot...)
+				data[bytes.Index(data, []byte("val50"))] ^= 1
+				return data
+			}(),
+			// truncated snapshot
+			snapshot[:len(snapshot)-1],
+		} {
+			if err := dst.RestorePhysical(bytes.NewReader(corrupt), true); !stderrors.Is(err, errors.ErrCorruptSnapshot) {
+				t.Error("expected ErrCorruptSnapshot", "got", err)
+			}
+
+			// Nothing is restored from a corrupt snapshot
+			if n, err := dst.Len(); err != nil || n != 1 {
+				t.Error("expected", 1, "got", n, err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dst.dir, restoreDir)); !os.IsNotExist(err) {
+				t.Error("expected the staging directory to be removed, got", err)
+			}
+		}
+	})
+
+	t.Run("interrupted restore", func(t *testing.T) {
+		dir := t.TempDir()
+		dst := New(dir, cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.Set([]byte("existing"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Simulate a crash right after the restore was committed
+		staging := filepath.Join(dir, restoreDir)
+		if err := stageSnapshot(context.Background(), staging, bytes.NewReader(snapshot)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Rename(staging, staging+commitExt); err != nil {
+			t.Fatal(err)
+		}
+
+		dst = New(dir, cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		if _, err := dst.Get([]byte("existing")); err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+		verify(t, dst)
+	})
+}
+
+func TestStorage_AsOf(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.DefaultConfig().WithCompactionRatio(0)
+
+	s := New(dir, cfg)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// mark returns the ID as of now, the writes made in the same
+	// millisecond are kept apart by sleeping.
+	mark := func() uint64 {
+		time.Sleep(2 * time.Millisecond)
+		defer time.Sleep(2 * time.Millisecond)
+
+		return id.Max(time.Now())
+	}
+
+	before := mark()
+
+	if err := s.Set([]byte("key"), []byte("val1")); err != nil {
+		t.Fatal(err)
+	}
+	_, v1, err := s.GetVersioned([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterVal1 := mark()
+
+	if err := s.Set([]byte("key"), []byte("val2")); err != nil {
+		t.Fatal(err)
+	}
+	afterVal2 := mark()
+
+	if err := s.Delete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	afterDelete := mark()
+
+	b := s.NewBatch()
+	b.Put([]byte("key"), []byte("val3"))
+	b.Put([]byte("other"), []byte("val"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_, v3, err := s.GetVersioned([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set([]byte("expiring"), []byte("val"), types.WithTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		asOf uint64
+		want string
+	}{
+		{"before the first write", "key", before, ""},
+		{"as of a write", "key", v1, "val1"},
+		{"as of a time", "key", afterVal1, "val1"},
+		{"as of an overwrite", "key", afterVal2, "val2"},
+		{"as of a delete", "key", afterDelete, ""},
+		{"as of a batch", "key", v3, "val3"},
+		{"as of the latest write", "other", id.Max(time.Now()), "val"},
+		{"as of a write before the batch", "other", afterDelete, ""},
+		{"as of a write before the expiry", "expiring", id.Max(time.Now()), "val"},
+		{"as of a time after the expiry", "expiring", id.Max(time.Now().Add(time.Hour)), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			val, err := s.GetAsOf([]byte(tc.key), tc.asOf)
+			if tc.want == "" {
+				if err != errors.ErrKeyNotFound {
+					t.Error("expected ErrKeyNotFound", "got", string(val), err)
+				}
+				return
+			}
+
+			if err != nil || string(val) != tc.want {
+				t.Error("expected", tc.want, "got", string(val), err)
+			}
+		})
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("open as of", func(t *testing.T) {
+		s := New(dir, cfg.WithAsOf(afterVal2))
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if val, err := s.Get([]byte("key")); err != nil || string(val) != "val2" {
+			t.Error("expected", "val2", "got", string(val), err)
+		}
+
+		if _, err := s.Get([]byte("other")); err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+
+		if n, err := s.Len(); err != nil || n != 1 {
+			t.Error("expected", 1, "got", n, err)
+		}
+
+		// The later writes are out of reach
+		if val, err := s.GetAsOf([]byte("key"), v3); err != nil || string(val) != "val2" {
+			t.Error("expected", "val2", "got", string(val), err)
+		}
+
+		if err := s.Set([]byte("key"), []byte("val")); err != errors.ErrReadOnlyStorage {
+			t.Error("expected ErrReadOnlyStorage", "got", err)
+		}
+
+		if err := s.PhysicalSnapshot(&bytes.Buffer{}); err != ErrSnapshotAsOf {
+			t.Error("expected ErrSnapshotAsOf", "got", err)
+		}
+
+		// The logical snapshot undoes the later writes
+		buf := &bytes.Buffer{}
+		if err := s.LogicalSnapshot(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := New(t.TempDir(), cfg)
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		if err := dst.Restore(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if val, err := dst.Get([]byte("key")); err != nil || string(val) != "val2" {
+			t.Error("expected", "val2", "got", string(val), err)
+		}
+
+		if n, err := dst.Len(); err != nil || n != 1 {
+			t.Error("expected", 1, "got", n, err)
+		}
+	})
+
+	t.Run("compacted", func(t *testing.T) {
+		s := New(dir, cfg)
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("live"), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		afterOld := mark()
+
+		if err := s.Set([]byte("live"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(t *testing.T, s *Storage) {
+			t.Helper()
+
+			// The overwritten and the deleted values are gone
+			if _, err := s.GetAsOf([]byte("key"), afterVal1); err != errors.ErrHistoryCompacted {
+				t.Error("expected ErrHistoryCompacted", "got", err)
+			}
+
+			if _, err := s.GetAsOf([]byte("live"), afterOld); err != errors.ErrHistoryCompacted {
+				t.Error("expected ErrHistoryCompacted", "got", err)
+			}
+
+			if val, err := s.GetAsOf([]byte("live"), id.Max(time.Now())); err != nil || string(val) != "new" {
+				t.Error("expected", "new", "got", string(val), err)
+			}
+		}
+
+		t.Run("compaction", func(t *testing.T) {
+			check(t, s)
+		})
+
+		buf := &bytes.Buffer{}
+		if err := s.PhysicalSnapshot(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("reopen", func(t *testing.T) {
+			s := New(dir, cfg)
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			check(t, s)
+		})
+
+		t.Run("open as of", func(t *testing.T) {
+			s := New(dir, cfg.WithAsOf(afterVal2))
+			if err := s.Init(); !stderrors.Is(err, errors.ErrHistoryCompacted) {
+				t.Error("expected ErrHistoryCompacted", "got", err)
+			}
+		})
+
+		t.Run("restore", func(t *testing.T) {
+			dst := New(t.TempDir(), cfg)
+			if err := dst.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			if err := dst.RestorePhysical(buf, false); err != nil {
+				t.Fatal(err)
+			}
+
+			check(t, dst)
+		})
+	})
+}
+
+func TestStorage_History(t *testing.T) {
+	s := New(t.TempDir(), config.DefaultConfig().WithCompactionRatio(0))
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+
+	if err := s.Set([]byte("key"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set([]byte("other"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set([]byte("key"), []byte("val2"), types.WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := s.NewBatch()
+	b.Put([]byte("key"), []byte("value3"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := s.History([]byte("key"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest writes go first
+	want := []struct {
+		deleted bool
+		size    int
+		expiry  bool
+		val     string
+	}{
+		{false, 6, false, "value3"},
+		{true, 0, false, ""},
+		{false, 4, true, "val2"},
+		{false, 2, false, "v1"},
+	}
+	if len(revs) != len(want) {
+		t.Fatal("expected", len(want), "revisions, got", len(revs))
+	}
+
+	for i, w := range want {
+		rev := revs[i]
+		if rev.Deleted != w.deleted || rev.Size != w.size || rev.Expiry.IsZero() == w.expiry {
+			t.Errorf("revision %d: unexpected %+v", i, rev)
+		}
+
+		if rev.Time.Before(start.Truncate(time.Millisecond)) || rev.Time.After(time.Now()) {
+			t.Errorf("revision %d: unexpected time %s", i, rev.Time)
+		}
+
+		if i > 0 && rev.ID >= revs[i-1].ID {
+			t.Errorf("revision %d: expected ID < %d, got %d", i, revs[i-1].ID, rev.ID)
+		}
+
+		// The values are fetched on demand
+		val, err := s.GetAsOf([]byte("key"), rev.ID)
+		if w.deleted && err != errors.ErrKeyNotFound {
+			t.Errorf("revision %d: expected ErrKeyNotFound, got %s %v", i, val, err)
+		}
+
+		if !w.deleted && (err != nil || string(val) != w.val) {
+			t.Errorf("revision %d: expected %s, got %s %v", i, w.val, val, err)
+		}
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		page, err := s.History([]byte("key"), 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page) != 2 || page[0].ID != revs[1].ID || page[1].ID != revs[2].ID {
+			t.Error("expected revisions 1 and 2, got", page)
+		}
+
+		page, err = s.History([]byte("key"), 2, 4)
+		if err != nil || len(page) != 0 {
+			t.Error("expected no revisions, got", page, err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		revs, err := s.History([]byte("missing"), 10, 0)
+		if err != nil || len(revs) != 0 {
+			t.Error("expected no revisions, got", revs, err)
+		}
+	})
+}
+
+func TestStorage_Watch(t *testing.T) {
+	s := New(t.TempDir(), config.DefaultConfig().WithCompactionRatio(0))
+	// The storage is closed by the last test
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// recv returns the next event of the given watch
+	recv := func(t *testing.T, w types.Watch) (types.Event, bool) {
+		t.Helper()
+
+		select {
+		case ev, ok := <-w.Events():
+			return ev, ok
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return types.Event{}, false
+		}
+	}
+
+	// expect expects the given events from the given watch, an empty
+	// value means a deleted key.
+	expect := func(t *testing.T, w types.Watch, kvs ...string) []types.Event {
+		t.Helper()
+
+		var events []types.Event
+		for i := 0; i < len(kvs); i += 2 {
+			ev, ok := recv(t, w)
+			if !ok {
+				t.Fatal("watch ended early: ", w.Err())
+			}
+
+			if string(ev.Key) != kvs[i] || string(ev.Value) != kvs[i+1] || ev.Deleted != (kvs[i+1] == "") {
+				t.Errorf("expected %s=%q, got %s=%q deleted=%t", kvs[i], kvs[i+1], ev.Key, ev.Value, ev.Deleted)
+			}
+
+			if len(events) > 0 && ev.ID <= events[len(events)-1].ID {
+				t.Errorf("expected ID > %d, got %d", events[len(events)-1].ID, ev.ID)
+			}
+
+			events = append(events, ev)
+		}
+
+		return events
+	}
+
+	// write makes the writes of the tests
+	write := func(t *testing.T) {
+		t.Helper()
+
+		for _, kv := range [][2]string{{"a1", "v1"}, {"b1", "v1"}, {"a2", "v2"}} {
+			if err := s.Set([]byte(kv[0]), []byte(kv[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.Delete([]byte("a1")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := s.NewBatch()
+		b.Put([]byte("a3"), []byte("v3"))
+		b.Put([]byte("b2"), []byte("v2"))
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix, err := s.Watch(types.WatchOptions{Prefix: []byte("a")})
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	testCases := []struct {
-		name         string
-		corruptBytes int
-	}{
-		{
-			name:         "corrupt last byte",
-			corruptBytes: 1,
-		},
-		{
-			name:         "corrupt last 2 bytes",
-			corruptBytes: 2,
-		},
-		{
-			name:         "corrupt random bytes [1, 40)",
-			corruptBytes: utils.GetRandomInRange(1, 40),
-		},
+	key, err := s.Watch(types.WatchOptions{Key: []byte("b2")})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			// Corrupt the storage by removing the last byte of the file
-			f, err := os.OpenFile(s.file, os.O_RDWR, 0644)
-			if err != nil {
-				t.Fatal(err)
-			}
+	write(t)
 
-			// Get position of the last byte
-			fi, err := f.Stat()
-			if err != nil {
-				t.Fatal(err)
-			}
+	var events []types.Event
+	t.Run("prefix", func(t *testing.T) {
+		events = expect(t, prefix, "a1", "v1", "a2", "v2", "a1", "", "a3", "v3")
+	})
 
-			// Remove the random number of bytes from the end of the file
-			if err := f.Truncate(fi.Size() - int64(utils.GetRandomInRange(1, 40))); err != nil {
-				t.Fatal(err)
-			}
+	t.Run("key", func(t *testing.T) {
+		expect(t, key, "b2", "v2")
+	})
 
-			// Close the file
-			if err := f.Close(); err != nil {
+	t.Run("resume", func(t *testing.T) {
+		if len(events) < 2 {
+			t.Skip("no events to resume from")
+		}
+
+		w, err := s.Watch(types.WatchOptions{Prefix: []byte("a"), After: events[1].ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		// The replayed writes are followed by the new writes
+		if err := s.Set([]byte("a4"), []byte("v4")); err != nil {
+			t.Fatal(err)
+		}
+
+		expect(t, w, "a1", "", "a3", "v3", "a4", "v4")
+		expect(t, prefix, "a4", "v4")
+	})
+
+	t.Run("close", func(t *testing.T) {
+		if err := key.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := recv(t, key); ok {
+			t.Error("expected the watch to end")
+		}
+
+		if err := key.Err(); err != nil {
+			t.Error("expected no error, got", err)
+		}
+	})
+
+	t.Run("lagging", func(t *testing.T) {
+		w, err := s.Watch(types.WatchOptions{Key: []byte("lagging")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The watch delivers one event and holds the rest in its queue
+		for i := 0; i < watchBuffer+2; i++ {
+			if err := s.Set([]byte("lagging"), []byte("val")); err != nil {
 				t.Fatal(err)
 			}
+		}
 
-			// create the store again
-			s = New(dir, config.DefaultConfig())
+		for ok := true; ok; _, ok = recv(t, w) {
+		}
 
-			// Detect and fix the storage
-			if err := s.Init(); err != nil {
-				t.Fatal(err)
+		if err := w.Err(); err != errors.ErrWatchLagging {
+			t.Error("expected ErrWatchLagging, got", err)
+		}
+	})
+
+	t.Run("committed writes only", func(t *testing.T) {
+		s := New(t.TempDir(), config.DefaultConfig().WithSync())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		w, err := s.Watch(types.WatchOptions{Prefix: []byte("c")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		var failing atomic.Bool
+		syncFile = func(f *os.File) error {
+			if failing.Load() {
+				return stderrors.New("fsync failed")
 			}
-		})
-	}
+
+			return f.Sync()
+		}
+		defer func() { syncFile = (*os.File).Sync }()
+
+		failing.Store(true)
+		if err := s.Set([]byte("c1"), []byte("v1")); err == nil {
+			t.Fatal("expected the write to fail")
+		}
+
+		select {
+		case ev := <-w.Events():
+			t.Fatal("expected no event for the failed write, got", ev)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// The next fsync makes the failed write durable too
+		failing.Store(false)
+		if err := s.Set([]byte("c2"), []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+
+		expect(t, w, "c1", "v1", "c2", "v2")
+	})
+
+	t.Run("storage closed", func(t *testing.T) {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for ok := true; ok; _, ok = recv(t, prefix) {
+		}
+
+		if err := prefix.Err(); err != errors.ErrStorageClosed {
+			t.Error("expected ErrStorageClosed, got", err)
+		}
+	})
 }
 
 type benchmarkTestCase struct {
@@ -419,6 +3142,29 @@ func BenchmarkStupidSetSync(b *testing.B) {
 	}
 }
 
+func BenchmarkStupidSetSyncParallel(b *testing.B) {
+	dir := b.TempDir()
+	s := New(dir, config.DefaultConfig().WithSync())
+	if err := s.Init(); err != nil {
+		b.Error(err)
+	}
+	defer s.Close()
+
+	value := []byte(strings.Repeat(" ", 1024))
+
+	b.SetBytes(int64(len(value)))
+	b.SetParallelism(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := s.Set([]byte("foo"), value); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
 func BenchmarkStupidSetAsyncSync(b *testing.B) {
 	dir := b.TempDir()
 	s := New(dir, config.DefaultConfig().WithAsyncSync())
@@ -516,3 +3262,321 @@ func BenchmarkStupidGet(b *testing.B) {
 		})
 	}
 }
+
+func TestStorage_Batch(t *testing.T) {
+	// setup writes a key before and after a batch of 10 keys and
+	// returns the size of the segment before the batch.
+	setup := func(t *testing.T) (string, int64) {
+		dir := t.TempDir()
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set([]byte("before"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		size := s.size()
+
+		b := s.NewBatch()
+		for i := 0; i < 10; i++ {
+			b.Put([]byte("key"+utils.IntToString(i)), []byte("val"+utils.IntToString(i)))
+		}
+		b.Delete([]byte("before"))
+
+		if b.Len() != 11 {
+			t.Error("expected", 11, "got", b.Len())
+		}
+
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Len() != 0 {
+			t.Error("expected empty batch after commit, got", b.Len())
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Make sure that the segment is scanned on startup
+		if err := os.Remove(hintPath(dir, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		return dir, size
+	}
+
+	// check verifies whether the batch was applied or not
+	check := func(t *testing.T, dir string, applied bool) {
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		_, err := s.Get([]byte("before"))
+		if applied && err != errors.ErrKeyNotFound {
+			t.Error("expected ErrKeyNotFound", "got", err)
+		}
+		if !applied && err != nil {
+			t.Error(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			val, err := s.Get([]byte("key" + utils.IntToString(i)))
+			if applied && (err != nil || string(val) != "val"+utils.IntToString(i)) {
+				t.Error("expected", "val"+utils.IntToString(i), "got", string(val), err)
+			}
+
+			if !applied && err != errors.ErrKeyNotFound {
+				t.Error("expected ErrKeyNotFound", "got", err)
+			}
+		}
+
+		n, err := s.Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 1
+		if applied {
+			expected = 10
+		}
+		if n != expected {
+			t.Error("expected", expected, "got", n)
+		}
+	}
+
+	t.Run("complete batch", func(t *testing.T) {
+		dir, _ := setup(t)
+		check(t, dir, true)
+	})
+
+	t.Run("torn batch", func(t *testing.T) {
+		dir, size := setup(t)
+
+		data, err := os.ReadFile(segmentPath(dir, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Cut the batch inside its header, its last packet and its
+		// second to last packet
+		for _, cut := range []int64{size + 10, int64(len(data)) - 1, int64(len(data)) - 60} {
+			if err := os.WriteFile(segmentPath(dir, 0), data[:cut], 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			check(t, dir, false)
+
+			// The torn batch should have been truncated
+			fi, err := os.Stat(segmentPath(dir, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != size {
+				t.Error("expected", size, "got", fi.Size())
+			}
+
+			if err := os.Remove(hintPath(dir, 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("corrupt packet in batch", func(t *testing.T) {
+		dir, size := setup(t)
+
+		data, err := os.ReadFile(segmentPath(dir, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Flip a bit in the last packet of the batch
+		data[len(data)-10] ^= 1
+		if err := os.WriteFile(segmentPath(dir, 0), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, dir, false)
+
+		fi, err := os.Stat(segmentPath(dir, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != size {
+			t.Error("expected", size, "got", fi.Size())
+		}
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		dir, _ := setup(t)
+
+		s := New(dir, config.DefaultConfig())
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, dir, true)
+	})
+}
+
+func TestStorage_Context(t *testing.T) {
+	s := New(t.TempDir(), config.DefaultConfig().WithCompactionRatio(0))
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var ids []uint64
+	for i := 0; i < 10; i++ {
+		if _, err := s.SetIfAbsent([]byte("key"+utils.IntToString(i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		_, version, err := s.GetVersioned([]byte("key" + utils.IntToString(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, version)
+	}
+
+	t.Run("ForEachContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The packets stop being read once the context is done
+		n := 0
+		err := s.ForEachContext(ctx, func(_ *reader, _ *Packet, err error) error {
+			n++
+			cancel()
+			return err
+		})
+		if err != context.Canceled {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if n != 1 {
+			t.Error("expected", 1, "packet", "got", n)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := s.GetByIDContext(ctx, ids[9]); err != context.Canceled {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if _, err := s.GetAsOfContext(ctx, []byte("key0"), ids[9]); err != context.Canceled {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if _, err := s.HistoryContext(ctx, []byte("key0"), 0, 0); err != context.Canceled {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if _, err := s.SetIfVersionContext(ctx, []byte("key0"), []byte("new"), ids[0]); err != context.Canceled {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if err := s.DeleteIfVersionContext(ctx, []byte("key0"), ids[0]); err != context.Canceled {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if val, err := s.Get([]byte("key0")); err != nil || string(val) != "val" {
+			t.Error("expected", "val", "got", string(val), err)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		// The key was overwritten later, so the log is replayed
+		if err := s.Set([]byte("key0"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if val, err := s.GetAsOfContext(ctx, []byte("key0"), ids[0]); err != nil || string(val) != "val" {
+			t.Error("expected", "val", "got", string(val), err)
+		}
+
+		if p, err := s.GetByIDContext(ctx, ids[5]); err != nil || string(p.Key) != "key5" {
+			t.Error("expected", "key5", "got", p, err)
+		}
+	})
+
+	t.Run("RestorePhysicalContext", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := s.PhysicalSnapshot(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		dst := New(dir, config.DefaultConfig().WithCompactionRatio(0))
+		if err := dst.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+
+		// The client goes away once the snapshot is read partially
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &cancelReader{r: buf, cancel: cancel}
+		if err := dst.RestorePhysicalContext(ctx, r, false); !stderrors.Is(err, context.Canceled) {
+			t.Error("expected context.Canceled", "got", err)
+		}
+
+		if n, err := dst.Len(); err != nil || n != 0 {
+			t.Error("expected", 0, "got", n, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, restoreDir)); !os.IsNotExist(err) {
+			t.Error("expected the staging directory to be removed", "got", err)
+		}
+	})
+}
+
+// cancelReader is a reader which cancels its context on the first read.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.r.Read(p)
+}
+
+func TestStorage_ZeroSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(dir, config.Config{Sync: config.SyncTypeNone})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := s.Set([]byte("key"+utils.IntToString(i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The zero size falls back to the default size
+	if len(s.segments) != 1 {
+		t.Error("expected", 1, "segment", "got", len(s.segments))
+	}
+}
@@ -0,0 +1,276 @@
+package stupid
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/types"
+)
+
+// watchBuffer is the number of events a watch can fall behind the
+// writes by before it is ended with errors.ErrWatchLagging.
+const watchBuffer = 1024
+
+// watch delivers the events of the writes matching its options.
+type watch struct {
+	s    *Storage
+	opts types.WatchOptions
+
+	// queue holds the published events till they are delivered.
+	queue chan published
+	// events is the channel the events are delivered on.
+	events chan types.Event
+
+	// done is closed once the watch ends.
+	done chan struct{}
+	// once makes sure that the watch ends only once.
+	once *sync.Once
+
+	// mu guards err.
+	mu *sync.Mutex
+	// err is the reason the watch ended.
+	err error
+}
+
+// published is an event published to a watch.
+type published struct {
+	// seq is the sequence number of the write of the event, the event
+	// isn't delivered till the write is committed.
+	seq uint64
+	ev  types.Event
+}
+
+// Watch returns a new watch over the writes matching the given options.
+//
+// The events of the new writes are delivered once the writes are
+// committed, see waitCommitted, the keys which expire don't publish any
+// event. The events
+// of the writes made after the write opts.After are replayed from the log
+// which holds the overwritten and the deleted values only till they are
+// compacted, the compacted writes aren't replayed.
+//
+// A watch which falls behind the writes by more than watchBuffer events
+// ends with errors.ErrWatchLagging, it can be resumed after the last event
+// delivered by it.
+func (s *Storage) Watch(opts types.WatchOptions) (types.Watch, error) {
+	if !s.isInit() {
+		return nil, errors.ErrStorageNotInitialized
+	}
+
+	w := &watch{
+		s:      s,
+		opts:   opts,
+		queue:  make(chan published, watchBuffer),
+		events: make(chan types.Event),
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+		mu:     &sync.Mutex{},
+	}
+
+	// The writes made till now are replayed from the log and
+	// the later writes are published to the watch.
+	s.wmu.Lock()
+	// The storage could have been closed meanwhile
+	if !s.isInit() {
+		s.wmu.Unlock()
+		return nil, errors.ErrStorageNotInitialized
+	}
+
+	upto, seq := s.lastID, s.seq
+	s.watches[w] = struct{}{}
+	s.wmu.Unlock()
+
+	go w.run(opts.After, upto, seq)
+
+	return w, nil
+}
+
+// Events returns the channel the events are delivered on.
+func (w *watch) Events() <-chan types.Event {
+	return w.events
+}
+
+// Err returns the reason the watch ended.
+func (w *watch) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Close ends the watch.
+func (w *watch) Close() error {
+	w.stop(nil)
+	return nil
+}
+
+// stop stops publishing to the watch and ends it with the given reason.
+func (w *watch) stop(err error) {
+	w.s.wmu.Lock()
+	delete(w.s.watches, w)
+	w.s.wmu.Unlock()
+
+	w.end(err)
+}
+
+// end ends the watch with the given reason, the events published to
+// the watch afterwards are dropped.
+func (w *watch) end(err error) {
+	w.once.Do(func() {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+
+		close(w.done)
+	})
+}
+
+// matches returns true if the watch is interested in the given key.
+func (w *watch) matches(key []byte) bool {
+	if w.opts.Key != nil && !bytes.Equal(key, w.opts.Key) {
+		return false
+	}
+
+	return bytes.HasPrefix(key, w.opts.Prefix)
+}
+
+// run replays the writes made after the given ID and as of upto, the
+// write with the given sequence number, and then delivers the published
+// events till the watch ends.
+func (w *watch) run(after, upto, seq uint64) {
+	defer close(w.events)
+
+	if after > 0 && after < upto {
+		if !w.s.waitCommitted(seq, w.done) {
+			return
+		}
+
+		if err := w.s.backfill(w, after, upto); err != nil {
+			w.stop(err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case p := <-w.queue:
+			if !w.s.waitCommitted(p.seq, w.done) {
+				return
+			}
+
+			select {
+			case w.events <- p.ev:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// backfill delivers the events of the writes made after the given ID and
+// as of upto to the given watch.
+//
+// The log is replayed one segment at a time so that the segments aren't
+// locked while the events are being delivered.
+func (s *Storage) backfill(w *watch, after, upto uint64) error {
+	for next := uint64(0); ; {
+		var events []types.Event
+
+		s.rmu.RLock()
+		i := sort.Search(len(s.segments), func(i int) bool {
+			return s.segments[i].id >= next
+		})
+		if i == len(s.segments) {
+			s.rmu.RUnlock()
+			return nil
+		}
+		seg := s.segments[i]
+
+		err := s.replaySegment(context.Background(), seg, upto, func(p *Packet) error {
+			// A compaction may have merged the segments replayed
+			// already into the segment being replayed.
+			if p.ID <= after || !w.matches(p.Key) {
+				return nil
+			}
+
+			ev := types.Event{ID: p.ID, Key: p.Key, Deleted: p.Op == DelOp}
+			if p.Op == SetOp {
+				val, err := s.read(entry(p))
+				if err != nil {
+					return err
+				}
+				ev.Value = val
+			}
+
+			events = append(events, ev)
+			return nil
+		})
+		s.rmu.RUnlock()
+
+		if err != nil {
+			return err
+		}
+
+		for _, ev := range events {
+			select {
+			case w.events <- ev:
+				after = ev.ID
+			case <-w.done:
+				return nil
+			}
+		}
+
+		next = seg.id + 1
+	}
+}
+
+// publish publishes the events of the given packets written by the write
+// with the given sequence number to the watches matching them, it should
+// be called with the write lock held.
+func (s *Storage) publish(seq uint64, packets []*Packet) {
+	if len(s.watches) == 0 {
+		return
+	}
+
+	for _, p := range packets {
+		if p.Op != SetOp && p.Op != DelOp {
+			continue
+		}
+
+		var ev *types.Event
+		for w := range s.watches {
+			if !w.matches(p.Key) {
+				continue
+			}
+
+			// The packet may share its key and value with the caller
+			if ev == nil {
+				ev = &types.Event{ID: p.ID, Key: append([]byte{}, p.Key...), Deleted: p.Op == DelOp}
+				if p.Op == SetOp {
+					ev.Value = append([]byte{}, p.Val...)
+				}
+			}
+
+			select {
+			case w.queue <- published{seq: seq, ev: *ev}:
+			default:
+				delete(s.watches, w)
+				w.end(errors.ErrWatchLagging)
+			}
+		}
+	}
+}
+
+// endWatches ends all the watches with the given reason, it should be
+// called with the write lock held.
+func (s *Storage) endWatches(err error) {
+	for w := range s.watches {
+		delete(s.watches, w)
+		w.end(err)
+	}
+}
@@ -0,0 +1,94 @@
+package types
+
+import (
+	"context"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+)
+
+// Condition checks whether a conditional write can go ahead given the
+// version of the current value of the key, ok is false if the key doesn't
+// exist.
+//
+// A storage evaluates the condition under its write lock so that no other
+// write to the key can sneak in before the conditional write.
+type Condition func(version uint64, ok bool) error
+
+// IfAbsent is the condition which holds if the key doesn't exist.
+func IfAbsent(_ uint64, ok bool) error {
+	if ok {
+		return errors.ErrKeyExists
+	}
+
+	return nil
+}
+
+// IfVersion returns the condition which holds if the key exists and its
+// value has the given version.
+func IfVersion(version uint64) Condition {
+	return func(v uint64, ok bool) error {
+		if !ok || v != version {
+			return errors.ErrVersionMismatch
+		}
+
+		return nil
+	}
+}
+
+// ConditionalWriter makes the writes under a condition.
+type ConditionalWriter interface {
+	// SetIf sets the value for the given key if the given condition, if
+	// any, holds and returns the version of the new value.
+	SetIf(ctx context.Context, key []byte, value []byte, opts []SetOption, cond Condition) (uint64, error)
+
+	// DeleteIf deletes the value for the given key if the given
+	// condition, if any, holds.
+	DeleteIf(ctx context.Context, key []byte, cond Condition) error
+}
+
+// Conditional implements the conditional writes of a storage over its
+// ConditionalWriter, the storages embed it.
+type Conditional struct {
+	w ConditionalWriter
+}
+
+// NewConditional returns the conditional writes over the given writer.
+func NewConditional(w ConditionalWriter) Conditional {
+	return Conditional{w: w}
+}
+
+// SetIfAbsent sets the value for the given key only if the key doesn't
+// exist and returns the version of the new value.
+func (c Conditional) SetIfAbsent(key []byte, value []byte, opts ...SetOption) (uint64, error) {
+	return c.SetIfAbsentContext(context.Background(), key, value, opts...)
+}
+
+// SetIfAbsentContext sets the value for the given key only if the key
+// doesn't exist and returns the version of the new value.
+func (c Conditional) SetIfAbsentContext(ctx context.Context, key []byte, value []byte, opts ...SetOption) (uint64, error) {
+	return c.w.SetIf(ctx, key, value, opts, IfAbsent)
+}
+
+// SetIfVersion sets the value for the given key only if the current
+// value has the given version and returns the version of the new value.
+func (c Conditional) SetIfVersion(key []byte, value []byte, version uint64, opts ...SetOption) (uint64, error) {
+	return c.SetIfVersionContext(context.Background(), key, value, version, opts...)
+}
+
+// SetIfVersionContext sets the value for the given key only if the current
+// value has the given version and returns the version of the new value.
+func (c Conditional) SetIfVersionContext(ctx context.Context, key []byte, value []byte, version uint64, opts ...SetOption) (uint64, error) {
+	return c.w.SetIf(ctx, key, value, opts, IfVersion(version))
+}
+
+// DeleteIfVersion deletes the value for the given key only if the
+// current value has the given version.
+func (c Conditional) DeleteIfVersion(key []byte, version uint64) error {
+	return c.DeleteIfVersionContext(context.Background(), key, version)
+}
+
+// DeleteIfVersionContext deletes the value for the given key only if the
+// current value has the given version.
+func (c Conditional) DeleteIfVersionContext(ctx context.Context, key []byte, version uint64) error {
+	return c.w.DeleteIf(ctx, key, IfVersion(version))
+}
@@ -0,0 +1,110 @@
+package types
+
+import (
+	"context"
+	"io"
+)
+
+// IteratorWithContext returns the given iterator stopping at its next move
+// once the given context is done, the error of the context is then
+// returned by Err.
+func IteratorWithContext(ctx context.Context, it Iterator) Iterator {
+	// The context is never done
+	if ctx.Done() == nil {
+		return it
+	}
+
+	return &ctxIterator{Iterator: it, ctx: ctx}
+}
+
+// ctxIterator is an iterator which stops once its context is done.
+type ctxIterator struct {
+	Iterator
+	ctx context.Context
+	err error
+}
+
+func (it *ctxIterator) Seek(key []byte) bool {
+	if it.done() {
+		return false
+	}
+
+	return it.Iterator.Seek(key)
+}
+
+func (it *ctxIterator) Next() bool {
+	if it.done() {
+		return false
+	}
+
+	return it.Iterator.Next()
+}
+
+func (it *ctxIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.Iterator.Err()
+}
+
+// done returns true once the context of the iterator is done.
+func (it *ctxIterator) done() bool {
+	if it.err == nil {
+		it.err = it.ctx.Err()
+	}
+
+	return it.err != nil
+}
+
+// ReaderWithContext returns the given reader failing with the error of
+// the given context once the context is done, so that a long copy from
+// the reader stops at its next read.
+func ReaderWithContext(ctx context.Context, r io.Reader) io.Reader {
+	// The context is never done
+	if ctx.Done() == nil {
+		return r
+	}
+
+	return &ctxReader{r: r, ctx: ctx}
+}
+
+// ctxReader is a reader which fails once its context is done.
+type ctxReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// WriterWithContext returns the given writer failing with the error of
+// the given context once the context is done, so that a long copy to the
+// writer stops at its next write.
+func WriterWithContext(ctx context.Context, w io.Writer) io.Writer {
+	// The context is never done
+	if ctx.Done() == nil {
+		return w
+	}
+
+	return &ctxWriter{w: w, ctx: ctx}
+}
+
+// ctxWriter is a writer which fails once its context is done.
+type ctxWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.w.Write(p)
+}
@@ -0,0 +1,169 @@
+package types
+
+import (
+	"context"
+	"time"
+
+	"github.com/utkarsh-pro/use/pkg/storage/errors"
+)
+
+// NoExpiry is the TTL reported for the keys which never expire.
+const NoExpiry = time.Duration(-1)
+
+// SetOptions are the options of a single Set.
+type SetOptions struct {
+	// TTL is the duration after which the key expires,
+	// the key never expires if no TTL is given.
+	TTL time.Duration
+
+	// hasTTL is true if a TTL is given.
+	hasTTL bool
+}
+
+// SetOption configures a single Set.
+type SetOption func(*SetOptions)
+
+// WithTTL makes the key expire after the given duration, which must be
+// positive.
+func WithTTL(ttl time.Duration) SetOption {
+	return func(o *SetOptions) {
+		o.TTL, o.hasTTL = ttl, true
+	}
+}
+
+// NewSetOptions returns the options configured by the given options.
+//
+// A TTL <= 0 is rejected with errors.ErrInvalidTTL rather than stored as
+// a key which never expires.
+func NewSetOptions(opts ...SetOption) (SetOptions, error) {
+	var o SetOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.hasTTL && o.TTL <= 0 {
+		return SetOptions{}, errors.ErrInvalidTTL
+	}
+
+	return o, nil
+}
+
+// Batch is a group of writes which are applied to the storage
+// atomically, either all of them survive a crash or none of them do.
+//
+// A batch isn't safe for concurrent use.
+type Batch interface {
+	// Put adds setting the value for the given key to the batch, the
+	// commit fails if the options are invalid, see NewSetOptions.
+	Put(key []byte, value []byte, opts ...SetOption)
+
+	// Delete adds deleting the value for the given key to the batch.
+	Delete(key []byte)
+
+	// Len returns the number of writes in the batch.
+	Len() int
+
+	// Commit applies the writes of the batch to the storage in the
+	// order they were added. The batch is empty after the commit.
+	Commit() error
+
+	// CommitContext is Commit which applies none of the writes once
+	// the context is done.
+	CommitContext(ctx context.Context) error
+}
+
+// Revision is a single write recorded in the history of a key.
+type Revision struct {
+	// ID is the ID of the write, which is the version of its value.
+	ID uint64
+	// Time is the time at which the write was made.
+	Time time.Time
+	// Deleted is true if the write deleted the key.
+	Deleted bool
+	// Size is the size of the value in bytes.
+	Size int
+	// Expiry is the time at which the value expires, the zero
+	// time means that the value never expires.
+	Expiry time.Time
+}
+
+// IterOptions are the options of an iterator.
+type IterOptions struct {
+	// Start is the key the iteration starts from, inclusive.
+	// Nil means the smallest key.
+	Start []byte
+	// End is the key the iteration stops at, exclusive.
+	// Nil means beyond the largest key.
+	End []byte
+	// Prefix limits the iteration to the keys with the given prefix.
+	Prefix []byte
+	// Reverse iterates the keys in the descending order.
+	Reverse bool
+}
+
+// Iterator iterates over the live keys of the storage in the
+// lexicographic order.
+//
+// An iterator starts positioned before the first key, Next has to be
+// called before the first key is accessible. An iterator isn't safe
+// for concurrent use.
+type Iterator interface {
+	// Seek moves the iterator to the smallest key >= the given key, or
+	// the largest key <= the given key when iterating in reverse, and
+	// returns true if there is such a key in the range.
+	Seek(key []byte) bool
+
+	// Next moves the iterator to the next key and returns true if
+	// there is one.
+	Next() bool
+
+	// Key returns the current key, it is valid till the iterator moves.
+	Key() []byte
+
+	// Value returns the value of the current key, it is valid till
+	// the iterator moves.
+	Value() []byte
+
+	// Err returns the error which stopped the iteration, if any.
+	Err() error
+
+	// Close releases the iterator.
+	Close() error
+}
+
+// Event is a write published to the watches of its key.
+type Event struct {
+	// ID is the ID of the write, which is the version of its value.
+	ID uint64
+	// Key is the key written to.
+	Key []byte
+	// Value is the value written, it is nil if the write deleted the key.
+	Value []byte
+	// Deleted is true if the write deleted the key.
+	Deleted bool
+}
+
+// WatchOptions are the options of a watch.
+type WatchOptions struct {
+	// Key limits the watch to the given key.
+	Key []byte
+	// Prefix limits the watch to the keys with the given prefix.
+	Prefix []byte
+	// After resumes the watch after the write with the given ID, the
+	// writes made after it are replayed before the new writes.
+	// After = 0 watches only the new writes.
+	After uint64
+}
+
+// Watch delivers the events of the writes matching its options in
+// the order in which the writes were made.
+type Watch interface {
+	// Events returns the channel the events are delivered on, the
+	// channel is closed once the watch ends.
+	Events() <-chan Event
+	// Err returns the reason the watch ended, it is nil while the
+	// watch is active and after the watch is closed by Close.
+	Err() error
+	// Close ends the watch.
+	Close() error
+}
@@ -1,8 +1,17 @@
 package bitset
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 // BitsetUnitSize is the size of a bitset unit.
 const BitsetUnitSize = 64
 
+// ErrInvalidEncoding is returned when the binary encoding of a
+// bitset is malformed.
+var ErrInvalidEncoding = fmt.Errorf("invalid bitset encoding")
+
 type Bitset struct {
 	// bits is the underlying bitset.
 	bits []uint64
@@ -127,3 +136,41 @@ func (b *Bitset) Count() int {
 
 	return count
 }
+
+// MarshalBinary encodes the bitset into a binary form.
+//
+// The encoding is the size of the bitset followed by its units, all
+// of them in little endian.
+func (b *Bitset) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 8+8*len(b.bits))
+	data = binary.LittleEndian.AppendUint64(data, b.size)
+	for _, bits := range b.bits {
+		data = binary.LittleEndian.AppendUint64(data, bits)
+	}
+
+	return data, nil
+}
+
+// UnmarshalBinary decodes the bitset from the binary form generated
+// by MarshalBinary.
+func (b *Bitset) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return ErrInvalidEncoding
+	}
+
+	size := binary.LittleEndian.Uint64(data)
+	units := size/BitsetUnitSize + 1
+	if uint64(len(data)-8)/8 != units || (len(data)-8)%8 != 0 {
+		return ErrInvalidEncoding
+	}
+
+	bits := make([]uint64, units)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(data[8+8*i:])
+	}
+
+	b.bits = bits
+	b.size = size
+
+	return nil
+}
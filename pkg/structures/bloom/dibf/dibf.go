@@ -1,6 +1,8 @@
 package dibf
 
 import (
+	"encoding/binary"
+	"fmt"
 	"math"
 
 	"github.com/utkarsh-pro/use/pkg/structures/bitset"
@@ -8,6 +10,34 @@ import (
 	"github.com/utkarsh-pro/use/pkg/utils"
 )
 
+const (
+	// encodingVersion is the version of the binary encoding.
+	encodingVersion = byte(1)
+
+	// flagCustomHash marks the filters encoded with the hash
+	// functions provided by the user.
+	flagCustomHash = byte(1 << 0)
+
+	// headerLen is the length of the encoded filter without
+	// the bitsets.
+	headerLen = 1 + // version
+		1 + // flags
+		8 + // m
+		8 + // k
+		8 + // seed
+		8 // length of the encoded collision bitset
+)
+
+var (
+	// ErrInvalidEncoding is returned when the binary encoding of a
+	// filter is malformed.
+	ErrInvalidEncoding = fmt.Errorf("invalid dibf encoding")
+
+	// ErrCustomHash is returned when a filter encoded with the hash
+	// functions provided by the user is decoded without them.
+	ErrCustomHash = fmt.Errorf("filter was encoded with custom hash functions")
+)
+
 // DIBF represents a Deletable Bloom filter.
 //
 // Based on: https://arxiv.org/pdf/1005.0352.pdf
@@ -17,6 +47,10 @@ type DIBF struct {
 	r *bitset.Bitset
 	b *bitset.Bitset
 
+	// seed is the seed of the default hash functions.
+	seed uint64
+	// custom is true if the hash functions were provided by the user.
+	custom  bool
 	hashFns []types.Hash
 }
 
@@ -35,6 +69,8 @@ func New(m, k, r uint64, hashFns []types.Hash) *DIBF {
 		k:       utils.Max(k, 1),
 		r:       bitset.New(r),
 		b:       bitset.New(utils.Max(m, 1)),
+		seed:    types.DefaultSeed,
+		custom:  hashFns != nil,
 		hashFns: hashFns,
 	}
 }
@@ -55,6 +91,17 @@ func NewWithEstimates(n uint, e float64, f float64, hashFns []types.Hash) *DIBF
 	return New(m, k, uint64(float64(m)/f), hashFns)
 }
 
+// WithSeed makes the filter use the default hash functions derived
+// from the given seed and returns the filter.
+//
+// WithSeed should be called before any item is added to the filter.
+func (f *DIBF) WithSeed(seed uint64) *DIBF {
+	f.seed = seed
+	f.custom = false
+	f.hashFns = nil
+	return f
+}
+
 // Add adds an item to the Bloom filter.
 func (f *DIBF) Add(item []byte) {
 	for _, i := range f.hash(item) {
@@ -146,6 +193,83 @@ func (f *DIBF) Clear() {
 	f.b.Clear()
 }
 
+// MarshalBinary encodes the Bloom filter into a binary form.
+//
+// The hash functions aren't encoded, only the seed of the default
+// hash functions is.
+func (f *DIBF) MarshalBinary() ([]byte, error) {
+	r, err := f.r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := f.b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0)
+	if f.custom {
+		flags |= flagCustomHash
+	}
+
+	data := make([]byte, 0, headerLen+len(r)+len(b))
+	data = append(data, encodingVersion, flags)
+	data = binary.LittleEndian.AppendUint64(data, f.m)
+	data = binary.LittleEndian.AppendUint64(data, f.k)
+	data = binary.LittleEndian.AppendUint64(data, f.seed)
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(r)))
+	data = append(data, r...)
+	data = append(data, b...)
+
+	return data, nil
+}
+
+// UnmarshalBinary decodes the Bloom filter from the binary form
+// generated by MarshalBinary.
+//
+// A filter encoded with custom hash functions can be decoded only
+// into a filter created with the same hash functions.
+func (f *DIBF) UnmarshalBinary(data []byte) error {
+	if len(data) < headerLen || data[0] != encodingVersion {
+		return ErrInvalidEncoding
+	}
+
+	flags := data[1]
+	m := binary.LittleEndian.Uint64(data[2:])
+	k := binary.LittleEndian.Uint64(data[10:])
+	seed := binary.LittleEndian.Uint64(data[18:])
+	rlen := binary.LittleEndian.Uint64(data[26:])
+
+	if flags&flagCustomHash != 0 && (!f.custom || uint64(len(f.hashFns)) != k) {
+		return ErrCustomHash
+	}
+
+	if rlen > uint64(len(data)-headerLen) {
+		return ErrInvalidEncoding
+	}
+
+	r, b := &bitset.Bitset{}, &bitset.Bitset{}
+	if err := r.UnmarshalBinary(data[headerLen : headerLen+rlen]); err != nil {
+		return ErrInvalidEncoding
+	}
+
+	if err := b.UnmarshalBinary(data[headerLen+rlen:]); err != nil {
+		return ErrInvalidEncoding
+	}
+
+	if m == 0 || k == 0 || b.Size() != m || r.Size() == 0 || r.Size() > m {
+		return ErrInvalidEncoding
+	}
+
+	f.m, f.k, f.r, f.b = m, k, r, b
+	if flags&flagCustomHash == 0 {
+		f.WithSeed(seed)
+	}
+
+	return nil
+}
+
 func (f *DIBF) getRegion(i uint64) uint64 {
 	regionSize := f.m / f.r.Size()
 	return i / regionSize
@@ -157,7 +281,7 @@ func (f *DIBF) hash(item []byte) []uint64 {
 
 	// if no hash functions were provided then use the default hash functions.
 	if f.hashFns == nil {
-		f.hashFns = types.DefaultHash(f.k)
+		f.hashFns = types.SeededHash(f.k, f.seed)
 	}
 
 	for i := uint64(0); i < f.k; i++ {
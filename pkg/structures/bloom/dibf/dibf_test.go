@@ -1,8 +1,11 @@
 package dibf
 
 import (
+	"bytes"
 	"encoding/binary"
 	"testing"
+
+	"github.com/utkarsh-pro/use/pkg/structures/bloom/types"
 )
 
 func TestBasic(t *testing.T) {
@@ -170,3 +173,93 @@ func TestFPP(t *testing.T) {
 		t.Errorf("Excessive fpp: %d", count)
 	}
 }
+
+func TestMarshalBinary(t *testing.T) {
+	f := NewWithEstimates(1000, 0.001, 20, nil).WithSeed(42)
+	for i := uint32(0); i < 1000; i++ {
+		n := make([]byte, 4)
+		binary.BigEndian.PutUint32(n, i)
+		f.Add(n)
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The decoded filter replaces the parameters of the filter
+	g := New(1, 1, 1, nil)
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.m != f.m || g.k != f.k || g.seed != f.seed {
+		t.Errorf("parameters mismatch: m: %v, %v; k: %v, %v; seed: %v, %v", f.m, g.m, f.k, g.k, f.seed, g.seed)
+	}
+
+	for i := uint32(0); i < 2000; i++ {
+		n := make([]byte, 4)
+		binary.BigEndian.PutUint32(n, i)
+		if f.Contains(n) != g.Contains(n) {
+			t.Errorf("%v membership mismatch", i)
+		}
+	}
+
+	redata, err := g.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, redata) {
+		t.Error("encoding isn't stable")
+	}
+
+	if err := g.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidEncoding {
+		t.Errorf("expected ErrInvalidEncoding, got %v", err)
+	}
+}
+
+func TestMarshalBinaryCustomHash(t *testing.T) {
+	hashFns := types.SeededHash(2, 7)
+	f := New(1000, 2, 50, hashFns)
+	f.Add([]byte("Utkarsh"))
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(1, 1, 1, nil).UnmarshalBinary(data); err != ErrCustomHash {
+		t.Errorf("expected ErrCustomHash, got %v", err)
+	}
+
+	g := New(1000, 2, 50, hashFns)
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !g.Contains([]byte("Utkarsh")) {
+		t.Error("Utkarsh should be in.")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	f1 := NewWithEstimates(1000, 0.001, 20, nil).WithSeed(1)
+	f2 := NewWithEstimates(1000, 0.001, 20, nil).WithSeed(1)
+	f3 := NewWithEstimates(1000, 0.001, 20, nil).WithSeed(2)
+	for _, f := range []*DIBF{f1, f2, f3} {
+		f.Add([]byte("Utkarsh"))
+	}
+
+	b1, _ := f1.b.MarshalBinary()
+	b2, _ := f2.b.MarshalBinary()
+	b3, _ := f3.b.MarshalBinary()
+
+	if !bytes.Equal(b1, b2) {
+		t.Error("filters with the same seed should set the same bits")
+	}
+
+	if bytes.Equal(b1, b3) {
+		t.Error("filters with different seeds should set different bits")
+	}
+}
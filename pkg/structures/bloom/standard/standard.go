@@ -1,6 +1,8 @@
 package standard
 
 import (
+	"encoding/binary"
+	"fmt"
 	"math"
 
 	"github.com/utkarsh-pro/use/pkg/structures/bitset"
@@ -8,12 +10,43 @@ import (
 	"github.com/utkarsh-pro/use/pkg/utils"
 )
 
+const (
+	// encodingVersion is the version of the binary encoding.
+	encodingVersion = byte(1)
+
+	// flagCustomHash marks the filters encoded with the hash
+	// functions provided by the user.
+	flagCustomHash = byte(1 << 0)
+
+	// headerLen is the length of the encoded filter without
+	// the bitset.
+	headerLen = 1 + // version
+		1 + // flags
+		8 + // m
+		8 + // k
+		8 // seed
+)
+
+var (
+	// ErrInvalidEncoding is returned when the binary encoding of a
+	// filter is malformed.
+	ErrInvalidEncoding = fmt.Errorf("invalid filter encoding")
+
+	// ErrCustomHash is returned when a filter encoded with the hash
+	// functions provided by the user is decoded without them.
+	ErrCustomHash = fmt.Errorf("filter was encoded with custom hash functions")
+)
+
 // Filter represents a Standard Bloom filter.
 type Filter struct {
 	m uint64
 	k uint64
 	b *bitset.Bitset
 
+	// seed is the seed of the default hash functions.
+	seed uint64
+	// custom is true if the hash functions were provided by the user.
+	custom  bool
 	hashFns []types.Hash
 }
 
@@ -27,6 +60,8 @@ func New(m, k uint64, hashFns []types.Hash) *Filter {
 		m:       utils.Max(m, 1),
 		k:       utils.Max(k, 1),
 		b:       bitset.New(utils.Max(m, 1)),
+		seed:    types.DefaultSeed,
+		custom:  hashFns != nil,
 		hashFns: hashFns,
 	}
 }
@@ -47,6 +82,17 @@ func NewWithEstimates(n uint, e float64, hashFns []types.Hash) *Filter {
 	return New(m, k, hashFns)
 }
 
+// WithSeed makes the filter use the default hash functions derived
+// from the given seed and returns the filter.
+//
+// WithSeed should be called before any item is added to the filter.
+func (f *Filter) WithSeed(seed uint64) *Filter {
+	f.seed = seed
+	f.custom = false
+	f.hashFns = nil
+	return f
+}
+
 // Add adds an item to the Bloom filter.
 func (f *Filter) Add(item []byte) {
 	for _, i := range f.hash(item) {
@@ -113,13 +159,74 @@ func (f *Filter) Clear() {
 	f.b.Clear()
 }
 
+// MarshalBinary encodes the Bloom filter into a binary form.
+//
+// The hash functions aren't encoded, only the seed of the default
+// hash functions is.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	b, err := f.b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0)
+	if f.custom {
+		flags |= flagCustomHash
+	}
+
+	data := make([]byte, 0, headerLen+len(b))
+	data = append(data, encodingVersion, flags)
+	data = binary.LittleEndian.AppendUint64(data, f.m)
+	data = binary.LittleEndian.AppendUint64(data, f.k)
+	data = binary.LittleEndian.AppendUint64(data, f.seed)
+	data = append(data, b...)
+
+	return data, nil
+}
+
+// UnmarshalBinary decodes the Bloom filter from the binary form
+// generated by MarshalBinary.
+//
+// A filter encoded with custom hash functions can be decoded only
+// into a filter created with the same hash functions.
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < headerLen || data[0] != encodingVersion {
+		return ErrInvalidEncoding
+	}
+
+	flags := data[1]
+	m := binary.LittleEndian.Uint64(data[2:])
+	k := binary.LittleEndian.Uint64(data[10:])
+	seed := binary.LittleEndian.Uint64(data[18:])
+
+	if flags&flagCustomHash != 0 && (!f.custom || uint64(len(f.hashFns)) != k) {
+		return ErrCustomHash
+	}
+
+	b := &bitset.Bitset{}
+	if err := b.UnmarshalBinary(data[headerLen:]); err != nil {
+		return ErrInvalidEncoding
+	}
+
+	if m == 0 || k == 0 || b.Size() != m {
+		return ErrInvalidEncoding
+	}
+
+	f.m, f.k, f.b = m, k, b
+	if flags&flagCustomHash == 0 {
+		f.WithSeed(seed)
+	}
+
+	return nil
+}
+
 // hash returns the hash values for the given item.
 func (f *Filter) hash(item []byte) []uint64 {
 	hashes := make([]uint64, f.k)
 
 	// if no hash functions were provided then use the default hash functions.
 	if f.hashFns == nil {
-		f.hashFns = types.DefaultHash(f.k)
+		f.hashFns = types.SeededHash(f.k, f.seed)
 	}
 
 	for i := uint64(0); i < f.k; i++ {
@@ -1,11 +1,12 @@
 package types
 
 import (
-	"hash/maphash"
-
 	"github.com/utkarsh-pro/use/pkg/hash"
 )
 
+// DefaultSeed is the seed used by the default hash functions.
+const DefaultSeed = uint64(1)
+
 // Hash type is a hash function.
 //
 // Hash functions should consume a byte slice and return a uint64.
@@ -13,16 +14,22 @@ type Hash func([]byte) uint64
 
 // DefaultHash returns a slice of k default hash functions.
 func DefaultHash(k uint64) []Hash {
+	return SeededHash(k, DefaultSeed)
+}
+
+// SeededHash returns a slice of k hash functions derived from the
+// given seed.
+//
+// The hash functions are deterministic, the same seed yields the same
+// hash values across processes which allows persisting the filters.
+func SeededHash(k uint64, seed uint64) []Hash {
 	hashFns := make([]Hash, k)
 
 	for i := uint64(0); i < k; i++ {
-		var h1 maphash.Hash
-		h1.SetSeed(maphash.MakeSeed())
-
-		var h2 maphash.Hash
-		h2.SetSeed(maphash.MakeSeed())
+		h1 := hash.NewSeeded64(seed)
+		h2 := hash.NewSeeded64(seed ^ 0x9e3779b97f4a7c15)
 
-		h := hash.NewDoubleHash64(&h1, &h2, i)
+		h := hash.NewDoubleHash64(h1, h2, i)
 
 		hashFns[i] = func(b []byte) uint64 {
 			h.Write(b)
@@ -0,0 +1,214 @@
+package skiplist
+
+import (
+	"math/rand"
+)
+
+const (
+	// MaxLevel is the maximum number of levels of a skiplist, it is
+	// enough for 4^32 elements.
+	MaxLevel = 32
+
+	// p is the probability of a node being promoted to the next level.
+	p = 0.25
+)
+
+// Node is an element of the skiplist.
+type Node[K, V any] struct {
+	key   K
+	value V
+
+	// next holds the next node at every level the node is part of.
+	next []*Node[K, V]
+	// prev is the previous node at the lowest level, it is nil
+	// for the first node.
+	prev *Node[K, V]
+}
+
+// Key returns the key of the node.
+func (n *Node[K, V]) Key() K {
+	return n.key
+}
+
+// Value returns the value of the node.
+func (n *Node[K, V]) Value() V {
+	return n.value
+}
+
+// Next returns the node with the next larger key, if any.
+func (n *Node[K, V]) Next() *Node[K, V] {
+	return n.next[0]
+}
+
+// Prev returns the node with the next smaller key, if any.
+func (n *Node[K, V]) Prev() *Node[K, V] {
+	return n.prev
+}
+
+// SkipList is an ordered map.
+//
+// SkipList isn't safe for concurrent use.
+//
+// Based on: https://15721.courses.cs.cmu.edu/spring2018/papers/08-oltpindexes1/pugh-skiplists-cacm1990.pdf
+type SkipList[K, V any] struct {
+	// head is a sentinel node which precedes every element.
+	head *Node[K, V]
+	// tail is the node with the largest key, if any.
+	tail *Node[K, V]
+	// level is the number of levels in use.
+	level int
+	// len is the number of elements.
+	len int
+
+	cmp func(a, b K) int
+	rnd *rand.Rand
+}
+
+// New returns a new empty skiplist ordered by the given comparison
+// function which returns a negative number if a < b, 0 if a == b and
+// a positive number if a > b.
+func New[K, V any](cmp func(a, b K) int) *SkipList[K, V] {
+	return &SkipList[K, V]{
+		head:  &Node[K, V]{next: make([]*Node[K, V], MaxLevel)},
+		level: 1,
+		cmp:   cmp,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// Len returns the number of elements in the skiplist.
+func (s *SkipList[K, V]) Len() int {
+	return s.len
+}
+
+// Get returns the value for the given key.
+func (s *SkipList[K, V]) Get(key K) (V, bool) {
+	if n := s.Seek(key); n != nil && s.cmp(n.key, key) == 0 {
+		return n.value, true
+	}
+
+	var zero V
+	return zero, false
+}
+
+// Set sets the value for the given key.
+func (s *SkipList[K, V]) Set(key K, value V) {
+	var update [MaxLevel]*Node[K, V]
+	x := s.findLess(key, &update)
+
+	if n := x.next[0]; n != nil && s.cmp(n.key, key) == 0 {
+		n.value = value
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	n := &Node[K, V]{key: key, value: value, next: make([]*Node[K, V], level)}
+	if x != s.head {
+		n.prev = x
+	}
+
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	} else {
+		s.tail = n
+	}
+
+	s.len++
+}
+
+// Delete removes the given key and returns true if it was present.
+func (s *SkipList[K, V]) Delete(key K) bool {
+	var update [MaxLevel]*Node[K, V]
+	x := s.findLess(key, &update)
+
+	n := x.next[0]
+	if n == nil || s.cmp(n.key, key) != 0 {
+		return false
+	}
+
+	for i := 0; i < s.level && update[i].next[i] == n; i++ {
+		update[i].next[i] = n.next[i]
+	}
+
+	if n.next[0] != nil {
+		n.next[0].prev = n.prev
+	} else {
+		s.tail = n.prev
+	}
+
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+
+	s.len--
+	return true
+}
+
+// First returns the node with the smallest key, if any.
+func (s *SkipList[K, V]) First() *Node[K, V] {
+	return s.head.next[0]
+}
+
+// Last returns the node with the largest key, if any.
+func (s *SkipList[K, V]) Last() *Node[K, V] {
+	return s.tail
+}
+
+// Seek returns the node with the smallest key >= the given key, if any.
+func (s *SkipList[K, V]) Seek(key K) *Node[K, V] {
+	return s.findLess(key, nil).next[0]
+}
+
+// SeekLE returns the node with the largest key <= the given key, if any.
+func (s *SkipList[K, V]) SeekLE(key K) *Node[K, V] {
+	x := s.findLess(key, nil)
+	if n := x.next[0]; n != nil && s.cmp(n.key, key) == 0 {
+		return n
+	}
+
+	if x == s.head {
+		return nil
+	}
+
+	return x
+}
+
+// findLess returns the node with the largest key < the given key, the
+// head if there is none. The nodes preceding the key at every level are
+// recorded in update, if given.
+func (s *SkipList[K, V]) findLess(key K, update *[MaxLevel]*Node[K, V]) *Node[K, V] {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && s.cmp(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+
+		if update != nil {
+			update[i] = x
+		}
+	}
+
+	return x
+}
+
+// randomLevel returns the number of levels of a new node.
+func (s *SkipList[K, V]) randomLevel() int {
+	level := 1
+	for level < MaxLevel && s.rnd.Float64() < p {
+		level++
+	}
+
+	return level
+}
@@ -0,0 +1,111 @@
+package skiplist
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	s := New[string, int](strings.Compare)
+	m := make(map[string]int)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		k := string(rune('a' + rnd.Intn(26)))
+		k += string(rune('a' + rnd.Intn(26)))
+		k += string(rune('a' + rnd.Intn(26)))
+
+		if rnd.Intn(3) == 0 {
+			_, ok := m[k]
+			if deleted := s.Delete(k); deleted != ok {
+				t.Fatal("expected", ok, "got", deleted, "key", k)
+			}
+			delete(m, k)
+			continue
+		}
+
+		s.Set(k, i)
+		m[k] = i
+	}
+
+	if s.Len() != len(m) {
+		t.Fatal("expected", len(m), "got", s.Len())
+	}
+
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		keys = append(keys, k)
+
+		if got, ok := s.Get(k); !ok || got != v {
+			t.Error("expected", v, "got", got, ok)
+		}
+	}
+	sort.Strings(keys)
+
+	t.Run("forward", func(t *testing.T) {
+		i := 0
+		for n := s.First(); n != nil; n = n.Next() {
+			if n.Key() != keys[i] || n.Value() != m[keys[i]] {
+				t.Fatal("expected", keys[i], "got", n.Key())
+			}
+			i++
+		}
+
+		if i != len(keys) {
+			t.Error("expected", len(keys), "got", i)
+		}
+	})
+
+	t.Run("reverse", func(t *testing.T) {
+		i := len(keys) - 1
+		for n := s.Last(); n != nil; n = n.Prev() {
+			if n.Key() != keys[i] {
+				t.Fatal("expected", keys[i], "got", n.Key())
+			}
+			i--
+		}
+
+		if i != -1 {
+			t.Error("expected", -1, "got", i)
+		}
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		for _, k := range []string{"", "a", "mmm", "mmmm", keys[0], keys[len(keys)-1], "zzzz"} {
+			i := sort.SearchStrings(keys, k)
+
+			n := s.Seek(k)
+			if i == len(keys) && n != nil {
+				t.Error("expected nil", "got", n.Key())
+			}
+			if i < len(keys) && (n == nil || n.Key() != keys[i]) {
+				t.Error("expected", keys[i], "got", n)
+			}
+
+			// The largest key <= k
+			if i == len(keys) || keys[i] != k {
+				i--
+			}
+
+			n = s.SeekLE(k)
+			if i < 0 && n != nil {
+				t.Error("expected nil", "got", n.Key())
+			}
+			if i >= 0 && (n == nil || n.Key() != keys[i]) {
+				t.Error("expected", keys[i], "got", n)
+			}
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		for _, k := range keys {
+			s.Delete(k)
+		}
+
+		if s.Len() != 0 || s.First() != nil || s.Last() != nil || s.Seek("") != nil {
+			t.Error("expected empty skiplist")
+		}
+	})
+}
@@ -138,6 +138,18 @@ func (r *Reader) Fill(tlv *TLV) error {
 	return nil
 }
 
+// Peek returns the type of the next TLV without moving the reader.
+//
+// Peek returns io.EOF if there are no more TLVs to read.
+func (r *Reader) Peek() (byte, error) {
+	typBytes := make([]byte, 1)
+	if _, err := r.r.ReadAt(typBytes, r.readerPos); err != nil {
+		return 0, err
+	}
+
+	return typBytes[0], nil
+}
+
 // Seek seeks to the given offset, supported whence are io.SeekStart and
 // io.SeekCurrent. io.SeekEnd is not supported.
 func (r *Reader) Seek(offset int64, whence int) (int64, error) {
@@ -117,3 +117,28 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestPeek(t *testing.T) {
+	tlvr := NewReader(bytes.NewReader([]byte("\x02\x05\x00\x00\x00hello")))
+
+	typ, err := tlvr.Peek()
+	if err != nil {
+		t.Fatalf("Peek() error = %v", err)
+	}
+	if typ != 2 {
+		t.Errorf("Peek() = %v, want %v", typ, 2)
+	}
+
+	// Peek should not move the reader
+	got := NewTLV(0, nil)
+	if err := tlvr.Read(got); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, NewTLV(2, []byte("hello"))) {
+		t.Errorf("Read() = %v, want %v", got, NewTLV(2, []byte("hello")))
+	}
+
+	if _, err := tlvr.Peek(); err != io.EOF {
+		t.Errorf("Peek() error = %v, want %v", err, io.EOF)
+	}
+}
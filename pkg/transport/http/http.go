@@ -2,24 +2,65 @@ package http
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/utkarsh-pro/use/pkg/config"
+	"github.com/utkarsh-pro/use/pkg/id"
 	"github.com/utkarsh-pro/use/pkg/storage"
 	"github.com/utkarsh-pro/use/pkg/storage/errors"
+	"github.com/utkarsh-pro/use/pkg/storage/logical"
+	"github.com/utkarsh-pro/use/pkg/transport"
 	"github.com/utkarsh-pro/use/pkg/utils"
 )
 
+const (
+	// versionHeader is the header holding the version of a value.
+	versionHeader = "X-Version"
+
+	// defaultScanLimit is the number of keys in a scan page
+	// if the limit isn't given.
+	defaultScanLimit = 100
+	// maxScanLimit is the maximum number of keys in a scan page.
+	maxScanLimit = 1000
+
+	// watchKeepAlive is the interval at which a comment is sent on an
+	// idle watch stream so that the connection isn't dropped as idle.
+	watchKeepAlive = 15 * time.Second
+)
+
 type Transport struct {
 	srv     *http.Server
 	storage storage.Storage
+	// cs is the storage taking the contexts of the requests, so that the
+	// storage stops working on a request once its client disconnects.
+	// The optional interfaces are looked up on storage.
+	cs storage.ContextStorage
+
+	// done is closed on shutdown to end the watch streams, which
+	// would otherwise hold the shutdown forever.
+	done chan struct{}
+}
+
+// init registers the transport, see transport.Register.
+func init() {
+	transport.Register(transport.HTTPTransportType, func(s storage.Storage) (transport.Transport, error) {
+		return New(s), nil
+	})
 }
 
 // New returns a new HTTP transport
-func New(storage storage.Storage) *Transport {
+func New(s storage.Storage) *Transport {
 	return &Transport{
-		storage: storage,
+		storage: s,
+		cs:      storage.WithContext(s),
+		done:    make(chan struct{}),
 	}
 }
 
@@ -43,6 +84,7 @@ func (t *Transport) Setup(addr string) error {
 }
 
 func (t *Transport) Shutdown() error {
+	close(t.done)
 	return t.srv.Shutdown(context.TODO())
 }
 
@@ -50,40 +92,133 @@ func (t *Transport) setupHandlers() {
 	http.HandleFunc("/version", createHTTPMethodsHandler([]string{http.MethodGet}, t.versionHandler))
 	http.HandleFunc("/api/set", createHTTPMethodsHandler([]string{http.MethodGet}, t.setHandler))
 	http.HandleFunc("/api/get", createHTTPMethodsHandler([]string{http.MethodGet}, t.getHandler))
+	http.HandleFunc("/api/asof", createHTTPMethodsHandler([]string{http.MethodGet}, t.asOfHandler))
+	http.HandleFunc("/api/history", createHTTPMethodsHandler([]string{http.MethodGet}, t.historyHandler))
+	http.HandleFunc("/api/watch", createHTTPMethodsHandler([]string{http.MethodGet}, t.watchHandler))
 	http.HandleFunc("/api/delete", createHTTPMethodsHandler([]string{http.MethodGet}, t.deleteHandler))
+	http.HandleFunc("/api/scan", createHTTPMethodsHandler([]string{http.MethodGet}, t.scanHandler))
 	http.HandleFunc("/api/len", createHTTPMethodsHandler([]string{http.MethodGet}, t.lenHandler))
+	http.HandleFunc("/api/ttl", createHTTPMethodsHandler([]string{http.MethodGet}, t.ttlHandler))
 	http.HandleFunc("/api/exists", createHTTPMethodsHandler([]string{http.MethodGet}, t.existsHandler))
+	http.HandleFunc("/api/batch", createHTTPMethodsHandler([]string{http.MethodPost}, t.batchHandler))
 	http.HandleFunc("/api/snapshot", createHTTPMethodsHandler([]string{http.MethodGet}, t.snapshotHandler))
+	http.HandleFunc("/api/export", createHTTPMethodsHandler([]string{http.MethodGet}, t.exportHandler))
+	http.HandleFunc("/api/restore", createHTTPMethodsHandler([]string{http.MethodPost}, t.restoreHandler))
+	http.HandleFunc("/admin/restore", createHTTPMethodsHandler([]string{http.MethodPost}, t.adminRestoreHandler))
+	http.HandleFunc("/admin/compact", createHTTPMethodsHandler([]string{http.MethodGet, http.MethodPost}, t.compactHandler))
 }
 
 func (t *Transport) setHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	val := r.URL.Query().Get("val")
 
-	if err := t.storage.Set([]byte(key), []byte(val)); err != nil {
-		if err == errors.ErrReadOnlyStorage {
-			w.WriteHeader(http.StatusTeapot)
+	var opts []storage.SetOption
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
 			return
 		}
 
-		w.WriteHeader(http.StatusInternalServerError)
+		// A key which expires right away is a mistake, not a key which
+		// never expires
+		if d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, errors.ErrInvalidTTL.Error())
+			return
+		}
+
+		opts = append(opts, storage.WithTTL(d))
+	}
+
+	version, conditional, err := parseVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		io.WriteString(w, err.Error())
 		return
 	}
 
+	ifAbsent := utils.StringToBool(r.URL.Query().Get("if_absent"))
+
+	// A key can't both be absent and have a version
+	if ifAbsent && conditional {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "if_absent and version are mutually exclusive")
+		return
+	}
+
+	switch {
+	case ifAbsent:
+		version, err = t.cs.SetIfAbsentContext(r.Context(), []byte(key), []byte(val), opts...)
+	case conditional:
+		version, err = t.cs.SetIfVersionContext(r.Context(), []byte(key), []byte(val), version, opts...)
+	default:
+		err = t.cs.SetContext(r.Context(), []byte(key), []byte(val), opts...)
+	}
+
+	if err != nil {
+		writeWriteError(w, err)
+		return
+	}
+
+	if version != 0 {
+		w.Header().Set(versionHeader, strconv.FormatUint(version, 10))
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (t *Transport) getHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
-	val, err := t.storage.Get([]byte(key))
+	val, version, err := t.cs.GetVersionedContext(r.Context(), []byte(key))
+	if err != nil {
+		if err == errors.ErrKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set(versionHeader, strconv.FormatUint(version, 10))
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, string(val))
+}
+
+func (t *Transport) asOfHandler(w http.ResponseWriter, r *http.Request) {
+	reader, ok := t.storage.(storage.AsOfReader)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+
+	// at is either the ID of a write or a point in time
+	asOf, err := id.Parse(r.URL.Query().Get("at"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	val, err := reader.GetAsOfContext(r.Context(), []byte(key), asOf)
 	if err != nil {
 		if err == errors.ErrKeyNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
+		// The value as of the write was compacted away
+		if err == errors.ErrHistoryCompacted {
+			w.WriteHeader(http.StatusGone)
+			io.WriteString(w, err.Error())
+			return
+		}
+
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
 		return
@@ -96,7 +231,94 @@ func (t *Transport) getHandler(w http.ResponseWriter, r *http.Request) {
 func (t *Transport) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
-	if err := t.storage.Delete([]byte(key)); err != nil {
+	version, conditional, err := parseVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if conditional {
+		err = t.cs.DeleteIfVersionContext(r.Context(), []byte(key), version)
+	} else {
+		err = t.cs.DeleteContext(r.Context(), []byte(key))
+	}
+
+	if err != nil {
+		writeWriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseVersion returns the version the write is conditioned on, if any.
+func parseVersion(r *http.Request) (uint64, bool, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, false, nil
+	}
+
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return version, true, nil
+}
+
+// writeWriteError responds with the status matching the given
+// error returned by a write.
+func writeWriteError(w http.ResponseWriter, err error) {
+	switch err {
+	case errors.ErrReadOnlyStorage:
+		w.WriteHeader(http.StatusTeapot)
+	case errors.ErrKeyExists:
+		w.WriteHeader(http.StatusConflict)
+	case errors.ErrVersionMismatch:
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case errors.ErrInvalidTTL:
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+	}
+}
+
+// batchRequest is the body of a batch request.
+type batchRequest struct {
+	Ops []struct {
+		// Op is either "set" or "delete".
+		Op  string `json:"op"`
+		Key string `json:"key"`
+		Val string `json:"val"`
+	} `json:"ops"`
+}
+
+func (t *Transport) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	batch := t.storage.NewBatch()
+	for _, op := range req.Ops {
+		switch op.Op {
+		case "set":
+			batch.Put([]byte(op.Key), []byte(op.Val))
+		case "delete":
+			batch.Delete([]byte(op.Key))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "invalid batch op: "+op.Op)
+			return
+		}
+	}
+
+	if err := batch.CommitContext(r.Context()); err != nil {
 		if err == errors.ErrReadOnlyStorage {
 			w.WriteHeader(http.StatusTeapot)
 			return
@@ -110,8 +332,279 @@ func (t *Transport) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// scanItem is a key value pair in a scan response.
+type scanItem struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
+}
+
+// scanResponse is the body of a scan response.
+type scanResponse struct {
+	Items []scanItem `json:"items"`
+	// Cursor fetches the next page when passed to the same scan,
+	// it is empty if there are no more keys.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// scanHandler responds with a page of the keys matching the given start,
+// end, prefix and reverse parameters in the lexicographic order.
+func (t *Transport) scanHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	opts := storage.IterOptions{Reverse: utils.StringToBool(q.Get("reverse"))}
+	if q.Has("start") {
+		opts.Start = []byte(q.Get("start"))
+	}
+	if q.Has("end") {
+		opts.End = []byte(q.Get("end"))
+	}
+	if q.Has("prefix") {
+		opts.Prefix = []byte(q.Get("prefix"))
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	// The cursor is the first key of the next page
+	var cursor []byte
+	if c := q.Get("cursor"); c != "" {
+		if cursor, err = base64.RawURLEncoding.DecodeString(c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "invalid cursor: "+c)
+			return
+		}
+	}
+
+	it, err := t.cs.NewIteratorContext(r.Context(), opts)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	defer it.Close()
+
+	resp := scanResponse{Items: []scanItem{}}
+
+	ok := false
+	if cursor != nil {
+		ok = it.Seek(cursor)
+	} else {
+		ok = it.Next()
+	}
+
+	for ; ok; ok = it.Next() {
+		if len(resp.Items) == limit {
+			resp.Cursor = base64.RawURLEncoding.EncodeToString(it.Key())
+			break
+		}
+
+		resp.Items = append(resp.Items, scanItem{Key: string(it.Key()), Val: string(it.Value())})
+	}
+
+	if err := it.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseLimit returns the page size given by the limit parameter of the
+// given request, capped to maxScanLimit.
+func parseLimit(r *http.Request) (int, error) {
+	l := r.URL.Query().Get("limit")
+	if l == "" {
+		return defaultScanLimit, nil
+	}
+
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit: %s", l)
+	}
+
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	return limit, nil
+}
+
+// historyItem is a single write in a history response.
+type historyItem struct {
+	// ID is the ID of the write, the value of the write is served by
+	// the asof endpoint at the ID.
+	ID     uint64 `json:"id,string"`
+	Time   string `json:"time"`
+	Op     string `json:"op"`
+	Size   int    `json:"size"`
+	Expiry string `json:"expiry,omitempty"`
+}
+
+// historyResponse is the body of a history response.
+type historyResponse struct {
+	Items []historyItem `json:"items"`
+}
+
+// historyHandler responds with a page of the writes to the given key
+// from the latest to the oldest.
+func (t *Transport) historyHandler(w http.ResponseWriter, r *http.Request) {
+	reader, ok := t.storage.(storage.HistoryReader)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	q := r.URL.Query()
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	offset := 0
+	if o := q.Get("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "invalid offset: "+o)
+			return
+		}
+	}
+
+	revs, err := reader.HistoryContext(r.Context(), []byte(q.Get("key")), limit, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	resp := historyResponse{Items: make([]historyItem, 0, len(revs))}
+	for _, rev := range revs {
+		item := historyItem{
+			ID:   rev.ID,
+			Time: rev.Time.UTC().Format(time.RFC3339Nano),
+			Op:   "set",
+			Size: rev.Size,
+		}
+		if rev.Deleted {
+			item.Op = "delete"
+		}
+		if !rev.Expiry.IsZero() {
+			item.Expiry = rev.Expiry.UTC().Format(time.RFC3339Nano)
+		}
+
+		resp.Items = append(resp.Items, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// watchEvent is the data of a watch stream event.
+type watchEvent struct {
+	Key string `json:"key"`
+	Val string `json:"val,omitempty"`
+}
+
+// watchHandler streams the writes matching the given key and prefix as
+// server-sent events. The stream resumes after the given ID, or after the
+// ID in the Last-Event-ID header sent by the reconnecting clients.
+func (t *Transport) watchHandler(w http.ResponseWriter, r *http.Request) {
+	watcher, ok := t.storage.(storage.Watcher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "streaming is not supported")
+		return
+	}
+
+	q := r.URL.Query()
+
+	var opts storage.WatchOptions
+	if q.Has("key") {
+		opts.Key = []byte(q.Get("key"))
+	}
+	if q.Has("prefix") {
+		opts.Prefix = []byte(q.Get("prefix"))
+	}
+
+	after := q.Get("after")
+	if after == "" {
+		after = r.Header.Get("Last-Event-ID")
+	}
+	if after != "" {
+		var err error
+		if opts.After, err = id.Parse(after); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	watch, err := watcher.Watch(opts)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	defer watch.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.done:
+			return
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case ev, ok := <-watch.Events():
+			if !ok {
+				// The client resumes after the last event it got
+				if err := watch.Err(); err != nil {
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+					flusher.Flush()
+				}
+				return
+			}
+
+			op, data := "set", watchEvent{Key: string(ev.Key), Val: string(ev.Value)}
+			if ev.Deleted {
+				op = "delete"
+			}
+
+			// Marshaling strings never fails
+			b, _ := json.Marshal(data)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, op, b)
+			flusher.Flush()
+		}
+	}
+}
+
 func (t *Transport) lenHandler(w http.ResponseWriter, r *http.Request) {
-	len, err := t.storage.Len()
+	len, err := t.cs.LenContext(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
@@ -122,10 +615,36 @@ func (t *Transport) lenHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, utils.IntToString(len))
 }
 
+// ttlHandler responds with the remaining TTL of the key in
+// milliseconds, -1 if the key never expires.
+func (t *Transport) ttlHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	ttl, err := t.cs.TTLContext(r.Context(), []byte(key))
+	if err != nil {
+		if err == errors.ErrKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	ms := int(ttl.Milliseconds())
+	if ttl == storage.NoExpiry {
+		ms = -1
+	}
+
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, utils.IntToString(ms))
+}
+
 func (t *Transport) existsHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
-	exists, err := t.storage.Exists([]byte(key))
+	exists, err := t.cs.ExistsContext(r.Context(), []byte(key))
 	if err != nil {
 		if err == errors.ErrKeyNotFound {
 			w.WriteHeader(http.StatusNotFound)
@@ -142,7 +661,7 @@ func (t *Transport) existsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (t *Transport) snapshotHandler(w http.ResponseWriter, r *http.Request) {
-	err := t.storage.PhysicalSnapshot(w)
+	err := t.cs.PhysicalSnapshotContext(r.Context(), w)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
@@ -150,6 +669,85 @@ func (t *Transport) snapshotHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (t *Transport) exportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	err := t.cs.LogicalSnapshotContext(r.Context(), w)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+func (t *Transport) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if err := t.cs.RestoreContext(r.Context(), r.Body); err != nil {
+		if stderrors.Is(err, logical.ErrCorruptSnapshot) || stderrors.Is(err, logical.ErrUnsupportedSnapshot) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		writeWriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *Transport) adminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	restorer, ok := t.storage.(storage.PhysicalRestorer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	force := utils.StringToBool(r.URL.Query().Get("force"))
+	if err := restorer.RestorePhysicalContext(r.Context(), r.Body, force); err != nil {
+		if stderrors.Is(err, errors.ErrCorruptSnapshot) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if err == errors.ErrStorageNotEmpty {
+			w.WriteHeader(http.StatusConflict)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		writeWriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *Transport) compactHandler(w http.ResponseWriter, r *http.Request) {
+	compactor, ok := t.storage.(storage.Compactor)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	if err := compactor.CompactContext(r.Context()); err != nil {
+		if err == errors.ErrReadOnlyStorage {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+
+		if err == errors.ErrCompactionInProgress {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 func (t *Transport) versionHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, config.Version)
@@ -2,9 +2,11 @@ package transport
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/utkarsh-pro/use/pkg/storage"
-	"github.com/utkarsh-pro/use/pkg/transport/http"
 )
 
 type TransportType string
@@ -17,18 +19,73 @@ type Transport interface {
 	Shutdown() error
 }
 
+// Factory returns a new transport serving the given storage.
+type Factory func(storage storage.Storage) (Transport, error)
+
 var (
+	// HTTPTransportType is the type of the built-in HTTP transport, it
+	// registers itself from the init of its package, so the package has
+	// to be imported for the transport to be available.
 	HTTPTransportType TransportType = "http"
 
 	ErrInvalidTransportType = fmt.Errorf("invalid transport type")
 )
 
+var (
+	// registryMu guards the registry.
+	registryMu sync.RWMutex
+	// registry holds the factories of the transports by their type.
+	registry = make(map[TransportType]Factory)
+)
+
+// Register makes the transport of the given type available to New, so
+// that the transports can be added without modifying this package.
+//
+// Register panics if the factory is nil or if the type is registered
+// already, it is meant to be called from the init of the transport.
+func Register(t TransportType, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("transport: Register factory is nil")
+	}
+
+	if _, dup := registry[t]; dup {
+		panic("transport: Register called twice for transport type " + t)
+	}
+
+	registry[t] = factory
+}
+
+// Types returns the registered transport types in the sorted order.
+func Types() []TransportType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]TransportType, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
 // New returns a new transport
 func New(transportType TransportType, storage storage.Storage) (Transport, error) {
-	switch transportType {
-	case HTTPTransportType:
-		return http.New(storage), nil
-	default:
-		return nil, ErrInvalidTransportType
+	registryMu.RLock()
+	factory, ok := registry[transportType]
+	registryMu.RUnlock()
+
+	if !ok {
+		var names []string
+		for _, t := range Types() {
+			names = append(names, string(t))
+		}
+
+		return nil, fmt.Errorf("%w: %s, available: %s", ErrInvalidTransportType, transportType, strings.Join(names, ", "))
 	}
+
+	return factory(storage)
 }
@@ -53,6 +53,40 @@ func StringToInt(s string) int {
 	return i
 }
 
+// Float64ToString returns the string representation of the given float.
+func Float64ToString(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// StringToFloat64 returns the float representation of the given string.
+//
+// If the string cannot be converted to a float, this function panics.
+func StringToFloat64(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// DurationToString returns the string representation of the given duration.
+func DurationToString(d time.Duration) string {
+	return d.String()
+}
+
+// StringToDuration returns the duration representation of the given string.
+//
+// If the string cannot be converted to a duration, this function panics.
+func StringToDuration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
 // StringToBool returns true if the given string is "true", otherwise
 // returns false.
 func StringToBool(s string) bool {